@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	stdlog "log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+func main() {
+	stdlog.SetFlags(stdlog.Lshortfile)
+	stdlog.SetOutput(log.StandardLogger().Writer())
+	log.SetFormatter(&prefixed.TextFormatter{
+		ForceColors:     true,
+		ForceFormatting: true,
+	})
+
+	from, to := config.Storage{}, config.Storage{}
+	flag.StringVar(&from.Type, "from-type", "sqlite", "source storage type")
+	flag.StringVar(&from.Addr, "from-addr", "./db.sqlite", "source storage address")
+	flag.StringVar(&to.Type, "to-type", "mongodb", "target storage type")
+	flag.StringVar(&to.Addr, "to-addr", "mongodb://localhost:27017", "target storage address")
+	migrate := flag.String("migrate", string(storage.MigrateAuto), "schema migrations of both storages: auto, check or off")
+	batch := flag.Int("batch", 500, "entities copied at once")
+	dryRun := flag.Bool("dry-run", false, "print the changes without making them")
+	checkpoint := flag.String("checkpoint", "", "file to resume the copy from, removed once it's done")
+	flag.Parse()
+	from.Migrate, to.Migrate = *migrate, *migrate
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, &from, &to, *batch, *dryRun, *checkpoint); !tools.Try(err) {
+		log.WithError(err).Fatalln("copy failed")
+	}
+}
+
+// run Copies the data, the target delete policy is restrict, and the writes are not audited.
+func run(ctx context.Context, from, to *config.Storage, batch int, dryRun bool, checkpoint string) error {
+	source, err := storage.New(ctx, from)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "source")
+	}
+	defer func() { tools.Try(source.Close(context.Background()), true) }()
+	target, err := storage.New(ctx, to)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "target")
+	}
+	defer func() { tools.Try(target.Close(context.Background()), true) }()
+	copier := &storage.Copier{
+		From:      source,
+		To:        target,
+		BatchSize: batch,
+		DryRun:    dryRun,
+		Report:    printChange,
+	}
+	if checkpoint != "" {
+		if copier.Checkpoint, err = loadCheckpoint(checkpoint); !tools.Try(err) {
+			return err
+		}
+		copier.Save = func(c storage.Checkpoint) error {
+			return saveCheckpoint(checkpoint, c)
+		}
+	}
+	log.Infof("copying %s %s to %s %s", from.Type, from.Addr, to.Type, to.Addr)
+	if err = copier.Run(ctx); !tools.Try(err) {
+		return err
+	}
+	if checkpoint != "" && !dryRun {
+		if err = os.Remove(checkpoint); !tools.Try(err) && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	log.Infoln("done")
+	return nil
+}
+
+// printChange Prints a line per change, with the changed fields, like:
+//
+//	replace client 2: name "Apple" -> "Apple Inc."
+func printChange(change storage.Change) {
+	var fields []string
+	for _, field := range change.Diff {
+		before, _ := json.Marshal(field.Before)
+		after, _ := json.Marshal(field.After)
+		fields = append(fields, fmt.Sprintf("%s %s -> %s", field.Field, before, after))
+	}
+	line := fmt.Sprintf("%s %s %d", change.Operation, change.Entity, change.ID)
+	if len(fields) > 0 {
+		line += ": " + strings.Join(fields, ", ")
+	}
+	fmt.Println(line)
+}
+
+func loadCheckpoint(file string) (storage.Checkpoint, error) {
+	raw, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return storage.Checkpoint{}, nil
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	var checkpoint storage.Checkpoint
+	return checkpoint, errors.Wrap(json.Unmarshal(raw, &checkpoint), "checkpoint")
+}
+
+func saveCheckpoint(file string, checkpoint storage.Checkpoint) error {
+	raw, err := json.Marshal(checkpoint)
+	if !tools.Try(err) {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o600); !tools.Try(err) {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	stdlog "log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/pkg/errors"
@@ -16,6 +18,7 @@ import (
 	"github.com/iamwavecut/ct-mend/internal/config"
 	"github.com/iamwavecut/ct-mend/internal/server"
 	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/internal/webhook"
 	"github.com/iamwavecut/ct-mend/tools"
 )
 
@@ -45,18 +48,111 @@ func main() {
 	ctx := context.WithValue(context.Background(), config.Key{}, cfg)
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, os.Kill, syscall.SIGTERM)
 	defer cancel()
-	eg, ctx := errgroup.WithContext(ctx)
+	if len(os.Args) > 1 {
+		if err := command(ctx, &cfg.Storage, os.Args[1:]); !tools.Try(err) {
+			log.WithError(err).Fatalln(os.Args[1], "failed")
+		}
+		return
+	}
+	err := serve(ctx, cfg)
+	if !tools.Try(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Fatalln("shut down with failure")
+	}
+	log.Traceln("bye")
+}
 
+// serve Listens while the migrations run, the readiness fails until they are done. The webhook deliveries start
+// once the schema is up to date.
+func serve(ctx context.Context, cfg *config.Config) error {
+	mode, err := storage.ParseMigrateMode(cfg.Storage.Migrate)
+	if !tools.Try(err) {
+		return err
+	}
+	db, err := storage.Open(ctx, &cfg.Storage)
+	if !tools.Try(err) {
+		return err
+	}
+	defer closeStorage(db, cfg.GracefulTimeout)
+	s := server.New(cfg.TLS, db, cfg.GracefulTimeout)
+	migrated := s.Migrating()
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return s.Listen(ctx) //nolint:wrapcheck // just no
+	})
 	eg.Go(func() error {
-		db, err := storage.New(ctx, &cfg.Storage)
+		err := storage.Migrate(ctx, db, mode)
+		migrated()
 		if !tools.Try(err) {
-			return err
+			return errors.Wrap(err, "migrate")
 		}
-		return server.New(cfg.TLS, db, cfg.GracefulTimeout).Listen(ctx) //nolint:wrapcheck // just no
+		return dispatch(ctx, db, cfg.Webhooks)
 	})
 	log.Traceln("hello on", cfg.TLS.Addr, cfg.Storage.Type, cfg.Storage.Addr)
-	if err := eg.Wait(); !tools.Try(err) && errors.Is(err, context.Canceled) {
-		log.WithError(err).Errorln("shut down with failure")
+	return eg.Wait()
+}
+
+// dispatch Delivers the outbox events to the webhooks until the context is done.
+func dispatch(ctx context.Context, db storage.Adapter, cfg config.Webhooks) error {
+	outbox, ok := storage.As[storage.Outbox](db)
+	if !ok {
+		return nil
+	}
+	return webhook.NewDispatcher(outbox, cfg).Run(ctx)
+}
+
+// command Runs the subcommand against the configured storage, instead of serving:
+//
+//	server backup <file>
+//	server restore <file>
+//
+// The file is stdout or stdin if it's "-".
+func command(ctx context.Context, cfg *config.Storage, args []string) error {
+	if len(args) != 2 || args[0] != "backup" && args[0] != "restore" {
+		return errors.New("usage: server backup|restore <file>")
+	}
+	db, err := storage.New(ctx, cfg)
+	if !tools.Try(err) {
+		return err
+	}
+	defer closeStorage(db, config.DefaultTimeout)
+	switch args[0] {
+	case "backup":
+		out := os.Stdout
+		if args[1] != "-" {
+			if out, err = os.Create(args[1]); !tools.Try(err) {
+				return err
+			}
+		}
+		manifest, err := storage.Backup(ctx, db, out)
+		if !tools.Try(err) {
+			_ = out.Close()
+			return err
+		}
+		log.Infof("backed up %+v", manifest.Files)
+		return out.Close()
+	case "restore":
+		in := os.Stdin
+		if args[1] != "-" {
+			if in, err = os.Open(args[1]); !tools.Try(err) {
+				return err
+			}
+			defer in.Close()
+		}
+		manifest, err := storage.Restore(ctx, db, in, 0)
+		if !tools.Try(err) {
+			return err
+		}
+		log.Infof("restored %+v", manifest.Files)
+		return nil
+	}
+	return nil
+}
+
+// closeStorage Releases the connections once the server is done, the app context is canceled by then.
+func closeStorage(db storage.Adapter, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.Close(ctx); !tools.Try(err) {
+		log.WithError(err).Errorln("storage close failed")
 	}
-	log.Traceln("bye")
 }
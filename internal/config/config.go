@@ -18,18 +18,77 @@ type (
 	// TLS Web-server config.
 	TLS struct {
 		Addr string `env:"TLS_ADDR"`
+		// CreateOnPut PUT of a missing entity creates it, otherwise responds with 404.
+		CreateOnPut bool `env:"CREATE_ON_PUT" envDefault:"true"`
+		// DrainDelay Keeps serving on shutdown with the readiness failed, until the load balancer notices.
+		DrainDelay time.Duration `env:"DRAIN_DELAY" envDefault:"0s"`
+		// MaxRestoreSize Bytes of the backup archive a restore takes, compressed and its files uncompressed each.
+		MaxRestoreSize int64 `env:"MAX_RESTORE_SIZE" envDefault:"268435456"`
 	}
 
 	// Storage Database config.
 	Storage struct {
-		Type string `env:"STORAGE_TYPE"`
-		Addr string `env:"STORAGE_ADDR"`
+		Type    string `env:"STORAGE_TYPE"`
+		Addr    string `env:"STORAGE_ADDR"`
+		Migrate string `env:"MIGRATE" envDefault:"auto"`
+		// ClientDeletePolicy One of restrict, cascade, nullify.
+		ClientDeletePolicy string `env:"CLIENT_DELETE_POLICY" envDefault:"restrict"`
+		// Audit Records the writes to the audit log.
+		Audit bool `env:"AUDIT" envDefault:"true"`
+		// Outbox Appends an event of every write to the outbox, for the webhooks.
+		Outbox bool `env:"OUTBOX" envDefault:"true"`
+		// CacheSize Entities and list pages cached in memory, 0 disables the cache.
+		CacheSize int           `env:"CACHE_SIZE" envDefault:"1000"`
+		CacheTTL  time.Duration `env:"CACHE_TTL" envDefault:"5s"`
+		// RetryAttempts Tries of a storage call failing with a transient error, 1 disables the retries.
+		RetryAttempts int `env:"RETRY_ATTEMPTS" envDefault:"3"`
+		// RetryBackoff Delay of the first retry, doubled by every next one up to RetryMaxBackoff, and jittered.
+		RetryBackoff    time.Duration `env:"RETRY_BACKOFF" envDefault:"50ms"`
+		RetryMaxBackoff time.Duration `env:"RETRY_MAX_BACKOFF" envDefault:"1s"`
+		// BreakerThreshold Consecutive transient failures opening the circuit breaker, 0 disables it.
+		BreakerThreshold int `env:"BREAKER_THRESHOLD" envDefault:"5"`
+		// BreakerCooldown How long the open breaker fails the calls fast, before letting a probe through.
+		BreakerCooldown time.Duration `env:"BREAKER_COOLDOWN" envDefault:"10s"`
+		// MaxConcurrent Storage calls running at once, 0 is unlimited.
+		MaxConcurrent int `env:"MAX_CONCURRENT_CALLS" envDefault:"64"`
+		// QueueTimeout How long a call waits for its turn past MaxConcurrent, before failing.
+		QueueTimeout time.Duration `env:"CALL_QUEUE_TIMEOUT" envDefault:"1s"`
+		// MaxOpenConns SQL connections open at once, 0 is unlimited.
+		MaxOpenConns int `env:"MAX_OPEN_CONNS" envDefault:"0"`
+		// MaxIdleConns SQL connections kept open between the calls, 0 keeps the default of 2.
+		MaxIdleConns int `env:"MAX_IDLE_CONNS" envDefault:"2"`
+		// ConnMaxLifetime Age of an SQL connection it's reopened at, 0 keeps them open for good.
+		ConnMaxLifetime time.Duration `env:"CONN_MAX_LIFETIME" envDefault:"0s"`
+		// MongoPoolSize Connections per MongoDB server, 0 keeps the driver default of 100.
+		MongoPoolSize uint64 `env:"MONGO_POOL_SIZE" envDefault:"100"`
+		// SQLiteWAL Lets the reads go on while a write is in progress.
+		SQLiteWAL bool `env:"SQLITE_WAL" envDefault:"true"`
+		// SQLiteBusyTimeout How long a write waits for the one in progress, before failing with database is locked.
+		SQLiteBusyTimeout time.Duration `env:"SQLITE_BUSY_TIMEOUT" envDefault:"5s"`
+	}
+
+	// Webhooks Delivery of the outbox events config.
+	Webhooks struct {
+		// PollInterval How often the dispatcher looks for the due deliveries, once it has made all of them.
+		PollInterval time.Duration `env:"WEBHOOK_POLL_INTERVAL" envDefault:"1s"`
+		// Concurrency Deliveries made at once.
+		Concurrency int `env:"WEBHOOK_CONCURRENCY" envDefault:"10"`
+		// Timeout How long a delivery waits for the response.
+		Timeout time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"5s"`
+		// MaxAttempts Attempts of a delivery before it goes to the dead letters.
+		MaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"10"`
+		// Backoff Delay of the first retry, doubled by every next one up to MaxBackoff, and jittered.
+		Backoff    time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"1s"`
+		MaxBackoff time.Duration `env:"WEBHOOK_MAX_BACKOFF" envDefault:"1h"`
+		// Retention How long the delivered events are kept, 0 keeps them forever.
+		Retention time.Duration `env:"WEBHOOK_RETENTION" envDefault:"168h"`
 	}
 
 	// Config Application config.
 	Config struct {
 		TLS             TLS
 		Storage         Storage
+		Webhooks        Webhooks
 		AppLogLevel     log.Level     `env:"LOG_LEVEL" envDefault:"trace"`
 		GracefulTimeout time.Duration `env:"GRACEFUL_TIMEOUT" envDefault:"10s"`
 	}
@@ -0,0 +1,119 @@
+// Package fault Error taxonomy shared by storage and server
+package fault
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Internal Anything unexpected, the default kind.
+	Internal Kind = iota
+	// Malformed Input which can't even be parsed.
+	Malformed
+	// Validation Well-formed input, which breaks the rules.
+	Validation
+	// NotFound Entity does not exist.
+	NotFound
+	// Conflict Operation clashes with the current state of the entity.
+	Conflict
+	// Unavailable Backing service is down or timed out, retry may help.
+	Unavailable
+	// Precondition Entity has changed since the version the caller expects.
+	Precondition
+)
+
+type (
+	Kind int
+
+	// Classified Errors which know their kind.
+	Classified interface {
+		error
+		Kind() Kind
+	}
+
+	// Delayed Errors which know when a retry may succeed.
+	Delayed interface {
+		error
+		RetryAfter() time.Duration
+	}
+
+	// Error Generic classified error.
+	Error struct {
+		kind  Kind
+		msg   string
+		cause error
+	}
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Malformed:
+		return "malformed"
+	case Validation:
+		return "validation"
+	case NotFound:
+		return "not-found"
+	case Conflict:
+		return "conflict"
+	case Unavailable:
+		return "unavailable"
+	case Precondition:
+		return "precondition"
+	}
+	return "internal"
+}
+
+// New Classified error with a message.
+func New(kind Kind, msg string) error {
+	return Error{kind: kind, msg: msg}
+}
+
+// Wrap Classifies the error, nil stays nil.
+func Wrap(kind Kind, err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return Error{kind: kind, msg: msg, cause: err}
+}
+
+func (e Error) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	if e.msg == "" {
+		return e.cause.Error()
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e Error) Kind() Kind {
+	return e.kind
+}
+
+func (e Error) Unwrap() error {
+	return e.cause
+}
+
+// KindOf Finds the kind of the first classified error in the chain, timeouts are taken as Unavailable.
+func KindOf(err error) Kind {
+	var classified Classified
+	if errors.As(err, &classified) {
+		return classified.Kind()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Unavailable
+	}
+	return Internal
+}
+
+// RetryAfterOf Finds the delay of the first delayed error in the chain, zero if there is none.
+func RetryAfterOf(err error) time.Duration {
+	var delayed Delayed
+	if errors.As(err, &delayed) {
+		return delayed.RetryAfter()
+	}
+	return 0
+}
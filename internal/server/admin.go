@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+)
+
+// archiveContentType Media type of the backup archives.
+const archiveContentType = "application/gzip"
+
+// AdminHandler Serves the backups and the cache counters of the storage.
+type AdminHandler struct {
+	db storage.Adapter
+	// maxRestoreSize Bytes of the restored archive, both the request body and the files it holds, 0 is unlimited.
+	maxRestoreSize int64
+}
+
+// Backup Responds with the tar.gz archive of every entity, it is built in full first to fail with a problem.
+func (h *AdminHandler) Backup(w http.ResponseWriter, r *http.Request) {
+	archive := &bytes.Buffer{}
+	_, err := storage.Backup(r.Context(), h.db, archive)
+	if !try(w, err) {
+		return
+	}
+	w.Header().Set("Content-Type", archiveContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="backup.tar.gz"`)
+	_, err = archive.WriteTo(w)
+	try(w, err)
+}
+
+// Restore Loads the tar.gz archive of the request body, responds with its manifest.
+func (h *AdminHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if h.maxRestoreSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxRestoreSize)
+	}
+	manifest, err := storage.Restore(r.Context(), h.db, body, h.maxRestoreSize)
+	if !try(w, err) {
+		return
+	}
+	err = json.NewEncoder(w).Encode(manifest)
+	if !try(w, err) {
+		return
+	}
+}
+
+// CacheStats Responds with the hit and miss counters of the storage cache.
+func (h *AdminHandler) CacheStats(w http.ResponseWriter, r *http.Request) {
+	meter, ok := storage.As[storage.CacheMeter](h.db)
+	if !ok {
+		try(w, fault.New(fault.NotFound, "storage is not cached"))
+		return
+	}
+	err := json.NewEncoder(w).Encode(meter.CacheStats())
+	if !try(w, err) {
+		return
+	}
+}
+
+func initAdminHandler(r *mux.Router, handler *AdminHandler) {
+	pr := r.PathPrefix("/admin").Subrouter()
+	pr.Use(contentTypeMiddleware(archiveContentType))
+	pr.Methods("POST").Path("/backup").HandlerFunc(handler.Backup)
+	pr.Methods("POST").Path("/restore").HandlerFunc(handler.Restore)
+	pr.Methods("GET").Path("/cache").HandlerFunc(handler.CacheStats)
+}
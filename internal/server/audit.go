@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+)
+
+// actorHeader Names who the caller claims to be, kept in the audit log unverified.
+const actorHeader = "X-Actor"
+
+// AuditHandler Serves the audit log of the writes.
+type AuditHandler struct {
+	log storage.AuditLog
+}
+
+// Select Lists the entries recorded since ?since=, if given, in RFC 3339.
+func (h *AuditHandler) Select(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			try(w, fault.Wrap(fault.Malformed, err, "since must be an RFC 3339 timestamp"))
+			return
+		}
+	}
+	query, page, err := parseList(r, storage.AuditSchema)
+	if !try(w, err) {
+		return
+	}
+	h.selectAudit(w, r, query, since, page)
+}
+
+// History Lists the entries of the entity with the {id} of the path.
+func (h *AuditHandler) History(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID, err := pathID(r, "id")
+		if !try(w, err) {
+			return
+		}
+		query, page, err := parseList(r, storage.AuditSchema)
+		if !try(w, err) {
+			return
+		}
+		byEntity, _ := storage.AuditSchema.Compare("entity", storage.OpEq, entity)
+		byID, _ := storage.AuditSchema.Compare("entity_id", storage.OpEq, ID)
+		query = query.And(byEntity).And(byID)
+		h.selectAudit(w, r, query, time.Time{}, page)
+	}
+}
+
+func (h *AuditHandler) selectAudit(w http.ResponseWriter, r *http.Request, query storage.Query, since time.Time, page storage.Page) {
+	entries, more, err := h.log.SelectAudit(r.Context(), query, since, page)
+	if !try(w, err) {
+		return
+	}
+	setPageLinks(w, r, storage.AuditSchema, query, page, entries, more)
+	err = json.NewEncoder(w).Encode(entries)
+	if !try(w, err) {
+		return
+	}
+}
+
+// actorMiddleware Tells the storage who makes the request: the remote host, as there is no authenticated identity.
+// The X-Actor header is passed along as the claimed actor only, since any caller may set it.
+func actorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			actor = host
+		}
+		ctx := storage.WithActor(r.Context(), actor)
+		if claimed := r.Header.Get(actorHeader); claimed != "" {
+			ctx = storage.WithClaimedActor(ctx, claimed)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func initAuditHandler(r *mux.Router, handler *AuditHandler) {
+	r.Methods("GET").Path("/audit").HandlerFunc(handler.Select)
+	r.Methods("GET").Path("/clients/{id:[0-9]+}/history").HandlerFunc(handler.History(storage.AuditClient))
+	r.Methods("GET").Path("/projects/{id:[0-9]+}/history").HandlerFunc(handler.History(storage.AuditProject))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const maxBatchSize = 1000
+
+// BatchHandler Serves the batches of client and project writes.
+type BatchHandler struct {
+	db storage.Adapter
+}
+
+// batchResult Outcome of the operation at the same position, with the status its own request would get.
+type batchResult[T any] struct {
+	Status  int      `json:"status"`
+	Entity  *T       `json:"entity,omitempty"`
+	Problem *problem `json:"problem,omitempty"`
+}
+
+// Clients Applies the array of client operations, see batch.
+func (h *BatchHandler) Clients(w http.ResponseWriter, r *http.Request) {
+	batch(w, r, func(ctx context.Context, ops []storage.Operation[storage.Client], atomic bool) ([]storage.Outcome[storage.Client], error) {
+		return storage.BatchClients(ctx, h.db, ops, atomic)
+	})
+}
+
+// Projects Applies the array of project operations, see batch.
+func (h *BatchHandler) Projects(w http.ResponseWriter, r *http.Request) {
+	batch(w, r, func(ctx context.Context, ops []storage.Operation[storage.Project], atomic bool) ([]storage.Outcome[storage.Project], error) {
+		return storage.BatchProjects(ctx, h.db, ops, atomic)
+	})
+}
+
+// batch Responds with 207 and the result of every operation, in the order of the request. With ?atomic=true
+// either all of them apply or none, the ones failed along with another get 424.
+func batch[T any](
+	w http.ResponseWriter,
+	r *http.Request,
+	apply func(ctx context.Context, ops []storage.Operation[T], atomic bool) ([]storage.Outcome[T], error),
+) {
+	atomic := false
+	if raw := r.URL.Query().Get("atomic"); raw != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(raw); err != nil {
+			try(w, fault.New(fault.Malformed, "atomic must be a boolean"))
+			return
+		}
+	}
+	var ops []storage.Operation[T]
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		try(w, fault.Wrap(fault.Malformed, err, "malformed batch"))
+		return
+	}
+	if len(ops) == 0 || len(ops) > maxBatchSize {
+		try(w, fault.New(fault.Malformed, "batch must have from 1 to "+strconv.Itoa(maxBatchSize)+" operations"))
+		return
+	}
+	outcomes, err := apply(r.Context(), ops, atomic)
+	if !try(w, err) {
+		return
+	}
+	results := make([]batchResult[T], len(outcomes))
+	for i, outcome := range outcomes {
+		results[i] = resultOf(ops[i].Op, outcome)
+	}
+	w.WriteHeader(http.StatusMultiStatus)
+	err = json.NewEncoder(w).Encode(results)
+	try(w, err)
+}
+
+func resultOf[T any](op storage.BatchOp, outcome storage.Outcome[T]) batchResult[T] {
+	if outcome.Err == nil {
+		status := http.StatusOK
+		switch op {
+		case storage.BatchCreate:
+			status = http.StatusCreated
+		case storage.BatchDelete:
+			status = http.StatusNoContent
+		}
+		return batchResult[T]{Status: status, Entity: outcome.Entity}
+	}
+	if fault.KindOf(outcome.Err) == fault.Internal {
+		tools.Try(outcome.Err, true)
+	}
+	p := newProblem(outcome.Err)
+	if _, aborted := outcome.Err.(storage.ErrBatchAborted); aborted {
+		p.Status, p.Title = http.StatusFailedDependency, http.StatusText(http.StatusFailedDependency)
+	}
+	return batchResult[T]{Status: p.Status, Problem: &p}
+}
+
+func initBatchHandler(r *mux.Router, handler *BatchHandler) {
+	r.Methods("POST").Path("/clients:batch").HandlerFunc(handler.Clients)
+	r.Methods("POST").Path("/projects:batch").HandlerFunc(handler.Projects)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	healthUp   = "up"
+	healthDown = "down"
+
+	// pingTimeout Bounds the storage ping of the readiness probe, orchestrators give up after a second by default.
+	pingTimeout = time.Second
+)
+
+type (
+	// Health Response of the probes, the status is down if any component is.
+	Health struct {
+		Status     string                     `json:"status"`
+		Components map[string]ComponentHealth `json:"components"`
+	}
+
+	ComponentHealth struct {
+		Status string `json:"status"`
+		Detail string `json:"detail,omitempty"`
+	}
+)
+
+// Migrating Fails the readiness until the returned func is called, for the migrations running meanwhile.
+func (s *TLS) Migrating() func() {
+	atomic.AddInt32(&s.migrating, 1)
+	return func() {
+		atomic.AddInt32(&s.migrating, -1)
+	}
+}
+
+// liveness Responds while the process serves at all, the storage is none of its business.
+func (s *TLS) liveness(w http.ResponseWriter, _ *http.Request) {
+	s.writeHealth(w, map[string]ComponentHealth{"server": {Status: healthUp}})
+}
+
+// readiness Tells if the requests may be routed here: no migrations running, the storage reachable
+// and its circuit closed, and no shutdown going on.
+func (s *TLS) readiness(w http.ResponseWriter, r *http.Request) {
+	components := map[string]ComponentHealth{
+		"server":     {Status: healthUp},
+		"migrations": {Status: healthUp},
+		"storage":    {Status: healthUp},
+	}
+	if atomic.LoadInt32(&s.draining) > 0 {
+		components["server"] = ComponentHealth{Status: healthDown, Detail: "shutting down"}
+	}
+	if atomic.LoadInt32(&s.migrating) > 0 {
+		components["migrations"] = ComponentHealth{Status: healthDown, Detail: "running"}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+	if err := s.db.Ping(ctx); !tools.Try(err) {
+		components["storage"] = ComponentHealth{Status: healthDown, Detail: err.Error()}
+	}
+	if breaker, ok := storage.As[storage.CircuitBreaker](s.db); ok {
+		components["circuit"] = ComponentHealth{Status: healthUp}
+		if breaker.CircuitOpen() {
+			components["circuit"] = ComponentHealth{Status: healthDown, Detail: "open"}
+		}
+	}
+	s.writeHealth(w, components)
+}
+
+func (s *TLS) writeHealth(w http.ResponseWriter, components map[string]ComponentHealth) {
+	health := Health{Status: healthUp, Components: components}
+	for _, component := range components {
+		if component.Status != healthUp {
+			health.Status = healthDown
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if health.Status != healthUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(health)
+	try(w, err)
+}
+
+func initHealthHandler(r *mux.Router, s *TLS) {
+	r.Methods("GET").Path("/healthz").HandlerFunc(s.liveness)
+	r.Methods("GET").Path("/readyz").HandlerFunc(s.readiness)
+}
@@ -24,21 +24,41 @@ func (_m *MockRESTHandler) Get(_a0 http.ResponseWriter, _a1 *http.Request) {
 	_m.Called(_a0, _a1)
 }
 
+// Patch provides a mock function with given fields: _a0, _a1
+func (_m *MockRESTHandler) Patch(_a0 http.ResponseWriter, _a1 *http.Request) {
+	_m.Called(_a0, _a1)
+}
+
 // Post provides a mock function with given fields: _a0, _a1
 func (_m *MockRESTHandler) Post(_a0 http.ResponseWriter, _a1 *http.Request) {
 	_m.Called(_a0, _a1)
 }
 
+// Purge provides a mock function with given fields: _a0, _a1
+func (_m *MockRESTHandler) Purge(_a0 http.ResponseWriter, _a1 *http.Request) {
+	_m.Called(_a0, _a1)
+}
+
 // Put provides a mock function with given fields: _a0, _a1
 func (_m *MockRESTHandler) Put(_a0 http.ResponseWriter, _a1 *http.Request) {
 	_m.Called(_a0, _a1)
 }
 
+// Restore provides a mock function with given fields: _a0, _a1
+func (_m *MockRESTHandler) Restore(_a0 http.ResponseWriter, _a1 *http.Request) {
+	_m.Called(_a0, _a1)
+}
+
 // Select provides a mock function with given fields: _a0, _a1
 func (_m *MockRESTHandler) Select(_a0 http.ResponseWriter, _a1 *http.Request) {
 	_m.Called(_a0, _a1)
 }
 
+// Trash provides a mock function with given fields: _a0, _a1
+func (_m *MockRESTHandler) Trash(_a0 http.ResponseWriter, _a1 *http.Request) {
+	_m.Called(_a0, _a1)
+}
+
 // WithStorageAdapter provides a mock function with given fields: db
 func (_m *MockRESTHandler) WithStorageAdapter(db storage.Adapter) RESTHandler {
 	ret := _m.Called(db)
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+
+	cursorAfter  = "a"
+	cursorBefore = "b"
+)
+
+// pageCursor Decoded ?cursor=, the keyset of the entity the page starts after or ends before.
+type pageCursor struct {
+	Direction string         `json:"d"`
+	Keyset    storage.Keyset `json:"k"`
+}
+
+// parseList Reads ?filter= and ?sort= of the list request against the schema, then its page.
+func parseList(r *http.Request, schema *storage.Schema) (storage.Query, storage.Page, error) {
+	params := r.URL.Query()
+	query, err := schema.ParseQuery(params.Get("filter"), params.Get("sort"))
+	if !tools.Try(err) {
+		return query, storage.Page{}, err
+	}
+	page, err := parsePage(r, schema, query)
+	return query, page, err
+}
+
+// parsePage Reads ?limit= and the opaque ?cursor= of the list request, the cursor must match the query sort.
+func parsePage(r *http.Request, schema *storage.Schema, query storage.Query) (storage.Page, error) {
+	page := storage.Page{Limit: defaultPageLimit}
+	params := r.URL.Query()
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if !tools.Try(err) || n < 1 || n > maxPageLimit {
+			return page, fault.New(fault.Malformed, "limit must be an integer from 1 to "+strconv.Itoa(maxPageLimit))
+		}
+		page.Limit = n
+	}
+	encoded := params.Get("cursor")
+	if encoded == "" {
+		return page, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if !tools.Try(err) {
+		return page, fault.Wrap(fault.Malformed, err, "malformed cursor")
+	}
+	var c pageCursor
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err = dec.Decode(&c); !tools.Try(err) {
+		return page, fault.Wrap(fault.Malformed, err, "malformed cursor")
+	}
+	keyset, err := schema.Keyset(query, c.Keyset)
+	if !tools.Try(err) {
+		return page, err
+	}
+	switch c.Direction {
+	case cursorAfter:
+		page.After = keyset
+	case cursorBefore:
+		page.Before = keyset
+	default:
+		return page, fault.New(fault.Malformed, "malformed cursor")
+	}
+	return page, nil
+}
+
+func encodeCursor(direction string, keyset storage.Keyset) string {
+	raw, _ := json.Marshal(pageCursor{Direction: direction, Keyset: keyset})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// setPageLinks Adds rel=next and rel=prev Link headers bounded by the sort keys of the first and the last entity,
+// given whether there are more entities past the page in its direction.
+func setPageLinks[T any](w http.ResponseWriter, r *http.Request, schema *storage.Schema, query storage.Query, page storage.Page, entities []T, more bool) {
+	if len(entities) == 0 {
+		return
+	}
+	hasNext, hasPrev := more, page.After != nil
+	if page.Backward() {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		last := schema.KeysetOf(query, entities[len(entities)-1])
+		w.Header().Add("Link", pageLink(r, page, encodeCursor(cursorAfter, last), "next"))
+	}
+	if hasPrev {
+		first := schema.KeysetOf(query, entities[0])
+		w.Header().Add("Link", pageLink(r, page, encodeCursor(cursorBefore, first), "prev"))
+	}
+}
+
+// pageLink Keeps the rest of the request query, like filters, intact.
+func pageLink(r *http.Request, page storage.Page, cursor, rel string) string {
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(page.Limit))
+	query.Set("cursor", cursor)
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return "<" + link.String() + `>; rel="` + rel + `"`
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	// mergePatchContentType RFC 7396 JSON Merge Patch.
+	mergePatchContentType = "application/merge-patch+json"
+	// jsonPatchContentType RFC 6902 JSON Patch.
+	jsonPatchContentType = "application/json-patch+json"
+)
+
+// patchFunc Applies the request patch to the JSON document of the entity.
+type patchFunc func(doc []byte) ([]byte, error)
+
+// readPatch Reads and validates the patch upfront, so it may be applied to the entity as many times as the storage needs.
+func readPatch(r *http.Request) (patchFunc, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !tools.Try(err) {
+		return nil, fault.Wrap(fault.Malformed, err, "malformed content type")
+	}
+	body, err := io.ReadAll(r.Body)
+	if !tools.Try(err) {
+		return nil, fault.Wrap(fault.Malformed, err, "unreadable patch")
+	}
+
+	switch mediaType {
+	case mergePatchContentType:
+		var obj map[string]interface{}
+		if err = json.Unmarshal(body, &obj); !tools.Try(err) {
+			return nil, fault.Wrap(fault.Malformed, err, "merge patch must be a JSON object")
+		}
+		return func(doc []byte) ([]byte, error) {
+			res, err := jsonpatch.MergePatch(doc, body)
+			return res, fault.Wrap(fault.Validation, err, "merge patch can't be applied")
+		}, nil
+	case jsonPatchContentType:
+		patch, err := jsonpatch.DecodePatch(body)
+		if !tools.Try(err) {
+			return nil, fault.Wrap(fault.Malformed, err, "malformed JSON patch")
+		}
+		return func(doc []byte) ([]byte, error) {
+			res, err := patch.Apply(doc)
+			if errors.Is(err, jsonpatch.ErrTestFailed) {
+				return nil, fault.Wrap(fault.Conflict, err, "JSON patch test failed")
+			}
+			return res, fault.Wrap(fault.Validation, err, "JSON patch can't be applied")
+		}, nil
+	}
+	return nil, fault.New(fault.Malformed, "unsupported patch type "+mediaType)
+}
+
+// patchEntity Replaces the entity with its patched version, fields dropped by the patch get zero values.
+func patchEntity[T any](patch patchFunc, entity *T) error {
+	doc, err := json.Marshal(entity)
+	if !tools.Try(err) {
+		return err
+	}
+	doc, err = patch(doc)
+	if !tools.Try(err) {
+		return err
+	}
+	var patched T
+	if err = json.Unmarshal(doc, &patched); !tools.Try(err) {
+		return fault.Wrap(fault.Validation, err, "patched entity is invalid")
+	}
+	*entity = patched
+	return nil
+}
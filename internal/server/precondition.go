@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type (
+	// precondition Parsed If-Match or If-None-Match header.
+	precondition struct {
+		present bool
+		any     bool
+		tags    []entityTag
+	}
+
+	entityTag struct {
+		version int
+		weak    bool
+	}
+)
+
+// etag Strong entity tag of the version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parsePrecondition Reads the list of entity tags, the ones not issued by the server never match.
+func parsePrecondition(r *http.Request, header string) precondition {
+	value := strings.TrimSpace(r.Header.Get(header))
+	if value == "" {
+		return precondition{}
+	}
+	cond := precondition{present: true}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			cond.any = true
+			continue
+		}
+		weak := strings.HasPrefix(tag, "W/")
+		tag = strings.TrimPrefix(tag, "W/")
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		version, err := strconv.Atoi(tag[1 : len(tag)-1])
+		if !tools.Try(err) || version <= 0 {
+			continue
+		}
+		cond.tags = append(cond.tags, entityTag{version: version, weak: weak})
+	}
+	return cond
+}
+
+// matches Compares the tags with the version, weak ones only count in the weak comparison.
+func (p precondition) matches(version int, weak bool) bool {
+	if p.any {
+		return true
+	}
+	for _, tag := range p.tags {
+		if tag.version == version && (weak || !tag.weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion Resolves If-Match into the version the write is conditional on, zero if it's unconditional.
+// Anything but a single strong tag needs the current version, which is then rechecked by the storage atomically.
+func expectedVersion(r *http.Request, current func() (int, error)) (int, error) {
+	cond := parsePrecondition(r, "If-Match")
+	if !cond.present {
+		return 0, nil
+	}
+	if !cond.any && len(cond.tags) == 1 && !cond.tags[0].weak {
+		return cond.tags[0].version, nil
+	}
+	version, err := current()
+	if fault.KindOf(err) == fault.NotFound {
+		return 0, storage.ErrVersionMismatch{}
+	}
+	if !tools.Try(err) {
+		return 0, err
+	}
+	if !cond.matches(version, false) {
+		return 0, storage.ErrVersionMismatch{}
+	}
+	return version, nil
+}
+
+// conditional If-Match fails on missing entities as well.
+func conditional(err error, version int) error {
+	if fault.KindOf(err) == fault.NotFound && version != 0 {
+		return storage.ErrVersionMismatch{}
+	}
+	return err
+}
+
+// notModified Responds with 304 if If-None-Match has the current version.
+func notModified(w http.ResponseWriter, r *http.Request, version int) bool {
+	w.Header().Set("ETag", etag(version))
+	if !parsePrecondition(r, "If-None-Match").matches(version, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
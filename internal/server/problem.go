@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:ct-mend:problem:"
+)
+
+// problem RFC 7807 problem details.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var problemStatuses = map[fault.Kind]int{
+	fault.Internal:     http.StatusInternalServerError,
+	fault.Malformed:    http.StatusBadRequest,
+	fault.Validation:   http.StatusUnprocessableEntity,
+	fault.NotFound:     http.StatusNotFound,
+	fault.Conflict:     http.StatusConflict,
+	fault.Unavailable:  http.StatusServiceUnavailable,
+	fault.Precondition: http.StatusPreconditionFailed,
+}
+
+func newProblem(err error) problem {
+	kind := fault.KindOf(err)
+	status := problemStatuses[kind]
+	p := problem{
+		Type:   problemTypePrefix + kind.String(),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	}
+	if kind == fault.Internal {
+		// internals are logged, not exposed
+		p.Detail = ""
+	}
+	return p
+}
+
+func writeProblem(w http.ResponseWriter, err error) {
+	p := newProblem(err)
+	w.Header().Set("Content-Type", problemContentType)
+	if delay := fault.RetryAfterOf(err); delay > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func notFoundHandler(w http.ResponseWriter, _ *http.Request) {
+	writeProblem(w, fault.New(fault.NotFound, "no such route"))
+}
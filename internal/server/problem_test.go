@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+)
+
+func TestProblemMapping(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		kind   string
+	}{
+		{storage.ErrNotFound{}, http.StatusNotFound, "not-found"},
+		{errors.Wrap(storage.ErrReferenced{}, "wrapped"), http.StatusConflict, "conflict"},
+		{storage.ErrDanglingReference{}, http.StatusUnprocessableEntity, "validation"},
+		{fault.New(fault.Malformed, "bad json"), http.StatusBadRequest, "malformed"},
+		{storage.ErrVersionMismatch{}, http.StatusPreconditionFailed, "precondition"},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, "unavailable"},
+		{errors.New("secret internals"), http.StatusInternalServerError, "internal"},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			writeProblem(resp, tc.err)
+
+			assert.Equal(t, tc.status, resp.Code)
+			assert.Equal(t, problemContentType, resp.Header().Get("Content-Type"))
+			p := problem{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+			assert.Equal(t, problemTypePrefix+tc.kind, p.Type)
+			assert.Equal(t, tc.status, p.Status)
+			assert.NotContains(t, p.Detail, "secret")
+		})
+	}
+}
+
+func TestProblemRetryAfter(t *testing.T) {
+	resp := httptest.NewRecorder()
+	writeProblem(resp, errors.Wrap(delayed{1500 * time.Millisecond}, "wrapped"))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get("Retry-After"), "rounded up to seconds")
+
+	resp = httptest.NewRecorder()
+	writeProblem(resp, context.DeadlineExceeded)
+	assert.Empty(t, resp.Header().Get("Retry-After"))
+}
+
+type delayed struct {
+	after time.Duration
+}
+
+func (d delayed) Error() string {
+	return "circuit breaker is open"
+}
+
+func (d delayed) Kind() fault.Kind {
+	return fault.Unavailable
+}
+
+func (d delayed) RetryAfter() time.Duration {
+	return d.after
+}
+
+func TestMalformedRequests(t *testing.T) {
+	handler := &ClientsHandler{db: storage.NewMockAdapter(t)}
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "https://about.blank/clients/", bytes.NewBufferString(`{"name":`))
+	handler.Post(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "https://about.blank/clients/?id=one", nil)
+	handler.Get(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchHandler Serves the search over the client and project names.
+type SearchHandler struct {
+	db storage.Adapter
+}
+
+// Search Responds with up to ?limit= hits named with every word of ?q=, the best matches first.
+// The storage without a search index gets its names scanned.
+func (h *SearchHandler) Search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	text := strings.TrimSpace(params.Get("q"))
+	if text == "" {
+		try(w, fault.New(fault.Malformed, "q is required"))
+		return
+	}
+	limit := defaultSearchLimit
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			try(w, fault.New(fault.Malformed, "limit must be an integer from 1 to "+strconv.Itoa(maxSearchLimit)))
+			return
+		}
+		limit = n
+	}
+	hits, err := storage.Search(r.Context(), h.db, text, limit)
+	if !try(w, err) {
+		return
+	}
+	err = json.NewEncoder(w).Encode(hits)
+	if !try(w, err) {
+		return
+	}
+}
+
+func initSearchHandler(r *mux.Router, handler *SearchHandler) {
+	r.Methods("GET").Path("/search").HandlerFunc(handler.Search)
+}
@@ -7,8 +7,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	stdlog "log"
+	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -17,6 +19,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
 	"github.com/iamwavecut/ct-mend/internal/storage"
 	"github.com/iamwavecut/ct-mend/resources"
 	"github.com/iamwavecut/ct-mend/tools"
@@ -26,7 +29,14 @@ type (
 	TLS struct {
 		addr    string
 		server  *http.Server
+		db      storage.Adapter
 		timeout time.Duration
+		// drainDelay Keeps serving with the readiness failed for a while on shutdown.
+		drainDelay time.Duration
+		// abort Cancels contexts of the requests still running once the graceful timeout is over.
+		abort context.CancelFunc
+		// migrating Migrations in progress, draining is set once the shutdown starts; both fail the readiness.
+		migrating, draining int32
 	}
 	RESTHandler interface {
 		WithStorageAdapter(db storage.Adapter) RESTHandler
@@ -34,15 +44,25 @@ type (
 		Get(http.ResponseWriter, *http.Request)
 		Post(http.ResponseWriter, *http.Request)
 		Put(http.ResponseWriter, *http.Request)
+		Patch(http.ResponseWriter, *http.Request)
+		// Delete Moves the entity to the trash.
 		Delete(http.ResponseWriter, *http.Request)
+		// Trash Lists the trashed entities, the same way Select does.
+		Trash(http.ResponseWriter, *http.Request)
+		Restore(http.ResponseWriter, *http.Request)
+		// Purge Deletes the trashed entity permanently.
+		Purge(http.ResponseWriter, *http.Request)
 	}
 
 	ClientsHandler struct {
 		db storage.Adapter
+		// createOnPut PUT of a missing entity creates it with the given ID, instead of 404.
+		createOnPut bool
 	}
 
 	ProjectsHanlder struct {
-		db storage.Adapter
+		db          storage.Adapter
+		createOnPut bool
 	}
 )
 
@@ -51,11 +71,25 @@ func (h *ClientsHandler) WithStorageAdapter(db storage.Adapter) RESTHandler {
 	return h
 }
 
-func (h *ClientsHandler) Select(w http.ResponseWriter, _ *http.Request) {
-	clients, err := h.db.SelectClients()
+func (h *ClientsHandler) Select(w http.ResponseWriter, r *http.Request) {
+	h.selectClients(w, r, false)
+}
+
+func (h *ClientsHandler) Trash(w http.ResponseWriter, r *http.Request) {
+	h.selectClients(w, r, true)
+}
+
+func (h *ClientsHandler) selectClients(w http.ResponseWriter, r *http.Request, trash bool) {
+	query, page, err := parseList(r, storage.ClientSchema)
+	if !try(w, err) {
+		return
+	}
+	query.Trash = trash
+	clients, more, err := h.db.SelectClients(r.Context(), query, page)
 	if !try(w, err) {
 		return
 	}
+	setPageLinks(w, r, storage.ClientSchema, query, page, clients, more)
 	err = json.NewEncoder(w).Encode(clients)
 	if !try(w, err) {
 		return
@@ -63,17 +97,12 @@ func (h *ClientsHandler) Select(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (h *ClientsHandler) Get(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
-	}
-	ID, err := strconv.Atoi(sid)
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 
-	client, err := h.db.GetClient(ID)
+	client, err := h.db.GetClient(r.Context(), ID)
 	if !try(w, err) {
 		return
 	}
@@ -81,6 +110,9 @@ func (h *ClientsHandler) Get(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if notModified(w, r, client.Version) {
+		return
+	}
 	err = json.NewEncoder(w).Encode(client)
 	if !try(w, err) {
 		return
@@ -89,17 +121,18 @@ func (h *ClientsHandler) Get(w http.ResponseWriter, r *http.Request) {
 
 func (h *ClientsHandler) Post(w http.ResponseWriter, r *http.Request) {
 	client := storage.Client{}
-	err := json.NewDecoder(r.Body).Decode(&client)
+	err := decodeEntity(r, &client)
 	if !try(w, err) {
 		return
 	}
 
-	newClient, err := h.db.UpsertClient(&client)
+	newClient, err := h.db.CreateClient(r.Context(), &client)
 	if !try(w, err) {
 		return
 	}
 	// TODO: replace with mux named route generated path
 	w.Header().Add("Location", "/clients/"+strconv.Itoa(*newClient.ID))
+	w.Header().Set("ETag", etag(newClient.Version))
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(newClient)
 	try(w, err)
@@ -107,65 +140,164 @@ func (h *ClientsHandler) Post(w http.ResponseWriter, r *http.Request) {
 
 //nolint:dupl
 func (h *ClientsHandler) Put(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
-	}
-	ID, err := strconv.Atoi(sid)
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 	client := &storage.Client{}
-	err = json.NewDecoder(r.Body).Decode(&client)
+	err = decodeEntity(r, client)
 	if !try(w, err) {
 		return
 	}
 	if client.ID == nil || ID != *client.ID {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		tools.Must(json.NewEncoder(w).Encode("validation error: path and entity ids must be equal"))
+		try(w, fault.New(fault.Validation, "path and entity ids must be equal"))
 		return
 	}
-	updatedClient, err := h.db.UpsertClient(client)
+	client.Version, err = expectedVersion(r, h.currentVersion(r, ID))
 	if !try(w, err) {
 		return
 	}
+	status := http.StatusOK
+	updatedClient, err := h.db.ReplaceClient(r.Context(), client)
+	if fault.KindOf(err) == fault.NotFound && h.createOnPut && client.Version == 0 {
+		status = http.StatusCreated
+		updatedClient, err = h.db.CreateClient(r.Context(), client)
+	}
+	if !try(w, conditional(err, client.Version)) {
+		return
+	}
 	// TODO: replace with mux named route generated path
 	w.Header().Set("Location", "/clients/"+strconv.Itoa(*updatedClient.ID))
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("ETag", etag(updatedClient.Version))
+	w.WriteHeader(status)
 	err = json.NewEncoder(w).Encode(updatedClient)
 	try(w, err)
 }
 
+func (h *ClientsHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	patch, err := readPatch(r)
+	if !try(w, err) {
+		return
+	}
+	version, err := expectedVersion(r, h.currentVersion(r, ID))
+	if !try(w, err) {
+		return
+	}
+	patchedClient, err := h.db.UpdateClient(r.Context(), ID, func(client *storage.Client) error {
+		if err := storage.CheckVersion(client.Version, version); !tools.Try(err) {
+			return err
+		}
+		return patchEntity(patch, client)
+	})
+	if !try(w, conditional(err, version)) {
+		return
+	}
+	w.Header().Set("ETag", etag(patchedClient.Version))
+	err = json.NewEncoder(w).Encode(patchedClient)
+	try(w, err)
+}
+
 func (h *ClientsHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
 	}
-	ID, err := strconv.Atoi(sid)
+
+	version, err := expectedVersion(r, h.currentVersion(r, ID))
 	if !try(w, err) {
 		return
 	}
+	err = h.db.DeleteClient(r.Context(), ID, version)
+	if !try(w, conditional(err, version)) {
+		return
+	}
 
-	err = h.db.DeleteClient(ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ClientsHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 
+	client, err := h.db.RestoreClient(r.Context(), ID)
+	if !try(w, err) {
+		return
+	}
+	w.Header().Set("ETag", etag(client.Version))
+	err = json.NewEncoder(w).Encode(client)
+	if !try(w, err) {
+		return
+	}
+}
+
+func (h *ClientsHandler) Purge(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+
+	if !try(w, h.db.PurgeClient(r.Context(), ID)) {
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// currentVersion Looks up the version of the client for If-Match, when it can't be taken from the header as is.
+func (h *ClientsHandler) currentVersion(r *http.Request, ID int) func() (int, error) {
+	return func() (int, error) {
+		client, err := h.db.GetClient(r.Context(), ID)
+		if !tools.Try(err) {
+			return 0, err
+		}
+		return client.Version, nil
+	}
+}
+
 func (h *ProjectsHanlder) WithStorageAdapter(db storage.Adapter) RESTHandler {
 	h.db = db
 	return h
 }
 
-func (h *ProjectsHanlder) Select(w http.ResponseWriter, _ *http.Request) {
-	projects, err := h.db.SelectProjects()
+func (h *ProjectsHanlder) Select(w http.ResponseWriter, r *http.Request) {
+	h.selectProjects(w, r, false)
+}
+
+func (h *ProjectsHanlder) Trash(w http.ResponseWriter, r *http.Request) {
+	h.selectProjects(w, r, true)
+}
+
+func (h *ProjectsHanlder) selectProjects(w http.ResponseWriter, r *http.Request, trash bool) {
+	clientID, scoped, err := clientScope(r)
 	if !try(w, err) {
 		return
 	}
+	query, page, err := parseList(r, storage.ProjectSchema)
+	if !try(w, err) {
+		return
+	}
+	query.Trash = trash
+	if scoped {
+		_, err = h.db.GetClient(r.Context(), clientID)
+		if !try(w, err) {
+			return
+		}
+		owned, err := storage.ProjectSchema.Compare("client_id", storage.OpEq, clientID)
+		if !try(w, err) {
+			return
+		}
+		query = query.And(owned)
+	}
+	projects, more, err := h.db.SelectProjects(r.Context(), query, page)
+	if !try(w, err) {
+		return
+	}
+	setPageLinks(w, r, storage.ProjectSchema, query, page, projects, more)
 	err = json.NewEncoder(w).Encode(projects)
 	if !try(w, err) {
 		return
@@ -173,17 +305,15 @@ func (h *ProjectsHanlder) Select(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (h *ProjectsHanlder) Get(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
-	}
-	ID, err := strconv.Atoi(sid)
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 
-	project, err := h.db.GetProject(ID)
+	if !try(w, h.checkScope(r, ID, true)) {
+		return
+	}
+	project, err := h.db.GetProject(r.Context(), ID)
 	if !try(w, err) {
 		return
 	}
@@ -191,6 +321,9 @@ func (h *ProjectsHanlder) Get(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if notModified(w, r, project.Version) {
+		return
+	}
 	err = json.NewEncoder(w).Encode(project)
 	if !try(w, err) {
 		return
@@ -199,17 +332,21 @@ func (h *ProjectsHanlder) Get(w http.ResponseWriter, r *http.Request) {
 
 func (h *ProjectsHanlder) Post(w http.ResponseWriter, r *http.Request) {
 	project := storage.Project{}
-	err := json.NewDecoder(r.Body).Decode(&project)
+	err := decodeEntity(r, &project)
 	if !try(w, err) {
 		return
 	}
+	if !scopeProject(w, r, &project) {
+		return
+	}
 
-	newProject, err := h.db.UpsertProject(&project)
+	newProject, err := h.db.CreateProject(r.Context(), &project)
 	if !try(w, err) {
 		return
 	}
 	// TODO: replace with mux named route generated path
-	w.Header().Add("Location", "/projects/"+strconv.Itoa(*newProject.ID))
+	w.Header().Add("Location", projectLocation(r, *newProject.ID))
+	w.Header().Set("ETag", etag(newProject.Version))
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(newProject)
 	try(w, err)
@@ -217,62 +354,272 @@ func (h *ProjectsHanlder) Post(w http.ResponseWriter, r *http.Request) {
 
 //nolint:dupl
 func (h *ProjectsHanlder) Put(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
-	}
-	ID, err := strconv.Atoi(sid)
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 	project := &storage.Project{}
-	err = json.NewDecoder(r.Body).Decode(&project)
+	err = decodeEntity(r, project)
 	if !try(w, err) {
 		return
 	}
 	if project.ID == nil || ID != *project.ID {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		tools.Must(json.NewEncoder(w).Encode("validation error: path and entity ids must be equal"))
+		try(w, fault.New(fault.Validation, "path and entity ids must be equal"))
+		return
+	}
+	if !scopeProject(w, r, project) || !try(w, h.checkScope(r, ID, false)) {
 		return
 	}
-	updatedProject, err := h.db.UpsertProject(project)
+	project.Version, err = expectedVersion(r, h.currentVersion(r, ID))
 	if !try(w, err) {
 		return
 	}
+	status := http.StatusOK
+	updatedProject, err := h.db.ReplaceProject(r.Context(), project)
+	if fault.KindOf(err) == fault.NotFound && h.createOnPut && project.Version == 0 {
+		status = http.StatusCreated
+		updatedProject, err = h.db.CreateProject(r.Context(), project)
+	}
+	if !try(w, conditional(err, project.Version)) {
+		return
+	}
 	// TODO: replace with mux named route generated path
-	w.Header().Set("Location", "/projects/"+strconv.Itoa(*updatedProject.ID))
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Location", projectLocation(r, *updatedProject.ID))
+	w.Header().Set("ETag", etag(updatedProject.Version))
+	w.WriteHeader(status)
 	err = json.NewEncoder(w).Encode(updatedProject)
 	try(w, err)
 }
 
+func (h *ProjectsHanlder) Patch(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	patch, err := readPatch(r)
+	if !try(w, err) {
+		return
+	}
+	clientID, scoped, err := clientScope(r)
+	if !try(w, err) || !try(w, h.checkScope(r, ID, true)) {
+		return
+	}
+	version, err := expectedVersion(r, h.currentVersion(r, ID))
+	if !try(w, err) {
+		return
+	}
+	patchedProject, err := h.db.UpdateProject(r.Context(), ID, func(project *storage.Project) error {
+		if err := storage.CheckVersion(project.Version, version); !tools.Try(err) {
+			return err
+		}
+		if err := patchEntity(patch, project); !tools.Try(err) {
+			return err
+		}
+		if scoped && (project.ClientID == nil || *project.ClientID != clientID) {
+			return fault.New(fault.Validation, "project can't be moved out of the client scope")
+		}
+		return nil
+	})
+	if !try(w, conditional(err, version)) {
+		return
+	}
+	w.Header().Set("ETag", etag(patchedProject.Version))
+	err = json.NewEncoder(w).Encode(patchedProject)
+	try(w, err)
+}
+
 func (h *ProjectsHanlder) Delete(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sid, ok := vars["id"]
-	if !ok {
-		sid = r.URL.Query().Get("id")
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
 	}
-	ID, err := strconv.Atoi(sid)
+
+	if !try(w, h.checkScope(r, ID, true)) {
+		return
+	}
+	version, err := expectedVersion(r, h.currentVersion(r, ID))
 	if !try(w, err) {
 		return
 	}
+	err = h.db.DeleteProject(r.Context(), ID, version)
+	if !try(w, conditional(err, version)) {
+		return
+	}
 
-	err = h.db.DeleteProject(ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ProjectsHanlder) Restore(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
 	if !try(w, err) {
 		return
 	}
 
+	if !try(w, h.checkTrashScope(r, ID)) {
+		return
+	}
+	project, err := h.db.RestoreProject(r.Context(), ID)
+	if !try(w, err) {
+		return
+	}
+	w.Header().Set("ETag", etag(project.Version))
+	err = json.NewEncoder(w).Encode(project)
+	if !try(w, err) {
+		return
+	}
+}
+
+func (h *ProjectsHanlder) Purge(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+
+	if !try(w, h.checkTrashScope(r, ID)) {
+		return
+	}
+	if !try(w, h.db.PurgeProject(r.Context(), ID)) {
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *ProjectsHanlder) currentVersion(r *http.Request, ID int) func() (int, error) {
+	return func() (int, error) {
+		project, err := h.db.GetProject(r.Context(), ID)
+		if !tools.Try(err) {
+			return 0, err
+		}
+		return project.Version, nil
+	}
+}
+
+// checkScope Hides projects of other clients than the one of the nested route, as if they don't exist.
+func (h *ProjectsHanlder) checkScope(r *http.Request, ID int, mustExist bool) error {
+	clientID, scoped, err := clientScope(r)
+	if err != nil || !scoped {
+		return err
+	}
+	project, err := h.db.GetProject(r.Context(), ID)
+	if fault.KindOf(err) == fault.NotFound && !mustExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if project.ClientID == nil || *project.ClientID != clientID {
+		return storage.ErrNotFound{}
+	}
+	return nil
+}
+
+// checkTrashScope Hides trashed projects of other clients than the one of the nested route.
+func (h *ProjectsHanlder) checkTrashScope(r *http.Request, ID int) error {
+	clientID, scoped, err := clientScope(r)
+	if err != nil || !scoped {
+		return err
+	}
+	byID, err := storage.ProjectSchema.Compare("id", storage.OpEq, ID)
+	if err != nil {
+		return err
+	}
+	owned, err := storage.ProjectSchema.Compare("client_id", storage.OpEq, clientID)
+	if err != nil {
+		return err
+	}
+	query := storage.Query{Filter: storage.And{Nodes: []storage.Node{byID, owned}}, Trash: true}
+	projects, _, err := h.db.SelectProjects(r.Context(), query, storage.Page{Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(projects) == 0 {
+		return storage.ErrNotFound{}
+	}
+	return nil
+}
+
+// clientScope Client ID of the nested /clients/{client_id}/projects routes, taken from the route only.
+func clientScope(r *http.Request) (int, bool, error) {
+	sid, ok := mux.Vars(r)["client_id"]
+	if !ok {
+		return 0, false, nil
+	}
+	clientID, err := strconv.Atoi(sid)
+	return clientID, true, fault.Wrap(fault.Malformed, err, "client_id must be an integer")
+}
+
+// pathID Integer route variable, falls back to the query parameter of the same name.
+func pathID(r *http.Request, name string) (int, error) {
+	sid, ok := mux.Vars(r)[name]
+	if !ok {
+		sid = r.URL.Query().Get(name)
+	}
+	ID, err := strconv.Atoi(sid)
+	return ID, fault.Wrap(fault.Malformed, err, name+" must be an integer")
+}
+
+// decodeEntity Reads JSON request body into the entity.
+func decodeEntity(r *http.Request, entity interface{}) error {
+	return fault.Wrap(fault.Malformed, json.NewDecoder(r.Body).Decode(entity), "malformed entity")
+}
+
+// scopeProject Assigns the project to the client of the nested route, writes the error response if it can't.
+func scopeProject(w http.ResponseWriter, r *http.Request, project *storage.Project) bool {
+	clientID, scoped, err := clientScope(r)
+	if !try(w, err) {
+		return false
+	}
+	if !scoped {
+		return true
+	}
+	if project.ClientID != nil && *project.ClientID != clientID {
+		return try(w, fault.New(fault.Validation, "path and entity client ids must be equal"))
+	}
+	project.ClientID = &clientID
+	return true
+}
+
+func projectLocation(r *http.Request, ID int) string {
+	if clientID, scoped, _ := clientScope(r); scoped {
+		return "/clients/" + strconv.Itoa(clientID) + "/projects/" + strconv.Itoa(ID)
+	}
+	return "/projects/" + strconv.Itoa(ID)
+}
+
 func New(config config.TLS, db storage.Adapter, gracefulTimeout time.Duration) *TLS {
 	r := mux.NewRouter().UseEncodedPath()
 	r.StrictSlash(true)
-	r.Use(loggingMiddleware, compressMiddleware, jsonMiddleware)
+	r.Use(loggingMiddleware, compressMiddleware, jsonMiddleware, actorMiddleware)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 
-	initObjectHandler("/clients", r, (&ClientsHandler{}).WithStorageAdapter(db))
-	initObjectHandler("/projects", r, (&ProjectsHanlder{}).WithStorageAdapter(db))
+	s := &TLS{
+		addr:       config.Addr,
+		db:         db,
+		timeout:    gracefulTimeout,
+		drainDelay: config.DrainDelay,
+	}
+	// admin goes first with the archives it takes, the rest of the routes take JSON
+	initAdminHandler(r, &AdminHandler{db: db, maxRestoreSize: config.MaxRestoreSize})
+	api := r.NewRoute().Subrouter()
+	api.Use(contentTypeMiddleware("application/json"))
+	initHealthHandler(api, s)
+	if auditLog, ok := storage.As[storage.AuditLog](db); ok {
+		initAuditHandler(api, &AuditHandler{log: auditLog})
+	}
+	initSearchHandler(api, &SearchHandler{db: db})
+	initBatchHandler(api, &BatchHandler{db: db})
+	if outbox, ok := storage.As[storage.Outbox](db); ok {
+		initWebhooksHandler(api, &WebhooksHandler{outbox: outbox})
+	}
+
+	projects := (&ProjectsHanlder{createOnPut: config.CreateOnPut}).WithStorageAdapter(db)
+	clients := (&ClientsHandler{createOnPut: config.CreateOnPut}).WithStorageAdapter(db)
+	// nested routes go first, otherwise /clients prefix takes them over
+	initObjectHandler("/clients/{client_id:[0-9]+}/projects", api, projects)
+	initObjectHandler("/clients", api, clients)
+	initObjectHandler("/projects", api, projects)
+	initTrashHandler("/trash/clients", api, clients)
+	initTrashHandler("/trash/projects", api, projects)
 
 	cfg := &tls.Config{
 		MinVersion:       tls.VersionTLS13,
@@ -296,10 +643,8 @@ func New(config config.TLS, db storage.Adapter, gracefulTimeout time.Duration) *
 		},
 	}
 
-	s := &TLS{
-		addr:    config.Addr,
-		timeout: gracefulTimeout,
-	}
+	baseCtx, abort := context.WithCancel(context.Background())
+	s.abort = abort
 
 	s.server = &http.Server{
 		ReadHeaderTimeout: s.timeout,
@@ -308,6 +653,9 @@ func New(config config.TLS, db storage.Adapter, gracefulTimeout time.Duration) *
 		TLSConfig:         cfg,
 		TLSNextProto:      make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 		ErrorLog:          stdlog.Default(),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
 	return s
@@ -321,8 +669,17 @@ func (s *TLS) Listen(ctx context.Context) error {
 
 	eg.Go(func() error {
 		<-ctx.Done()
+		atomic.StoreInt32(&s.draining, 1)
+		if s.drainDelay > 0 {
+			log.Infoln("draining for", s.drainDelay)
+			time.Sleep(s.drainDelay)
+		}
 		timeoutCtx, cancel := context.WithTimeout(context.Background(), s.timeout)
 		defer cancel()
+		go func() {
+			<-timeoutCtx.Done()
+			s.abort()
+		}()
 		return s.server.Shutdown(timeoutCtx)
 	})
 
@@ -338,7 +695,15 @@ func initObjectHandler(prefix string, r *mux.Router, handler RESTHandler) {
 	pr.Methods("GET").Path("/{id:[0-9]+}").HandlerFunc(handler.Get)
 	pr.Methods("POST").Path("/").HandlerFunc(handler.Post)
 	pr.Methods("PUT").Path("/{id:[0-9]+}").HandlerFunc(handler.Put)
+	pr.Methods("PATCH").Path("/{id:[0-9]+}").HandlerFunc(handler.Patch)
 	pr.Methods("DELETE").Path("/{id:[0-9]+}").HandlerFunc(handler.Delete)
+	pr.Methods("POST").Path("/{id:[0-9]+}:restore").HandlerFunc(handler.Restore)
+}
+
+func initTrashHandler(prefix string, r *mux.Router, handler RESTHandler) {
+	pr := r.PathPrefix(prefix).Subrouter()
+	pr.Methods("GET").Path("/").HandlerFunc(handler.Trash)
+	pr.Methods("DELETE").Path("/{id:[0-9]+}").HandlerFunc(handler.Purge)
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -353,20 +718,37 @@ func jsonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Del("Content-Type")
 		w.Header().Add("Content-Type", "application/json")
-		handlers.ContentTypeHandler(next, "application/json").ServeHTTP(w, r)
+		next.ServeHTTP(w, r)
 	})
 }
 
+// contentTypeMiddleware Refuses the request bodies of other types with 415, the ones of PATCH must be patch documents.
+func contentTypeMiddleware(contentTypes ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		checked := handlers.ContentTypeHandler(next, contentTypes...)
+		patch := handlers.ContentTypeHandler(next, mergePatchContentType, jsonPatchContentType)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.ContentLength == 0:
+				// nothing to tell the type of, like POST of a backup
+				next.ServeHTTP(w, r)
+			case r.Method == http.MethodPatch:
+				patch.ServeHTTP(w, r)
+			default:
+				checked.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// try Writes the problem response on error.
 func try(w http.ResponseWriter, err error) bool {
-	if !tools.Try(err, true) {
-		if _, ok := err.(storage.ErrNotFound); ok {
-			w.WriteHeader(http.StatusNotFound)
-			_, _ = w.Write([]byte(`"entity not found"`))
-			return false
-		}
-		w.WriteHeader(http.StatusNotImplemented)
-		_, _ = w.Write([]byte(`"server error: ` + err.Error() + `"`))
-		return false
+	if tools.Try(err) {
+		return true
 	}
-	return true
+	if fault.KindOf(err) == fault.Internal {
+		tools.Try(err, true)
+	}
+	writeProblem(w, err)
+	return false
 }
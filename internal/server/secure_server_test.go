@@ -2,14 +2,21 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/iamwavecut/ct-mend/internal/config"
 	"github.com/iamwavecut/ct-mend/internal/storage"
 	"github.com/iamwavecut/ct-mend/tools"
 )
@@ -26,7 +33,8 @@ func (s *TLSTestSuite) SetupTest() {
 
 func (s *TLSTestSuite) TestClientHandlers() {
 	db := storage.NewMockAdapter(s.T())
-	handler := &ClientsHandler{db: db}
+	handler := &ClientsHandler{db: db, createOnPut: true}
+	strict := &ClientsHandler{db: db}
 
 	for _, tc := range []struct {
 		methodName string
@@ -41,7 +49,7 @@ func (s *TLSTestSuite) TestClientHandlers() {
 			"/",
 			200,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("SelectClients").Return([]*storage.Client{{}, {}}, nil).Once()
+				db.On("SelectClients", mock.Anything, mock.Anything, mock.Anything).Return([]*storage.Client{{}, {}}, false, nil).Once()
 				return handler.Select
 			}(),
 		},
@@ -51,7 +59,7 @@ func (s *TLSTestSuite) TestClientHandlers() {
 			"/1",
 			200,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("GetClient", mock.AnythingOfType("int")).Return(&storage.Client{}, nil).Once()
+				db.On("GetClient", mock.Anything, mock.AnythingOfType("int")).Return(&storage.Client{}, nil).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Get
 			}(),
@@ -62,7 +70,17 @@ func (s *TLSTestSuite) TestClientHandlers() {
 			"/",
 			201,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("UpsertClient", mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+				db.On("CreateClient", mock.Anything, mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+				return handler.Post
+			}(),
+		},
+		{
+			"PostExistingClient",
+			"POST",
+			"/",
+			409,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("CreateClient", mock.Anything, mock.IsType(&storage.Client{})).Return(nil, storage.ErrAlreadyExists{}).Once()
 				return handler.Post
 			}(),
 		},
@@ -70,20 +88,66 @@ func (s *TLSTestSuite) TestClientHandlers() {
 			"PutClient",
 			"PUT",
 			"/1",
+			200,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("ReplaceClient", mock.Anything, mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+				vars = map[string]string{"id": "1"}
+				return handler.Put
+			}(),
+		},
+		{
+			"PutMissingClient",
+			"PUT",
+			"/1",
+			201,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("ReplaceClient", mock.Anything, mock.IsType(&storage.Client{})).Return(nil, storage.ErrNotFound{}).Once()
+				db.On("CreateClient", mock.Anything, mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+				vars = map[string]string{"id": "1"}
+				return handler.Put
+			}(),
+		},
+		{
+			"PutMissingClientWrapped",
+			"PUT",
+			"/1",
 			201,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("UpsertClient", mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+				db.On("ReplaceClient", mock.Anything, mock.IsType(&storage.Client{})).Return(nil, errors.Wrap(storage.ErrNotFound{}, "decorated")).Once()
+				db.On("CreateClient", mock.Anything, mock.IsType(&storage.Client{})).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Put
 			}(),
 		},
+		{
+			"PutMissingClientWithoutCreate",
+			"PUT",
+			"/1",
+			404,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("ReplaceClient", mock.Anything, mock.IsType(&storage.Client{})).Return(nil, storage.ErrNotFound{}).Once()
+				vars = map[string]string{"id": "1"}
+				return strict.Put
+			}(),
+		},
 		{
 			"DeleteClient",
 			"DELETE",
 			"/1",
 			204,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("DeleteClient", mock.AnythingOfType("int")).Return(nil).Once()
+				db.On("DeleteClient", mock.Anything, mock.AnythingOfType("int"), 0).Return(nil).Once()
+				vars = map[string]string{"id": "1"}
+				return handler.Delete
+			}(),
+		},
+		{
+			"DeleteReferencedClient",
+			"DELETE",
+			"/1",
+			409,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("DeleteClient", mock.Anything, mock.AnythingOfType("int"), 0).Return(storage.ErrReferenced{}).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Delete
 			}(),
@@ -111,7 +175,7 @@ func (s *TLSTestSuite) TestClientHandlers() {
 
 func (s *TLSTestSuite) TestProjectHandlers() {
 	db := storage.NewMockAdapter(s.T())
-	handler := &ProjectsHanlder{db: db}
+	handler := &ProjectsHanlder{db: db, createOnPut: true}
 
 	for _, tc := range []struct {
 		methodName string
@@ -126,7 +190,7 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 			"/",
 			200,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("SelectProjects").Return([]*storage.Project{{}, {}}, nil).Once()
+				db.On("SelectProjects", mock.Anything, mock.Anything, mock.Anything).Return([]*storage.Project{{}, {}}, false, nil).Once()
 				return handler.Select
 			}(),
 		},
@@ -136,7 +200,7 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 			"/1",
 			200,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("GetProject", mock.AnythingOfType("int")).Return(&storage.Project{}, nil).Once()
+				db.On("GetProject", mock.Anything, mock.AnythingOfType("int")).Return(&storage.Project{}, nil).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Get
 			}(),
@@ -147,7 +211,17 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 			"/",
 			201,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("UpsertProject", mock.IsType(&storage.Project{})).Return(&storage.Project{ID: tools.IntPtr(1)}, nil).Once()
+				db.On("CreateProject", mock.Anything, mock.IsType(&storage.Project{})).Return(&storage.Project{ID: tools.IntPtr(1)}, nil).Once()
+				return handler.Post
+			}(),
+		},
+		{
+			"PostProjectOfMissingClient",
+			"POST",
+			"/",
+			422,
+			func() func(writer http.ResponseWriter, request *http.Request) {
+				db.On("CreateProject", mock.Anything, mock.IsType(&storage.Project{})).Return(nil, storage.ErrDanglingReference{}).Once()
 				return handler.Post
 			}(),
 		},
@@ -155,9 +229,9 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 			"PutProject",
 			"PUT",
 			"/1",
-			201,
+			200,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("UpsertProject", mock.IsType(&storage.Project{})).Return(&storage.Project{ID: tools.IntPtr(1)}, nil).Once()
+				db.On("ReplaceProject", mock.Anything, mock.IsType(&storage.Project{})).Return(&storage.Project{ID: tools.IntPtr(1)}, nil).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Put
 			}(),
@@ -168,7 +242,7 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 			"/1",
 			204,
 			func() func(writer http.ResponseWriter, request *http.Request) {
-				db.On("DeleteProject", mock.AnythingOfType("int")).Return(nil).Once()
+				db.On("DeleteProject", mock.Anything, mock.AnythingOfType("int"), 0).Return(nil).Once()
 				vars = map[string]string{"id": "1"}
 				return handler.Delete
 			}(),
@@ -194,6 +268,628 @@ func (s *TLSTestSuite) TestProjectHandlers() {
 	}
 }
 
+func (s *TLSTestSuite) TestClientProjectRoutes() {
+	db := storage.NewMockAdapter(s.T())
+	router := New(config.TLS{CreateOnPut: true}, db, time.Second).server.Handler
+	ownProject := &storage.Project{ID: tools.IntPtr(2), ClientID: tools.IntPtr(1)}
+	foreignProject := &storage.Project{ID: tools.IntPtr(3), ClientID: tools.IntPtr(2)}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		resultCode int
+		setup      func()
+	}{
+		{"SelectOfClient", "GET", "/clients/1/projects/", "", 200, func() {
+			db.On("GetClient", mock.Anything, 1).Return(&storage.Client{ID: tools.IntPtr(1)}, nil).Once()
+			owned, err := storage.ProjectSchema.Compare("client_id", storage.OpEq, 1)
+			s.Require().NoError(err)
+			db.On("SelectProjects", mock.Anything, storage.Query{Filter: owned}, mock.Anything).Return([]*storage.Project{ownProject}, false, nil).Once()
+		}},
+		{"SelectOfMissingClient", "GET", "/clients/9/projects/", "", 404, func() {
+			db.On("GetClient", mock.Anything, 9).Return(nil, storage.ErrNotFound{}).Once()
+		}},
+		{"GetOwn", "GET", "/clients/1/projects/2", "", 200, func() {
+			db.On("GetProject", mock.Anything, 2).Return(ownProject, nil).Twice()
+		}},
+		{"GetForeign", "GET", "/clients/1/projects/3", "", 404, func() {
+			db.On("GetProject", mock.Anything, 3).Return(foreignProject, nil).Once()
+		}},
+		{"PostSetsClient", "POST", "/clients/1/projects/", `{"name":"nested"}`, 201, func() {
+			db.On("CreateProject", mock.Anything, mock.MatchedBy(func(p *storage.Project) bool {
+				return p.ClientID != nil && *p.ClientID == 1
+			})).Return(ownProject, nil).Once()
+		}},
+		{"PostOtherClient", "POST", "/clients/1/projects/", `{"name":"nested","client_id":2}`, 422, func() {}},
+		{"PutForeign", "PUT", "/clients/1/projects/3", `{"id":3,"name":"stolen"}`, 404, func() {
+			db.On("GetProject", mock.Anything, 3).Return(foreignProject, nil).Once()
+		}},
+		{"PutMissingCreates", "PUT", "/clients/1/projects/4", `{"id":4,"name":"new"}`, 201, func() {
+			db.On("GetProject", mock.Anything, 4).Return(nil, storage.ErrNotFound{}).Once()
+			db.On("ReplaceProject", mock.Anything, mock.IsType(&storage.Project{})).Return(nil, storage.ErrNotFound{}).Once()
+			db.On("CreateProject", mock.Anything, mock.MatchedBy(func(p *storage.Project) bool {
+				return *p.ID == 4 && *p.ClientID == 1
+			})).Return(&storage.Project{ID: tools.IntPtr(4), ClientID: tools.IntPtr(1)}, nil).Once()
+		}},
+		{"DeleteForeign", "DELETE", "/clients/1/projects/3", "", 404, func() {
+			db.On("GetProject", mock.Anything, 3).Return(foreignProject, nil).Once()
+		}},
+		{"DeleteOwn", "DELETE", "/clients/1/projects/2", "", 204, func() {
+			db.On("GetProject", mock.Anything, 2).Return(ownProject, nil).Once()
+			db.On("DeleteProject", mock.Anything, 2, 0).Return(nil).Once()
+		}},
+		{"QueryIsNoScope", "GET", "/projects/3?client_id=1", "", 200, func() {
+			db.On("GetProject", mock.Anything, 3).Return(foreignProject, nil).Once()
+		}},
+	} {
+		s.Run(tc.name, func() {
+			tc.setup()
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(tc.method, "https://about.blank"+tc.path, bytes.NewBufferString(tc.body))
+			s.Require().NoError(err)
+			req.Header.Set("Content-Type", "application/json")
+
+			router.ServeHTTP(resp, req)
+			s.Assert().Equal(tc.resultCode, resp.Code)
+		})
+	}
+}
+
+func (s *TLSTestSuite) TestPatch() {
+	ctx := context.Background()
+	db := &storage.Memory{}
+	s.Require().NoError(db.Init(ctx, &config.Storage{}))
+	_, err := db.CreateClient(ctx, &storage.Client{Name: "owner", Settings: storage.ClientSettings{CodeScanInterval: 10}})
+	s.Require().NoError(err)
+	router := New(config.TLS{}, db, time.Second).server.Handler
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		resultCode  int
+		expected    string
+	}{
+		{"MergeKeepsOmitted", mergePatchContentType, `{"settings":{"code_scan_interval":20}}`, 200, "owner"},
+		{"MergeRename", mergePatchContentType, `{"name":"renamed"}`, 200, "renamed"},
+		{"JSONPatch", jsonPatchContentType, `[{"op":"test","path":"/name","value":"renamed"},{"op":"replace","path":"/name","value":"patched"}]`, 200, "patched"},
+		{"JSONPatchTestFailed", jsonPatchContentType, `[{"op":"test","path":"/name","value":"renamed"},{"op":"replace","path":"/name","value":"lost"}]`, 409, "patched"},
+		{"JSONPatchMissingPath", jsonPatchContentType, `[{"op":"replace","path":"/nope/deeper","value":1}]`, 422, "patched"},
+		{"MalformedPatch", jsonPatchContentType, `{"op":"replace"}`, 400, "patched"},
+		{"IDChange", mergePatchContentType, `{"id":2}`, 422, "patched"},
+		{"PlainJSON", "application/json", `{"name":"plain"}`, 415, "patched"},
+	} {
+		s.Run(tc.name, func() {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("PATCH", "https://about.blank/clients/1", bytes.NewBufferString(tc.body))
+			s.Require().NoError(err)
+			req.Header.Set("Content-Type", tc.contentType)
+
+			router.ServeHTTP(resp, req)
+			s.Assert().Equal(tc.resultCode, resp.Code)
+			client, err := db.GetClient(ctx, 1)
+			s.Require().NoError(err)
+			s.Equal(tc.expected, client.Name)
+			s.Equal(time.Duration(20), client.Settings.CodeScanInterval)
+		})
+	}
+}
+
+func (s *TLSTestSuite) TestPreconditionsOfWrappedErrors() {
+	notFound := errors.Wrap(storage.ErrNotFound{}, "decorated")
+	s.IsType(storage.ErrVersionMismatch{}, conditional(notFound, 1))
+	s.Equal(notFound, conditional(notFound, 0))
+
+	req, err := http.NewRequest("PUT", "https://about.blank/clients/1", nil)
+	s.Require().NoError(err)
+	req.Header.Set("If-Match", "*")
+	_, err = expectedVersion(req, func() (int, error) { return 0, notFound })
+	s.IsType(storage.ErrVersionMismatch{}, err)
+}
+
+func (s *TLSTestSuite) TestPreconditions() {
+	ctx := context.Background()
+	db := &storage.Memory{}
+	s.Require().NoError(db.Init(ctx, &config.Storage{}))
+	router := New(config.TLS{CreateOnPut: true}, db, time.Second).server.Handler
+	for _, name := range []string{"first", "second"} {
+		_, err := db.CreateClient(ctx, &storage.Client{Name: name})
+		s.Require().NoError(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		header     string
+		value      string
+		body       string
+		resultCode int
+		etag       string
+	}{
+		{"GetTagged", "GET", "/clients/1", "", "", "", 200, `"1"`},
+		{"GetNotModified", "GET", "/clients/1", "If-None-Match", `"2", W/"1"`, "", 304, `"1"`},
+		{"GetModified", "GET", "/clients/1", "If-None-Match", `"2"`, "", 200, `"1"`},
+		{"PutStale", "PUT", "/clients/1", "If-Match", `"2"`, `{"id":1,"name":"lost"}`, 412, ""},
+		{"PutWeak", "PUT", "/clients/1", "If-Match", `W/"1"`, `{"id":1,"name":"lost"}`, 412, ""},
+		{"PutCurrent", "PUT", "/clients/1", "If-Match", `"1"`, `{"id":1,"name":"kept"}`, 200, `"2"`},
+		{"PutListed", "PUT", "/clients/1", "If-Match", `"7", "2"`, `{"id":1,"name":"kept again"}`, 200, `"3"`},
+		{"PutMissingConditional", "PUT", "/clients/3", "If-Match", "*", `{"id":3,"name":"never"}`, 412, ""},
+		{"PatchStale", "PATCH", "/clients/1", "If-Match", `"2"`, `{"name":"lost"}`, 412, ""},
+		{"PatchAny", "PATCH", "/clients/1", "If-Match", "*", `{"name":"patched"}`, 200, `"4"`},
+		{"DeleteStale", "DELETE", "/clients/2", "If-Match", `"2"`, "", 412, ""},
+		{"DeleteCurrent", "DELETE", "/clients/2", "If-Match", `"1"`, "", 204, ""},
+		{"DeleteMissing", "DELETE", "/clients/2", "If-Match", `"1"`, "", 412, ""},
+	} {
+		s.Run(tc.name, func() {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(tc.method, "https://about.blank"+tc.path, bytes.NewBufferString(tc.body))
+			s.Require().NoError(err)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.method == "PATCH" {
+				req.Header.Set("Content-Type", mergePatchContentType)
+			}
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+
+			router.ServeHTTP(resp, req)
+			s.Assert().Equal(tc.resultCode, resp.Code)
+			s.Assert().Equal(tc.etag, resp.Header().Get("ETag"))
+		})
+	}
+	client, err := db.GetClient(ctx, 1)
+	s.Require().NoError(err)
+	s.Equal("patched", client.Name)
+}
+
+func (s *TLSTestSuite) TestTrash() {
+	ctx := context.Background()
+	db := &storage.Memory{}
+	s.Require().NoError(db.Init(ctx, &config.Storage{ClientDeletePolicy: string(storage.DeleteCascade)}))
+	router := New(config.TLS{}, db, time.Second).server.Handler
+	for _, name := range []string{"first", "second"} {
+		client, err := db.CreateClient(ctx, &storage.Client{Name: name})
+		s.Require().NoError(err)
+		_, err = db.CreateProject(ctx, &storage.Project{ClientID: client.ID, Name: name})
+		s.Require().NoError(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		resultCode int
+		count      int
+	}{
+		{"Delete", "DELETE", "/clients/1", 204, 0},
+		{"GetTrashed", "GET", "/clients/1", 404, 0},
+		{"ListLive", "GET", "/clients/", 200, 1},
+		{"ListTrash", "GET", "/trash/clients/", 200, 1},
+		{"ListTrashedProjects", "GET", "/trash/projects/?filter=client_id==1", 200, 1},
+		{"RestoreProjectOfTrashedClient", "POST", "/projects/1:restore", 422, 0},
+		{"RestoreOtherClientProject", "POST", "/clients/2/projects/1:restore", 404, 0},
+		{"Restore", "POST", "/clients/1:restore", 200, 0},
+		{"RestoreLive", "POST", "/clients/1:restore", 404, 0},
+		{"GetRestoredProject", "GET", "/clients/1/projects/1", 200, 0},
+		{"PurgeLive", "DELETE", "/trash/clients/1", 404, 0},
+		{"DeleteProject", "DELETE", "/projects/2", 204, 0},
+		{"PurgeProject", "DELETE", "/trash/projects/2", 204, 0},
+		{"RestorePurged", "POST", "/projects/2:restore", 404, 0},
+	} {
+		s.Run(tc.name, func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(tc.method, "https://about.blank"+tc.path, nil))
+			s.Require().Equal(tc.resultCode, resp.Code)
+			if tc.count > 0 {
+				var entities []map[string]interface{}
+				s.Require().NoError(json.NewDecoder(resp.Body).Decode(&entities))
+				s.Len(entities, tc.count)
+			}
+		})
+	}
+}
+
+func (s *TLSTestSuite) TestPagination() {
+	ctx := context.Background()
+	db := &storage.Memory{}
+	s.Require().NoError(db.Init(ctx, &config.Storage{}))
+	for i := 1; i <= 5; i++ {
+		_, err := db.CreateClient(ctx, &storage.Client{Name: "client " + strconv.Itoa(i)})
+		s.Require().NoError(err)
+	}
+	router := New(config.TLS{}, db, time.Second).server.Handler
+	get := func(target string) (*httptest.ResponseRecorder, []int, map[string]string) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest("GET", "https://about.blank"+target, nil))
+		var clients []*storage.Client
+		if resp.Code == http.StatusOK {
+			s.Require().NoError(json.NewDecoder(resp.Body).Decode(&clients))
+		}
+		var IDs []int
+		for _, client := range clients {
+			IDs = append(IDs, *client.ID)
+		}
+		links := map[string]string{}
+		for _, link := range resp.Header().Values("Link") {
+			target, rel, _ := strings.Cut(link, ">; rel=")
+			links[strings.Trim(rel, `"`)] = strings.TrimPrefix(target, "<")
+		}
+		return resp, IDs, links
+	}
+
+	_, IDs, links := get("/clients/?limit=2")
+	s.Equal([]int{1, 2}, IDs)
+	s.Empty(links["prev"])
+	_, IDs, links = get(links["next"])
+	s.Equal([]int{3, 4}, IDs)
+	s.NotEmpty(links["prev"])
+	next := links["next"]
+	_, IDs, _ = get(links["prev"])
+	s.Equal([]int{1, 2}, IDs)
+	_, IDs, links = get(next)
+	s.Equal([]int{5}, IDs)
+	s.Empty(links["next"])
+
+	query := url.Values{"filter": {`name!="client 3"`}, "sort": {"-name"}, "limit": {"2"}}
+	_, IDs, links = get("/clients/?" + query.Encode())
+	s.Equal([]int{5, 4}, IDs)
+	_, IDs, links = get(links["next"])
+	s.Equal([]int{2, 1}, IDs)
+	s.Empty(links["next"])
+	sorted, _ := url.Parse(links["prev"])
+
+	for _, target := range []string{
+		"/clients/?limit=0",
+		"/clients/?limit=1001",
+		"/clients/?cursor=nope",
+		"/clients/?cursor=" + sorted.Query().Get("cursor"),
+		"/clients/?filter=version==1",
+		"/clients/?sort=version",
+	} {
+		resp, _, _ := get(target)
+		s.Equal(http.StatusBadRequest, resp.Code, target)
+	}
+}
+
+func (s *TLSTestSuite) TestAudit() {
+	ctx := context.Background()
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(ctx, &config.Storage{}))
+	db, err := storage.NewAudited(memory)
+	s.Require().NoError(err)
+	router := New(config.TLS{}, db, time.Second).server.Handler
+	since := time.Now().UTC().Add(-time.Second).Format(time.RFC3339)
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "https://about.blank"+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(actorHeader, "alice")
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	s.Require().Equal(201, send("POST", "/clients/", `{"name":"Acme"}`).Code)
+	s.Require().Equal(201, send("POST", "/projects/", `{"name":"Rocket"}`).Code)
+	s.Require().Equal(200, send("PUT", "/clients/1", `{"id":1,"name":"Acme Corp"}`).Code)
+
+	var history []*storage.AuditEntry
+	resp := send("GET", "/clients/1/history", "")
+	s.Require().Equal(200, resp.Code)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&history))
+	s.Require().Len(history, 2)
+	s.Equal(storage.AuditCreate, history[0].Operation)
+	s.Equal(storage.AuditReplace, history[1].Operation)
+	s.Equal("192.0.2.1", history[1].Actor, "the header is not trusted")
+	s.Equal("alice", history[1].ClaimedActor)
+	s.Equal(storage.Diff{{Field: "name", Before: "Acme", After: "Acme Corp"}}, history[1].Diff)
+
+	var entries []*storage.AuditEntry
+	resp = send("GET", "/audit?filter=entity==project&since="+url.QueryEscape(since), "")
+	s.Require().Equal(200, resp.Code)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&entries))
+	s.Require().Len(entries, 1)
+	s.Equal(storage.AuditProject, entries[0].Entity)
+
+	resp = send("GET", "/audit?since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), "")
+	s.Require().Equal(200, resp.Code)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&entries))
+	s.Empty(entries)
+	s.Equal(http.StatusBadRequest, send("GET", "/audit?since=yesterday", "").Code)
+}
+
+func (s *TLSTestSuite) TestBackup() {
+	ctx := context.Background()
+	from, to := &storage.Memory{}, &storage.Memory{}
+	s.Require().NoError(from.Init(ctx, &config.Storage{}))
+	s.Require().NoError(to.Init(ctx, &config.Storage{}))
+	_, err := from.CreateClient(ctx, &storage.Client{Name: "Acme"})
+	s.Require().NoError(err)
+	_, err = from.CreateProject(ctx, &storage.Project{ClientID: tools.IntPtr(1), Name: "Rocket"})
+	s.Require().NoError(err)
+
+	resp := httptest.NewRecorder()
+	New(config.TLS{}, from, time.Second).server.Handler.ServeHTTP(resp, httptest.NewRequest("POST", "https://about.blank/admin/backup", nil))
+	s.Require().Equal(200, resp.Code)
+	s.Equal(archiveContentType, resp.Header().Get("Content-Type"))
+
+	router := New(config.TLS{MaxRestoreSize: 1 << 20}, to, time.Second).server.Handler
+	restore := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "https://about.blank/admin/restore", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	s.Equal(http.StatusUnsupportedMediaType, restore("application/json", resp.Body.Bytes()).Code)
+	s.Equal(http.StatusBadRequest, restore(archiveContentType, []byte("not an archive")).Code)
+	limited := New(config.TLS{MaxRestoreSize: 64}, to, time.Second).server.Handler
+	tooLarge := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "https://about.blank/admin/restore", bytes.NewReader(resp.Body.Bytes()))
+	req.Header.Set("Content-Type", archiveContentType)
+	limited.ServeHTTP(tooLarge, req)
+	s.Equal(http.StatusBadRequest, tooLarge.Code, "archive over the size limit")
+	restored := restore(archiveContentType, resp.Body.Bytes())
+	s.Require().Equal(200, restored.Code)
+	manifest := &storage.Manifest{}
+	s.Require().NoError(json.NewDecoder(restored.Body).Decode(manifest))
+	s.Equal(storage.BackupSchemaVersion, manifest.SchemaVersion)
+	project, err := to.GetProject(ctx, 1)
+	s.Require().NoError(err)
+	s.Equal("Rocket", project.Name)
+}
+
+func (s *TLSTestSuite) TestCacheStats() {
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(context.Background(), &config.Storage{}))
+	cached, err := storage.NewCached(memory, 10, time.Minute)
+	s.Require().NoError(err)
+	get := func(db storage.Adapter, target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		New(config.TLS{}, db, time.Second).server.Handler.ServeHTTP(resp, httptest.NewRequest("GET", "https://about.blank"+target, nil))
+		return resp
+	}
+	s.Equal(http.StatusNotFound, get(memory, "/admin/cache").Code)
+	s.Equal(http.StatusOK, get(cached, "/clients/").Code)
+	s.Equal(http.StatusOK, get(cached, "/clients/").Code)
+	resp := get(cached, "/admin/cache")
+	s.Require().Equal(http.StatusOK, resp.Code)
+	stats := storage.CacheStats{}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&stats))
+	s.Equal(storage.CacheStats{Hits: 1, Misses: 1, Size: 1}, stats)
+}
+
+func (s *TLSTestSuite) TestSearch() {
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(context.Background(), &config.Storage{}))
+	for _, name := range []string{"Kernel Labs", "Linux"} {
+		_, err := memory.CreateClient(context.Background(), &storage.Client{Name: name})
+		s.Require().NoError(err)
+	}
+	_, err := memory.CreateProject(context.Background(), &storage.Project{ClientID: tools.IntPtr(2), Name: "kernel"})
+	s.Require().NoError(err)
+	handler := New(config.TLS{}, memory, time.Second).server.Handler
+	for _, tc := range []struct {
+		target string
+		code   int
+		hits   []storage.SearchHit
+	}{
+		{target: "/search?q=KERNEL", code: http.StatusOK, hits: []storage.SearchHit{
+			{Type: storage.HitProject, ID: 1, Name: "kernel", Rank: 1},
+			{Type: storage.HitClient, ID: 1, Name: "Kernel Labs", Rank: 6.0 / 11},
+		}},
+		{target: "/search?q=kernel&limit=1", code: http.StatusOK, hits: []storage.SearchHit{
+			{Type: storage.HitProject, ID: 1, Name: "kernel", Rank: 1},
+		}},
+		{target: "/search?q=nothing", code: http.StatusOK, hits: []storage.SearchHit{}},
+		{target: "/search?q=+", code: http.StatusBadRequest},
+		{target: "/search?q=kernel&limit=101", code: http.StatusBadRequest},
+	} {
+		s.Run(tc.target, func() {
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, httptest.NewRequest("GET", "https://about.blank"+tc.target, nil))
+			s.Require().Equal(tc.code, resp.Code, resp.Body.String())
+			if tc.hits == nil {
+				return
+			}
+			var hits []storage.SearchHit
+			s.Require().NoError(json.NewDecoder(resp.Body).Decode(&hits))
+			s.Equal(tc.hits, hits)
+		})
+	}
+}
+
+func (s *TLSTestSuite) TestBatch() {
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(context.Background(), &config.Storage{}))
+	_, err := memory.CreateClient(context.Background(), &storage.Client{Name: "Acme"})
+	s.Require().NoError(err)
+	handler := New(config.TLS{}, memory, time.Second).server.Handler
+	send := func(target, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "https://about.blank"+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	type result struct {
+		Status  int             `json:"status"`
+		Entity  *storage.Client `json:"entity"`
+		Problem *problem        `json:"problem"`
+	}
+	for _, tc := range []struct {
+		name     string
+		target   string
+		body     string
+		code     int
+		statuses []int
+	}{
+		{
+			name:   "partial",
+			target: "/clients:batch",
+			body: `[{"op":"create","entity":{"name":"Initech"}},{"op":"update","entity":{"id":1,"name":"Acme Corp","version":2}},
+				{"op":"update","entity":{"id":1,"name":"Acme Corp"}},{"op":"delete","id":9}]`,
+			code:     http.StatusMultiStatus,
+			statuses: []int{http.StatusCreated, http.StatusPreconditionFailed, http.StatusOK, http.StatusNotFound},
+		},
+		{
+			name:     "atomic",
+			target:   "/clients:batch?atomic=true",
+			body:     `[{"op":"create","entity":{"name":"Hooli"}},{"op":"delete","id":9}]`,
+			code:     http.StatusMultiStatus,
+			statuses: []int{http.StatusFailedDependency, http.StatusNotFound},
+		},
+		{
+			name:     "projects",
+			target:   "/projects:batch",
+			body:     `[{"op":"create","entity":{"client_id":1,"name":"Rocket"}},{"op":"delete","id":1}]`,
+			code:     http.StatusMultiStatus,
+			statuses: []int{http.StatusCreated, http.StatusNoContent},
+		},
+		{name: "empty", target: "/clients:batch", body: `[]`, code: http.StatusBadRequest},
+		{name: "not an array", target: "/clients:batch", body: `{"op":"create"}`, code: http.StatusBadRequest},
+		{name: "bad atomic", target: "/clients:batch?atomic=maybe", body: `[{"op":"delete","id":1}]`, code: http.StatusBadRequest},
+	} {
+		s.Run(tc.name, func() {
+			resp := send(tc.target, tc.body)
+			s.Require().Equal(tc.code, resp.Code, resp.Body.String())
+			if tc.statuses == nil {
+				return
+			}
+			var results []result
+			s.Require().NoError(json.NewDecoder(resp.Body).Decode(&results))
+			var statuses []int
+			for _, res := range results {
+				statuses = append(statuses, res.Status)
+				s.Equal(res.Status >= 400, res.Problem != nil)
+			}
+			s.Equal(tc.statuses, statuses)
+		})
+	}
+	clients, _, err := memory.SelectClients(context.Background(), storage.Query{}, storage.Page{})
+	s.Require().NoError(err)
+	s.Len(clients, 2, "atomic batch has left nothing behind")
+}
+
+func (s *TLSTestSuite) TestWebhooks() {
+	ctx := context.Background()
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(ctx, &config.Storage{}))
+	handler := New(config.TLS{}, memory, time.Second).server.Handler
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "https://about.blank"+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := send("POST", "/webhooks/", `{"url":"https://example.com/hook"}`)
+	s.Require().Equal(http.StatusCreated, resp.Code, resp.Body.String())
+	var created storage.Webhook
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&created))
+	s.Len(created.Secret, 64, "secret is generated")
+	s.Equal("/webhooks/"+strconv.Itoa(created.ID), resp.Header().Get("Location"))
+	resp = send("POST", "/webhooks/", `{"url":"ftp://example.com/hook"}`)
+	s.Equal(http.StatusUnprocessableEntity, resp.Code, "url must be http or https")
+
+	resp = send("GET", "/webhooks/"+strconv.Itoa(created.ID), "")
+	s.Require().Equal(http.StatusOK, resp.Code)
+	s.NotContains(resp.Body.String(), "secret", "secret is responded on create only")
+	resp = send("PUT", "/webhooks/"+strconv.Itoa(created.ID), `{"url":"https://example.com/replaced"}`)
+	s.Require().Equal(http.StatusOK, resp.Code, resp.Body.String())
+	stored, err := memory.GetWebhook(ctx, created.ID)
+	s.Require().NoError(err)
+	s.Equal("https://example.com/replaced", stored.URL)
+	s.Equal(created.Secret, stored.Secret, "secret is kept unless given")
+	resp = send("GET", "/webhooks/", "")
+	s.Require().Equal(http.StatusOK, resp.Code)
+	s.JSONEq(`[{"id":`+strconv.Itoa(created.ID)+`,"url":"https://example.com/replaced"}]`, resp.Body.String())
+
+	s.Require().NoError(memory.AppendEvent(ctx, &storage.Event{At: time.Now().UTC(), Type: "client.create", Data: storage.Payload(`{}`)}))
+	deliveries, err := memory.ClaimDeliveries(ctx, time.Now().UTC(), time.Minute, 1)
+	s.Require().NoError(err)
+	s.Require().Len(deliveries, 1)
+	deliveries[0].State, deliveries[0].LastError = storage.DeliveryDead, "boom"
+	s.Require().NoError(memory.SaveDelivery(ctx, deliveries[0]))
+	resp = send("GET", "/webhooks/dead-letters", "")
+	s.Require().Equal(http.StatusOK, resp.Code)
+	var letters []storage.Delivery
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&letters))
+	s.Require().Len(letters, 1)
+	s.Equal("boom", letters[0].LastError)
+	s.Equal("client.create", letters[0].Event.Type)
+	retry := "/webhooks/dead-letters/" + strconv.Itoa(letters[0].ID) + ":retry"
+	s.Equal(http.StatusAccepted, send("POST", retry, "").Code)
+	s.Equal(http.StatusNotFound, send("POST", retry, "").Code, "it's not dead anymore")
+
+	s.Equal(http.StatusNoContent, send("DELETE", "/webhooks/"+strconv.Itoa(created.ID), "").Code)
+	s.Equal(http.StatusNotFound, send("GET", "/webhooks/"+strconv.Itoa(created.ID), "").Code)
+}
+
+func (s *TLSTestSuite) TestHealth() {
+	memory := &storage.Memory{}
+	s.Require().NoError(memory.Init(context.Background(), &config.Storage{}))
+	probe := func(srv *TLS, target string) (int, Health) {
+		resp := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(resp, httptest.NewRequest("GET", "https://about.blank"+target, nil))
+		health := Health{}
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&health))
+		return resp.Code, health
+	}
+	srv := New(config.TLS{}, memory, time.Second)
+	code, health := probe(srv, "/readyz")
+	s.Equal(http.StatusOK, code)
+	s.Equal(Health{Status: healthUp, Components: map[string]ComponentHealth{
+		"server":     {Status: healthUp},
+		"migrations": {Status: healthUp},
+		"storage":    {Status: healthUp},
+	}}, health)
+
+	migrated := srv.Migrating()
+	code, health = probe(srv, "/readyz")
+	s.Equal(http.StatusServiceUnavailable, code)
+	s.Equal(healthDown, health.Components["migrations"].Status)
+	code, _ = probe(srv, "/healthz")
+	s.Equal(http.StatusOK, code, "liveness doesn't depend on the readiness")
+	migrated()
+	code, _ = probe(srv, "/readyz")
+	s.Equal(http.StatusOK, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.server.Addr, srv.drainDelay = "127.0.0.1:0", 100*time.Millisecond
+	listening := make(chan error)
+	go func() { listening <- srv.Listen(ctx) }()
+	cancel()
+	s.Eventually(func() bool {
+		code, health = probe(srv, "/readyz")
+		return code == http.StatusServiceUnavailable
+	}, time.Second, time.Millisecond)
+	s.Equal("shutting down", health.Components["server"].Detail)
+	<-listening
+
+	db := storage.NewMockAdapter(s.T())
+	db.On("Ping", mock.Anything).Return(errors.New("connection refused"))
+	code, health = probe(New(config.TLS{}, db, time.Second), "/readyz")
+	s.Equal(http.StatusServiceUnavailable, code)
+	s.Equal(ComponentHealth{Status: healthDown, Detail: "connection refused"}, health.Components["storage"])
+
+	db = storage.NewMockAdapter(s.T())
+	db.On("Ping", mock.Anything).Return(nil)
+	db.On("GetClient", mock.Anything, 1).Return(nil, context.DeadlineExceeded)
+	breaker := storage.NewResilient(db, &config.Storage{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	srv = New(config.TLS{}, breaker, time.Second)
+	code, health = probe(srv, "/readyz")
+	s.Equal(http.StatusOK, code)
+	s.Equal(healthUp, health.Components["circuit"].Status)
+	_, err := breaker.GetClient(context.Background(), 1)
+	s.Require().Error(err)
+	code, health = probe(srv, "/readyz")
+	s.Equal(http.StatusServiceUnavailable, code)
+	s.Equal(ComponentHealth{Status: healthDown, Detail: "open"}, health.Components["circuit"])
+}
+
 func TestSuite(t *testing.T) {
 	suite.Run(t, new(TLSTestSuite))
 }
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/internal/webhook"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+// WebhooksHandler Serves the webhook subscriptions and the dead letters of their deliveries.
+type WebhooksHandler struct {
+	outbox storage.Outbox
+}
+
+// Select Lists the webhooks, without their secrets.
+func (h *WebhooksHandler) Select(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.outbox.SelectWebhooks(r.Context())
+	if !try(w, err) {
+		return
+	}
+	for _, hook := range webhooks {
+		hook.Secret = ""
+	}
+	err = json.NewEncoder(w).Encode(webhooks)
+	try(w, err)
+}
+
+func (h *WebhooksHandler) Get(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	hook, err := h.outbox.GetWebhook(r.Context(), ID)
+	if !try(w, err) {
+		return
+	}
+	hook.Secret = ""
+	err = json.NewEncoder(w).Encode(hook)
+	try(w, err)
+}
+
+// Post Subscribes the URL to every event, generating the secret unless given. The secret is responded once, here.
+func (h *WebhooksHandler) Post(w http.ResponseWriter, r *http.Request) {
+	hook, err := decodeWebhook(r)
+	if !try(w, err) {
+		return
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = webhook.NewSecret(); !try(w, err) {
+			return
+		}
+	}
+	created, err := h.outbox.CreateWebhook(r.Context(), hook)
+	if !try(w, err) {
+		return
+	}
+	w.Header().Add("Location", "/webhooks/"+strconv.Itoa(created.ID))
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(created)
+	try(w, err)
+}
+
+// Put Replaces the URL of the webhook, and the secret if given.
+func (h *WebhooksHandler) Put(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	hook, err := decodeWebhook(r)
+	if !try(w, err) {
+		return
+	}
+	hook.ID = ID
+	if hook.Secret == "" {
+		stored, err := h.outbox.GetWebhook(r.Context(), ID)
+		if !try(w, err) {
+			return
+		}
+		hook.Secret = stored.Secret
+	}
+	replaced, err := h.outbox.ReplaceWebhook(r.Context(), hook)
+	if !try(w, err) {
+		return
+	}
+	replaced.Secret = ""
+	err = json.NewEncoder(w).Encode(replaced)
+	try(w, err)
+}
+
+// Delete Unsubscribes the webhook, its pending deliveries and dead letters are gone too.
+func (h *WebhooksHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	if err = h.outbox.DeleteWebhook(r.Context(), ID); !try(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeadLetters Lists up to ?limit= deliveries the attempts are over for, the oldest first.
+func (h *WebhooksHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := defaultPageLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageLimit {
+			try(w, fault.New(fault.Malformed, "limit must be an integer from 1 to "+strconv.Itoa(maxPageLimit)))
+			return
+		}
+		limit = n
+	}
+	deliveries, err := h.outbox.SelectDeliveries(r.Context(), storage.DeliveryDead, limit)
+	if !try(w, err) {
+		return
+	}
+	err = json.NewEncoder(w).Encode(deliveries)
+	try(w, err)
+}
+
+// Retry Makes the dead letter pending again, it's delivered with the attempts started over.
+func (h *WebhooksHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	ID, err := pathID(r, "id")
+	if !try(w, err) {
+		return
+	}
+	if err = h.outbox.RetryDelivery(r.Context(), ID); !try(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeWebhook Reads the webhook of the request, its URL must be an absolute http or https one.
+func decodeWebhook(r *http.Request) (*storage.Webhook, error) {
+	hook := &storage.Webhook{}
+	if err := decodeEntity(r, hook); !tools.Try(err) {
+		return nil, err
+	}
+	parsed, err := url.Parse(hook.URL)
+	if !tools.Try(err) || parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fault.New(fault.Validation, "url must be an absolute http or https URL")
+	}
+	return hook, nil
+}
+
+func initWebhooksHandler(r *mux.Router, handler *WebhooksHandler) {
+	pr := r.PathPrefix("/webhooks").Subrouter()
+	// dead letters go first, otherwise /{id} takes them over
+	pr.Methods("GET").Path("/dead-letters").HandlerFunc(handler.DeadLetters)
+	pr.Methods("POST").Path("/dead-letters/{id:[0-9]+}:retry").HandlerFunc(handler.Retry)
+	pr.Methods("GET").Path("/").HandlerFunc(handler.Select)
+	pr.Methods("GET").Path("/{id:[0-9]+}").HandlerFunc(handler.Get)
+	pr.Methods("POST").Path("/").HandlerFunc(handler.Post)
+	pr.Methods("PUT").Path("/{id:[0-9]+}").HandlerFunc(handler.Put)
+	pr.Methods("DELETE").Path("/{id:[0-9]+}").HandlerFunc(handler.Delete)
+}
@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	AuditCreate  = "create"
+	AuditReplace = "replace"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+
+	AuditClient  = "client"
+	AuditProject = "project"
+)
+
+type (
+	// AuditLog Adapters keeping the audit trail, written by the Audited decorator.
+	AuditLog interface {
+		AppendAudit(ctx context.Context, entry *AuditEntry) error
+		// SelectAudit Returns the page of the entries matching the query and recorded since the given time, if it's set.
+		SelectAudit(ctx context.Context, query Query, since time.Time, page Page) ([]*AuditEntry, bool, error)
+	}
+
+	AuditEntry struct {
+		_ primitive.ObjectID `bson:"_id"`
+
+		ID    int       `json:"id" bson:"id" db:"id"`
+		At    time.Time `json:"at" bson:"at" db:"at"`
+		Actor string    `json:"actor" bson:"actor" db:"actor"`
+		// ClaimedActor Who the caller claims to be, unverified, so it never takes the place of the Actor.
+		ClaimedActor string `json:"claimed_actor,omitempty" bson:"claimed_actor,omitempty" db:"claimed_actor"`
+		Operation    string `json:"operation" bson:"operation" db:"operation"`
+		// Entity Either AuditClient or AuditProject.
+		Entity   string `json:"entity" bson:"entity" db:"entity"`
+		EntityID int    `json:"entity_id" bson:"entity_id" db:"entity_id"`
+		Diff     Diff   `json:"diff" bson:"diff" db:"diff"`
+	}
+
+	// Diff Changed fields of the entity, stored as JSON by the SQL adapters.
+	Diff []FieldChange
+
+	// FieldChange Values of the field before and after the write, nested fields are joined with dots.
+	FieldChange struct {
+		Field  string      `json:"field" bson:"field"`
+		Before interface{} `json:"before" bson:"before"`
+		After  interface{} `json:"after" bson:"after"`
+	}
+
+	// Audited Records every write of the decorated adapter to its audit log, in the transaction of the write, so
+	// a failure to append the entry rolls the write back. MongoDB standalone servers have no transactions, there
+	// the entry is appended after the write. Changes the client delete policy makes to the projects are not recorded.
+	Audited struct {
+		Adapter
+	}
+
+	actorKey        struct{}
+	claimedActorKey struct{}
+)
+
+var AuditSchema = newSchema(
+	&Field{Name: "id", Column: "id", Key: "id", Type: FieldInt, Sortable: true, value: func(e interface{}) interface{} {
+		return int64(e.(*AuditEntry).ID)
+	}},
+	&Field{Name: "actor", Column: "actor", Key: "actor", Type: FieldString, value: func(e interface{}) interface{} {
+		return e.(*AuditEntry).Actor
+	}},
+	&Field{Name: "operation", Column: "operation", Key: "operation", Type: FieldString, value: func(e interface{}) interface{} {
+		return e.(*AuditEntry).Operation
+	}},
+	&Field{Name: "entity", Column: "entity", Key: "entity", Type: FieldString, value: func(e interface{}) interface{} {
+		return e.(*AuditEntry).Entity
+	}},
+	&Field{Name: "entity_id", Column: "entity_id", Key: "entity_id", Type: FieldInt, value: func(e interface{}) interface{} {
+		return int64(e.(*AuditEntry).EntityID)
+	}},
+)
+
+// WithActor Tells the audit who makes the writes within the context.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorOf The actor of the context, "system" unless set.
+func ActorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "system"
+}
+
+// WithClaimedActor Tells the audit who the caller claims to be, recorded apart from the actor as it's not verified.
+func WithClaimedActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, claimedActorKey{}, actor)
+}
+
+// ClaimedActorOf The claimed actor of the context, empty unless set.
+func ClaimedActorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(claimedActorKey{}).(string)
+	return actor
+}
+
+// NewAudited Decorates the adapter, which must keep an audit log itself.
+func NewAudited(adapter Adapter) (*Audited, error) {
+	if _, ok := As[AuditLog](adapter); !ok {
+		return nil, errors.Errorf("%T has no audit log", adapter)
+	}
+	return &Audited{Adapter: adapter}, nil
+}
+
+// Unwrap The decorated adapter, the audit log is its own.
+func (a *Audited) Unwrap() Adapter {
+	return a.Adapter
+}
+
+// WithTx Records the writes of fn in the same transaction, so the entries are rolled back along with them.
+func (a *Audited) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	return a.Adapter.WithTx(ctx, func(tx Adapter) error {
+		audited, err := NewAudited(tx)
+		if !tools.Try(err) {
+			return err
+		}
+		return fn(audited)
+	})
+}
+
+// BatchClients Records the applied operations of the atomic batch in order, each one against the state the previous
+// one has left, in the transaction of the batch, so a failure to record one fails the whole batch. The batch that is
+// not atomic is applied one operation after another, each one recorded in a transaction of its own.
+func (a *Audited) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	if !atomic {
+		return applyDecorated(ctx, a, ops, applyClient)
+	}
+	var outcomes []Outcome[Client]
+	err := a.Adapter.WithTx(ctx, func(tx Adapter) error {
+		log, ok := As[AuditLog](tx)
+		if !ok {
+			return errors.Errorf("%T has no audit log", tx)
+		}
+		before := map[int]*Client{}
+		for _, op := range ops {
+			if ID, ok := opID(op, func(client *Client) *int { return client.ID }); ok && before[ID] == nil {
+				before[ID], _ = tx.GetClient(ctx, ID)
+			}
+		}
+		var err error
+		if outcomes, err = BatchClients(ctx, tx, ops, atomic); !tools.Try(err) {
+			return err
+		}
+		return recordBatch(ctx, log, AuditClient, ops, outcomes, before, tx, func(client *Client) int { return *client.ID }, trashedClient)
+	})
+	return settleBatch(a.Adapter, len(ops), outcomes, err)
+}
+
+func (a *Audited) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	if !atomic {
+		return applyDecorated(ctx, a, ops, applyProject)
+	}
+	var outcomes []Outcome[Project]
+	err := a.Adapter.WithTx(ctx, func(tx Adapter) error {
+		log, ok := As[AuditLog](tx)
+		if !ok {
+			return errors.Errorf("%T has no audit log", tx)
+		}
+		before := map[int]*Project{}
+		for _, op := range ops {
+			if ID, ok := opID(op, func(project *Project) *int { return project.ID }); ok && before[ID] == nil {
+				before[ID], _ = tx.GetProject(ctx, ID)
+			}
+		}
+		var err error
+		if outcomes, err = BatchProjects(ctx, tx, ops, atomic); !tools.Try(err) {
+			return err
+		}
+		return recordBatch(ctx, log, AuditProject, ops, outcomes, before, tx, func(project *Project) int { return *project.ID }, trashedProject)
+	})
+	return settleBatch(a.Adapter, len(ops), outcomes, err)
+}
+
+func (a *Audited) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		res, err := tx.CreateClient(ctx, client)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditCreate, AuditClient, *res.ID, nil, res)
+	})
+}
+
+func (a *Audited) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil || client.ID == nil {
+		return a.Adapter.ReplaceClient(ctx, client)
+	}
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		before, _ := tx.GetClient(ctx, *client.ID)
+		res, err := tx.ReplaceClient(ctx, client)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditReplace, AuditClient, *res.ID, before, res)
+	})
+}
+
+func (a *Audited) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		var before *Client
+		res, err := tx.UpdateClient(ctx, ID, func(client *Client) error {
+			snapshot := *client
+			before = &snapshot
+			return update(client)
+		})
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditUpdate, AuditClient, ID, before, res)
+	})
+}
+
+func (a *Audited) DeleteClient(ctx context.Context, ID int, version int) error {
+	_, err := withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		before, _ := tx.GetClient(ctx, ID)
+		if err := tx.DeleteClient(ctx, ID, version); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, record(ctx, log, AuditDelete, AuditClient, ID, before, trashedClient(ctx, tx, ID))
+	})
+	return err
+}
+
+func (a *Audited) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		before := trashedClient(ctx, tx, ID)
+		res, err := tx.RestoreClient(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditRestore, AuditClient, ID, before, res)
+	})
+}
+
+func (a *Audited) PurgeClient(ctx context.Context, ID int) error {
+	_, err := withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Client, error) {
+		before := trashedClient(ctx, tx, ID)
+		if err := tx.PurgeClient(ctx, ID); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, record(ctx, log, AuditPurge, AuditClient, ID, before, nil)
+	})
+	return err
+}
+
+func (a *Audited) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		res, err := tx.CreateProject(ctx, project)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditCreate, AuditProject, *res.ID, nil, res)
+	})
+}
+
+func (a *Audited) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil || project.ID == nil {
+		return a.Adapter.ReplaceProject(ctx, project)
+	}
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		before, _ := tx.GetProject(ctx, *project.ID)
+		res, err := tx.ReplaceProject(ctx, project)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditReplace, AuditProject, *res.ID, before, res)
+	})
+}
+
+func (a *Audited) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		var before *Project
+		res, err := tx.UpdateProject(ctx, ID, func(project *Project) error {
+			snapshot := *project
+			before = &snapshot
+			return update(project)
+		})
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditUpdate, AuditProject, ID, before, res)
+	})
+}
+
+func (a *Audited) DeleteProject(ctx context.Context, ID int, version int) error {
+	_, err := withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		before, _ := tx.GetProject(ctx, ID)
+		if err := tx.DeleteProject(ctx, ID, version); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, record(ctx, log, AuditDelete, AuditProject, ID, before, trashedProject(ctx, tx, ID))
+	})
+	return err
+}
+
+func (a *Audited) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	return withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		before := trashedProject(ctx, tx, ID)
+		res, err := tx.RestoreProject(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, record(ctx, log, AuditRestore, AuditProject, ID, before, res)
+	})
+}
+
+func (a *Audited) PurgeProject(ctx context.Context, ID int) error {
+	_, err := withEntry(ctx, a, func(tx Adapter, log AuditLog) (*Project, error) {
+		before := trashedProject(ctx, tx, ID)
+		if err := tx.PurgeProject(ctx, ID); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, record(ctx, log, AuditPurge, AuditProject, ID, before, nil)
+	})
+	return err
+}
+
+// withEntry Runs the write, which reads the state before it and appends its entry, in a transaction of the
+// decorated adapter.
+func withEntry[T any](ctx context.Context, a *Audited, write func(tx Adapter, log AuditLog) (*T, error)) (*T, error) {
+	var res *T
+	err := a.Adapter.WithTx(ctx, func(tx Adapter) error {
+		log, ok := As[AuditLog](tx)
+		if !ok {
+			return errors.Errorf("%T has no audit log", tx)
+		}
+		var err error
+		res, err = write(tx, log)
+		return err
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// trashedClient Looks the client up in the trash, nil if it's not there.
+func trashedClient(ctx context.Context, adapter Adapter, ID int) *Client {
+	byID, _ := ClientSchema.Compare("id", OpEq, ID)
+	clients, _, err := adapter.SelectClients(ctx, Query{Filter: byID, Trash: true}, Page{Limit: 1})
+	if !tools.Try(err) || len(clients) == 0 {
+		return nil
+	}
+	return clients[0]
+}
+
+func trashedProject(ctx context.Context, adapter Adapter, ID int) *Project {
+	byID, _ := ProjectSchema.Compare("id", OpEq, ID)
+	projects, _, err := adapter.SelectProjects(ctx, Query{Filter: byID, Trash: true}, Page{Limit: 1})
+	if !tools.Try(err) || len(projects) == 0 {
+		return nil
+	}
+	return projects[0]
+}
+
+// record Appends the entry of the write, either state may be nil.
+func record[T any](ctx context.Context, log AuditLog, operation, entity string, ID int, before, after *T) error {
+	diff, err := diffOf(before, after)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "audit")
+	}
+	err = log.AppendAudit(ctx, &AuditEntry{
+		At:           time.Now().UTC().Truncate(time.Millisecond),
+		Actor:        ActorOf(ctx),
+		ClaimedActor: ClaimedActorOf(ctx),
+		Operation:    operation,
+		Entity:       entity,
+		EntityID:     ID,
+		Diff:         diff,
+	})
+	return errors.Wrap(err, "audit")
+}
+
+// recordBatch Appends the entries of the applied operations.
+func recordBatch[T any](
+	ctx context.Context,
+	log AuditLog,
+	entity string,
+	ops []Operation[T],
+	outcomes []Outcome[T],
+	before map[int]*T,
+	tx Adapter,
+	idOf func(entity *T) int,
+	trashed func(ctx context.Context, adapter Adapter, ID int) *T,
+) error {
+	for i, op := range ops {
+		if outcomes[i].Err != nil {
+			continue
+		}
+		var err error
+		switch res := outcomes[i].Entity; op.Op {
+		case BatchCreate:
+			err = record(ctx, log, AuditCreate, entity, idOf(res), nil, res)
+			before[idOf(res)] = res
+		case BatchUpdate:
+			err = record(ctx, log, AuditReplace, entity, idOf(res), before[idOf(res)], res)
+			before[idOf(res)] = res
+		case BatchDelete:
+			err = record(ctx, log, AuditDelete, entity, op.ID, before[op.ID], trashed(ctx, tx, op.ID))
+			before[op.ID] = nil
+		}
+		if !tools.Try(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// opID ID of the entity the operation changes, unless it's a create.
+func opID[T any](op Operation[T], idOf func(entity *T) *int) (int, bool) {
+	switch {
+	case op.Op == BatchDelete:
+		return op.ID, true
+	case op.Op == BatchUpdate && op.Entity != nil && idOf(op.Entity) != nil:
+		return *idOf(op.Entity), true
+	}
+	return 0, false
+}
+
+// diffOf Compares the JSON documents of the entity states, leaving the version out.
+func diffOf[T any](before, after *T) (Diff, error) {
+	b, err := flatten(before)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	a, err := flatten(after)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	fields := make([]string, 0, len(b)+len(a))
+	for field := range b {
+		fields = append(fields, field)
+	}
+	for field := range a {
+		if _, ok := b[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	diff := Diff{}
+	for _, field := range fields {
+		if field == "version" || reflect.DeepEqual(b[field], a[field]) {
+			continue
+		}
+		diff = append(diff, FieldChange{Field: field, Before: b[field], After: a[field]})
+	}
+	return diff, nil
+}
+
+// flatten Leaf values of the entity JSON by their dotted paths, integers are kept as int64.
+func flatten[T any](entity *T) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	if entity == nil {
+		return res, nil
+	}
+	raw, err := json.Marshal(entity)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err = unmarshalNumbers(raw, &doc); !tools.Try(err) {
+		return nil, err
+	}
+	var walk func(prefix string, doc map[string]interface{})
+	walk = func(prefix string, doc map[string]interface{}) {
+		for key, value := range doc {
+			if nested, ok := value.(map[string]interface{}); ok {
+				walk(prefix+key+".", nested)
+				continue
+			}
+			res[prefix+key] = value
+		}
+	}
+	walk("", doc)
+	return res, nil
+}
+
+// Value Stores the diff as a JSON document.
+func (d Diff) Value() (driver.Value, error) {
+	raw, err := json.Marshal(d)
+	return string(raw), err
+}
+
+// Scan Reads the diff from a JSON document.
+func (d *Diff) Scan(src interface{}) error {
+	var raw []byte
+	switch src := src.(type) {
+	case []byte:
+		raw = src
+	case string:
+		raw = []byte(src)
+	default:
+		return errors.Errorf("unsupported diff type %T", src)
+	}
+	var changes []FieldChange
+	if err := unmarshalNumbers(raw, &changes); !tools.Try(err) {
+		return err
+	}
+	for i := range changes {
+		changes[i].Before, changes[i].After = normalizeNumber(changes[i].Before), normalizeNumber(changes[i].After)
+	}
+	*d = changes
+	return nil
+}
+
+// unmarshalNumbers Decodes JSON keeping integers as int64, the way BSON does.
+func unmarshalNumbers(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(v); !tools.Try(err) {
+		return err
+	}
+	if doc, ok := v.(*map[string]interface{}); ok {
+		normalizeNumbers(*doc)
+	}
+	return nil
+}
+
+func normalizeNumbers(doc map[string]interface{}) {
+	for key, value := range doc {
+		if nested, ok := value.(map[string]interface{}); ok {
+			normalizeNumbers(nested)
+			continue
+		}
+		doc[key] = normalizeNumber(value)
+	}
+}
+
+func normalizeNumber(value interface{}) interface{} {
+	n, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if i, err := n.Int64(); tools.Try(err) {
+		return i
+	}
+	if strings.ContainsAny(n.String(), ".eE") {
+		f, _ := n.Float64()
+		return f
+	}
+	return n.String()
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+)
+
+func TestAudited(t *testing.T) {
+	for name, adapter := range map[string]Adapter{"memory": &Memory{}, "sqlite": &SQLite{}} {
+		adapter := adapter
+		t.Run(name, func(t *testing.T) {
+			ctx := WithActor(context.Background(), "alice")
+			require.NoError(t, adapter.Init(ctx, &config.Storage{
+				Addr:               filepath.Join(t.TempDir(), "db.sqlite"),
+				ClientDeletePolicy: string(DeleteCascade),
+			}))
+			require.NoError(t, Migrate(ctx, adapter, MigrateAuto))
+			db, err := NewAudited(adapter)
+			require.NoError(t, err)
+			auditLog, ok := As[AuditLog](db)
+			require.True(t, ok, "the audit log of the decorated adapter")
+			since := time.Now().UTC().Add(-time.Second)
+
+			client, err := db.CreateClient(ctx, &Client{Name: "Acme"})
+			require.NoError(t, err)
+			_, err = db.UpdateClient(ctx, *client.ID, func(client *Client) error {
+				client.Settings.CodeScanInterval = time.Minute
+				return nil
+			})
+			require.NoError(t, err)
+			_, err = db.UpdateClient(ctx, *client.ID, func(client *Client) error {
+				return errors.New("rejected")
+			})
+			require.Error(t, err)
+			project, err := db.CreateProject(WithClaimedActor(WithActor(ctx, "bob"), "carol"), &Project{ClientID: client.ID, Name: "Rocket"})
+			require.NoError(t, err)
+			require.NoError(t, db.DeleteClient(ctx, *client.ID, 0))
+			_, err = db.RestoreClient(ctx, *client.ID)
+			require.NoError(t, err)
+			require.NoError(t, db.DeleteProject(ctx, *project.ID, 0))
+			require.NoError(t, db.PurgeProject(ctx, *project.ID))
+
+			byClient, _ := AuditSchema.Compare("entity", OpEq, AuditClient)
+			history, _, err := auditLog.SelectAudit(ctx, Query{Filter: byClient}, since, Page{})
+			require.NoError(t, err)
+			require.Len(t, history, 4, "failed writes are not recorded")
+			assert.Equal(t, AuditCreate, history[0].Operation)
+			assert.Equal(t, "alice", history[0].Actor)
+			assert.Equal(t, *client.ID, history[0].EntityID)
+			assert.Equal(t, Diff{
+				{Field: "id", After: int64(*client.ID)},
+				{Field: "name", After: "Acme"},
+				{Field: "settings.code_scan_interval", After: int64(0)},
+			}, history[0].Diff)
+			assert.Equal(t, Diff{
+				{Field: "settings.code_scan_interval", Before: int64(0), After: int64(time.Minute)},
+			}, history[1].Diff)
+			assert.Equal(t, AuditDelete, history[2].Operation)
+			require.Len(t, history[2].Diff, 1)
+			assert.Equal(t, "deleted_at", history[2].Diff[0].Field)
+			assert.Nil(t, history[2].Diff[0].Before)
+			assert.Equal(t, AuditRestore, history[3].Operation)
+			assert.False(t, history[3].At.Before(history[0].At))
+
+			byActor, _ := AuditSchema.Compare("actor", OpEq, "bob")
+			entries, _, err := auditLog.SelectAudit(ctx, Query{Filter: byActor}, since, Page{})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, AuditProject, entries[0].Entity)
+			assert.Equal(t, "carol", entries[0].ClaimedActor)
+			assert.Empty(t, history[0].ClaimedActor)
+
+			byProject, _ := AuditSchema.Compare("entity", OpEq, AuditProject)
+			entries, more, err := auditLog.SelectAudit(ctx, Query{Filter: byProject, Sort: []SortKey{{
+				Field: AuditSchema.fields["id"], Desc: true,
+			}}}, since, Page{Limit: 1})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.True(t, more)
+			assert.Equal(t, AuditPurge, entries[0].Operation)
+			assert.Equal(t, "name", entries[0].Diff[len(entries[0].Diff)-1].Field)
+			assert.Nil(t, entries[0].Diff[len(entries[0].Diff)-1].After)
+
+			entries, _, err = auditLog.SelectAudit(ctx, Query{}, time.Now().Add(time.Hour), Page{})
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestAuditedRollsBackUnrecorded(t *testing.T) {
+	ctx := context.Background()
+	adapter := &SQLite{}
+	require.NoError(t, adapter.Init(ctx, &config.Storage{Addr: filepath.Join(t.TempDir(), "db.sqlite")}))
+	require.NoError(t, Migrate(ctx, adapter, MigrateAuto))
+	db, err := NewAudited(adapter)
+	require.NoError(t, err)
+	client, err := db.CreateClient(ctx, &Client{Name: "Acme"})
+	require.NoError(t, err)
+	_, err = adapter.conn.ExecContext(ctx, "alter table audit rename to audit_gone;")
+	require.NoError(t, err)
+
+	_, err = db.CreateClient(ctx, &Client{Name: "Initech"})
+	require.Error(t, err)
+	_, err = db.UpdateClient(ctx, *client.ID, func(client *Client) error {
+		client.Name = "Acme Corp"
+		return nil
+	})
+	require.Error(t, err)
+	require.Error(t, db.DeleteClient(ctx, *client.ID, 0))
+	outcomes, err := db.BatchClients(ctx, []Operation[Client]{{Op: BatchCreate, Entity: &Client{Name: "Initech"}}}, false)
+	require.NoError(t, err)
+	require.Error(t, outcomes[0].Err, "the operation fails, not leaving its write unrecorded")
+	_, err = db.BatchClients(ctx, []Operation[Client]{{Op: BatchCreate, Entity: &Client{Name: "Initech"}}}, true)
+	require.Error(t, err, "the atomic batch fails as a whole")
+
+	byName, _ := ClientSchema.Compare("name", OpEq, "Initech")
+	clients, _, err := adapter.SelectClients(ctx, Query{Filter: byName}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, clients, "writes are rolled back along with their entries")
+	stored, err := adapter.GetClient(ctx, *client.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Acme", stored.Name)
+}
+
+func TestNewAudited(t *testing.T) {
+	_, err := NewAudited(&MockAdapter{})
+	assert.Error(t, err)
+}
+
+func TestAuditedWithTx(t *testing.T) {
+	for name, adapter := range map[string]Adapter{"memory": &Memory{}, "sqlite": &SQLite{}} {
+		adapter := adapter
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, adapter.Init(ctx, &config.Storage{Addr: filepath.Join(t.TempDir(), "db.sqlite")}))
+			require.NoError(t, Migrate(ctx, adapter, MigrateAuto))
+			db, err := NewAudited(adapter)
+			require.NoError(t, err)
+			auditLog, ok := As[AuditLog](db)
+			require.True(t, ok, "the audit log of the decorated adapter")
+
+			rollback := errors.New("rollback")
+			err = db.WithTx(ctx, func(tx Adapter) error {
+				if _, err := tx.CreateClient(ctx, &Client{Name: "Acme"}); err != nil {
+					return err
+				}
+				return rollback
+			})
+			require.ErrorIs(t, err, rollback)
+			var client *Client
+			require.NoError(t, db.WithTx(ctx, func(tx Adapter) (err error) {
+				client, err = tx.CreateClient(ctx, &Client{Name: "Initech"})
+				return err
+			}))
+
+			entries, _, err := auditLog.SelectAudit(ctx, Query{}, time.Time{}, Page{})
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "entries are rolled back along with the writes")
+			assert.Equal(t, Diff{
+				{Field: "id", After: int64(*client.ID)},
+				{Field: "name", After: "Initech"},
+				{Field: "settings.code_scan_interval", After: int64(0)},
+			}, entries[0].Diff)
+		})
+	}
+}
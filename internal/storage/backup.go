@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+// BackupSchemaVersion Version of the entity documents in the archives, restores refuse newer ones.
+const BackupSchemaVersion = 1
+
+const manifestFile = "manifest.json"
+
+type (
+	// Loader Adapters writing every entity of a type at once, all or none. Entities are upserted by ID as is,
+	// with their versions and deletion times, and the sequence is moved past the given one and every loaded ID.
+	Loader interface {
+		LoadClients(ctx context.Context, clients []*Client, seq int) error
+		// LoadProjects Fails with ErrDanglingReference if a project refers to a client the adapter has neither
+		// live nor trashed.
+		LoadProjects(ctx context.Context, projects []*Project, seq int) error
+	}
+
+	// Manifest Describes the backup archive, it goes first.
+	Manifest struct {
+		SchemaVersion int            `json:"schema_version"`
+		CreatedAt     time.Time      `json:"created_at"`
+		Files         []ManifestFile `json:"files"`
+		// Sequences The last allocated IDs of the tables, if the adapter exposes them.
+		Sequences map[string]int `json:"sequences,omitempty"`
+	}
+
+	// ManifestFile NDJSON file of the archive, a line per entity.
+	ManifestFile struct {
+		Name string `json:"name"`
+		// Table Either clients or projects.
+		Table  string `json:"table"`
+		Count  int    `json:"count"`
+		SHA256 string `json:"sha256"`
+	}
+)
+
+// Backup Writes every client and project, trashed ones included, to the tar.gz archive. Entities are read in batches
+// without a snapshot, so writes made meanwhile may or may not get in.
+func Backup(ctx context.Context, db Adapter, w io.Writer) (*Manifest, error) {
+	manifest := &Manifest{SchemaVersion: BackupSchemaVersion, CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	if seq, ok := As[Sequencer](db); ok {
+		manifest.Sequences = map[string]int{}
+		for _, table := range []string{"clients", "projects"} {
+			n, err := seq.Sequence(ctx, table)
+			if !tools.Try(err) {
+				return nil, err
+			}
+			manifest.Sequences[table] = n
+		}
+	}
+	clients, err := dumpEntities(ctx, db, clientOps, "clients")
+	if !tools.Try(err) {
+		return nil, err
+	}
+	projects, err := dumpEntities(ctx, db, projectOps, "projects")
+	if !tools.Try(err) {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	files := []*bytes.Buffer{clients.data, projects.data}
+	manifest.Files = []ManifestFile{clients.file, projects.file}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if err = writeFile(archive, manifestFile, raw, manifest.CreatedAt); !tools.Try(err) {
+		return nil, err
+	}
+	for i, file := range manifest.Files {
+		if err = writeFile(archive, file.Name, files[i].Bytes(), manifest.CreatedAt); !tools.Try(err) {
+			return nil, err
+		}
+	}
+	if err = archive.Close(); !tools.Try(err) {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// Restore Loads the archive Backup has written, clients first, each table in a single transaction. Entities are
+// upserted, the ones missing in the archive are kept. The archive is verified against its manifest before
+// anything is written, a broken one fails with a fault.Malformed error, as well as the one with its files over
+// maxSize bytes uncompressed in total, 0 is unlimited.
+func Restore(ctx context.Context, db Adapter, r io.Reader, maxSize int64) (*Manifest, error) {
+	loader, ok := As[Loader](db)
+	if !ok {
+		return nil, errors.Errorf("%T can't load backups", db)
+	}
+	manifest, files, err := readArchive(r, maxSize)
+	if !tools.Try(err) {
+		return nil, fault.Wrap(fault.Malformed, err, "malformed backup")
+	}
+	var clients []*Client
+	var projects []*Project
+	for _, file := range manifest.Files {
+		switch file.Table {
+		case "clients":
+			clients, err = parseEntities(file, files[file.Name], clientOps)
+		case "projects":
+			projects, err = parseEntities(file, files[file.Name], projectOps)
+		default:
+			err = errors.Errorf("unknown table %s", file.Table)
+		}
+		if !tools.Try(err) {
+			return nil, fault.Wrap(fault.Malformed, err, "malformed backup")
+		}
+	}
+	if err = loader.LoadClients(ctx, clients, manifest.Sequences["clients"]); !tools.Try(err) {
+		return nil, errors.Wrap(err, "clients")
+	}
+	if err = loader.LoadProjects(ctx, projects, manifest.Sequences["projects"]); !tools.Try(err) {
+		return nil, errors.Wrap(err, "projects")
+	}
+	return manifest, nil
+}
+
+type dump struct {
+	file ManifestFile
+	data *bytes.Buffer
+}
+
+// dumpEntities Encodes the live and the trashed entities of the table as NDJSON.
+func dumpEntities[T any](ctx context.Context, db Adapter, ops entityOps[T], table string) (*dump, error) {
+	res := &dump{file: ManifestFile{Name: table + ".ndjson", Table: table}, data: &bytes.Buffer{}}
+	enc := json.NewEncoder(res.data)
+	for _, trash := range []bool{false, true} {
+		page := Page{Limit: defaultCopyBatch}
+		for {
+			entities, more, err := ops.page(db)(ctx, Query{Trash: trash}, page)
+			if !tools.Try(err) {
+				return nil, err
+			}
+			for _, entity := range entities {
+				if err = enc.Encode(entity); !tools.Try(err) {
+					return nil, err
+				}
+			}
+			res.file.Count += len(entities)
+			if !more {
+				break
+			}
+			page.After = Keyset{int64(ops.id(entities[len(entities)-1]))}
+		}
+	}
+	sum := sha256.Sum256(res.data.Bytes())
+	res.file.SHA256 = hex.EncodeToString(sum[:])
+	return res, nil
+}
+
+func checkLoaded(ID *int, version int) error {
+	if ID == nil {
+		return errors.New("no id")
+	}
+	if version < 1 {
+		return errors.Errorf("version %d of %d is below 1", version, *ID)
+	}
+	return nil
+}
+
+func writeFile(archive *tar.Writer, name string, data []byte, modTime time.Time) error {
+	err := archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o644,
+		ModTime:  modTime,
+	})
+	if !tools.Try(err) {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+// readArchive Reads the manifest and the files it lists, checking their sums. The files are held in memory, so
+// the ones past maxSize bytes in total are refused before they are read, unless it's 0.
+func readArchive(r io.Reader, maxSize int64) (*Manifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if !tools.Try(err) {
+		return nil, nil, err
+	}
+	archive := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if !tools.Try(err) {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if maxSize > 0 {
+			if header.Size > maxSize {
+				return nil, nil, errors.Errorf("%s is over the size limit of %d bytes", header.Name, maxSize)
+			}
+			maxSize -= header.Size
+		}
+		if files[header.Name], err = io.ReadAll(archive); !tools.Try(err) {
+			return nil, nil, err
+		}
+	}
+	raw, ok := files[manifestFile]
+	if !ok {
+		return nil, nil, errors.New("no " + manifestFile)
+	}
+	manifest := &Manifest{}
+	if err = json.Unmarshal(raw, manifest); !tools.Try(err) {
+		return nil, nil, errors.Wrap(err, manifestFile)
+	}
+	if manifest.SchemaVersion < 1 || manifest.SchemaVersion > BackupSchemaVersion {
+		return nil, nil, errors.Errorf("unsupported schema version %d", manifest.SchemaVersion)
+	}
+	for _, file := range manifest.Files {
+		data, ok := files[file.Name]
+		if !ok {
+			return nil, nil, errors.Errorf("no %s", file.Name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, nil, errors.Errorf("checksum mismatch of %s", file.Name)
+		}
+	}
+	return manifest, files, nil
+}
+
+// parseEntities Decodes the NDJSON lines, every entity must have its ID.
+func parseEntities[T any](file ManifestFile, data []byte, ops entityOps[T]) ([]*T, error) {
+	var res []*T
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lines.Buffer(nil, 1<<20)
+	for n := 1; lines.Scan(); n++ {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		entity := new(T)
+		if err := json.Unmarshal(lines.Bytes(), entity); !tools.Try(err) {
+			return nil, errors.Wrapf(err, "%s:%d", file.Name, n)
+		}
+		if err := ops.check(entity); !tools.Try(err) {
+			return nil, errors.Wrapf(err, "%s:%d", file.Name, n)
+		}
+		res = append(res, entity)
+	}
+	if err := lines.Err(); !tools.Try(err) {
+		return nil, errors.Wrap(err, file.Name)
+	}
+	if len(res) != file.Count {
+		return nil, errors.Errorf("%s has %d entities, %d expected", file.Name, len(res), file.Count)
+	}
+	return res, nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	from := &Memory{}
+	require.NoError(t, from.Init(ctx, &config.Storage{ClientDeletePolicy: string(DeleteCascade)}))
+	for _, name := range []string{"Apple", "Meta", "purged"} {
+		_, err := from.CreateClient(ctx, &Client{Name: name})
+		require.NoError(t, err)
+	}
+	_, err := from.CreateProject(ctx, &Project{ClientID: tools.IntPtr(2), Name: "Oculus"})
+	require.NoError(t, err)
+	_, err = from.CreateProject(ctx, &Project{Name: "orphan"})
+	require.NoError(t, err)
+	_, err = from.UpdateClient(ctx, 1, func(client *Client) error {
+		client.Name = "Apple Inc."
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, from.DeleteClient(ctx, 3, 0))
+	require.NoError(t, from.PurgeClient(ctx, 3))
+	require.NoError(t, from.DeleteClient(ctx, 2, 0))
+
+	archive := &bytes.Buffer{}
+	manifest, err := Backup(ctx, from, archive)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"clients": 3, "projects": 2}, manifest.Sequences)
+	require.Len(t, manifest.Files, 2)
+	assert.Equal(t, 2, manifest.Files[0].Count)
+	assert.Equal(t, 2, manifest.Files[1].Count)
+	names := archiveNames(t, archive.Bytes())
+	assert.Equal(t, []string{"manifest.json", "clients.ndjson", "projects.ndjson"}, names, "manifest goes first")
+
+	to := &SQLite{}
+	require.NoError(t, to.Init(ctx, &config.Storage{Addr: filepath.Join(t.TempDir(), "db.sqlite")}))
+	require.NoError(t, to.Migrate(ctx, MigrateAuto))
+	_, err = to.conn.Exec("delete from projects; delete from clients; delete from sqlite_sequence;") // fixtures of the migrations
+	require.NoError(t, err)
+
+	_, err = Restore(ctx, to, bytes.NewReader(tamper(t, archive.Bytes(), "clients.ndjson")), 0)
+	assert.Equal(t, fault.Malformed, fault.KindOf(err), "checksum mismatch")
+	_, err = Restore(ctx, to, bytes.NewReader(archive.Bytes()), 100)
+	assert.Equal(t, fault.Malformed, fault.KindOf(err), "over the size limit")
+
+	_, err = Restore(ctx, to, bytes.NewReader(archive.Bytes()), 1<<20)
+	require.NoError(t, err)
+	for _, db := range []Adapter{from, to} {
+		client, err := db.GetClient(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "Apple Inc.", client.Name)
+		assert.Equal(t, 2, client.Version, "versions are kept")
+	}
+	trashed, _, err := to.SelectClients(ctx, Query{Trash: true}, Page{})
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	original, _, err := from.SelectClients(ctx, Query{Trash: true}, Page{})
+	require.NoError(t, err)
+	assert.True(t, original[0].DeletedAt.Equal(*trashed[0].DeletedAt), "deletion times are kept")
+	_, err = to.RestoreClient(ctx, 2)
+	require.NoError(t, err)
+	project, err := to.GetProject(ctx, 1)
+	require.NoError(t, err, "cascade trashed project is restored along with the client")
+	assert.Equal(t, 2, *project.ClientID)
+	created, err := to.CreateClient(ctx, &Client{Name: "next"})
+	require.NoError(t, err)
+	assert.Equal(t, 4, *created.ID, "sequence is not behind the purged client")
+
+	from.projects[7] = Project{ID: tools.IntPtr(7), ClientID: tools.IntPtr(99), Name: "dangling", Version: 1}
+	archive.Reset()
+	_, err = Backup(ctx, from, archive)
+	require.NoError(t, err)
+	_, err = Restore(ctx, to, archive, 0)
+	assert.IsType(t, ErrDanglingReference{}, errors.Cause(err))
+	projects, _, err := to.SelectProjects(ctx, Query{}, Page{})
+	require.NoError(t, err)
+	assert.Len(t, projects, 2, "projects are restored all or none")
+}
+
+func archiveNames(t *testing.T, data []byte) []string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	archive := tar.NewReader(gz)
+	var names []string
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return names
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+}
+
+// tamper Rewrites the archive with a byte of the file changed.
+func tamper(t *testing.T, data []byte, name string) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	in := tar.NewReader(gz)
+	res := &bytes.Buffer{}
+	zw := gzip.NewWriter(res)
+	out := tar.NewWriter(zw)
+	for {
+		header, err := in.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(in)
+		require.NoError(t, err)
+		if header.Name == name {
+			content[0] ^= 1
+		}
+		require.NoError(t, out.WriteHeader(header))
+		_, err = out.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, out.Close())
+	require.NoError(t, zw.Close())
+	return res.Bytes()
+}
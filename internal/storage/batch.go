@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	BatchCreate BatchOp = "create"
+	// BatchUpdate Replaces the entity with its ID, checking its version unless it's 0.
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+type (
+	BatchOp string
+
+	// Operation One write of a batch: create or update of the Entity, or delete of the entity with the ID.
+	Operation[T any] struct {
+		Op     BatchOp `json:"op"`
+		Entity *T      `json:"entity,omitempty"`
+		ID     int     `json:"id,omitempty"`
+		// Version Expected version of the entity to delete, 0 for any.
+		Version int `json:"version,omitempty"`
+	}
+
+	// Outcome Result of the operation at the same position: the entity written, nil for a delete, or the error.
+	Outcome[T any] struct {
+		Entity *T
+		Err    error
+	}
+
+	// Batcher Adapters applying batches of writes at once.
+	Batcher interface {
+		// BatchClients Applies the operations in order, each one on its own, or all or none if the batch is atomic.
+		// Once an operation of the atomic batch fails, the rest fail with ErrBatchAborted.
+		// The error is returned if the batch could not be applied at all.
+		BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error)
+		BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error)
+	}
+
+	// ErrBatchAborted Operation is not applied, as another one of the atomic batch has failed.
+	ErrBatchAborted struct {
+		// Index Position of the failed operation.
+		Index int
+	}
+
+	// batchFailure Fails the atomic batch within a session transaction, which has no savepoints to roll the batch back
+	// alone, so the whole transaction has to be. The decorator that has begun it builds the outcomes, see settleBatch.
+	batchFailure struct {
+		index int
+		err   error
+	}
+
+	// sessionBound Adapters bound to a session transaction, which is aborted as a whole by a failed write.
+	sessionBound interface {
+		inSession() bool
+	}
+)
+
+var (
+	errAtomicBatch = fault.New(fault.Validation, "storage can't apply batches atomically")
+	// errSessionBatch Failed operations of the batch that is not atomic would abort the session transaction.
+	errSessionBatch = fault.New(fault.Validation, "batch that is not atomic can't be applied within a session transaction")
+)
+
+func (e ErrBatchAborted) Error() string {
+	return "not applied, operation " + strconv.Itoa(e.Index) + " of the atomic batch has failed"
+}
+
+func (e ErrBatchAborted) Kind() fault.Kind {
+	return fault.Conflict
+}
+
+// BatchClients Applies the batch with the adapter, or one operation after another if it's not a Batcher.
+func BatchClients(ctx context.Context, adapter Adapter, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	if batcher, ok := adapter.(Batcher); ok {
+		return batcher.BatchClients(ctx, ops, atomic)
+	}
+	if atomic {
+		return nil, errAtomicBatch
+	}
+	outcomes, _ := applyEach(ctx, adapter, ops, false, applyClient)
+	return outcomes, nil
+}
+
+// BatchProjects Applies the batch with the adapter, or one operation after another if it's not a Batcher.
+func BatchProjects(ctx context.Context, adapter Adapter, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	if batcher, ok := adapter.(Batcher); ok {
+		return batcher.BatchProjects(ctx, ops, atomic)
+	}
+	if atomic {
+		return nil, errAtomicBatch
+	}
+	outcomes, _ := applyEach(ctx, adapter, ops, false, applyProject)
+	return outcomes, nil
+}
+
+// applyEach Applies the operations one by one, up to the first failure if atomic, and tells if all have succeeded.
+func applyEach[T any](
+	ctx context.Context,
+	adapter Adapter,
+	ops []Operation[T],
+	atomic bool,
+	apply func(ctx context.Context, adapter Adapter, op Operation[T]) (*T, error),
+) ([]Outcome[T], bool) {
+	outcomes := make([]Outcome[T], len(ops))
+	ok := true
+	for i, op := range ops {
+		outcomes[i].Entity, outcomes[i].Err = apply(ctx, adapter, op)
+		if outcomes[i].Err == nil {
+			continue
+		}
+		ok = false
+		if atomic {
+			return abortBatch(outcomes, i), false
+		}
+	}
+	return outcomes, ok
+}
+
+func (e batchFailure) Error() string {
+	return "operation " + strconv.Itoa(e.index) + " of the atomic batch has failed: " + e.err.Error()
+}
+
+func (e batchFailure) Unwrap() error {
+	return errBatchFailed
+}
+
+// inSession Tells if the adapter, or a decorated one, is bound to a session transaction.
+func inSession(adapter Adapter) bool {
+	bound, ok := As[sessionBound](adapter)
+	return ok && bound.inSession()
+}
+
+// applyDecorated Applies the batch that is not atomic one operation after another through the decorator, each
+// one in a transaction of its own along with what the decorator writes, so a failed one is rolled back alone.
+func applyDecorated[T any](
+	ctx context.Context,
+	decorator Adapter,
+	ops []Operation[T],
+	apply func(ctx context.Context, adapter Adapter, op Operation[T]) (*T, error),
+) ([]Outcome[T], error) {
+	if inSession(decorator) {
+		return nil, errSessionBatch
+	}
+	outcomes, _ := applyEach(ctx, decorator, ops, false, apply)
+	return outcomes, nil
+}
+
+// settleBatch Builds the outcomes of the atomic batch failed within the transaction the decorator has begun, once
+// it's rolled back. Within a session transaction begun by the caller the failure is passed on, to roll that back.
+func settleBatch[T any](adapter Adapter, ops int, outcomes []Outcome[T], err error) ([]Outcome[T], error) {
+	var failure batchFailure
+	if errors.As(err, &failure) && !inSession(adapter) {
+		outcomes = make([]Outcome[T], ops)
+		outcomes[failure.index].Err = failure.err
+		return abortBatch(outcomes, failure.index), nil
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// abortBatch Fails every outcome of the atomic batch but the one of the failed operation.
+func abortBatch[T any](outcomes []Outcome[T], failed int) []Outcome[T] {
+	for i := range outcomes {
+		if i != failed {
+			outcomes[i] = Outcome[T]{Err: ErrBatchAborted{Index: failed}}
+		}
+	}
+	return outcomes
+}
+
+func applyClient(ctx context.Context, adapter Adapter, op Operation[Client]) (*Client, error) {
+	switch op.Op {
+	case BatchCreate:
+		return adapter.CreateClient(ctx, op.Entity)
+	case BatchUpdate:
+		return adapter.ReplaceClient(ctx, op.Entity)
+	case BatchDelete:
+		return nil, adapter.DeleteClient(ctx, op.ID, op.Version)
+	}
+	return nil, errUnknownOp(op.Op)
+}
+
+func applyProject(ctx context.Context, adapter Adapter, op Operation[Project]) (*Project, error) {
+	switch op.Op {
+	case BatchCreate:
+		return adapter.CreateProject(ctx, op.Entity)
+	case BatchUpdate:
+		return adapter.ReplaceProject(ctx, op.Entity)
+	case BatchDelete:
+		return nil, adapter.DeleteProject(ctx, op.ID, op.Version)
+	}
+	return nil, errUnknownOp(op.Op)
+}
+
+func errUnknownOp(op BatchOp) error {
+	return fault.New(fault.Malformed, "unknown operation "+strconv.Quote(string(op)))
+}
+
+// BatchClients Applies the operations to a copy of the data, which takes its place unless the atomic batch fails.
+// Other calls wait for the batch to finish.
+func (m *Memory) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	return memoryBatch(ctx, m, ops, atomic, applyClient)
+}
+
+func (m *Memory) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	return memoryBatch(ctx, m, ops, atomic, applyProject)
+}
+
+func memoryBatch[T any](
+	ctx context.Context,
+	m *Memory,
+	ops []Operation[T],
+	atomic bool,
+	apply func(ctx context.Context, adapter Adapter, op Operation[T]) (*T, error),
+) ([]Outcome[T], error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	staged := m.stage()
+	outcomes, ok := applyEach(ctx, staged, ops, atomic, apply)
+	if ok || !atomic {
+		m.commit(staged)
+	}
+	return outcomes, nil
+}
+
+// BatchClients Applies the operations in a single transaction, each one within a savepoint, so a failed one is
+// rolled back alone, unless the batch is atomic.
+func (s *sqlStore) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	return sqlBatch(ctx, s, ops, atomic, s.applyClient)
+}
+
+func (s *sqlStore) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	return sqlBatch(ctx, s, ops, atomic, s.applyProject)
+}
+
+// errBatchFailed Rolls the transaction of the atomic batch back.
+var errBatchFailed = errors.New("batch failed")
+
+func sqlBatch[T any](
+	ctx context.Context,
+	s *sqlStore,
+	ops []Operation[T],
+	atomic bool,
+	apply func(ctx context.Context, tx *sqlx.Tx, op Operation[T]) (*T, error),
+) ([]Outcome[T], error) {
+	outcomes := make([]Outcome[T], len(ops))
+	failed := -1
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		for i, op := range ops {
+			if _, err := tx.ExecContext(ctx, "savepoint batch_op;"); !tools.Try(err) {
+				return err
+			}
+			outcomes[i].Entity, outcomes[i].Err = apply(ctx, tx, op)
+			if outcomes[i].Err == nil {
+				if _, err := tx.ExecContext(ctx, "release savepoint batch_op;"); !tools.Try(err) {
+					return err
+				}
+				continue
+			}
+			if atomic {
+				failed = i
+				return errBatchFailed
+			}
+			if _, err := tx.ExecContext(ctx, "rollback to savepoint batch_op;"); !tools.Try(err) {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "release savepoint batch_op;"); !tools.Try(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if failed >= 0 {
+		return abortBatch(outcomes, failed), nil
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+func (s *sqlStore) applyClient(ctx context.Context, tx *sqlx.Tx, op Operation[Client]) (*Client, error) {
+	switch op.Op {
+	case BatchCreate:
+		if op.Entity == nil {
+			return nil, ErrNilEntity{}
+		}
+		res, err := s.createClient(ctx, tx, op.Entity)
+		return res, s.writeError(err)
+	case BatchUpdate:
+		if op.Entity == nil || op.Entity.ID == nil {
+			return nil, ErrNilEntity{}
+		}
+		if err := s.checkVersion(ctx, tx, "clients", *op.Entity.ID, op.Entity.Version); !tools.Try(err) {
+			return nil, err
+		}
+		res, err := s.replaceClient(ctx, tx, op.Entity)
+		return res, s.writeError(err)
+	case BatchDelete:
+		return nil, s.deleteClient(ctx, tx, op.ID, op.Version)
+	}
+	return nil, errUnknownOp(op.Op)
+}
+
+func (s *sqlStore) applyProject(ctx context.Context, tx *sqlx.Tx, op Operation[Project]) (*Project, error) {
+	switch op.Op {
+	case BatchCreate:
+		if op.Entity == nil {
+			return nil, ErrNilEntity{}
+		}
+		res, err := s.createProject(ctx, tx, op.Entity)
+		return res, s.writeError(err)
+	case BatchUpdate:
+		if op.Entity == nil || op.Entity.ID == nil {
+			return nil, ErrNilEntity{}
+		}
+		if err := s.checkVersion(ctx, tx, "projects", *op.Entity.ID, op.Entity.Version); !tools.Try(err) {
+			return nil, err
+		}
+		res, err := s.replaceProject(ctx, tx, op.Entity)
+		return res, s.writeError(err)
+	case BatchDelete:
+		return nil, s.deleteProject(ctx, tx, op.ID, op.Version)
+	}
+	return nil, errUnknownOp(op.Op)
+}
+
+// writeError Tells the constraint violations of a write apart, other errors are returned as is.
+func (s *sqlStore) writeError(err error) error {
+	var exists ErrAlreadyExists
+	var dangling ErrDanglingReference
+	switch {
+	case err == nil, errors.As(err, &exists), errors.As(err, &dangling):
+		return err
+	case s.dialect.isUniqueViolation(err):
+		return ErrAlreadyExists{err}
+	case s.dialect.isForeignKeyViolation(err):
+		return ErrDanglingReference{err}
+	}
+	return err
+}
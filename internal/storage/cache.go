@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type (
+	// CacheStats Counters of the Cached decorator since it's made.
+	CacheStats struct {
+		Hits   uint64 `json:"hits"`
+		Misses uint64 `json:"misses"`
+		// Evictions Entries dropped to fit the size or expired, invalidations aren't counted.
+		Evictions uint64 `json:"evictions"`
+		Size      int    `json:"size"`
+	}
+
+	// CacheMeter Adapters exposing the counters of their cache.
+	CacheMeter interface {
+		CacheStats() CacheStats
+	}
+
+	// Cached Serves the reads of the decorated adapter from a bounded LRU cache, entries expire after the TTL.
+	// Writes made through the decorator invalidate what they may have changed, the ones made around it, e.g. by
+	// other instances of the server, are seen once the entries expire.
+	Cached struct {
+		Adapter
+		size int
+		ttl  time.Duration
+
+		mu      sync.Mutex
+		entries map[string]*list.Element
+		// lru Most recently used entries go first.
+		lru *list.List
+		// generation Incremented by every invalidation, reads started before it don't store what they've read.
+		generation uint64
+		stats      CacheStats
+	}
+
+	cacheEntry struct {
+		key     string
+		value   interface{}
+		expires time.Time
+	}
+
+	// listing Result of the list calls, the page and whether there are more past it.
+	listing[T any] struct {
+		entities []*T
+		more     bool
+	}
+)
+
+// Cache key prefixes, the entity ones are followed by the ID, the list ones by the query and the page.
+const (
+	cacheClient   = "client/"
+	cacheClients  = "clients?"
+	cacheProject  = "project/"
+	cacheProjects = "projects?"
+)
+
+// NewCached Decorates the adapter with the cache of up to size entries.
+func NewCached(adapter Adapter, size int, ttl time.Duration) (*Cached, error) {
+	if size < 1 || ttl <= 0 {
+		return nil, errors.Errorf("cache size %d and ttl %s must be positive", size, ttl)
+	}
+	return &Cached{
+		Adapter: adapter,
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}, nil
+}
+
+// Unwrap The decorated adapter, the calls the cache has nothing to do with go straight to it.
+func (c *Cached) Unwrap() Adapter {
+	return c.Adapter
+}
+
+func (c *Cached) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := c.stats
+	res.Size = c.lru.Len()
+	return res
+}
+
+func (c *Cached) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	res, err := read(c, cacheClients+listKey(query, page), func() (listing[Client], error) {
+		clients, more, err := c.Adapter.SelectClients(ctx, query, page)
+		return listing[Client]{clients, more}, err
+	}, clonePage(cloneClient))
+	return res.entities, res.more, err
+}
+
+func (c *Cached) GetClient(ctx context.Context, ID int) (*Client, error) {
+	return read(c, fmt.Sprint(cacheClient, ID), func() (*Client, error) {
+		return c.Adapter.GetClient(ctx, ID)
+	}, cloneClient)
+}
+
+func (c *Cached) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	defer c.invalidate(cacheClients)
+	return c.Adapter.CreateClient(ctx, client)
+}
+
+func (c *Cached) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	if client != nil && client.ID != nil {
+		defer c.invalidate(fmt.Sprint(cacheClient, *client.ID), cacheClients)
+	}
+	return c.Adapter.ReplaceClient(ctx, client)
+}
+
+func (c *Cached) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	defer c.invalidate(fmt.Sprint(cacheClient, ID), cacheClients)
+	return c.Adapter.UpdateClient(ctx, ID, update)
+}
+
+// DeleteClient Invalidates every project too, the delete policy may change them.
+func (c *Cached) DeleteClient(ctx context.Context, ID int, version int) error {
+	defer c.invalidate(fmt.Sprint(cacheClient, ID), cacheClients, cacheProject, cacheProjects)
+	return c.Adapter.DeleteClient(ctx, ID, version)
+}
+
+func (c *Cached) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	defer c.invalidate(fmt.Sprint(cacheClient, ID), cacheClients, cacheProject, cacheProjects)
+	return c.Adapter.RestoreClient(ctx, ID)
+}
+
+func (c *Cached) PurgeClient(ctx context.Context, ID int) error {
+	defer c.invalidate(fmt.Sprint(cacheClient, ID), cacheClients, cacheProjects)
+	return c.Adapter.PurgeClient(ctx, ID)
+}
+
+func (c *Cached) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	res, err := read(c, cacheProjects+listKey(query, page), func() (listing[Project], error) {
+		projects, more, err := c.Adapter.SelectProjects(ctx, query, page)
+		return listing[Project]{projects, more}, err
+	}, clonePage(cloneProject))
+	return res.entities, res.more, err
+}
+
+func (c *Cached) GetProject(ctx context.Context, ID int) (*Project, error) {
+	return read(c, fmt.Sprint(cacheProject, ID), func() (*Project, error) {
+		return c.Adapter.GetProject(ctx, ID)
+	}, cloneProject)
+}
+
+func (c *Cached) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	defer c.invalidate(cacheProjects)
+	return c.Adapter.CreateProject(ctx, project)
+}
+
+func (c *Cached) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	if project != nil && project.ID != nil {
+		defer c.invalidate(fmt.Sprint(cacheProject, *project.ID), cacheProjects)
+	}
+	return c.Adapter.ReplaceProject(ctx, project)
+}
+
+func (c *Cached) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	defer c.invalidate(fmt.Sprint(cacheProject, ID), cacheProjects)
+	return c.Adapter.UpdateProject(ctx, ID, update)
+}
+
+func (c *Cached) DeleteProject(ctx context.Context, ID int, version int) error {
+	defer c.invalidate(fmt.Sprint(cacheProject, ID), cacheProjects)
+	return c.Adapter.DeleteProject(ctx, ID, version)
+}
+
+func (c *Cached) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	defer c.invalidate(fmt.Sprint(cacheProject, ID), cacheProjects)
+	return c.Adapter.RestoreProject(ctx, ID)
+}
+
+func (c *Cached) PurgeProject(ctx context.Context, ID int) error {
+	defer c.invalidate(cacheProjects)
+	return c.Adapter.PurgeProject(ctx, ID)
+}
+
+// WithTx Calls of fn bypass the cache, as the transaction may not commit, and every entry is dropped afterwards.
+func (c *Cached) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	defer c.invalidate("")
+	return c.Adapter.WithTx(ctx, fn)
+}
+
+// BatchClients Drops every cached client and project, whatever the batch has applied.
+func (c *Cached) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	defer c.invalidate(cacheClient, cacheClients, cacheProject, cacheProjects)
+	return BatchClients(ctx, c.Adapter, ops, atomic)
+}
+
+func (c *Cached) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	defer c.invalidate(cacheProject, cacheProjects)
+	return BatchProjects(ctx, c.Adapter, ops, atomic)
+}
+
+// LoadClients Passes through to the decorated adapter, dropping the whole cache.
+func (c *Cached) LoadClients(ctx context.Context, clients []*Client, seq int) error {
+	loader, ok := As[Loader](c.Adapter)
+	if !ok {
+		return errors.Errorf("%T can't load backups", c.Adapter)
+	}
+	defer c.invalidate("")
+	return loader.LoadClients(ctx, clients, seq)
+}
+
+func (c *Cached) LoadProjects(ctx context.Context, projects []*Project, seq int) error {
+	loader, ok := As[Loader](c.Adapter)
+	if !ok {
+		return errors.Errorf("%T can't load backups", c.Adapter)
+	}
+	defer c.invalidate("")
+	return loader.LoadProjects(ctx, projects, seq)
+}
+
+// read Returns a copy of the cached value, or loads and caches it. Errors are not cached.
+func read[T any](c *Cached, key string, load func() (T, error), clone func(T) T) (T, error) {
+	value, generation, ok := c.lookup(key)
+	if ok {
+		return clone(value.(T)), nil
+	}
+	res, err := load()
+	if !tools.Try(err) {
+		return res, err
+	}
+	c.store(key, clone(res), generation)
+	return res, nil
+}
+
+// lookup Returns the live entry, or the generation to store the loaded one with.
+func (c *Cached) lookup(key string) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			return entry.value, c.generation, true
+		}
+		c.remove(elem)
+		c.stats.Evictions++
+	}
+	c.stats.Misses++
+	return nil, c.generation, false
+}
+
+// store Caches the value unless there was an invalidation since the generation, evicting the least recently used
+// entries past the size.
+func (c *Cached) store(key string, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidate Drops the entries with any of the key prefixes, an empty one drops everything.
+func (c *Cached) invalidate(prefixes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, elem := range c.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				c.remove(elem)
+				break
+			}
+		}
+	}
+}
+
+func (c *Cached) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// listKey Renders the query and the page unambiguously.
+func listKey(query Query, page Page) string {
+	b := &strings.Builder{}
+	writeNode(b, query.Filter)
+	for _, key := range query.Sort {
+		fmt.Fprintf(b, ";%s:%t", key.Field.Name, key.Desc)
+	}
+	fmt.Fprintf(b, ";trash:%t;limit:%d;after:%#v;before:%#v", query.Trash, page.Limit, page.After, page.Before)
+	return b.String()
+}
+
+func writeNode(b *strings.Builder, node Node) {
+	var nodes []Node
+	switch n := node.(type) {
+	case And:
+		b.WriteString("and(")
+		nodes = n.Nodes
+	case Or:
+		b.WriteString("or(")
+		nodes = n.Nodes
+	case Comparison:
+		fmt.Fprintf(b, "%s%s%#v", n.Field.Name, n.Op, n.Values)
+		return
+	default:
+		return
+	}
+	for i, child := range nodes {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeNode(b, child)
+	}
+	b.WriteByte(')')
+}
+
+// cloneClient Copies the client, so the callers can't change the cached one.
+func cloneClient(client *Client) *Client {
+	if client == nil {
+		return nil
+	}
+	res := *client
+	res.ID = clonePtr(client.ID)
+	res.DeletedAt = clonePtr(client.DeletedAt)
+	return &res
+}
+
+func cloneProject(project *Project) *Project {
+	if project == nil {
+		return nil
+	}
+	res := *project
+	res.ID = clonePtr(project.ID)
+	res.ClientID = clonePtr(project.ClientID)
+	res.DeletedAt = clonePtr(project.DeletedAt)
+	return &res
+}
+
+func clonePage[T any](clone func(*T) *T) func(listing[T]) listing[T] {
+	return func(page listing[T]) listing[T] {
+		res := listing[T]{entities: make([]*T, len(page.entities)), more: page.more}
+		for i, entity := range page.entities {
+			res.entities[i] = clone(entity)
+		}
+		return res
+	}
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	memory := &Memory{}
+	require.NoError(t, memory.Init(ctx, &config.Storage{ClientDeletePolicy: string(DeleteCascade)}))
+	db, err := NewCached(memory, 3, 50*time.Millisecond)
+	require.NoError(t, err)
+	for _, name := range []string{"Apple", "Meta", "Google"} {
+		_, err = db.CreateClient(ctx, &Client{Name: name})
+		require.NoError(t, err)
+	}
+	_, err = db.CreateProject(ctx, &Project{ClientID: tools.IntPtr(1), Name: "iPhone"})
+	require.NoError(t, err)
+
+	client, err := db.GetClient(ctx, 1)
+	require.NoError(t, err)
+	client.Name = "changed by the caller"
+	client, err = db.GetClient(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Apple", client.Name, "cached entity is a copy")
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Size: 1}, db.CacheStats())
+
+	clients, _, err := db.SelectClients(ctx, Query{}, Page{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	_, err = db.UpdateClient(ctx, 1, func(client *Client) error {
+		client.Name = "Apple Inc."
+		return nil
+	})
+	require.NoError(t, err)
+	client, err = db.GetClient(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Apple Inc.", client.Name, "writes through the cache invalidate it")
+	clients, _, err = db.SelectClients(ctx, Query{}, Page{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "Apple Inc.", clients[0].Name, "lists too")
+
+	_, err = db.GetProject(ctx, 1)
+	require.NoError(t, err)
+	require.NoError(t, db.DeleteClient(ctx, 1, 0))
+	_, err = db.GetProject(ctx, 1)
+	assert.IsType(t, ErrNotFound{}, err, "projects trashed by the delete policy are invalidated")
+
+	for _, ID := range []int{3, 2} {
+		_, err = db.GetClient(ctx, ID)
+		require.NoError(t, err)
+	}
+	_, err = memory.UpdateClient(ctx, 2, func(client *Client) error {
+		client.Name = "Meta Platforms"
+		return nil
+	})
+	require.NoError(t, err)
+	client, err = db.GetClient(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Meta", client.Name, "writes around the cache are not seen until the entry expires")
+	time.Sleep(60 * time.Millisecond)
+	client, err = db.GetClient(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Meta Platforms", client.Name)
+
+	stats := db.CacheStats()
+	assert.LessOrEqual(t, stats.Size, 3, "bounded")
+	assert.Positive(t, stats.Evictions)
+}
+
+func TestCachedSkipsStaleStore(t *testing.T) {
+	db, err := NewCached(&Memory{}, 10, time.Minute)
+	require.NoError(t, err)
+	_, generation, ok := db.lookup("client/1")
+	require.False(t, ok)
+	db.invalidate("client/1")
+	db.store("client/1", &Client{Name: "read before the write"}, generation)
+	_, _, ok = db.lookup("client/1")
+	assert.False(t, ok, "value read before the invalidation is not stored")
+
+	_, err = NewCached(&Memory{}, 0, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestAsDecorated(t *testing.T) {
+	ctx := context.Background()
+	memory := &Memory{}
+	require.NoError(t, memory.Init(ctx, &config.Storage{ClientDeletePolicy: string(DeleteCascade)}))
+	resilient := NewResilient(memory, &config.Storage{RetryAttempts: 2})
+	db, err := NewCached(resilient, 3, time.Minute)
+	require.NoError(t, err)
+
+	meter, ok := As[CacheMeter](db)
+	require.True(t, ok)
+	assert.Same(t, db, meter)
+	breaker, ok := As[CircuitBreaker](db)
+	require.True(t, ok, "found in the decorated adapter")
+	assert.Same(t, resilient, breaker)
+	loader, ok := As[Loader](db)
+	require.True(t, ok)
+	assert.Same(t, db, loader, "the outermost one goes first")
+	_, ok = As[CacheMeter](resilient)
+	assert.False(t, ok, "decorators are not looked up from the inside")
+}
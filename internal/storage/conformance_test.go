@@ -0,0 +1,131 @@
+package storage_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/internal/storage/storagetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	suite.Run(t, &storagetest.Suite{New: func(t *testing.T) storage.Adapter {
+		db, err := storage.New(context.Background(), &config.Storage{Type: "memory", Migrate: "auto"})
+		require.NoError(t, err)
+		return db
+	}})
+}
+
+// TestDecoratedConformance Runs against the adapter with every decorator on.
+func TestDecoratedConformance(t *testing.T) {
+	suite.Run(t, &storagetest.Suite{New: func(t *testing.T) storage.Adapter {
+		db, err := storage.New(context.Background(), &config.Storage{
+			Type:             "sqlite",
+			Addr:             filepath.Join(t.TempDir(), "db.sqlite"),
+			Migrate:          "auto",
+			Audit:            true,
+			Outbox:           true,
+			CacheSize:        4,
+			CacheTTL:         time.Minute,
+			RetryAttempts:    3,
+			RetryBackoff:     time.Millisecond,
+			BreakerThreshold: 5,
+			BreakerCooldown:  time.Second,
+			MaxConcurrent:    4,
+			QueueTimeout:     time.Second,
+		})
+		require.NoError(t, err)
+		require.NoError(t, storagetest.Clear(context.Background(), db), "populated by migrations")
+		return db
+	}})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	suite.Run(t, &storagetest.Suite{New: func(t *testing.T) storage.Adapter {
+		db, err := storage.New(context.Background(), &config.Storage{
+			Type:    "sqlite",
+			Addr:    filepath.Join(t.TempDir(), "db.sqlite"),
+			Migrate: "auto",
+		})
+		require.NoError(t, err)
+		require.NoError(t, storagetest.Clear(context.Background(), db), "populated by migrations")
+		return db
+	}})
+}
+
+// TestPostgresConformance Runs against POSTGRES_TEST_ADDR, its public schema gets dropped and migrated again for every test.
+func TestPostgresConformance(t *testing.T) {
+	dsn, ok := os.LookupEnv("POSTGRES_TEST_ADDR")
+	if !ok {
+		t.Skip("POSTGRES_TEST_ADDR is not set")
+	}
+	suite.Run(t, &storagetest.Suite{New: func(t *testing.T) storage.Adapter {
+		ctx := context.Background()
+		conn, err := sqlx.ConnectContext(ctx, "postgres", dsn)
+		require.NoError(t, err)
+		_, err = conn.ExecContext(ctx, "drop schema public cascade; create schema public;")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		db, err := storage.New(ctx, &config.Storage{Type: "postgres", Addr: dsn, Migrate: "auto"})
+		require.NoError(t, err)
+		require.NoError(t, storagetest.Clear(ctx, db), "populated by migrations")
+		return db
+	}})
+}
+
+// TestMongoDBConformance Runs against MONGODB_TEST_ADDR, or a mongod on the default port if there is one.
+func TestMongoDBConformance(t *testing.T) {
+	mongoConformance(t, config.Storage{Type: "mongodb", Migrate: "auto"})
+}
+
+// TestMongoDBDecoratedConformance Runs against MongoDB with the decorators writing in its transactions on.
+func TestMongoDBDecoratedConformance(t *testing.T) {
+	mongoConformance(t, config.Storage{Type: "mongodb", Migrate: "auto", Audit: true, Outbox: true})
+}
+
+// mongoConformance Every test gets its own database, dropped afterwards.
+func mongoConformance(t *testing.T, cfg config.Storage) {
+	addr, ok := os.LookupEnv("MONGODB_TEST_ADDR")
+	if !ok {
+		conn, err := net.DialTimeout("tcp", "localhost:27017", 200*time.Millisecond)
+		if err != nil {
+			t.Skip("MONGODB_TEST_ADDR is not set and there is no local mongod")
+		}
+		_ = conn.Close()
+		addr = "mongodb://localhost:27017"
+	}
+	var seq int64
+	conformance := &storagetest.Suite{}
+	conformance.New = func(t *testing.T) storage.Adapter {
+		ctx := context.Background()
+		database := "mend_test_" + strconv.FormatInt(time.Now().UnixNano(), 36) + "_" + strconv.FormatInt(atomic.AddInt64(&seq, 1), 10)
+		cfg := cfg
+		cfg.Addr = addr + "/" + database
+		db, err := storage.New(ctx, &cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			client, err := mongo.Connect(ctx, options.Client().ApplyURI(addr))
+			require.NoError(t, err)
+			defer func() { _ = client.Disconnect(ctx) }()
+			require.NoError(t, client.Database(database).Drop(ctx))
+		})
+		mongoDB, _ := storage.As[*storage.MongoDB](db)
+		conformance.NoTransactions = !mongoDB.Transactional()
+		return db
+	}
+	suite.Run(t, conformance)
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	// CopyExtra The entity is only in the target, it's left as is.
+	CopyExtra = "extra"
+	// CopySequence The sequence of the entity table is moved up to the ID.
+	CopySequence = "sequence"
+
+	defaultCopyBatch = 500
+)
+
+type (
+	// Sequencer Adapters exposing the ID sequences of the clients and projects tables (collections),
+	// so the data copied between them keeps allocating the same IDs.
+	Sequencer interface {
+		// Sequence Returns the last ID allocated for the table, 0 if none.
+		Sequence(ctx context.Context, table string) (int, error)
+		// AdvanceSequence Moves the sequence of the table up to the ID, never back.
+		AdvanceSequence(ctx context.Context, table string, ID int) error
+	}
+
+	// Copier Copies every client and project, trashed ones included, from one adapter to another with the same IDs.
+	// Entities the target has already are replaced if they differ, so a copy may be repeated or resumed from
+	// the Checkpoint. Versions start over and trashed entities get new deletion times in the target.
+	Copier struct {
+		From, To Adapter
+		// BatchSize Entities read at once, the checkpoint is saved after every batch.
+		BatchSize int
+		// DryRun Reports the changes without making them.
+		DryRun bool
+		// Report Receives every change, as it's made or would be made on a dry run.
+		Report func(change Change)
+		// Checkpoint The last IDs copied by every stage, to resume from.
+		Checkpoint Checkpoint
+		// Save Stores the checkpoint after every batch, if set.
+		Save func(checkpoint Checkpoint) error
+	}
+
+	// Checkpoint The last ID of every copy stage.
+	Checkpoint map[string]int
+
+	// Change The write of the copy, Operation is one of AuditCreate, AuditReplace, AuditRestore, AuditDelete,
+	// CopyExtra or CopySequence.
+	Change struct {
+		Operation string
+		// Entity Either AuditClient or AuditProject.
+		Entity string
+		ID     int
+		Diff   Diff
+	}
+
+	// entityOps Adapter calls of the entity being copied or backed up.
+	entityOps[T any] struct {
+		entity  string
+		schema  *Schema
+		id      func(entity *T) int
+		trashed func(entity *T) bool
+		// check Tells what's wrong with the entity to be loaded as is, if anything.
+		check func(entity *T) error
+		// normalize Returns the copy of the entity with only the copied fields.
+		normalize func(entity *T) *T
+		page      func(db Adapter) func(ctx context.Context, query Query, page Page) ([]*T, bool, error)
+		get       func(db Adapter) func(ctx context.Context, ID int) (*T, error)
+		create    func(db Adapter) func(ctx context.Context, entity *T) (*T, error)
+		replace   func(db Adapter) func(ctx context.Context, entity *T) (*T, error)
+		restore   func(db Adapter) func(ctx context.Context, ID int) (*T, error)
+		delete    func(db Adapter) func(ctx context.Context, ID int, version int) error
+	}
+)
+
+var (
+	clientOps = entityOps[Client]{
+		entity:  AuditClient,
+		schema:  ClientSchema,
+		id:      func(client *Client) int { return *client.ID },
+		trashed: func(client *Client) bool { return client.DeletedAt != nil },
+		check: func(client *Client) error {
+			return checkLoaded(client.ID, client.Version)
+		},
+		normalize: func(client *Client) *Client {
+			res := copyClient(*client)
+			res.Version, res.DeletedAt = 0, nil
+			return res
+		},
+		page:    func(db Adapter) func(context.Context, Query, Page) ([]*Client, bool, error) { return db.SelectClients },
+		get:     func(db Adapter) func(context.Context, int) (*Client, error) { return db.GetClient },
+		create:  func(db Adapter) func(context.Context, *Client) (*Client, error) { return db.CreateClient },
+		replace: func(db Adapter) func(context.Context, *Client) (*Client, error) { return db.ReplaceClient },
+		restore: func(db Adapter) func(context.Context, int) (*Client, error) { return db.RestoreClient },
+		delete:  func(db Adapter) func(context.Context, int, int) error { return db.DeleteClient },
+	}
+	projectOps = entityOps[Project]{
+		entity:  AuditProject,
+		schema:  ProjectSchema,
+		id:      func(project *Project) int { return *project.ID },
+		trashed: func(project *Project) bool { return project.DeletedAt != nil },
+		check: func(project *Project) error {
+			return checkLoaded(project.ID, project.Version)
+		},
+		normalize: func(project *Project) *Project {
+			res := copyProject(*project)
+			res.Version, res.DeletedAt = 0, nil
+			return res
+		},
+		page: func(db Adapter) func(context.Context, Query, Page) ([]*Project, bool, error) {
+			return db.SelectProjects
+		},
+		get:     func(db Adapter) func(context.Context, int) (*Project, error) { return db.GetProject },
+		create:  func(db Adapter) func(context.Context, *Project) (*Project, error) { return db.CreateProject },
+		replace: func(db Adapter) func(context.Context, *Project) (*Project, error) { return db.ReplaceProject },
+		restore: func(db Adapter) func(context.Context, int) (*Project, error) { return db.RestoreProject },
+		delete:  func(db Adapter) func(context.Context, int, int) error { return db.DeleteProject },
+	}
+)
+
+// Run Copies the clients first, then the projects, so the references hold. Clients trashed in the source get
+// trashed in the target last, once their projects are there, and the sequences follow. Entities only the target has
+// are reported in the end.
+func (c *Copier) Run(ctx context.Context) error {
+	if c.Checkpoint == nil {
+		c.Checkpoint = Checkpoint{}
+	}
+	stages := []struct {
+		name string
+		run  func(ctx context.Context, stage string) error
+	}{
+		{"clients", func(ctx context.Context, stage string) error {
+			return copyStage(ctx, c, stage, clientOps, c.From, false, func(client *Client) error {
+				return copyEntity(ctx, c, clientOps, client, false)
+			})
+		}},
+		{"trashed clients", func(ctx context.Context, stage string) error {
+			return copyStage(ctx, c, stage, clientOps, c.From, true, func(client *Client) error {
+				return copyEntity(ctx, c, clientOps, client, false)
+			})
+		}},
+		{"projects", func(ctx context.Context, stage string) error {
+			return copyStage(ctx, c, stage, projectOps, c.From, false, func(project *Project) error {
+				return copyEntity(ctx, c, projectOps, project, true)
+			})
+		}},
+		{"trashed projects", func(ctx context.Context, stage string) error {
+			return copyStage(ctx, c, stage, projectOps, c.From, true, func(project *Project) error {
+				return copyEntity(ctx, c, projectOps, project, true)
+			})
+		}},
+		{"trashing clients", func(ctx context.Context, stage string) error {
+			if c.DryRun {
+				return nil // reported along with the trashed clients
+			}
+			return copyStage(ctx, c, stage, clientOps, c.From, true, func(client *Client) error {
+				err := c.To.DeleteClient(ctx, *client.ID, 0)
+				if !tools.Try(err) && fault.KindOf(err) == fault.NotFound {
+					return nil // trashed by the previous run
+				}
+				return err
+			})
+		}},
+		{"sequences", func(ctx context.Context, _ string) error {
+			return c.copySequences(ctx)
+		}},
+		{"extra clients", func(ctx context.Context, stage string) error {
+			return reportExtras(ctx, c, stage, clientOps)
+		}},
+		{"extra projects", func(ctx context.Context, stage string) error {
+			return reportExtras(ctx, c, stage, projectOps)
+		}},
+	}
+	for _, stage := range stages {
+		if err := stage.run(ctx, stage.name); !tools.Try(err) {
+			return errors.Wrap(err, stage.name)
+		}
+	}
+	return nil
+}
+
+// copySequences Moves the target sequences up to the source ones, which may be past every ID left.
+func (c *Copier) copySequences(ctx context.Context) error {
+	from, ok := As[Sequencer](c.From)
+	if !ok {
+		return nil
+	}
+	to, ok := As[Sequencer](c.To)
+	if !ok {
+		return nil
+	}
+	for _, table := range []struct{ name, entity string }{{"clients", AuditClient}, {"projects", AuditProject}} {
+		seq, err := from.Sequence(ctx, table.name)
+		if !tools.Try(err) {
+			return err
+		}
+		current, err := to.Sequence(ctx, table.name)
+		if !tools.Try(err) {
+			return err
+		}
+		if seq <= current {
+			continue
+		}
+		c.report(Change{Operation: CopySequence, Entity: table.entity, ID: seq})
+		if c.DryRun {
+			continue
+		}
+		if err = to.AdvanceSequence(ctx, table.name, seq); !tools.Try(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Copier) report(change Change) {
+	if c.Report != nil {
+		c.Report(change)
+	}
+}
+
+// copyStage Passes every live or trashed entity of the adapter past the stage checkpoint to fn, batch by batch.
+func copyStage[T any](
+	ctx context.Context, c *Copier, stage string, ops entityOps[T], db Adapter, trash bool, fn func(entity *T) error,
+) error {
+	limit := c.BatchSize
+	if limit <= 0 {
+		limit = defaultCopyBatch
+	}
+	for {
+		page := Page{Limit: limit}
+		if last, ok := c.Checkpoint[stage]; ok {
+			page.After = Keyset{int64(last)}
+		}
+		entities, more, err := ops.page(db)(ctx, Query{Trash: trash}, page)
+		if !tools.Try(err) {
+			return err
+		}
+		for _, entity := range entities {
+			if err = fn(entity); !tools.Try(err) {
+				return errors.Wrapf(err, "%s %d", ops.entity, ops.id(entity))
+			}
+		}
+		if len(entities) > 0 {
+			c.Checkpoint[stage] = ops.id(entities[len(entities)-1])
+			if c.Save != nil && !c.DryRun {
+				if err = c.Save(c.Checkpoint); !tools.Try(err) {
+					return errors.Wrap(err, "checkpoint")
+				}
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// copyEntity Brings the target entity to the source state. Entities trashed in both are left as is.
+func copyEntity[T any](ctx context.Context, c *Copier, ops entityOps[T], src *T, trashNow bool) error {
+	ID := ops.id(src)
+	dst, trashed, err := lookup(ctx, ops, c.To, ID)
+	if !tools.Try(err) {
+		return err
+	}
+	switch {
+	case dst == nil:
+		diff, err := diffOf(nil, ops.normalize(src))
+		if !tools.Try(err) {
+			return err
+		}
+		c.report(Change{Operation: AuditCreate, Entity: ops.entity, ID: ID, Diff: diff})
+		if !c.DryRun {
+			if _, err = ops.create(c.To)(ctx, ops.normalize(src)); !tools.Try(err) {
+				return err
+			}
+		}
+	case trashed && ops.trashed(src):
+		return nil
+	default:
+		if trashed {
+			c.report(Change{Operation: AuditRestore, Entity: ops.entity, ID: ID})
+			if !c.DryRun {
+				if _, err = ops.restore(c.To)(ctx, ID); !tools.Try(err) {
+					return err
+				}
+			}
+		}
+		diff, err := diffOf(ops.normalize(dst), ops.normalize(src))
+		if !tools.Try(err) {
+			return err
+		}
+		if len(diff) > 0 {
+			c.report(Change{Operation: AuditReplace, Entity: ops.entity, ID: ID, Diff: diff})
+			if !c.DryRun {
+				if _, err = ops.replace(c.To)(ctx, ops.normalize(src)); !tools.Try(err) {
+					return err
+				}
+			}
+		}
+	}
+	if !ops.trashed(src) {
+		return nil
+	}
+	c.report(Change{Operation: AuditDelete, Entity: ops.entity, ID: ID})
+	if trashNow && !c.DryRun {
+		return ops.delete(c.To)(ctx, ID, 0)
+	}
+	return nil
+}
+
+// reportExtras Reports the entities of the target the source has neither live nor trashed.
+func reportExtras[T any](ctx context.Context, c *Copier, stage string, ops entityOps[T]) error {
+	for _, trash := range []bool{false, true} {
+		err := copyStage(ctx, c, stage+trashStage(trash), ops, c.To, trash, func(entity *T) error {
+			src, _, err := lookup(ctx, ops, c.From, ops.id(entity))
+			if !tools.Try(err) || src != nil {
+				return err
+			}
+			c.report(Change{Operation: CopyExtra, Entity: ops.entity, ID: ops.id(entity)})
+			return nil
+		})
+		if !tools.Try(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func trashStage(trash bool) string {
+	if trash {
+		return " in trash"
+	}
+	return ""
+}
+
+// lookup Finds the entity either live or in the trash, nil if it's not there at all.
+func lookup[T any](ctx context.Context, ops entityOps[T], db Adapter, ID int) (*T, bool, error) {
+	entity, err := ops.get(db)(ctx, ID)
+	if tools.Try(err) {
+		return entity, false, nil
+	}
+	if fault.KindOf(err) != fault.NotFound {
+		return nil, false, err
+	}
+	byID, _ := ops.schema.Compare("id", OpEq, ID)
+	trashed, _, err := ops.page(db)(ctx, Query{Filter: byID, Trash: true}, Page{Limit: 1})
+	if !tools.Try(err) || len(trashed) == 0 {
+		return nil, false, err
+	}
+	return trashed[0], true, nil
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+func TestCopier(t *testing.T) {
+	ctx := context.Background()
+	from := &Memory{}
+	require.NoError(t, from.Init(ctx, &config.Storage{ClientDeletePolicy: string(DeleteCascade)}))
+	for _, client := range []*Client{{ID: tools.IntPtr(2), Name: "Apple"}, {ID: tools.IntPtr(5), Name: "Meta"}} {
+		_, err := from.CreateClient(ctx, client)
+		require.NoError(t, err)
+	}
+	for _, project := range []*Project{
+		{ID: tools.IntPtr(1), ClientID: tools.IntPtr(2), Name: "iPhone"},
+		{ID: tools.IntPtr(3), ClientID: tools.IntPtr(5), Name: "Oculus"},
+		{ID: tools.IntPtr(4), Name: "orphan"},
+	} {
+		_, err := from.CreateProject(ctx, project)
+		require.NoError(t, err)
+	}
+	_, err := from.CreateClient(ctx, &Client{ID: tools.IntPtr(9), Name: "purged"})
+	require.NoError(t, err)
+	require.NoError(t, from.DeleteClient(ctx, 9, 0))
+	require.NoError(t, from.PurgeClient(ctx, 9))
+	require.NoError(t, from.DeleteClient(ctx, 5, 0))
+
+	to := &SQLite{}
+	require.NoError(t, to.Init(ctx, &config.Storage{Addr: filepath.Join(t.TempDir(), "db.sqlite")}))
+	require.NoError(t, to.Migrate(ctx, MigrateAuto))
+	_, err = to.conn.Exec("delete from projects; delete from clients;") // fixtures of the migrations
+	require.NoError(t, err)
+
+	var planned []Change
+	dryRun := &Copier{From: from, To: to, DryRun: true, Report: func(change Change) { planned = append(planned, change) }}
+	require.NoError(t, dryRun.Run(ctx))
+	_, err = to.GetClient(ctx, 2)
+	assert.IsType(t, ErrNotFound{}, err, "dry run writes nothing")
+
+	failing := &Copier{From: from, To: to, BatchSize: 1, Save: func(checkpoint Checkpoint) error {
+		if checkpoint["projects"] == 1 {
+			return errors.New("interrupted")
+		}
+		return nil
+	}}
+	require.Error(t, failing.Run(ctx))
+	var made []Change
+	resumed := &Copier{From: from, To: to, BatchSize: 1, Checkpoint: failing.Checkpoint, Report: func(change Change) {
+		made = append(made, change)
+	}}
+	require.NoError(t, resumed.Run(ctx))
+	assert.Equal(t, Change{Operation: AuditCreate, Entity: AuditProject, ID: 4, Diff: Diff{
+		{Field: "id", After: int64(4)},
+		{Field: "name", After: "orphan"},
+	}}, made[0], "resumed past the checkpoint")
+	assert.Subset(t, planned, made)
+
+	client, err := to.GetClient(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Apple", client.Name)
+	trash, _, err := to.SelectProjects(ctx, Query{Trash: true}, Page{})
+	require.NoError(t, err)
+	require.Len(t, trash, 1)
+	assert.Equal(t, 3, *trash[0].ID)
+	restored, err := to.RestoreClient(ctx, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "Meta", restored.Name)
+	created, err := to.CreateClient(ctx, &Client{Name: "next"})
+	require.NoError(t, err)
+	assert.Equal(t, 10, *created.ID, "sequence follows the source")
+
+	var again []Change
+	require.NoError(t, (&Copier{From: from, To: to, Report: func(change Change) { again = append(again, change) }}).Run(ctx))
+	assert.Equal(t, []Change{
+		{Operation: AuditDelete, Entity: AuditClient, ID: 5},
+		{Operation: CopyExtra, Entity: AuditClient, ID: 10},
+	}, again, "repeated copy only trashes the restored client again")
+}
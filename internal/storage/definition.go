@@ -4,35 +4,93 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
 	"github.com/iamwavecut/ct-mend/tools"
 )
 
+const (
+	// DeleteRestrict Refuse to delete a client while there are projects of it.
+	DeleteRestrict DeletePolicy = "restrict"
+	// DeleteCascade Trash projects along with the client.
+	DeleteCascade DeletePolicy = "cascade"
+	// DeleteNullify Keep projects of the deleted client, but unset their client_id.
+	DeleteNullify DeletePolicy = "nullify"
+)
+
 const (
 	TypeSQLite Type = iota + 1
 	TypeMongoDB
+	TypeMemory
+	TypePostgres
 )
 
 type (
 	Type int
 
+	// DeletePolicy What happens to the projects of a client being deleted.
+	DeletePolicy string
+
 	Adapter interface {
-		Init(ctx context.Context, connAddr string) error
+		Init(ctx context.Context, cfg *config.Storage) error
+		// Ping Checks the connection to the database.
+		Ping(ctx context.Context) error
+		// Close Releases the connections, the adapter is not usable afterwards.
+		Close(ctx context.Context) error
+		// WithTx Runs fn with the adapter making its calls in a single transaction, committed if fn returns nil and
+		// rolled back otherwise, the error of fn is returned as is. Within fn the calls go through tx only, as the
+		// transaction may hold the locks the other calls wait for. Nested WithTx calls of tx join the transaction.
+		WithTx(ctx context.Context, fn func(tx Adapter) error) error
 
-		SelectClients() ([]*Client, error)
-		GetClient(id int) (*Client, error)
-		UpsertClient(client *Client) (*Client, error)
-		DeleteClient(id int) error
+		// SelectClients Returns the page of the clients matching the query, and whether there are more past it in the page direction.
+		SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error)
+		// GetClient Trashed clients are not found, as well as by every other call but the trash related ones.
+		GetClient(ctx context.Context, id int) (*Client, error)
+		// CreateClient Allocates the ID unless given, fails with ErrAlreadyExists if it's taken.
+		CreateClient(ctx context.Context, client *Client) (*Client, error)
+		// ReplaceClient Overwrites the existing client, fails with ErrNotFound if there is none.
+		// Non-zero Version of the client must match the stored one, ErrVersionMismatch otherwise.
+		ReplaceClient(ctx context.Context, client *Client) (*Client, error)
+		// UpdateClient Applies changes to the current state of the client atomically.
+		UpdateClient(ctx context.Context, id int, update func(client *Client) error) (*Client, error)
+		// DeleteClient Moves the client to the trash, non-zero version must match the stored one, ErrVersionMismatch otherwise.
+		DeleteClient(ctx context.Context, id int, version int) error
+		// RestoreClient Brings the trashed client back, along with the projects the delete policy has trashed with it.
+		RestoreClient(ctx context.Context, id int) (*Client, error)
+		// PurgeClient Deletes the trashed client permanently, along with its trashed projects.
+		PurgeClient(ctx context.Context, id int) error
+
+		SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error)
+		GetProject(ctx context.Context, id int) (*Project, error)
+		CreateProject(ctx context.Context, project *Project) (*Project, error)
+		ReplaceProject(ctx context.Context, project *Project) (*Project, error)
+		UpdateProject(ctx context.Context, id int, update func(project *Project) error) (*Project, error)
+		DeleteProject(ctx context.Context, id int, version int) error
+		// RestoreProject Fails with ErrDanglingReference while the client of the project is trashed.
+		RestoreProject(ctx context.Context, id int) (*Project, error)
+		PurgeProject(ctx context.Context, id int) error
+	}
+
+	// Decorator Adapters adding to the calls of the adapter they decorate. Calls of the optional interfaces the
+	// decorator leaves as they are go straight to the decorated adapter, see As.
+	Decorator interface {
+		Unwrap() Adapter
+	}
 
-		SelectProjects() ([]*Project, error)
-		GetProject(id int) (*Project, error)
-		SelectProjectsOfClient(id int) ([]*Project, error)
-		UpsertProject(project *Project) (*Project, error)
-		DeleteProject(id int) error
+	// Page Keyset pagination window in the query order, zero values mean no bounds.
+	Page struct {
+		// Limit Max number of entities.
+		Limit int
+		// After Entities past this keyset only.
+		After Keyset
+		// Before Entities ahead of this keyset only. Unless After is set too, the ones right before it are taken.
+		Before Keyset
 	}
 
 	ErrNotFound struct {
@@ -41,6 +99,27 @@ type (
 	ErrNilEntity struct {
 		cause error
 	}
+	// ErrAlreadyExists Entity with the same ID is there already.
+	ErrAlreadyExists struct {
+		cause error
+	}
+	// ErrDanglingReference Entity refers to another one, which does not exist.
+	ErrDanglingReference struct {
+		cause error
+	}
+	// ErrReferenced Entity can't be deleted while others refer to it.
+	ErrReferenced struct {
+		cause error
+	}
+	// ErrVersionMismatch Entity has changed since the expected version.
+	ErrVersionMismatch struct {
+		cause error
+	}
+	// ErrUnavailable Storage is down or overloaded, the call may succeed after a while.
+	ErrUnavailable struct {
+		cause      error
+		retryAfter time.Duration
+	}
 )
 
 func (e ErrNotFound) Error() string {
@@ -59,7 +138,204 @@ func (e ErrNilEntity) Error() string {
 	return msg
 }
 
+func (e ErrAlreadyExists) Error() string {
+	msg := "already exists"
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e ErrDanglingReference) Error() string {
+	msg := "dangling reference"
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e ErrReferenced) Error() string {
+	msg := "entity is referenced"
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e ErrVersionMismatch) Error() string {
+	msg := "version mismatch"
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e ErrUnavailable) Error() string {
+	msg := "storage unavailable"
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e ErrNotFound) Kind() fault.Kind {
+	return fault.NotFound
+}
+
+func (e ErrNilEntity) Kind() fault.Kind {
+	return fault.Validation
+}
+
+func (e ErrAlreadyExists) Kind() fault.Kind {
+	return fault.Conflict
+}
+
+func (e ErrDanglingReference) Kind() fault.Kind {
+	return fault.Validation
+}
+
+func (e ErrReferenced) Kind() fault.Kind {
+	return fault.Conflict
+}
+
+func (e ErrVersionMismatch) Kind() fault.Kind {
+	return fault.Precondition
+}
+
+func (e ErrUnavailable) Kind() fault.Kind {
+	return fault.Unavailable
+}
+
+// RetryAfter Zero if it's unknown.
+func (e ErrUnavailable) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+func (e ErrNotFound) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrNilEntity) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrAlreadyExists) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrDanglingReference) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrReferenced) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrVersionMismatch) Unwrap() error {
+	return e.cause
+}
+
+func (e ErrUnavailable) Unwrap() error {
+	return e.cause
+}
+
+// Backward Tells if the page is taken from its upper bound.
+func (p Page) Backward() bool {
+	return p.Before != nil && p.After == nil
+}
+
+// window Trims entities, selected in the page direction with one extra to peek past the limit, and puts them in the query order.
+func window[T any](entities []T, page Page) ([]T, bool) {
+	more := page.Limit > 0 && len(entities) > page.Limit
+	if more {
+		entities = entities[:page.Limit]
+	}
+	if page.Backward() {
+		for i, j := 0, len(entities)-1; i < j; i, j = i+1, j-1 {
+			entities[i], entities[j] = entities[j], entities[i]
+		}
+	}
+	return entities, more
+}
+
+// lastTombstone Time of the latest deletion, see tombstone.
+var lastTombstone struct {
+	sync.Mutex
+	t time.Time
+}
+
+// errIDChanged Updates must keep the entity ID intact.
+var errIDChanged = fault.New(fault.Validation, "entity id can't be changed")
+
+// CheckVersion Compares the stored version with the expected one, unless that's zero.
+func CheckVersion(stored, expected int) error {
+	if expected == 0 || stored == expected {
+		return nil
+	}
+	return ErrVersionMismatch{errors.Errorf("version is %d, not %d", stored, expected)}
+}
+
+// tombstone Time of the deletion, truncated to the precision every backend keeps, so it may be compared as stored.
+// It's strictly increasing within the process, so entities trashed separately don't pass for trashed together.
+func tombstone() time.Time {
+	lastTombstone.Lock()
+	defer lastTombstone.Unlock()
+	t := time.Now().UTC().Truncate(time.Millisecond)
+	if !t.After(lastTombstone.t) {
+		t = lastTombstone.t.Add(time.Millisecond)
+	}
+	lastTombstone.t = t
+	return t
+}
+
+func ParseDeletePolicy(policy string) (DeletePolicy, error) {
+	switch p := DeletePolicy(policy); p {
+	case "":
+		return DeleteRestrict, nil
+	case DeleteRestrict, DeleteCascade, DeleteNullify:
+		return p, nil
+	}
+	return "", errors.New("unrecognized delete policy " + policy)
+}
+
+// New Opens the storage and brings its schema up to date, see MIGRATE.
 func New(ctx context.Context, cfg *config.Storage) (Adapter, error) {
+	if cfg == nil {
+		return nil, errors.New("no storage config provided")
+	}
+	mode, err := ParseMigrateMode(cfg.Migrate)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	adapter, err := Open(ctx, cfg)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if err = Migrate(ctx, adapter, mode); !tools.Try(err) {
+		_ = adapter.Close(ctx)
+		return nil, errors.Wrap(err, "migrate")
+	}
+	return adapter, nil
+}
+
+// As Finds the optional interface of the adapter, or of the decorated ones, the outermost first.
+func As[T any](adapter Adapter) (T, bool) {
+	for adapter != nil {
+		if res, ok := adapter.(T); ok {
+			return res, true
+		}
+		decorator, ok := adapter.(Decorator)
+		if !ok {
+			break
+		}
+		adapter = decorator.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// Open Connects the storage and decorates it as configured, leaving the schema as is.
+func Open(ctx context.Context, cfg *config.Storage) (Adapter, error) {
 	if cfg == nil {
 		return nil, errors.New("no storage config provided")
 	}
@@ -73,20 +349,45 @@ func New(ctx context.Context, cfg *config.Storage) (Adapter, error) {
 		adapter = &SQLite{}
 	case sType == TypeMongoDB:
 		adapter = &MongoDB{}
+	case sType == TypeMemory:
+		adapter = &Memory{}
+	case sType == TypePostgres:
+		adapter = &Postgres{}
 	default:
 		return nil, errors.New("unknown storage type " + cfg.Type)
 	}
-	err = adapter.Init(ctx, cfg.Addr)
+	err = adapter.Init(ctx, cfg)
 	if !tools.Try(err) {
 		return nil, err
 	}
+	if cfg.RetryAttempts > 1 || cfg.BreakerThreshold > 0 || cfg.MaxConcurrent > 0 {
+		// innermost, so the audit entries are guarded on their own and the cache hits skip the bulkhead
+		adapter = NewResilient(adapter, cfg)
+	}
+	if cfg.Outbox {
+		// under the audit, so its entries of the writes rolled back along with their events are not recorded
+		if adapter, err = NewOutboxed(adapter); !tools.Try(err) {
+			return nil, err
+		}
+	}
+	if cfg.Audit {
+		if adapter, err = NewAudited(adapter); !tools.Try(err) {
+			return nil, err
+		}
+	}
+	if cfg.CacheSize > 0 {
+		return NewCached(adapter, cfg.CacheSize, cfg.CacheTTL)
+	}
 	return adapter, nil
 }
 
 func typeFromString(toFind string) (Type, error) {
 	if foundType, ok := map[string]Type{
-		"sqlite":  TypeSQLite,
-		"mongodb": TypeMongoDB,
+		"sqlite":     TypeSQLite,
+		"mongodb":    TypeMongoDB,
+		"memory":     TypeMemory,
+		"postgres":   TypePostgres,
+		"postgresql": TypePostgres,
 	}[toFind]; ok {
 		return foundType, nil
 	}
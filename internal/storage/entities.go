@@ -13,6 +13,10 @@ type (
 		ID       *int           `json:"id,omitempty" bson:"id" db:"id"`
 		Name     string         `json:"name" bson:"name" db:"name"`
 		Settings ClientSettings `json:"settings" bson:"settings"`
+		// Version Incremented by every write, starting from 1.
+		Version int `json:"version" bson:"version" db:"version"`
+		// DeletedAt Set while the client is in the trash, ignored on writes.
+		DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at" db:"deleted_at"`
 	}
 
 	ClientSettings struct {
@@ -22,8 +26,10 @@ type (
 	Project struct {
 		_ primitive.ObjectID `bson:"_id"`
 
-		ID       *int   `json:"id,omitempty" bson:"id" db:"id"`
-		ClientID *int   `json:"client_id,omitempty" bson:"client_id" db:"client_id"`
-		Name     string `json:"name" bson:"name" db:"name"`
+		ID        *int       `json:"id,omitempty" bson:"id" db:"id"`
+		ClientID  *int       `json:"client_id,omitempty" bson:"client_id" db:"client_id"`
+		Name      string     `json:"name" bson:"name" db:"name"`
+		Version   int        `json:"version" bson:"version" db:"version"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at" db:"deleted_at"`
 	}
 )
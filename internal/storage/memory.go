@@ -0,0 +1,830 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type (
+	// Memory keeps everything in process memory, mimicking SQLite semantics: IDs are never reused,
+	// explicit IDs bump the sequence.
+	Memory struct {
+		mu             sync.RWMutex
+		clients        map[int]Client
+		projects       map[int]Project
+		clientSeq      int
+		projectSeq     int
+		audit          []AuditEntry
+		events         map[int]Event
+		eventSeq       int
+		deliveries     map[int]Delivery
+		deliverySeq    int
+		webhooks       map[int]Webhook
+		webhookSeq     int
+		onClientDelete DeletePolicy
+	}
+)
+
+func (m *Memory) Init(_ context.Context, cfg *config.Storage) error {
+	policy, err := ParseDeletePolicy(cfg.ClientDeletePolicy)
+	if !tools.Try(err) {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onClientDelete = policy
+	m.clients = map[int]Client{}
+	m.projects = map[int]Project{}
+	m.clientSeq, m.projectSeq = 0, 0
+	m.audit = nil
+	m.events, m.deliveries, m.webhooks = map[int]Event{}, map[int]Delivery{}, map[int]Webhook{}
+	m.eventSeq, m.deliverySeq, m.webhookSeq = 0, 0, 0
+	return nil
+}
+
+// Ping Memory is always there, unless the context is done.
+func (m *Memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close Memory has nothing to release, the data stays.
+func (m *Memory) Close(context.Context) error {
+	return nil
+}
+
+// WithTx Runs fn on a copy of the data, which takes its place once fn succeeds. The other calls wait for fn to finish.
+func (m *Memory) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	staged := m.stage()
+	if err := fn(staged); err != nil {
+		return err
+	}
+	m.commit(staged)
+	return nil
+}
+
+func (m *Memory) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer m.mu.RUnlock()
+	var res []*Client
+	for _, client := range m.clients {
+		if client := copyClient(client); (client.DeletedAt != nil) == query.Trash && match(query.Filter, client) {
+			res = append(res, client)
+		}
+	}
+	res, more := pageOf(res, ClientSchema.sortKeys(query), page)
+	return res, more, nil
+}
+
+func (m *Memory) GetClient(ctx context.Context, ID int) (*Client, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	client, ok := m.clients[ID]
+	if !ok || client.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	return copyClient(client), nil
+}
+
+func (m *Memory) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	if client.ID != nil {
+		if _, ok := m.clients[*client.ID]; ok {
+			return nil, ErrAlreadyExists{errors.Errorf("client %d exists", *client.ID)}
+		}
+	}
+	ID := nextID(&m.clientSeq, client.ID)
+	stored := *copyClient(*client)
+	stored.ID = &ID
+	stored.Version = 1
+	stored.DeletedAt = nil
+	m.clients[ID] = stored
+	return copyClient(stored), nil
+}
+
+func (m *Memory) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil || client.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	current, ok := m.clients[*client.ID]
+	if !ok || current.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	if err := CheckVersion(current.Version, client.Version); err != nil {
+		return nil, err
+	}
+	stored := *copyClient(*client)
+	stored.Version = current.Version + 1
+	stored.DeletedAt = nil
+	m.clients[*stored.ID] = stored
+	return copyClient(stored), nil
+}
+
+func (m *Memory) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	stored, ok := m.clients[ID]
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	client := copyClient(stored)
+	if err := update(client); !tools.Try(err) {
+		return nil, err
+	}
+	if client.ID == nil || *client.ID != ID {
+		return nil, errIDChanged
+	}
+	client.Version = stored.Version + 1
+	client.DeletedAt = nil
+	m.clients[ID] = *copyClient(*client)
+	return client, nil
+}
+
+func (m *Memory) DeleteClient(ctx context.Context, ID int, version int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	client, ok := m.clients[ID]
+	if !ok || client.DeletedAt != nil {
+		return ErrNotFound{}
+	}
+	if err := CheckVersion(client.Version, version); err != nil {
+		return err
+	}
+	var owned []int
+	for projectID, project := range m.projects {
+		if project.ClientID != nil && *project.ClientID == ID && project.DeletedAt == nil {
+			owned = append(owned, projectID)
+		}
+	}
+	deletedAt := tombstone()
+	switch {
+	case len(owned) == 0:
+	case m.onClientDelete == DeleteCascade:
+		for _, projectID := range owned {
+			project := m.projects[projectID]
+			project.DeletedAt = &deletedAt
+			project.Version++
+			m.projects[projectID] = project
+		}
+	case m.onClientDelete == DeleteNullify:
+		for _, projectID := range owned {
+			project := m.projects[projectID]
+			project.ClientID = nil
+			project.Version++
+			m.projects[projectID] = project
+		}
+	default:
+		return ErrReferenced{errors.Errorf("client %d has %d projects", ID, len(owned))}
+	}
+	client.DeletedAt = &deletedAt
+	client.Version++
+	m.clients[ID] = client
+	return nil
+}
+
+// RestoreClient Projects trashed at the same moment as the client were trashed along with it.
+func (m *Memory) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	client, ok := m.clients[ID]
+	if !ok || client.DeletedAt == nil {
+		return nil, ErrNotFound{}
+	}
+	for projectID, project := range m.projects {
+		if project.ClientID != nil && *project.ClientID == ID && project.DeletedAt != nil && project.DeletedAt.Equal(*client.DeletedAt) {
+			project.DeletedAt = nil
+			project.Version++
+			m.projects[projectID] = project
+		}
+	}
+	client.DeletedAt = nil
+	client.Version++
+	m.clients[ID] = client
+	return copyClient(client), nil
+}
+
+func (m *Memory) PurgeClient(ctx context.Context, ID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	client, ok := m.clients[ID]
+	if !ok || client.DeletedAt == nil {
+		return ErrNotFound{}
+	}
+	for projectID, project := range m.projects {
+		if project.ClientID != nil && *project.ClientID == ID && project.DeletedAt != nil {
+			delete(m.projects, projectID)
+		}
+	}
+	delete(m.clients, ID)
+	return nil
+}
+
+func (m *Memory) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer m.mu.RUnlock()
+	//goland:noinspection ALL
+	res := []*Project{}
+	for _, project := range m.projects {
+		if project := copyProject(project); (project.DeletedAt != nil) == query.Trash && match(query.Filter, project) {
+			res = append(res, project)
+		}
+	}
+	res, more := pageOf(res, ProjectSchema.sortKeys(query), page)
+	return res, more, nil
+}
+
+func (m *Memory) GetProject(ctx context.Context, ID int) (*Project, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	project, ok := m.projects[ID]
+	if !ok || project.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	return copyProject(project), nil
+}
+
+func (m *Memory) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	if project.ID != nil {
+		if _, ok := m.projects[*project.ID]; ok {
+			return nil, ErrAlreadyExists{errors.Errorf("project %d exists", *project.ID)}
+		}
+	}
+	if err := m.checkClientExists(project.ClientID); err != nil {
+		return nil, err
+	}
+	ID := nextID(&m.projectSeq, project.ID)
+	stored := *copyProject(*project)
+	stored.ID = &ID
+	stored.Version = 1
+	stored.DeletedAt = nil
+	m.projects[ID] = stored
+	return copyProject(stored), nil
+}
+
+func (m *Memory) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil || project.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	current, ok := m.projects[*project.ID]
+	if !ok || current.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	if err := CheckVersion(current.Version, project.Version); err != nil {
+		return nil, err
+	}
+	if err := m.checkClientExists(project.ClientID); err != nil {
+		return nil, err
+	}
+	stored := *copyProject(*project)
+	stored.Version = current.Version + 1
+	stored.DeletedAt = nil
+	m.projects[*stored.ID] = stored
+	return copyProject(stored), nil
+}
+
+func (m *Memory) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	stored, ok := m.projects[ID]
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNotFound{}
+	}
+	project := copyProject(stored)
+	if err := update(project); !tools.Try(err) {
+		return nil, err
+	}
+	if project.ID == nil || *project.ID != ID {
+		return nil, errIDChanged
+	}
+	if err := m.checkClientExists(project.ClientID); err != nil {
+		return nil, err
+	}
+	project.Version = stored.Version + 1
+	project.DeletedAt = nil
+	m.projects[ID] = *copyProject(*project)
+	return project, nil
+}
+
+func (m *Memory) DeleteProject(ctx context.Context, ID int, version int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	project, ok := m.projects[ID]
+	if !ok || project.DeletedAt != nil {
+		return ErrNotFound{}
+	}
+	if err := CheckVersion(project.Version, version); err != nil {
+		return err
+	}
+	deletedAt := tombstone()
+	project.DeletedAt = &deletedAt
+	project.Version++
+	m.projects[ID] = project
+	return nil
+}
+
+func (m *Memory) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	project, ok := m.projects[ID]
+	if !ok || project.DeletedAt == nil {
+		return nil, ErrNotFound{}
+	}
+	if err := m.checkClientExists(project.ClientID); err != nil {
+		return nil, err
+	}
+	project.DeletedAt = nil
+	project.Version++
+	m.projects[ID] = project
+	return copyProject(project), nil
+}
+
+func (m *Memory) PurgeProject(ctx context.Context, ID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	project, ok := m.projects[ID]
+	if !ok || project.DeletedAt == nil {
+		return ErrNotFound{}
+	}
+	delete(m.projects, ID)
+	return nil
+}
+
+func (m *Memory) LoadClients(ctx context.Context, clients []*Client, seq int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for _, client := range clients {
+		m.clients[*client.ID] = *copyClient(*client)
+		nextID(&m.clientSeq, client.ID)
+	}
+	nextID(&m.clientSeq, &seq)
+	return nil
+}
+
+func (m *Memory) LoadProjects(ctx context.Context, projects []*Project, seq int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for _, project := range projects {
+		if project.ClientID == nil {
+			continue
+		}
+		if _, ok := m.clients[*project.ClientID]; !ok {
+			return ErrDanglingReference{errors.Errorf("client %d does not exist", *project.ClientID)}
+		}
+	}
+	for _, project := range projects {
+		m.projects[*project.ID] = *copyProject(*project)
+		nextID(&m.projectSeq, project.ID)
+	}
+	nextID(&m.projectSeq, &seq)
+	return nil
+}
+
+func (m *Memory) Sequence(ctx context.Context, table string) (int, error) {
+	if err := m.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.RUnlock()
+	seq, err := m.sequence(table)
+	if !tools.Try(err) {
+		return 0, err
+	}
+	return *seq, nil
+}
+
+func (m *Memory) AdvanceSequence(ctx context.Context, table string, ID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	seq, err := m.sequence(table)
+	if !tools.Try(err) {
+		return err
+	}
+	nextID(seq, &ID)
+	return nil
+}
+
+// sequence Must be called under the lock.
+func (m *Memory) sequence(table string) (*int, error) {
+	switch table {
+	case "clients":
+		return &m.clientSeq, nil
+	case "projects":
+		return &m.projectSeq, nil
+	}
+	return nil, errors.Errorf("unknown table %s", table)
+}
+
+func (m *Memory) AppendAudit(ctx context.Context, entry *AuditEntry) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	entry.ID = len(m.audit) + 1
+	stored := *entry
+	stored.Diff = append(Diff{}, entry.Diff...)
+	m.audit = append(m.audit, stored)
+	return nil
+}
+
+func (m *Memory) SelectAudit(ctx context.Context, query Query, since time.Time, page Page) ([]*AuditEntry, bool, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer m.mu.RUnlock()
+	var res []*AuditEntry
+	for _, entry := range m.audit {
+		if entry := entry; !entry.At.Before(since) && match(query.Filter, &entry) {
+			res = append(res, &entry)
+		}
+	}
+	res, more := pageOf(res, AuditSchema.sortKeys(query), page)
+	return res, more, nil
+}
+
+// AppendEvent The payload is not copied, events are never changed.
+func (m *Memory) AppendEvent(ctx context.Context, event *Event) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.eventSeq++
+	event.ID = m.eventSeq
+	m.events[event.ID] = *event
+	for webhookID := range m.webhooks {
+		m.deliverySeq++
+		m.deliveries[m.deliverySeq] = Delivery{
+			ID:            m.deliverySeq,
+			EventID:       event.ID,
+			WebhookID:     webhookID,
+			State:         DeliveryPending,
+			NextAttemptAt: event.At,
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	var res []*Delivery
+	for _, delivery := range m.deliveries {
+		if delivery := delivery; delivery.State == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			res = append(res, &delivery)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].NextAttemptAt.Equal(res[j].NextAttemptAt) {
+			return res[i].NextAttemptAt.Before(res[j].NextAttemptAt)
+		}
+		return res[i].ID < res[j].ID
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	for _, delivery := range res {
+		delivery.NextAttemptAt = now.Add(lease)
+		m.deliveries[delivery.ID] = *delivery
+	}
+	m.attachEvents(res)
+	return res, nil
+}
+
+func (m *Memory) SaveDelivery(ctx context.Context, delivery *Delivery) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	stored, ok := m.deliveries[delivery.ID]
+	if !ok {
+		return ErrNotFound{}
+	}
+	stored.State, stored.Attempts = delivery.State, delivery.Attempts
+	stored.NextAttemptAt, stored.LastError = delivery.NextAttemptAt, delivery.LastError
+	m.deliveries[delivery.ID] = stored
+	return nil
+}
+
+func (m *Memory) SelectDeliveries(ctx context.Context, state DeliveryState, limit int) ([]*Delivery, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	res := []*Delivery{}
+	for _, delivery := range m.deliveries {
+		if delivery := delivery; delivery.State == state {
+			res = append(res, &delivery)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	m.attachEvents(res)
+	return res, nil
+}
+
+func (m *Memory) RetryDelivery(ctx context.Context, ID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	delivery, ok := m.deliveries[ID]
+	if !ok || delivery.State != DeliveryDead {
+		return ErrNotFound{}
+	}
+	delivery.State, delivery.Attempts, delivery.LastError = DeliveryPending, 0, ""
+	delivery.NextAttemptAt = time.Now().UTC()
+	m.deliveries[ID] = delivery
+	return nil
+}
+
+func (m *Memory) SelectWebhooks(ctx context.Context) ([]*Webhook, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	res := make([]*Webhook, 0, len(m.webhooks))
+	for _, webhook := range m.webhooks {
+		webhook := webhook
+		res = append(res, &webhook)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (m *Memory) GetWebhook(ctx context.Context, ID int) (*Webhook, error) {
+	if err := m.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	webhook, ok := m.webhooks[ID]
+	if !ok {
+		return nil, ErrNotFound{}
+	}
+	return &webhook, nil
+}
+
+func (m *Memory) CreateWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	m.webhookSeq++
+	stored := *webhook
+	stored.ID = m.webhookSeq
+	m.webhooks[stored.ID] = stored
+	return &stored, nil
+}
+
+func (m *Memory) ReplaceWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
+		return nil, ErrNilEntity{}
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[webhook.ID]; !ok {
+		return nil, ErrNotFound{}
+	}
+	stored := *webhook
+	m.webhooks[stored.ID] = stored
+	return &stored, nil
+}
+
+func (m *Memory) DeleteWebhook(ctx context.Context, ID int) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[ID]; !ok {
+		return ErrNotFound{}
+	}
+	delete(m.webhooks, ID)
+	for deliveryID, delivery := range m.deliveries {
+		if delivery.WebhookID == ID {
+			delete(m.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+	delivering := map[int]bool{}
+	for ID, delivery := range m.deliveries {
+		if delivery.State == DeliveryDone && m.events[delivery.EventID].At.Before(before) {
+			delete(m.deliveries, ID)
+		} else {
+			delivering[delivery.EventID] = true
+		}
+	}
+	n := 0
+	for ID, event := range m.events {
+		if event.At.Before(before) && !delivering[ID] {
+			delete(m.events, ID)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// attachEvents Must be called under the lock.
+func (m *Memory) attachEvents(deliveries []*Delivery) {
+	for _, delivery := range deliveries {
+		event := m.events[delivery.EventID]
+		delivery.Event = &event
+	}
+}
+
+// checkClientExists Must be called under the lock.
+func (m *Memory) checkClientExists(ID *int) error {
+	if ID == nil {
+		return nil
+	}
+	if client, ok := m.clients[*ID]; !ok || client.DeletedAt != nil {
+		return ErrDanglingReference{errors.Errorf("client %d does not exist", *ID)}
+	}
+	return nil
+}
+
+// stage Copies the data for the writes to be applied all at once by commit, the caller holds the write lock.
+func (m *Memory) stage() *Memory {
+	staged := &Memory{
+		clients:        make(map[int]Client, len(m.clients)),
+		projects:       make(map[int]Project, len(m.projects)),
+		clientSeq:      m.clientSeq,
+		projectSeq:     m.projectSeq,
+		audit:          append([]AuditEntry(nil), m.audit...),
+		events:         make(map[int]Event, len(m.events)),
+		eventSeq:       m.eventSeq,
+		deliveries:     make(map[int]Delivery, len(m.deliveries)),
+		deliverySeq:    m.deliverySeq,
+		webhooks:       make(map[int]Webhook, len(m.webhooks)),
+		webhookSeq:     m.webhookSeq,
+		onClientDelete: m.onClientDelete,
+	}
+	for ID, event := range m.events {
+		staged.events[ID] = event
+	}
+	for ID, delivery := range m.deliveries {
+		staged.deliveries[ID] = delivery
+	}
+	for ID, webhook := range m.webhooks {
+		staged.webhooks[ID] = webhook
+	}
+	for ID, client := range m.clients {
+		staged.clients[ID] = *copyClient(client)
+	}
+	for ID, project := range m.projects {
+		staged.projects[ID] = *copyProject(project)
+	}
+	return staged
+}
+
+func (m *Memory) commit(staged *Memory) {
+	m.clients, m.projects = staged.clients, staged.projects
+	m.clientSeq, m.projectSeq = staged.clientSeq, staged.projectSeq
+	m.audit = staged.audit
+	m.events, m.deliveries, m.webhooks = staged.events, staged.deliveries, staged.webhooks
+	m.eventSeq, m.deliverySeq, m.webhookSeq = staged.eventSeq, staged.deliverySeq, staged.webhookSeq
+}
+
+// lock Acquires the write lock unless the caller has already given up.
+func (m *Memory) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	return nil
+}
+
+// rlock Acquires the read lock unless the caller has already given up.
+func (m *Memory) rlock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	return nil
+}
+
+// nextID Allocates the ID the way SQLite AUTOINCREMENT does: explicit IDs are kept and advance the sequence.
+func nextID(seq *int, ID *int) int {
+	if ID == nil {
+		*seq++
+		return *seq
+	}
+	if *ID > *seq {
+		*seq = *ID
+	}
+	return *ID
+}
+
+// pageOf Sorts the entities by the keys and takes the ones within the page.
+func pageOf[T any](entities []T, keys []SortKey, page Page) ([]T, bool) {
+	sort.Slice(entities, func(i, j int) bool {
+		less := compareKeyset(keys, entities[i], keysetOf(keys, entities[j])) < 0
+		return less != page.Backward()
+	})
+	res := []T{}
+	for _, entity := range entities {
+		if page.Limit > 0 && len(res) > page.Limit {
+			break
+		}
+		if page.After != nil && compareKeyset(keys, entity, page.After) <= 0 {
+			continue
+		}
+		if page.Before != nil && compareKeyset(keys, entity, page.Before) >= 0 {
+			continue
+		}
+		res = append(res, entity)
+	}
+	return window(res, page)
+}
+
+func copyClient(client Client) *Client {
+	client.ID = copyIntPtr(client.ID)
+	return &client
+}
+
+func copyProject(project Project) *Project {
+	project.ID = copyIntPtr(project.ID)
+	project.ClientID = copyIntPtr(project.ClientID)
+	return &project
+}
+
+func copyIntPtr(n *int) *int {
+	if n == nil {
+		return nil
+	}
+	v := *n
+	return &v
+}
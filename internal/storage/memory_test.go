@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type MemoryTestSuite struct {
+	suite.Suite
+	db *Memory
+}
+
+func (s *MemoryTestSuite) SetupTest() {
+	s.db = &Memory{}
+	s.Require().NoError(s.db.Init(context.Background(), &config.Storage{}))
+}
+
+func (s *MemoryTestSuite) TestClientIDAllocation() {
+	ctx := context.Background()
+	first, err := s.db.CreateClient(ctx, &Client{Name: "first"})
+	s.Require().NoError(err)
+	s.Equal(1, *first.ID)
+
+	explicit, err := s.db.CreateClient(ctx, &Client{ID: tools.IntPtr(10), Name: "explicit"})
+	s.Require().NoError(err)
+	s.Equal(10, *explicit.ID)
+
+	s.Require().NoError(s.db.DeleteClient(ctx, 10, 0))
+	next, err := s.db.CreateClient(ctx, &Client{Name: "next"})
+	s.Require().NoError(err)
+	s.Equal(11, *next.ID, "deleted IDs must not be reused")
+}
+
+func (s *MemoryTestSuite) TestClientWriteSemantics() {
+	ctx := context.Background()
+	_, err := s.db.GetClient(ctx, 1)
+	s.IsType(ErrNotFound{}, err)
+	s.IsType(ErrNotFound{}, s.db.DeleteClient(ctx, 1, 0))
+	_, err = s.db.CreateClient(ctx, nil)
+	s.IsType(ErrNilEntity{}, err)
+
+	_, err = s.db.ReplaceClient(ctx, &Client{ID: tools.IntPtr(1), Name: "missing"})
+	s.IsType(ErrNotFound{}, err)
+	_, err = s.db.UpdateClient(ctx, 1, func(*Client) error { return nil })
+	s.IsType(ErrNotFound{}, err)
+
+	_, err = s.db.CreateClient(ctx, &Client{ID: tools.IntPtr(1), Name: "before"})
+	s.Require().NoError(err)
+	_, err = s.db.CreateClient(ctx, &Client{ID: tools.IntPtr(1), Name: "again"})
+	s.IsType(ErrAlreadyExists{}, err)
+	_, err = s.db.ReplaceClient(ctx, &Client{ID: tools.IntPtr(1), Name: "replaced"})
+	s.Require().NoError(err)
+	updated, err := s.db.UpdateClient(ctx, 1, func(client *Client) error {
+		client.Name = "after"
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal("after", updated.Name)
+	_, err = s.db.UpdateClient(ctx, 1, func(client *Client) error {
+		client.ID = tools.IntPtr(2)
+		return nil
+	})
+	s.ErrorIs(err, errIDChanged)
+
+	updated.Name = "mutated outside"
+	stored, err := s.db.GetClient(ctx, 1)
+	s.Require().NoError(err)
+	s.Equal("after", stored.Name, "returned entities must not alias stored ones")
+
+	clients, _, err := s.db.SelectClients(ctx, Query{}, Page{})
+	s.Require().NoError(err)
+	s.Len(clients, 1)
+}
+
+func (s *MemoryTestSuite) TestProjectsOfClient() {
+	ctx := context.Background()
+	for _, name := range []string{"first", "second"} {
+		_, err := s.db.CreateClient(ctx, &Client{Name: name})
+		s.Require().NoError(err)
+	}
+	for _, project := range []*Project{
+		{ClientID: tools.IntPtr(2), Name: "b"},
+		{ClientID: tools.IntPtr(1), Name: "a"},
+		{Name: "orphan"},
+		{ClientID: tools.IntPtr(2), Name: "c"},
+	} {
+		_, err := s.db.CreateProject(ctx, project)
+		s.Require().NoError(err)
+	}
+
+	owned, err := ProjectSchema.Compare("client_id", OpEq, 2)
+	s.Require().NoError(err)
+	projects, _, err := s.db.SelectProjects(ctx, Query{Filter: owned}, Page{})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 2)
+	s.Equal("b", projects[0].Name)
+	s.Equal("c", projects[1].Name)
+
+	all, _, err := s.db.SelectProjects(ctx, Query{}, Page{})
+	s.Require().NoError(err)
+	s.Len(all, 4)
+
+	unowned, err := ProjectSchema.ParseQuery("client_id!=2", "")
+	s.Require().NoError(err)
+	projects, _, err = s.db.SelectProjects(ctx, unowned, Page{})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 2)
+	s.Equal("a", projects[0].Name)
+	s.Equal("orphan", projects[1].Name, "null is not equal to anything")
+}
+
+func (s *MemoryTestSuite) TestReferentialIntegrity() {
+	ctx := context.Background()
+	_, err := s.db.CreateProject(ctx, &Project{ClientID: tools.IntPtr(753), Name: "dangling"})
+	s.IsType(ErrDanglingReference{}, err)
+
+	for _, tc := range []struct {
+		policy    DeletePolicy
+		deleteErr error
+		clientID  *int
+		projectOk bool
+	}{
+		{DeleteRestrict, ErrReferenced{}, tools.IntPtr(1), true},
+		{DeleteCascade, nil, nil, false},
+		{DeleteNullify, nil, nil, true},
+	} {
+		s.Run(string(tc.policy), func() {
+			s.Require().NoError(s.db.Init(ctx, &config.Storage{ClientDeletePolicy: string(tc.policy)}))
+			client, err := s.db.CreateClient(ctx, &Client{Name: "owner"})
+			s.Require().NoError(err)
+			project, err := s.db.CreateProject(ctx, &Project{ClientID: client.ID, Name: "owned"})
+			s.Require().NoError(err)
+
+			s.IsType(tc.deleteErr, s.db.DeleteClient(ctx, *client.ID, 0))
+			project, err = s.db.GetProject(ctx, *project.ID)
+			if !tc.projectOk {
+				s.IsType(ErrNotFound{}, err)
+				return
+			}
+			s.Require().NoError(err)
+			s.Equal(tc.clientID, project.ClientID)
+		})
+	}
+}
+
+func (s *MemoryTestSuite) TestVersions() {
+	ctx := context.Background()
+	client, err := s.db.CreateClient(ctx, &Client{Name: "first", Version: 7})
+	s.Require().NoError(err)
+	s.Equal(1, client.Version, "created entities start from version 1")
+
+	client, err = s.db.ReplaceClient(ctx, &Client{ID: client.ID, Name: "second", Version: 1})
+	s.Require().NoError(err)
+	s.Equal(2, client.Version)
+	_, err = s.db.ReplaceClient(ctx, &Client{ID: client.ID, Name: "stale", Version: 1})
+	s.IsType(ErrVersionMismatch{}, err)
+
+	client, err = s.db.UpdateClient(ctx, *client.ID, func(client *Client) error {
+		client.Version = 100
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal(3, client.Version, "version is kept by the storage")
+
+	s.IsType(ErrVersionMismatch{}, s.db.DeleteClient(ctx, *client.ID, 2))
+	s.NoError(s.db.DeleteClient(ctx, *client.ID, 3))
+}
+
+func (s *MemoryTestSuite) TestTrash() {
+	ctx := context.Background()
+	s.Require().NoError(s.db.Init(ctx, &config.Storage{ClientDeletePolicy: string(DeleteCascade)}))
+	client, err := s.db.CreateClient(ctx, &Client{Name: "owner"})
+	s.Require().NoError(err)
+	earlier, err := s.db.CreateProject(ctx, &Project{ClientID: client.ID, Name: "trashed earlier"})
+	s.Require().NoError(err)
+	cascaded, err := s.db.CreateProject(ctx, &Project{ClientID: client.ID, Name: "trashed with the client"})
+	s.Require().NoError(err)
+	s.Require().NoError(s.db.DeleteProject(ctx, *earlier.ID, 0))
+	s.Require().NoError(s.db.DeleteClient(ctx, *client.ID, 0))
+
+	_, err = s.db.GetClient(ctx, *client.ID)
+	s.IsType(ErrNotFound{}, err)
+	s.IsType(ErrNotFound{}, s.db.DeleteClient(ctx, *client.ID, 0))
+	_, err = s.db.CreateClient(ctx, &Client{ID: client.ID, Name: "reused"})
+	s.IsType(ErrAlreadyExists{}, err, "trashed IDs stay taken")
+	_, err = s.db.CreateProject(ctx, &Project{ClientID: client.ID, Name: "dangling"})
+	s.IsType(ErrDanglingReference{}, err)
+	trash, _, err := s.db.SelectProjects(ctx, Query{Trash: true}, Page{})
+	s.Require().NoError(err)
+	s.Len(trash, 2)
+	s.NotNil(trash[0].DeletedAt)
+
+	_, err = s.db.RestoreProject(ctx, *cascaded.ID)
+	s.IsType(ErrDanglingReference{}, err, "client is still trashed")
+	restored, err := s.db.RestoreClient(ctx, *client.ID)
+	s.Require().NoError(err)
+	s.Nil(restored.DeletedAt)
+	s.Equal(3, restored.Version)
+	projects, _, err := s.db.SelectProjects(ctx, Query{}, Page{})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 1)
+	s.Equal(*cascaded.ID, *projects[0].ID)
+	_, err = s.db.RestoreClient(ctx, *client.ID)
+	s.IsType(ErrNotFound{}, err)
+
+	s.IsType(ErrNotFound{}, s.db.PurgeClient(ctx, *client.ID), "only trashed entities are purged")
+	s.Require().NoError(s.db.DeleteClient(ctx, *client.ID, 0))
+	s.Require().NoError(s.db.PurgeClient(ctx, *client.ID))
+	trash, _, err = s.db.SelectProjects(ctx, Query{Trash: true}, Page{})
+	s.Require().NoError(err)
+	s.Empty(trash, "trashed projects go along with the client")
+	s.IsType(ErrNotFound{}, s.db.PurgeProject(ctx, *earlier.ID))
+}
+
+func (s *MemoryTestSuite) TestPagination() {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := s.db.CreateClient(ctx, &Client{Name: "client"})
+		s.Require().NoError(err)
+	}
+	for _, tc := range []struct {
+		name string
+		page Page
+		IDs  []int
+		more bool
+	}{
+		{"First", Page{Limit: 2}, []int{1, 2}, true},
+		{"Middle", Page{Limit: 2, After: Keyset{int64(2)}}, []int{3, 4}, true},
+		{"Last", Page{Limit: 2, After: Keyset{int64(4)}}, []int{5}, false},
+		{"Backward", Page{Limit: 2, Before: Keyset{int64(5)}}, []int{3, 4}, true},
+		{"BackwardToStart", Page{Limit: 2, Before: Keyset{int64(3)}}, []int{1, 2}, false},
+		{"Bounded", Page{After: Keyset{int64(1)}, Before: Keyset{int64(5)}}, []int{2, 3, 4}, false},
+	} {
+		s.Run(tc.name, func() {
+			clients, more, err := s.db.SelectClients(ctx, Query{}, tc.page)
+			s.Require().NoError(err)
+			var IDs []int
+			for _, client := range clients {
+				IDs = append(IDs, *client.ID)
+			}
+			s.Equal(tc.IDs, IDs)
+			s.Equal(tc.more, more)
+		})
+	}
+}
+
+func (s *MemoryTestSuite) TestFilterAndSort() {
+	ctx := context.Background()
+	for _, client := range []*Client{
+		{Name: "Microsoft", Settings: ClientSettings{CodeScanInterval: time.Hour}},
+		{Name: "Apple", Settings: ClientSettings{CodeScanInterval: time.Minute}},
+		{Name: "Alphabet", Settings: ClientSettings{CodeScanInterval: time.Hour}},
+		{Name: "Meta", Settings: ClientSettings{CodeScanInterval: time.Second}},
+	} {
+		_, err := s.db.CreateClient(ctx, client)
+		s.Require().NoError(err)
+	}
+	for _, tc := range []struct {
+		name, filter, sort string
+		IDs                []int
+	}{
+		{"All", "", "", []int{1, 2, 3, 4}},
+		{"Like", "name=like=a*", "", []int{2, 3}},
+		{"Or", "name==Meta,id=in=(1,2)", "", []int{1, 2, 4}},
+		{"Duration", "settings.code_scan_interval=ge=1m", "-name", []int{1, 2, 3}},
+		{"TieBreak", "", "-settings.code_scan_interval,-id", []int{3, 1, 2, 4}},
+	} {
+		s.Run(tc.name, func() {
+			query, err := ClientSchema.ParseQuery(tc.filter, tc.sort)
+			s.Require().NoError(err)
+			clients, _, err := s.db.SelectClients(ctx, query, Page{})
+			s.Require().NoError(err)
+			var IDs []int
+			for _, client := range clients {
+				IDs = append(IDs, *client.ID)
+			}
+			s.Equal(tc.IDs, IDs)
+		})
+	}
+
+	query, err := ClientSchema.ParseQuery("", "-settings.code_scan_interval,name")
+	s.Require().NoError(err)
+	first, more, err := s.db.SelectClients(ctx, query, Page{Limit: 1})
+	s.Require().NoError(err)
+	s.True(more)
+	s.Equal("Alphabet", first[0].Name)
+	next, _, err := s.db.SelectClients(ctx, query, Page{Limit: 2, After: ClientSchema.KeysetOf(query, first[0])})
+	s.Require().NoError(err)
+	s.Require().Len(next, 2)
+	s.Equal("Microsoft", next[0].Name)
+	s.Equal("Apple", next[1].Name)
+	prev, more, err := s.db.SelectClients(ctx, query, Page{Limit: 2, Before: ClientSchema.KeysetOf(query, next[0])})
+	s.Require().NoError(err)
+	s.False(more)
+	s.Require().Len(prev, 1)
+	s.Equal("Alphabet", prev[0].Name)
+}
+
+func (s *MemoryTestSuite) TestCanceledContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.db.CreateClient(ctx, &Client{Name: "never"})
+	s.ErrorIs(err, context.Canceled)
+	clients, _, err := s.db.SelectClients(context.Background(), Query{}, Page{})
+	s.Require().NoError(err)
+	s.Empty(clients)
+}
+
+func TestMemorySuite(t *testing.T) {
+	suite.Run(t, new(MemoryTestSuite))
+}
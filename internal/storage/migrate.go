@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ct-mend/resources"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	// MigrateAuto Apply pending migrations on start.
+	MigrateAuto MigrateMode = "auto"
+	// MigrateOff Leave the schema alone.
+	MigrateOff MigrateMode = "off"
+	// MigrateCheck Refuse to start unless the schema is up-to-date.
+	MigrateCheck MigrateMode = "check"
+)
+
+type (
+	MigrateMode string
+
+	// Migrator Adapters with a versioned schema. Versions are kept in the golang-migrate compatible
+	// schema_migrations table (collection), so databases migrated by its CLI are picked up as is.
+	Migrator interface {
+		Migrate(ctx context.Context, mode MigrateMode) error
+	}
+
+	ErrSchemaOutdated struct {
+		Current, Latest int
+	}
+
+	sqlMigration struct {
+		version int
+		file    string
+	}
+)
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_.+\.up\.sql$`)
+
+func (e ErrSchemaOutdated) Error() string {
+	return fmt.Sprintf("schema version %d is behind %d, migrations needed", e.Current, e.Latest)
+}
+
+func ParseMigrateMode(mode string) (MigrateMode, error) {
+	switch m := MigrateMode(mode); m {
+	case MigrateAuto, MigrateOff, MigrateCheck:
+		return m, nil
+	}
+	return "", errors.New("unrecognized migrate mode " + mode)
+}
+
+// Migrate Brings the SQL schema to the latest embedded version in a single transaction, which takes the migration
+// lock of the dialect first, so of the replicas starting at once only one applies the pending versions.
+func (s *sqlStore) Migrate(ctx context.Context, mode MigrateMode) error {
+	if mode == MigrateOff {
+		return nil
+	}
+	migrations, err := loadSQLMigrations(s.dialect.migrationsDir())
+	if !tools.Try(err) {
+		return err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+
+	var applied []string
+	err = s.atomic(ctx, func(tx *sqlx.Tx) error {
+		if err := s.dialect.lockMigrations(ctx, tx); !tools.Try(err) {
+			return errors.Wrap(err, "migration lock")
+		}
+		_, err := tx.ExecContext(ctx, `
+			create table if not exists schema_migrations (version bigint not null primary key, dirty boolean not null);
+		`)
+		if !tools.Try(err) {
+			return errors.Wrap(err, "schema version table")
+		}
+		current, err := schemaVersion(ctx, tx)
+		if !tools.Try(err) || current >= latest {
+			return err
+		}
+		if mode == MigrateCheck {
+			return ErrSchemaOutdated{Current: current, Latest: latest}
+		}
+		for _, migration := range migrations {
+			if migration.version <= current {
+				continue
+			}
+			if err = applyMigration(ctx, tx, migration); !tools.Try(err) {
+				return errors.Wrapf(err, "migration %s", migration.file)
+			}
+			applied = append(applied, migration.file)
+		}
+		return nil
+	})
+	if !tools.Try(err) {
+		return err
+	}
+	for _, file := range applied {
+		log.Infoln("applied migration", file)
+	}
+	return nil
+}
+
+func schemaVersion(ctx context.Context, db sqlx.QueryerContext) (int, error) {
+	var versions []struct {
+		Version int  `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+	err := sqlx.SelectContext(ctx, db, &versions, "select version, dirty from schema_migrations;")
+	if !tools.Try(err) {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	if versions[0].Dirty {
+		return 0, errors.Errorf("schema version %d is dirty, fix it manually", versions[0].Version)
+	}
+	return versions[0].Version, nil
+}
+
+func applyMigration(ctx context.Context, tx *sqlx.Tx, migration sqlMigration) error {
+	query, err := resources.FS.ReadFile(migration.file)
+	if !tools.Try(err) {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, string(query)); !tools.Try(err) {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "delete from schema_migrations;"); !tools.Try(err) {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, tx.Rebind("insert into schema_migrations (version, dirty) values (?, ?);"), migration.version, false)
+	return err
+}
+
+func loadSQLMigrations(dir string) ([]sqlMigration, error) {
+	entries, err := fs.ReadDir(resources.FS, dir)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	var res []sqlMigration
+	for _, entry := range entries {
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if !tools.Try(err) {
+			return nil, err
+		}
+		res = append(res, sqlMigration{version: version, file: path.Join(dir, entry.Name())})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].version < res[j].version
+	})
+	return res, nil
+}
+
+// Migrate Runs the adapter migrations, if it has any.
+func Migrate(ctx context.Context, adapter Adapter, mode MigrateMode) error {
+	migrator, ok := As[Migrator](adapter)
+	if !ok || mode == MigrateOff {
+		return nil
+	}
+	return migrator.Migrate(ctx, mode)
+}
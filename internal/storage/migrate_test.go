@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+	db   *SQLite
+	addr string
+}
+
+func (s *MigrateTestSuite) SetupTest() {
+	s.addr = filepath.Join(s.T().TempDir(), "db.sqlite")
+	s.db = &SQLite{}
+	s.Require().NoError(s.db.Init(context.Background(), &config.Storage{Addr: s.addr}))
+}
+
+func (s *MigrateTestSuite) TestModes() {
+	ctx := context.Background()
+	s.Require().NoError(s.db.Migrate(ctx, MigrateOff))
+	s.IsType(ErrSchemaOutdated{}, s.db.Migrate(ctx, MigrateCheck))
+
+	s.Require().NoError(s.db.Migrate(ctx, MigrateAuto))
+	version, err := schemaVersion(ctx, s.db.conn)
+	s.Require().NoError(err)
+	migrations, err := loadSQLMigrations("migrations/sqlite")
+	s.Require().NoError(err)
+	s.Equal(migrations[len(migrations)-1].version, version)
+	s.Require().NoError(s.db.Migrate(ctx, MigrateCheck))
+	s.Require().NoError(s.db.Migrate(ctx, MigrateAuto), "must be idempotent")
+
+	clients, _, err := s.db.SelectClients(ctx, Query{}, Page{})
+	s.Require().NoError(err)
+	s.NotEmpty(clients)
+}
+
+func (s *MigrateTestSuite) TestConcurrent() {
+	ctx := context.Background()
+	cfg := &config.Storage{Addr: s.addr, SQLiteBusyTimeout: 5 * time.Second}
+	replicas := make([]*SQLite, 3)
+	for i := range replicas {
+		replicas[i] = &SQLite{}
+		s.Require().NoError(replicas[i].Init(ctx, cfg))
+		defer replicas[i].Close(ctx)
+	}
+	eg := errgroup.Group{}
+	for _, replica := range replicas {
+		replica := replica
+		eg.Go(func() error {
+			return replica.Migrate(ctx, MigrateAuto)
+		})
+	}
+	s.Require().NoError(eg.Wait(), "every version must be applied once")
+	for _, replica := range replicas {
+		s.Require().NoError(replica.Migrate(ctx, MigrateCheck))
+	}
+}
+
+func (s *MigrateTestSuite) TestDirtyVersion() {
+	ctx := context.Background()
+	_, err := s.db.conn.Exec(`
+		create table schema_migrations (version bigint not null primary key, dirty boolean not null);
+		insert into schema_migrations (version, dirty) values (1, true);
+	`)
+	s.Require().NoError(err)
+	s.Error(s.db.Migrate(ctx, MigrateAuto))
+}
+
+func (s *MigrateTestSuite) TestUnknownMode() {
+	_, err := ParseMigrateMode("sometimes")
+	s.Error(err)
+}
+
+func TestMigrateSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
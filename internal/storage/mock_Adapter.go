@@ -5,6 +5,8 @@ package storage
 import (
 	context "context"
 
+	config "github.com/iamwavecut/ct-mend/internal/config"
+
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -13,13 +15,13 @@ type MockAdapter struct {
 	mock.Mock
 }
 
-// DeleteClient provides a mock function with given fields: id
-func (_m *MockAdapter) DeleteClient(id int) error {
-	ret := _m.Called(id)
+// Close provides a mock function with given fields: ctx
+func (_m *MockAdapter) Close(ctx context.Context) error {
+	ret := _m.Called(ctx)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(int) error); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -27,13 +29,59 @@ func (_m *MockAdapter) DeleteClient(id int) error {
 	return r0
 }
 
-// DeleteProject provides a mock function with given fields: id
-func (_m *MockAdapter) DeleteProject(id int) error {
-	ret := _m.Called(id)
+// CreateClient provides a mock function with given fields: ctx, client
+func (_m *MockAdapter) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	ret := _m.Called(ctx, client)
+
+	var r0 *Client
+	if rf, ok := ret.Get(0).(func(context.Context, *Client) *Client); ok {
+		r0 = rf(ctx, client)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Client)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *Client) error); ok {
+		r1 = rf(ctx, client)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateProject provides a mock function with given fields: ctx, project
+func (_m *MockAdapter) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	ret := _m.Called(ctx, project)
+
+	var r0 *Project
+	if rf, ok := ret.Get(0).(func(context.Context, *Project) *Project); ok {
+		r0 = rf(ctx, project)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Project)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *Project) error); ok {
+		r1 = rf(ctx, project)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteClient provides a mock function with given fields: ctx, id, version
+func (_m *MockAdapter) DeleteClient(ctx context.Context, id int, version int) error {
+	ret := _m.Called(ctx, id, version)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(int) error); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, int, int) error); ok {
+		r0 = rf(ctx, id, version)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -41,13 +89,27 @@ func (_m *MockAdapter) DeleteProject(id int) error {
 	return r0
 }
 
-// GetClient provides a mock function with given fields: id
-func (_m *MockAdapter) GetClient(id int) (*Client, error) {
-	ret := _m.Called(id)
+// DeleteProject provides a mock function with given fields: ctx, id, version
+func (_m *MockAdapter) DeleteProject(ctx context.Context, id int, version int) error {
+	ret := _m.Called(ctx, id, version)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int, int) error); ok {
+		r0 = rf(ctx, id, version)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetClient provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) GetClient(ctx context.Context, id int) (*Client, error) {
+	ret := _m.Called(ctx, id)
 
 	var r0 *Client
-	if rf, ok := ret.Get(0).(func(int) *Client); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, int) *Client); ok {
+		r0 = rf(ctx, id)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Client)
@@ -55,8 +117,8 @@ func (_m *MockAdapter) GetClient(id int) (*Client, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(int) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(ctx, id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -64,13 +126,13 @@ func (_m *MockAdapter) GetClient(id int) (*Client, error) {
 	return r0, r1
 }
 
-// GetProject provides a mock function with given fields: id
-func (_m *MockAdapter) GetProject(id int) (*Project, error) {
-	ret := _m.Called(id)
+// GetProject provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) GetProject(ctx context.Context, id int) (*Project, error) {
+	ret := _m.Called(ctx, id)
 
 	var r0 *Project
-	if rf, ok := ret.Get(0).(func(int) *Project); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, int) *Project); ok {
+		r0 = rf(ctx, id)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Project)
@@ -78,8 +140,8 @@ func (_m *MockAdapter) GetProject(id int) (*Project, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(int) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(ctx, id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -87,13 +149,13 @@ func (_m *MockAdapter) GetProject(id int) (*Project, error) {
 	return r0, r1
 }
 
-// Init provides a mock function with given fields: ctx, connAddr
-func (_m *MockAdapter) Init(ctx context.Context, connAddr string) error {
-	ret := _m.Called(ctx, connAddr)
+// Init provides a mock function with given fields: ctx, cfg
+func (_m *MockAdapter) Init(ctx context.Context, cfg *config.Storage) error {
+	ret := _m.Called(ctx, cfg)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
-		r0 = rf(ctx, connAddr)
+	if rf, ok := ret.Get(0).(func(context.Context, *config.Storage) error); ok {
+		r0 = rf(ctx, cfg)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -101,22 +163,64 @@ func (_m *MockAdapter) Init(ctx context.Context, connAddr string) error {
 	return r0
 }
 
-// SelectClients provides a mock function with given fields:
-func (_m *MockAdapter) SelectClients() ([]*Client, error) {
-	ret := _m.Called()
+// Ping provides a mock function with given fields: ctx
+func (_m *MockAdapter) Ping(ctx context.Context) error {
+	ret := _m.Called(ctx)
 
-	var r0 []*Client
-	if rf, ok := ret.Get(0).(func() []*Client); ok {
-		r0 = rf()
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PurgeClient provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) PurgeClient(ctx context.Context, id int) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PurgeProject provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) PurgeProject(ctx context.Context, id int) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReplaceClient provides a mock function with given fields: ctx, client
+func (_m *MockAdapter) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	ret := _m.Called(ctx, client)
+
+	var r0 *Client
+	if rf, ok := ret.Get(0).(func(context.Context, *Client) *Client); ok {
+		r0 = rf(ctx, client)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]*Client)
+			r0 = ret.Get(0).(*Client)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, *Client) error); ok {
+		r1 = rf(ctx, client)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -124,22 +228,22 @@ func (_m *MockAdapter) SelectClients() ([]*Client, error) {
 	return r0, r1
 }
 
-// SelectProjects provides a mock function with given fields:
-func (_m *MockAdapter) SelectProjects() ([]*Project, error) {
-	ret := _m.Called()
+// ReplaceProject provides a mock function with given fields: ctx, project
+func (_m *MockAdapter) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	ret := _m.Called(ctx, project)
 
-	var r0 []*Project
-	if rf, ok := ret.Get(0).(func() []*Project); ok {
-		r0 = rf()
+	var r0 *Project
+	if rf, ok := ret.Get(0).(func(context.Context, *Project) *Project); ok {
+		r0 = rf(ctx, project)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]*Project)
+			r0 = ret.Get(0).(*Project)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, *Project) error); ok {
+		r1 = rf(ctx, project)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -147,22 +251,22 @@ func (_m *MockAdapter) SelectProjects() ([]*Project, error) {
 	return r0, r1
 }
 
-// SelectProjectsOfClient provides a mock function with given fields: id
-func (_m *MockAdapter) SelectProjectsOfClient(id int) ([]*Project, error) {
-	ret := _m.Called(id)
+// RestoreClient provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) RestoreClient(ctx context.Context, id int) (*Client, error) {
+	ret := _m.Called(ctx, id)
 
-	var r0 []*Project
-	if rf, ok := ret.Get(0).(func(int) []*Project); ok {
-		r0 = rf(id)
+	var r0 *Client
+	if rf, ok := ret.Get(0).(func(context.Context, int) *Client); ok {
+		r0 = rf(ctx, id)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]*Project)
+			r0 = ret.Get(0).(*Client)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(int) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(ctx, id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -170,13 +274,96 @@ func (_m *MockAdapter) SelectProjectsOfClient(id int) ([]*Project, error) {
 	return r0, r1
 }
 
-// UpsertClient provides a mock function with given fields: client
-func (_m *MockAdapter) UpsertClient(client *Client) (*Client, error) {
-	ret := _m.Called(client)
+// RestoreProject provides a mock function with given fields: ctx, id
+func (_m *MockAdapter) RestoreProject(ctx context.Context, id int) (*Project, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 *Project
+	if rf, ok := ret.Get(0).(func(context.Context, int) *Project); ok {
+		r0 = rf(ctx, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*Project)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SelectClients provides a mock function with given fields: ctx, query, page
+func (_m *MockAdapter) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	ret := _m.Called(ctx, query, page)
+
+	var r0 []*Client
+	if rf, ok := ret.Get(0).(func(context.Context, Query, Page) []*Client); ok {
+		r0 = rf(ctx, query, page)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*Client)
+		}
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(context.Context, Query, Page) bool); ok {
+		r1 = rf(ctx, query, page)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, Query, Page) error); ok {
+		r2 = rf(ctx, query, page)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// SelectProjects provides a mock function with given fields: ctx, query, page
+func (_m *MockAdapter) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	ret := _m.Called(ctx, query, page)
+
+	var r0 []*Project
+	if rf, ok := ret.Get(0).(func(context.Context, Query, Page) []*Project); ok {
+		r0 = rf(ctx, query, page)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*Project)
+		}
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(context.Context, Query, Page) bool); ok {
+		r1 = rf(ctx, query, page)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, Query, Page) error); ok {
+		r2 = rf(ctx, query, page)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// UpdateClient provides a mock function with given fields: ctx, id, update
+func (_m *MockAdapter) UpdateClient(ctx context.Context, id int, update func(*Client) error) (*Client, error) {
+	ret := _m.Called(ctx, id, update)
 
 	var r0 *Client
-	if rf, ok := ret.Get(0).(func(*Client) *Client); ok {
-		r0 = rf(client)
+	if rf, ok := ret.Get(0).(func(context.Context, int, func(*Client) error) *Client); ok {
+		r0 = rf(ctx, id, update)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Client)
@@ -184,8 +371,8 @@ func (_m *MockAdapter) UpsertClient(client *Client) (*Client, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*Client) error); ok {
-		r1 = rf(client)
+	if rf, ok := ret.Get(1).(func(context.Context, int, func(*Client) error) error); ok {
+		r1 = rf(ctx, id, update)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -193,13 +380,13 @@ func (_m *MockAdapter) UpsertClient(client *Client) (*Client, error) {
 	return r0, r1
 }
 
-// UpsertProject provides a mock function with given fields: project
-func (_m *MockAdapter) UpsertProject(project *Project) (*Project, error) {
-	ret := _m.Called(project)
+// UpdateProject provides a mock function with given fields: ctx, id, update
+func (_m *MockAdapter) UpdateProject(ctx context.Context, id int, update func(*Project) error) (*Project, error) {
+	ret := _m.Called(ctx, id, update)
 
 	var r0 *Project
-	if rf, ok := ret.Get(0).(func(*Project) *Project); ok {
-		r0 = rf(project)
+	if rf, ok := ret.Get(0).(func(context.Context, int, func(*Project) error) *Project); ok {
+		r0 = rf(ctx, id, update)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*Project)
@@ -207,8 +394,8 @@ func (_m *MockAdapter) UpsertProject(project *Project) (*Project, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*Project) error); ok {
-		r1 = rf(project)
+	if rf, ok := ret.Get(1).(func(context.Context, int, func(*Project) error) error); ok {
+		r1 = rf(ctx, id, update)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -216,6 +403,20 @@ func (_m *MockAdapter) UpsertProject(project *Project) (*Project, error) {
 	return r0, r1
 }
 
+// WithTx provides a mock function with given fields: ctx, fn
+func (_m *MockAdapter) WithTx(ctx context.Context, fn func(Adapter) error) error {
+	ret := _m.Called(ctx, fn)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, func(Adapter) error) error); ok {
+		r0 = rf(ctx, fn)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 type mockConstructorTestingTNewMockAdapter interface {
 	mock.TestingT
 	Cleanup(func())
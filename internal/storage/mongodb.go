@@ -5,37 +5,67 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 
 	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
 	"github.com/iamwavecut/ct-mend/tools"
 )
 
+// casAttempts How many times an update is retried when the document keeps changing underneath.
+const casAttempts = 5
+
+var errConcurrentUpdate = fault.New(fault.Conflict, "entity is being modified concurrently, try again")
+
 type MongoDB struct {
-	ctx      context.Context
-	conn     *mongo.Client
-	clients  *mongo.Collection
-	projects *mongo.Collection
-	counters *mongo.Collection
-	cancel   context.CancelFunc
-	timeout  time.Duration
+	ctx            context.Context
+	onClientDelete DeletePolicy
+	conn           *mongo.Client
+	db             *mongo.Database
+	clients        *mongo.Collection
+	projects       *mongo.Collection
+	counters       *mongo.Collection
+	audit          *mongo.Collection
+	outbox         *mongo.Collection
+	deliveries     *mongo.Collection
+	webhooks       *mongo.Collection
+	cancel         context.CancelFunc
+	timeout        time.Duration
+	// transactional The server is a replica set or a sharded cluster, which have transactions.
+	transactional bool
+	// session Session in the transaction of WithTx the calls are made in, if set.
+	session mongo.Session
 }
 
-func (m *MongoDB) Init(ctx context.Context, connAddr string) error {
+func (m *MongoDB) Init(ctx context.Context, cfg *config.Storage) error {
+	policy, err := ParseDeletePolicy(cfg.ClientDeletePolicy)
+	if !tools.Try(err) {
+		return err
+	}
+	m.onClientDelete = policy
+
 	ctx, cancel := context.WithCancel(ctx)
 	m.cancel = cancel
 	m.ctx = ctx
 
 	timeout := config.DefaultTimeout // Default
-	cfg := ctx.Value(config.Key{})
-	if cfg, ok := cfg.(*config.Config); ok && cfg != nil {
-		timeout = cfg.GracefulTimeout
+	if appCfg, ok := ctx.Value(config.Key{}).(*config.Config); ok && appCfg != nil {
+		timeout = appCfg.GracefulTimeout
 	}
 	m.timeout = timeout
 
-	opts := options.Client().ApplyURI(connAddr).SetConnectTimeout(timeout)
+	cs, err := connstring.ParseAndValidate(cfg.Addr)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "mongo address")
+	}
+	opts := options.Client().ApplyURI(cfg.Addr).SetConnectTimeout(timeout)
+	if cfg.MongoPoolSize > 0 {
+		opts.SetMaxPoolSize(cfg.MongoPoolSize)
+	}
 	client, err := mongo.Connect(ctx, opts)
 	if !tools.Try(err) {
 		return errors.Wrap(err, "mongo connect failed")
@@ -46,51 +76,291 @@ func (m *MongoDB) Init(ctx context.Context, connAddr string) error {
 	if !tools.Try(err) {
 		return errors.Wrap(err, "mongo ping failed")
 	}
-	m.clients = client.Database("mend").Collection("clients")
-	m.projects = client.Database("mend").Collection("projects")
-	m.counters = client.Database("mend").Collection("counters")
+	database := cs.Database // Defaults to mend, unless the address has a path
+	if database == "" {
+		database = "mend"
+	}
+	m.db = client.Database(database)
+	m.clients = m.db.Collection("clients")
+	m.projects = m.db.Collection("projects")
+	m.counters = m.db.Collection("counters")
+	m.audit = m.db.Collection("audit")
+	m.outbox = m.db.Collection("outbox")
+	m.deliveries = m.db.Collection("deliveries")
+	m.webhooks = m.db.Collection("webhooks")
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err = client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "mongo hello failed")
+	}
+	m.transactional = hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !m.transactional {
+		log.Warnln("MongoDB is standalone, transactions are not available")
+	}
 	return nil
 }
 
-func (m *MongoDB) Shutdown() {
-	tools.Try(m.conn.Disconnect(m.ctx), true)
+// Transactional Tells if WithTx runs in a transaction, the server has to be a replica set or a sharded cluster.
+func (m *MongoDB) Transactional() bool {
+	return m.transactional
 }
 
-func (m *MongoDB) SelectClients() ([]*Client, error) {
-	//goland:noinspection ALL
-	res := []*Client{}
-	ctx := m.getCtx()
-	cur, err := m.clients.Find(ctx, bson.D{})
-	if !tools.Try(err) {
-		return nil, passNotFound(err)
+// WithTx Runs fn in a session transaction, which is retried as a whole on transient errors, so fn may run again.
+// There are no savepoints, a failed write aborts the transaction. Standalone servers have no transactions,
+// so fn runs on the adapter itself, every call applied on its own, see Transactional.
+func (m *MongoDB) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	if m.session != nil || !m.transactional {
+		return fn(m)
 	}
+	return m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		scoped := *m
+		scoped.session = ctx
+		return fn(&scoped)
+	})
+}
 
-	for cur.Next(ctx) {
-		client := &Client{}
-		err = cur.Decode(client)
-		if !tools.Try(err) {
-			return nil, err
+// Migrate Applies mongoMigrations, the version is kept in the schema_migrations collection.
+func (m *MongoDB) Migrate(ctx context.Context, mode MigrateMode) error {
+	if mode == MigrateOff {
+		return nil
+	}
+	versions := m.db.Collection("schema_migrations")
+	current := struct {
+		Version int  `bson:"version"`
+		Dirty   bool `bson:"dirty"`
+	}{}
+	err := versions.FindOne(ctx, bson.M{"_id": "version"}).Decode(&current)
+	if !tools.Try(err) && err != mongo.ErrNoDocuments {
+		return errors.Wrap(err, "schema version")
+	}
+	if current.Dirty {
+		return errors.Errorf("schema version %d is dirty, fix it manually", current.Version)
+	}
+	latest := len(mongoMigrations)
+	if current.Version >= latest {
+		return nil
+	}
+	if mode == MigrateCheck {
+		return ErrSchemaOutdated{Current: current.Version, Latest: latest}
+	}
+
+	setVersion := func(version int, dirty bool) error {
+		_, err := versions.UpdateOne(
+			ctx,
+			bson.M{"_id": "version"},
+			bson.M{"$set": bson.M{"version": version, "dirty": dirty}},
+			options.Update().SetUpsert(true),
+		)
+		return err
+	}
+	for version := current.Version + 1; version <= latest; version++ {
+		if err = setVersion(version, true); !tools.Try(err) {
+			return err
+		}
+		if err = mongoMigrations[version-1](ctx, m.db); !tools.Try(err) {
+			return errors.Wrapf(err, "migration %d", version)
 		}
-		res = append(res, client)
+		if err = setVersion(version, false); !tools.Try(err) {
+			return err
+		}
+		log.Infoln("applied mongo migration", version)
 	}
-	err = cur.Err()
+	return nil
+}
+
+// mongoMigrations Schema steps of MongoDB, the position in the slice is the version.
+var mongoMigrations = []func(ctx context.Context, db *mongo.Database) error{
+	// 1: collections and indexes equivalent to the SQL tables.
+	func(ctx context.Context, db *mongo.Database) error {
+		if err := ensureCollections(ctx, db, "clients", "projects", "counters"); !tools.Try(err) {
+			return err
+		}
+		unique := options.Index().SetUnique(true)
+		_, err := db.Collection("clients").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "id", Value: 1}}, Options: unique,
+		})
+		if !tools.Try(err) {
+			return err
+		}
+		_, err = db.Collection("projects").Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+			{Keys: bson.D{{Key: "client_id", Value: 1}}},
+		})
+		return err
+	},
+	// 2: projects of missing clients get detached, as client_id is checked since.
+	func(ctx context.Context, db *mongo.Database) error {
+		clientIDs, err := db.Collection("clients").Distinct(ctx, "id", bson.D{})
+		if !tools.Try(err) {
+			return err
+		}
+		_, err = db.Collection("projects").UpdateMany(
+			ctx,
+			bson.M{"client_id": bson.M{"$ne": nil, "$nin": clientIDs}},
+			bson.M{"$set": bson.M{"client_id": nil}},
+		)
+		return err
+	},
+	// 3: entity versions for optimistic concurrency.
+	func(ctx context.Context, db *mongo.Database) error {
+		for _, name := range []string{"clients", "projects"} {
+			_, err := db.Collection(name).UpdateMany(
+				ctx,
+				bson.M{"version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version": 1}},
+			)
+			if !tools.Try(err) {
+				return err
+			}
+		}
+		return nil
+	},
+	// 4: audit log of the writes.
+	func(ctx context.Context, db *mongo.Database) error {
+		if err := ensureCollections(ctx, db, "audit"); !tools.Try(err) {
+			return err
+		}
+		_, err := db.Collection("audit").Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "entity", Value: 1}, {Key: "entity_id", Value: 1}}},
+		})
+		return err
+	},
+	// 5: text indexes of the names for the search.
+	func(ctx context.Context, db *mongo.Database) error {
+		for _, name := range []string{"clients", "projects"} {
+			_, err := db.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "name", Value: "text"}},
+			})
+			if !tools.Try(err) {
+				return err
+			}
+		}
+		return nil
+	},
+	// 6: outbox of the events, their deliveries and the webhooks.
+	func(ctx context.Context, db *mongo.Database) error {
+		if err := ensureCollections(ctx, db, "outbox", "deliveries", "webhooks"); !tools.Try(err) {
+			return err
+		}
+		unique := options.Index().SetUnique(true)
+		for _, name := range []string{"outbox", "webhooks"} {
+			_, err := db.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "id", Value: 1}}, Options: unique,
+			})
+			if !tools.Try(err) {
+				return err
+			}
+		}
+		_, err := db.Collection("outbox").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "at", Value: 1}},
+		})
+		if !tools.Try(err) {
+			return err
+		}
+		_, err = db.Collection("deliveries").Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+			{Keys: bson.D{{Key: "webhook_id", Value: 1}}},
+			{Keys: bson.D{{Key: "event_id", Value: 1}}},
+		})
+		return err
+	},
+}
+
+func ensureCollections(ctx context.Context, db *mongo.Database, names ...string) error {
+	existing, err := db.ListCollectionNames(ctx, bson.D{})
 	if !tools.Try(err) {
-		return res, passNotFound(err)
+		return err
 	}
-	err = cur.Close(ctx)
-	if !tools.Try(err) {
-		return res, passNotFound(err)
+	for _, name := range names {
+		found := false
+		for _, e := range existing {
+			found = found || e == name
+		}
+		if found {
+			continue
+		}
+		if err = db.CreateCollection(ctx, name); !tools.Try(err) {
+			return err
+		}
 	}
+	return nil
+}
 
-	if len(res) == 0 {
-		return res, ErrNotFound{}
+// Close Disconnects, waiting for the operations in progress until the context is done.
+// Within WithTx the connections are left open, they are not the transaction's to close.
+func (m *MongoDB) Close(ctx context.Context) error {
+	if m.session != nil {
+		return nil
 	}
-	return res, nil
+	defer m.cancel()
+	return m.conn.Disconnect(ctx)
+}
+
+// Ping Checks the primary is reachable.
+func (m *MongoDB) Ping(ctx context.Context) error {
+	return m.conn.Ping(ctx, nil)
 }
 
-func (m *MongoDB) GetClient(ID int) (*Client, error) {
+// Search Ranks the names by the score of the text indexes, the words match whole and stemmed.
+func (m *MongoDB) Search(ctx context.Context, text string, limit int) ([]*SearchHit, error) {
+	hits := []*SearchHit{}
+	phrases := searchPhrases(text, false)
+	if phrases == "" {
+		return hits, nil
+	}
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"id": 1, "name": 1, "score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	for hitType, collection := range map[string]*mongo.Collection{HitClient: m.clients, HitProject: m.projects} {
+		cur, err := collection.Find(ctx, bson.M{"$text": bson.M{"$search": phrases}, "deleted_at": nil}, opts)
+		if !tools.Try(err) {
+			return nil, errors.Wrap(err, "search")
+		}
+		var docs []struct {
+			ID    int     `bson:"id"`
+			Name  string  `bson:"name"`
+			Score float64 `bson:"score"`
+		}
+		if err = cur.All(ctx, &docs); !tools.Try(err) {
+			return nil, errors.Wrap(err, "search")
+		}
+		for _, doc := range docs {
+			hits = append(hits, &SearchHit{Type: hitType, ID: doc.ID, Name: doc.Name, Rank: doc.Score})
+		}
+	}
+	return sortHits(hits, limit), nil
+}
+
+func (m *MongoDB) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	//goland:noinspection ALL
+	res := []*Client{}
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	err := m.findPage(ctx, m.clients, trashFilter(query), ClientSchema, query, page, &res)
+	if !tools.Try(err) {
+		return nil, false, err
+	}
+	res, more := window(res, page)
+	return res, more, nil
+}
+
+func (m *MongoDB) GetClient(ctx context.Context, ID int) (*Client, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
 	var res *Client
-	mres := m.clients.FindOne(m.getCtx(), bson.M{"id": ID})
+	mres := m.clients.FindOne(ctx, liveFilter(ID))
 	if mres == nil {
 		return nil, ErrNotFound{}
 	}
@@ -105,81 +375,220 @@ func (m *MongoDB) GetClient(ID int) (*Client, error) {
 	return res, nil
 }
 
-func (m *MongoDB) UpsertClient(client *Client) (*Client, error) {
+func (m *MongoDB) CreateClient(ctx context.Context, client *Client) (*Client, error) {
 	if client == nil {
 		return nil, ErrNilEntity{}
 	}
 
-	if client.ID == nil {
-		newID := m.newClientID()
-		client.ID = &newID
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	stored := *client
+	ID, err := m.claimID(ctx, "clients", client.ID)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	stored.ID = &ID
+	stored.Version = 1
+	stored.DeletedAt = nil
+	_, err = m.clients.InsertOne(ctx, stored)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrAlreadyExists{err}
 	}
-	ctx := m.getCtx()
-	res, err := m.clients.UpdateOne(
-		ctx,
-		bson.M{"id": client.ID},
-		bson.D{{Key: "$set", Value: client}},
-		options.Update().SetUpsert(true),
-	)
 	if !tools.Try(err) {
 		return nil, err
 	}
-	if res.UpsertedCount+res.ModifiedCount == 0 {
-		return nil, ErrNotFound{}
+	return m.GetClient(ctx, ID)
+}
+
+func (m *MongoDB) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil || client.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	var res *Client
+	err := m.clients.FindOneAndUpdate(
+		ctx,
+		versionFilter(*client.ID, client.Version),
+		clientChanges(client),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&res)
+	if err == mongo.ErrNoDocuments {
+		return nil, m.unmatched(ctx, m.clients, *client.ID, client.Version)
 	}
-	newClient, err := m.GetClient(*client.ID)
 	if !tools.Try(err) {
 		return nil, err
 	}
-	return newClient, nil
+	return res, nil
 }
 
-func (m *MongoDB) DeleteClient(ID int) error {
-	dres, err := m.clients.DeleteOne(m.getCtx(), bson.M{"id": ID})
+// UpdateClient Compare-and-swap: the changes only apply to the version which was read.
+func (m *MongoDB) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		client, err := m.GetClient(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		version := client.Version
+		if err = update(client); !tools.Try(err) {
+			return nil, err
+		}
+		if client.ID == nil || *client.ID != ID {
+			return nil, errIDChanged
+		}
+		var res *Client
+		err = m.clients.FindOneAndUpdate(
+			ctx,
+			versionFilter(ID, version),
+			clientChanges(client),
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&res)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, errConcurrentUpdate
+}
+
+// DeleteClient Trashes the client before its projects are dealt with, so they are only touched once the versioned
+// write has matched. Both run in a transaction unless the server is standalone.
+func (m *MongoDB) DeleteClient(ctx context.Context, ID int, version int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	if !m.transactional {
+		return m.deleteClient(ctx, ID, version)
+	}
+	return m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		return m.deleteClient(ctx, ID, version)
+	})
+}
+
+func (m *MongoDB) deleteClient(ctx context.Context, ID int, version int) error {
+	client, err := m.GetClient(ctx, ID)
 	if !tools.Try(err) {
-		return passNotFound(err)
+		return err
 	}
-	if dres.DeletedCount == 0 {
-		return ErrNotFound{}
+	if err = CheckVersion(client.Version, version); !tools.Try(err) {
+		return err
 	}
-	return nil
+	owned := bson.M{"client_id": ID, "deleted_at": nil}
+	if m.onClientDelete != DeleteCascade && m.onClientDelete != DeleteNullify {
+		n, err := m.projects.CountDocuments(ctx, owned)
+		if !tools.Try(err) {
+			return err
+		}
+		if n > 0 {
+			return ErrReferenced{errors.Errorf("client %d has %d projects", ID, n)}
+		}
+	}
+
+	deletedAt := tombstone()
+	ures, err := m.clients.UpdateOne(ctx, versionFilter(ID, version), trashChanges(deletedAt))
+	if !tools.Try(err) {
+		return err
+	}
+	if ures.MatchedCount == 0 {
+		return m.unmatched(ctx, m.clients, ID, version)
+	}
+	switch m.onClientDelete {
+	case DeleteCascade:
+		_, err = m.projects.UpdateMany(ctx, owned, trashChanges(deletedAt))
+	case DeleteNullify:
+		_, err = m.projects.UpdateMany(ctx, owned, bson.M{
+			"$set": bson.M{"client_id": nil},
+			"$inc": bson.M{"version": 1},
+		})
+	}
+	return err
 }
 
-func (m *MongoDB) SelectProjects() ([]*Project, error) {
-	//goland:noinspection ALL
-	res := []*Project{}
-	ctx := m.getCtx()
-	cur, err := m.projects.Find(ctx, bson.D{})
+// RestoreClient Projects trashed at the same moment as the client were trashed along with it.
+// Both run in a transaction unless the server is standalone.
+func (m *MongoDB) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	if !m.transactional {
+		return m.restoreClient(ctx, ID)
+	}
+	var res *Client
+	err := m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var err error
+		res, err = m.restoreClient(ctx, ID)
+		return err
+	})
+	return res, err
+}
+
+func (m *MongoDB) restoreClient(ctx context.Context, ID int) (*Client, error) {
+	var trashed *Client
+	err := m.clients.FindOneAndUpdate(
+		ctx,
+		trashedFilter(ID),
+		restoreChanges(),
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&trashed)
 	if !tools.Try(err) {
 		return nil, passNotFound(err)
 	}
+	_, err = m.projects.UpdateMany(ctx, bson.M{"client_id": ID, "deleted_at": trashed.DeletedAt}, restoreChanges())
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return m.GetClient(ctx, ID)
+}
 
-	for cur.Next(ctx) {
-		project := &Project{}
-		err = cur.Decode(project)
-		if !tools.Try(err) {
-			return nil, err
-		}
-		res = append(res, project)
+// PurgeClient Deletes the trashed projects of the client along with it, in a transaction unless the server is standalone.
+func (m *MongoDB) PurgeClient(ctx context.Context, ID int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	if !m.transactional {
+		return m.purgeClient(ctx, ID)
 	}
-	err = cur.Err()
+	return m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		return m.purgeClient(ctx, ID)
+	})
+}
+
+func (m *MongoDB) purgeClient(ctx context.Context, ID int) error {
+	n, err := m.clients.CountDocuments(ctx, trashedFilter(ID))
 	if !tools.Try(err) {
-		return res, passNotFound(err)
+		return err
 	}
-	err = cur.Close(ctx)
+	if n == 0 {
+		return ErrNotFound{}
+	}
+	_, err = m.projects.DeleteMany(ctx, bson.M{"client_id": ID, "deleted_at": bson.M{"$ne": nil}})
 	if !tools.Try(err) {
-		return res, passNotFound(err)
+		return err
 	}
+	return m.purge(ctx, m.clients, ID)
+}
 
-	if len(res) == 0 {
-		return res, ErrNotFound{}
+func (m *MongoDB) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	//goland:noinspection ALL
+	res := []*Project{}
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	err := m.findPage(ctx, m.projects, trashFilter(query), ProjectSchema, query, page, &res)
+	if !tools.Try(err) {
+		return nil, false, err
 	}
-	return res, nil
+	res, more := window(res, page)
+	return res, more, nil
 }
 
-func (m *MongoDB) GetProject(ID int) (*Project, error) {
+func (m *MongoDB) GetProject(ctx context.Context, ID int) (*Project, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
 	var res *Project
-	mres := m.projects.FindOne(m.getCtx(), bson.M{"id": ID})
+	mres := m.projects.FindOne(ctx, liveFilter(ID))
 	if mres == nil {
 		return nil, ErrNotFound{}
 	}
@@ -194,71 +603,545 @@ func (m *MongoDB) GetProject(ID int) (*Project, error) {
 	return res, nil
 }
 
-func (m *MongoDB) SelectProjectsOfClient(ID int) ([]*Project, error) {
-	//goland:noinspection ALL
-	res := []*Project{}
-	ctx := m.getCtx()
-	cur, err := m.projects.Find(ctx, bson.M{"client_id": ID})
+func (m *MongoDB) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil {
+		return nil, ErrNilEntity{}
+	}
+
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	if err := m.checkClientExists(ctx, project.ClientID); !tools.Try(err) {
+		return nil, err
+	}
+	stored := *project
+	ID, err := m.claimID(ctx, "projects", project.ID)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	stored.ID = &ID
+	stored.Version = 1
+	stored.DeletedAt = nil
+	_, err = m.projects.InsertOne(ctx, stored)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrAlreadyExists{err}
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return m.GetProject(ctx, ID)
+}
+
+func (m *MongoDB) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil || project.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	if err := m.checkClientExists(ctx, project.ClientID); !tools.Try(err) {
+		return nil, err
+	}
+	var res *Project
+	err := m.projects.FindOneAndUpdate(
+		ctx,
+		versionFilter(*project.ID, project.Version),
+		projectChanges(project),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&res)
+	if err == mongo.ErrNoDocuments {
+		return nil, m.unmatched(ctx, m.projects, *project.ID, project.Version)
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateProject Compare-and-swap: the changes only apply to the version which was read.
+func (m *MongoDB) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		project, err := m.GetProject(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		version := project.Version
+		if err = update(project); !tools.Try(err) {
+			return nil, err
+		}
+		if project.ID == nil || *project.ID != ID {
+			return nil, errIDChanged
+		}
+		if err = m.checkClientExists(ctx, project.ClientID); !tools.Try(err) {
+			return nil, err
+		}
+		var res *Project
+		err = m.projects.FindOneAndUpdate(
+			ctx,
+			versionFilter(ID, version),
+			projectChanges(project),
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&res)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, errConcurrentUpdate
+}
+
+func (m *MongoDB) DeleteProject(ctx context.Context, ID int, version int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ures, err := m.projects.UpdateOne(ctx, versionFilter(ID, version), trashChanges(tombstone()))
+	if !tools.Try(err) {
+		return err
+	}
+	if ures.MatchedCount == 0 {
+		return m.unmatched(ctx, m.projects, ID, version)
+	}
+	return nil
+}
+
+func (m *MongoDB) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	var trashed *Project
+	if err := m.projects.FindOne(ctx, trashedFilter(ID)).Decode(&trashed); !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	if err := m.checkClientExists(ctx, trashed.ClientID); !tools.Try(err) {
+		return nil, err
+	}
+	var res *Project
+	err := m.projects.FindOneAndUpdate(
+		ctx,
+		trashedFilter(ID),
+		restoreChanges(),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&res)
 	if !tools.Try(err) {
 		return nil, passNotFound(err)
 	}
+	return res, nil
+}
 
-	for cur.Next(ctx) {
-		project := &Project{}
-		err = cur.Decode(project)
+func (m *MongoDB) PurgeProject(ctx context.Context, ID int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	return m.purge(ctx, m.projects, ID)
+}
+
+// inSession Tells if the calls are made in the transaction of WithTx.
+func (m *MongoDB) inSession() bool {
+	return m.session != nil
+}
+
+// getCtx Bounds the caller's context with the configured per-operation timeout, binding it to the session of WithTx.
+func (m *MongoDB) getCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	if m.session != nil {
+		return mongo.NewSessionContext(ctx, m.session), cancel
+	}
+	return ctx, cancel
+}
+
+func (m *MongoDB) checkClientExists(ctx context.Context, ID *int) error {
+	if ID == nil {
+		return nil
+	}
+	n, err := m.clients.CountDocuments(ctx, liveFilter(*ID))
+	if !tools.Try(err) {
+		return err
+	}
+	if n == 0 {
+		return ErrDanglingReference{errors.Errorf("client %d does not exist", *ID)}
+	}
+	return nil
+}
+
+func (m *MongoDB) AppendAudit(ctx context.Context, entry *AuditEntry) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ID, err := m.newID(ctx, "audit")
+	if !tools.Try(err) {
+		return err
+	}
+	entry.ID = ID
+	_, err = m.audit.InsertOne(ctx, entry)
+	return err
+}
+
+func (m *MongoDB) SelectAudit(ctx context.Context, query Query, since time.Time, page Page) ([]*AuditEntry, bool, error) {
+	//goland:noinspection ALL
+	res := []*AuditEntry{}
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	err := m.findPage(ctx, m.audit, bson.M{"at": bson.M{"$gte": since}}, AuditSchema, query, page, &res)
+	if !tools.Try(err) {
+		return nil, false, err
+	}
+	res, more := window(res, page)
+	return res, more, nil
+}
+
+// AppendEvent Outside of a transaction the event may be left with a part of its deliveries, if the insert fails.
+func (m *MongoDB) AppendEvent(ctx context.Context, event *Event) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ID, err := m.newID(ctx, "outbox")
+	if !tools.Try(err) {
+		return err
+	}
+	event.ID = ID
+	if _, err = m.outbox.InsertOne(ctx, event); !tools.Try(err) {
+		return err
+	}
+	cursor, err := m.webhooks.Find(ctx, bson.D{}, options.Find().SetProjection(bson.M{"id": 1}))
+	if !tools.Try(err) {
+		return err
+	}
+	var webhooks []*Webhook
+	if err = cursor.All(ctx, &webhooks); !tools.Try(err) || len(webhooks) == 0 {
+		return err
+	}
+	deliveries := make([]interface{}, len(webhooks))
+	for i, webhook := range webhooks {
+		ID, err := m.newID(ctx, "deliveries")
+		if !tools.Try(err) {
+			return err
+		}
+		deliveries[i] = Delivery{
+			ID:            ID,
+			EventID:       event.ID,
+			WebhookID:     webhook.ID,
+			State:         DeliveryPending,
+			NextAttemptAt: event.At,
+		}
+	}
+	_, err = m.deliveries.InsertMany(ctx, deliveries)
+	return err
+}
+
+// ClaimDeliveries Postpones the due deliveries one by one, each of them is claimed by a single caller.
+func (m *MongoDB) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	until := now.Add(lease).UTC().Truncate(time.Millisecond)
+	res := []*Delivery{}
+	for limit <= 0 || len(res) < limit {
+		var delivery *Delivery
+		err := m.deliveries.FindOneAndUpdate(
+			ctx,
+			bson.M{"state": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"next_attempt_at": until}},
+			options.FindOneAndUpdate().
+				SetSort(bson.D{{Key: "next_attempt_at", Value: 1}, {Key: "id", Value: 1}}).
+				SetReturnDocument(options.After),
+		).Decode(&delivery)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
 		if !tools.Try(err) {
 			return nil, err
 		}
-		res = append(res, project)
+		res = append(res, delivery)
 	}
-	err = cur.Err()
+	if err := m.attachEvents(ctx, res); !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *MongoDB) SaveDelivery(ctx context.Context, delivery *Delivery) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ures, err := m.deliveries.UpdateOne(ctx, bson.M{"id": delivery.ID}, bson.M{"$set": bson.M{
+		"state":           delivery.State,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"last_error":      delivery.LastError,
+	}})
 	if !tools.Try(err) {
-		return res, passNotFound(err)
+		return err
+	}
+	if ures.MatchedCount == 0 {
+		return ErrNotFound{}
+	}
+	return nil
+}
+
+func (m *MongoDB) SelectDeliveries(ctx context.Context, state DeliveryState, limit int) ([]*Delivery, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
 	}
-	err = cur.Close(ctx)
+	cursor, err := m.deliveries.Find(ctx, bson.M{"state": state}, opts)
 	if !tools.Try(err) {
-		return res, passNotFound(err)
+		return nil, err
+	}
+	res := []*Delivery{}
+	if err = cursor.All(ctx, &res); !tools.Try(err) {
+		return nil, err
+	}
+	if err = m.attachEvents(ctx, res); !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *MongoDB) RetryDelivery(ctx context.Context, ID int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ures, err := m.deliveries.UpdateOne(ctx, bson.M{"id": ID, "state": DeliveryDead}, bson.M{"$set": bson.M{
+		"state":           DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now().UTC(),
+		"last_error":      "",
+	}})
+	if !tools.Try(err) {
+		return err
+	}
+	if ures.MatchedCount == 0 {
+		return ErrNotFound{}
+	}
+	return nil
+}
+
+func (m *MongoDB) SelectWebhooks(ctx context.Context) ([]*Webhook, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	cursor, err := m.webhooks.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if !tools.Try(err) {
+		return nil, err
+	}
+	res := []*Webhook{}
+	if err = cursor.All(ctx, &res); !tools.Try(err) {
+		return nil, err
 	}
+	return res, nil
+}
 
-	if len(res) == 0 {
-		return res, ErrNotFound{}
+func (m *MongoDB) GetWebhook(ctx context.Context, ID int) (*Webhook, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	var res *Webhook
+	if err := m.webhooks.FindOne(ctx, bson.M{"id": ID}).Decode(&res); !tools.Try(err) {
+		return nil, passNotFound(err)
 	}
 	return res, nil
 }
 
-func (m *MongoDB) UpsertProject(project *Project) (*Project, error) {
-	if project == nil {
+func (m *MongoDB) CreateWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
 		return nil, ErrNilEntity{}
 	}
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	ID, err := m.newID(ctx, "webhooks")
+	if !tools.Try(err) {
+		return nil, err
+	}
+	res := *webhook
+	res.ID = ID
+	if _, err = m.webhooks.InsertOne(ctx, res); !tools.Try(err) {
+		return nil, err
+	}
+	return &res, nil
+}
 
-	if project.ID == nil {
-		newID := m.newProjectID()
-		project.ID = &newID
+func (m *MongoDB) ReplaceWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
+		return nil, ErrNilEntity{}
 	}
-	ctx := m.getCtx()
-	res, err := m.projects.UpdateOne(
-		ctx,
-		bson.M{"id": project.ID},
-		bson.D{{Key: "$set", Value: project}},
-		options.Update().SetUpsert(true),
-	)
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	res := *webhook
+	ures, err := m.webhooks.ReplaceOne(ctx, bson.M{"id": webhook.ID}, res)
 	if !tools.Try(err) {
 		return nil, err
 	}
-	if res.UpsertedCount+res.ModifiedCount == 0 {
+	if ures.MatchedCount == 0 {
 		return nil, ErrNotFound{}
 	}
-	newProject, err := m.GetProject(*project.ID)
+	return &res, nil
+}
+
+// DeleteWebhook The deliveries go first, so the ones left behind by a failure still have their webhook.
+func (m *MongoDB) DeleteWebhook(ctx context.Context, ID int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	n, err := m.webhooks.CountDocuments(ctx, bson.M{"id": ID})
 	if !tools.Try(err) {
-		return nil, err
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound{}
+	}
+	if _, err = m.deliveries.DeleteMany(ctx, bson.M{"webhook_id": ID}); !tools.Try(err) {
+		return err
 	}
-	return newProject, nil
+	dres, err := m.webhooks.DeleteOne(ctx, bson.M{"id": ID})
+	if !tools.Try(err) {
+		return err
+	}
+	if dres.DeletedCount == 0 {
+		return ErrNotFound{}
+	}
+	return nil
 }
 
-func (m *MongoDB) DeleteProject(ID int) error {
-	dres, err := m.projects.DeleteOne(m.getCtx(), bson.M{"id": ID})
+// PruneEvents The deliveries go first, so a failure leaves no deliveries without their events.
+func (m *MongoDB) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	old, err := m.outbox.Distinct(ctx, "id", bson.M{"at": bson.M{"$lt": before}})
+	if !tools.Try(err) || len(old) == 0 {
+		return 0, err
+	}
+	_, err = m.deliveries.DeleteMany(ctx, bson.M{"state": DeliveryDone, "event_id": bson.M{"$in": old}})
 	if !tools.Try(err) {
-		return passNotFound(err)
+		return 0, err
+	}
+	delivering, err := m.deliveries.Distinct(ctx, "event_id", bson.M{"event_id": bson.M{"$in": old}})
+	if !tools.Try(err) {
+		return 0, err
+	}
+	dres, err := m.outbox.DeleteMany(ctx, bson.M{"id": bson.M{"$in": old, "$nin": delivering}})
+	if !tools.Try(err) {
+		return 0, err
+	}
+	return int(dres.DeletedCount), nil
+}
+
+// attachEvents Finds the events of the deliveries.
+func (m *MongoDB) attachEvents(ctx context.Context, deliveries []*Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	cursor, err := m.outbox.Find(ctx, bson.M{"id": bson.M{"$in": eventIDs(deliveries)}})
+	if !tools.Try(err) {
+		return err
+	}
+	var events []*Event
+	if err = cursor.All(ctx, &events); !tools.Try(err) {
+		return err
+	}
+	attachEvents(deliveries, events)
+	return nil
+}
+
+// findPage Finds the documents matching the base filter and the query filter within the keyset bounds of the page,
+// in the query order, taking one extra document to peek past its limit.
+func (m *MongoDB) findPage(
+	ctx context.Context, coll *mongo.Collection, base bson.M, schema *Schema, query Query, page Page, res interface{},
+) error {
+	conds := bson.A{base}
+	if query.Filter != nil {
+		conds = append(conds, bsonFilter(query.Filter))
+	}
+	keys := schema.sortKeys(query)
+	if page.After != nil {
+		conds = append(conds, bsonKeyset(keys, page.After, false))
+	}
+	if page.Before != nil {
+		conds = append(conds, bsonKeyset(keys, page.Before, true))
+	}
+	filter := bson.M{"$and": conds}
+	order := bson.D{}
+	for _, key := range keys {
+		direction := 1
+		if key.Desc != page.Backward() {
+			direction = -1
+		}
+		order = append(order, bson.E{Key: key.Field.Key, Value: direction})
+	}
+	opts := options.Find().SetSort(order)
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit + 1))
+	}
+	cur, err := coll.Find(ctx, filter, opts)
+	if !tools.Try(err) {
+		return err
+	}
+	return cur.All(ctx, res)
+}
+
+// trashFilter Selects either the live or the trashed documents.
+func trashFilter(query Query) bson.M {
+	if query.Trash {
+		return bson.M{"deleted_at": bson.M{"$ne": nil}}
+	}
+	return bson.M{"deleted_at": nil}
+}
+
+// bsonFilter Translates the filter into the query document, a missing key counts as null.
+func bsonFilter(node Node) bson.M {
+	var conds bson.A
+	switch n := node.(type) {
+	case And:
+		for _, operand := range n.Nodes {
+			conds = append(conds, bsonFilter(operand))
+		}
+		return bson.M{"$and": conds}
+	case Or:
+		for _, operand := range n.Nodes {
+			conds = append(conds, bsonFilter(operand))
+		}
+		return bson.M{"$or": conds}
+	case Comparison:
+		return bson.M{n.Field.Key: bsonComparison(n)}
+	}
+	return bson.M{"_id": bson.M{"$exists": false}}
+}
+
+func bsonComparison(c Comparison) bson.M {
+	switch c.Op {
+	case OpIsNull:
+		if c.Values[0].(bool) {
+			return bson.M{"$eq": nil}
+		}
+		return bson.M{"$ne": nil}
+	case OpLike:
+		return bson.M{"$regex": likeRegexp(c.Values[0].(string)), "$options": "is"}
+	case OpIn:
+		return bson.M{"$in": c.Values}
+	case OpOut:
+		return bson.M{"$nin": c.Values}
+	}
+	op := map[Operator]string{OpEq: "$eq", OpNe: "$ne", OpLt: "$lt", OpLe: "$lte", OpGt: "$gt", OpGe: "$gte"}[c.Op]
+	return bson.M{op: c.Values[0]}
+}
+
+// bsonKeyset Condition of the documents past the keyset in the order of the keys, or ahead of it.
+func bsonKeyset(keys []SortKey, keyset Keyset, ahead bool) bson.M {
+	var ors bson.A
+	for i, key := range keys {
+		cond := bson.M{}
+		for j, prev := range keys[:i] {
+			cond[prev.Field.Key] = keyset[j]
+		}
+		op := "$gt"
+		if key.Desc != ahead {
+			op = "$lt"
+		}
+		cond[key.Field.Key] = bson.M{op: keyset[i]}
+		ors = append(ors, cond)
+	}
+	return bson.M{"$or": ors}
+}
+
+// purge Deletes the trashed entity permanently.
+func (m *MongoDB) purge(ctx context.Context, coll *mongo.Collection, ID int) error {
+	dres, err := coll.DeleteOne(ctx, trashedFilter(ID))
+	if !tools.Try(err) {
+		return err
 	}
 	if dres.DeletedCount == 0 {
 		return ErrNotFound{}
@@ -266,25 +1149,168 @@ func (m *MongoDB) DeleteProject(ID int) error {
 	return nil
 }
 
-func (m *MongoDB) getCtx() context.Context {
-	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
-	time.AfterFunc(m.timeout+(1*time.Second), func() {
-		cancel()
+// unmatched Tells why the versioned filter of the entity matched nothing.
+func (m *MongoDB) unmatched(ctx context.Context, coll *mongo.Collection, ID int, version int) error {
+	var stored struct {
+		Version int `bson:"version"`
+	}
+	err := coll.FindOne(ctx, liveFilter(ID)).Decode(&stored)
+	if !tools.Try(err) {
+		return passNotFound(err)
+	}
+	if err = CheckVersion(stored.Version, version); !tools.Try(err) {
+		return err
+	}
+	return ErrVersionMismatch{errors.New("entity has changed concurrently")}
+}
+
+// liveFilter Matches the entity unless it's trashed, a missing deleted_at counts as null.
+func liveFilter(ID int) bson.M {
+	return bson.M{"id": ID, "deleted_at": nil}
+}
+
+func trashedFilter(ID int) bson.M {
+	return bson.M{"id": ID, "deleted_at": bson.M{"$ne": nil}}
+}
+
+// versionFilter Matches the entity of the version, any version if it's zero.
+func versionFilter(ID int, version int) bson.M {
+	filter := liveFilter(ID)
+	if version != 0 {
+		filter["version"] = version
+	}
+	return filter
+}
+
+func trashChanges(deletedAt time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{"deleted_at": deletedAt},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+func restoreChanges() bson.M {
+	return bson.M{
+		"$set": bson.M{"deleted_at": nil},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+func clientChanges(client *Client) bson.M {
+	return bson.M{
+		"$set": bson.M{"name": client.Name, "settings": client.Settings},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+func projectChanges(project *Project) bson.M {
+	return bson.M{
+		"$set": bson.M{"client_id": project.ClientID, "name": project.Name},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+// LoadClients Needs MongoDB to be a replica set, standalone servers have no transactions.
+func (m *MongoDB) LoadClients(ctx context.Context, clients []*Client, seq int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	return m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		for _, client := range clients {
+			_, err := m.clients.ReplaceOne(ctx, bson.M{"id": *client.ID}, client, options.Replace().SetUpsert(true))
+			if !tools.Try(err) {
+				return err
+			}
+			if _, err = m.claimID(ctx, "clients", client.ID); !tools.Try(err) {
+				return err
+			}
+		}
+		_, err := m.claimID(ctx, "clients", &seq)
+		return err
 	})
-	return ctx
 }
 
-func (m *MongoDB) newClientID() int {
-	return m.newID("clients")
+func (m *MongoDB) LoadProjects(ctx context.Context, projects []*Project, seq int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	return m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		for _, project := range projects {
+			if project.ClientID != nil {
+				n, err := m.clients.CountDocuments(ctx, bson.M{"id": *project.ClientID})
+				if !tools.Try(err) {
+					return err
+				}
+				if n == 0 {
+					return ErrDanglingReference{errors.Errorf("client %d does not exist", *project.ClientID)}
+				}
+			}
+			_, err := m.projects.ReplaceOne(ctx, bson.M{"id": *project.ID}, project, options.Replace().SetUpsert(true))
+			if !tools.Try(err) {
+				return err
+			}
+			if _, err = m.claimID(ctx, "projects", project.ID); !tools.Try(err) {
+				return err
+			}
+		}
+		_, err := m.claimID(ctx, "projects", &seq)
+		return err
+	})
+}
+
+// transaction Runs the statements in a multi-document transaction, retried on transient errors.
+// Within WithTx they join its transaction.
+func (m *MongoDB) transaction(ctx context.Context, stmts func(ctx mongo.SessionContext) error) error {
+	if m.session != nil {
+		return stmts(mongo.NewSessionContext(ctx, m.session))
+	}
+	return m.conn.UseSession(ctx, func(ctx mongo.SessionContext) error {
+		_, err := ctx.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+			return nil, stmts(ctx)
+		})
+		return err
+	})
+}
+
+// Sequence Returns the counter of the collection.
+func (m *MongoDB) Sequence(ctx context.Context, collection string) (int, error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	counter := struct {
+		Seq int `bson:"seq"`
+	}{}
+	err := m.counters.FindOne(ctx, bson.D{{Key: "_id", Value: collection}}).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return counter.Seq, err
 }
 
-func (m *MongoDB) newProjectID() int {
-	return m.newID("projects")
+func (m *MongoDB) AdvanceSequence(ctx context.Context, collection string, ID int) error {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	_, err := m.claimID(ctx, collection, &ID)
+	return err
 }
 
-func (m *MongoDB) newID(key string) int {
+// claimID Allocates the next ID, or moves the counter past the explicit one, so it's never handed out later.
+func (m *MongoDB) claimID(ctx context.Context, key string, ID *int) (int, error) {
+	if ID == nil {
+		return m.newID(ctx, key)
+	}
+	_, err := m.counters.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: key}},
+		bson.D{{Key: "$max", Value: bson.D{{Key: "seq", Value: *ID}}}},
+		options.Update().SetUpsert(true),
+	)
+	if !tools.Try(err) {
+		return 0, err
+	}
+	return *ID, nil
+}
+
+func (m *MongoDB) newID(ctx context.Context, key string) (int, error) {
 	res := m.counters.FindOneAndUpdate(
-		m.getCtx(),
+		ctx,
 		bson.D{{Key: "_id", Value: key}},
 		bson.D{
 			{Key: "$inc", Value: bson.D{{Key: "seq", Value: 1}}},
@@ -293,10 +1319,9 @@ func (m *MongoDB) newID(key string) int {
 	)
 	if !tools.Try(res.Err()) {
 		if res.Err() == mongo.ErrNoDocuments {
-			return 1
-		} else {
-			tools.Must(res.Err())
+			return 1, nil
 		}
+		return 0, res.Err()
 	}
 
 	ID := struct {
@@ -304,6 +1329,424 @@ func (m *MongoDB) newID(key string) int {
 		Seq int    `bson:"seq"`
 	}{}
 	err := res.Decode(&ID)
-	tools.Must(err)
-	return ID.Seq
+	if !tools.Try(err) {
+		return 0, err
+	}
+	return ID.Seq, nil
+}
+
+// mongoStep Write of the batch operation at the index, which leaves the entity at the version.
+type mongoStep[T any] struct {
+	index   int
+	model   mongo.WriteModel
+	ID      int
+	version int
+	entity  *T
+	// after Writes to the other collections, once this one is done.
+	after  func(ctx context.Context) error
+	failed bool
+}
+
+// BatchClients Checks the operations against the stored clients, then writes them with a single ordered bulk write.
+// Projects of the deleted clients are dealt with after it, according to the delete policy.
+// Atomic batches run in a transaction, so MongoDB has to be a replica set for them. Within WithTx only atomic
+// batches are applied, their failure is returned as an error for the transaction to be rolled back.
+func (m *MongoDB) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	return mongoBatch(ctx, m, m.clients, ops, atomic, m.stageClients)
+}
+
+// BatchProjects Checks the operations against the stored projects and clients, then writes them with a single ordered bulk write.
+func (m *MongoDB) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	return mongoBatch(ctx, m, m.projects, ops, atomic, m.stageProjects)
+}
+
+func mongoBatch[T any](
+	ctx context.Context,
+	m *MongoDB,
+	coll *mongo.Collection,
+	ops []Operation[T],
+	atomic bool,
+	stage func(ctx context.Context, ops []Operation[T], outcomes []Outcome[T], atomic bool) ([]mongoStep[T], int, error),
+) ([]Outcome[T], error) {
+	ctx, cancel := m.getCtx(ctx)
+	defer cancel()
+	var outcomes []Outcome[T]
+	failed := -1
+	apply := func(ctx context.Context) (err error) {
+		var steps []mongoStep[T]
+		outcomes = make([]Outcome[T], len(ops))
+		steps, failed, err = stage(ctx, ops, outcomes, atomic)
+		if !tools.Try(err) || failed >= 0 {
+			return err
+		}
+		failed, err = bulkApply(ctx, coll, steps, outcomes, atomic)
+		return err
+	}
+	if !atomic {
+		if m.session != nil {
+			return nil, errSessionBatch
+		}
+		if err := apply(ctx); !tools.Try(err) {
+			return nil, err
+		}
+		return outcomes, nil
+	}
+	err := m.transaction(ctx, func(ctx mongo.SessionContext) error {
+		if err := apply(ctx); !tools.Try(err) {
+			return err
+		}
+		if failed >= 0 {
+			return errBatchFailed
+		}
+		return nil
+	})
+	if failed >= 0 && m.session != nil {
+		return nil, batchFailure{index: failed, err: outcomes[failed].Err}
+	}
+	if failed >= 0 {
+		return abortBatch(outcomes, failed), nil
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+// bulkApply Writes the steps in order, resuming past the failed ones unless atomic, then reads the entities back
+// to catch the concurrent changes, which the versioned filters silently skip.
+// Returns the index of the operation failing the atomic batch, or -1.
+func bulkApply[T any](ctx context.Context, coll *mongo.Collection, steps []mongoStep[T], outcomes []Outcome[T], atomic bool) (int, error) {
+	fail := func(step *mongoStep[T], err error) bool {
+		step.failed = true
+		outcomes[step.index].Err = err
+		return atomic
+	}
+	for start := 0; start < len(steps); {
+		models := make([]mongo.WriteModel, 0, len(steps)-start)
+		for _, step := range steps[start:] {
+			models = append(models, step.model)
+		}
+		_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+			if !tools.Try(err) {
+				return -1, err
+			}
+			break
+		}
+		writeErr := bwe.WriteErrors[0]
+		step := &steps[start+writeErr.Index]
+		err = writeErr
+		if mongo.IsDuplicateKeyError(writeErr) {
+			err = ErrAlreadyExists{writeErr}
+		}
+		if fail(step, err) {
+			return step.index, nil
+		}
+		start += writeErr.Index + 1
+	}
+
+	IDs := make([]int, 0, len(steps))
+	for _, step := range steps {
+		IDs = append(IDs, step.ID)
+	}
+	cur, err := coll.Find(ctx, bson.M{"id": bson.M{"$in": IDs}})
+	if !tools.Try(err) {
+		return -1, err
+	}
+	var docs []struct {
+		ID      int `bson:"id"`
+		Version int `bson:"version"`
+	}
+	if err = cur.All(ctx, &docs); !tools.Try(err) {
+		return -1, err
+	}
+	versions := make(map[int]int, len(docs))
+	for _, doc := range docs {
+		versions[doc.ID] = doc.Version
+	}
+	// the last write of the entity leaves it at the final version
+	final := make(map[int]int, len(steps))
+	for _, step := range steps {
+		if !step.failed {
+			final[step.ID] = step.version
+		}
+	}
+	for i := range steps {
+		step := &steps[i]
+		if step.failed {
+			continue
+		}
+		if versions[step.ID] != final[step.ID] {
+			if fail(step, ErrVersionMismatch{errors.New("entity has changed concurrently")}) {
+				return step.index, nil
+			}
+			continue
+		}
+		if step.after != nil {
+			if err = step.after(ctx); !tools.Try(err) && fail(step, err) {
+				return step.index, nil
+			}
+		}
+		outcomes[step.index].Entity = step.entity
+	}
+	return -1, nil
+}
+
+// stageClients Turns the operations into the steps, the ones which can't apply to the stored clients fail right away.
+func (m *MongoDB) stageClients(ctx context.Context, ops []Operation[Client], outcomes []Outcome[Client], atomic bool) ([]mongoStep[Client], int, error) {
+	var IDs []int
+	for _, op := range ops {
+		switch {
+		case op.Op == BatchDelete:
+			IDs = append(IDs, op.ID)
+		case op.Entity != nil && op.Entity.ID != nil:
+			IDs = append(IDs, *op.Entity.ID)
+		}
+	}
+	stored, err := findAll[Client](ctx, m.clients, IDs)
+	if !tools.Try(err) {
+		return nil, -1, err
+	}
+	var steps []mongoStep[Client]
+	for i, op := range ops {
+		step, err := m.stageClient(ctx, op, stored)
+		if err != nil && fault.KindOf(err) == fault.Internal {
+			return nil, -1, err
+		}
+		if !tools.Try(err) {
+			outcomes[i].Err = err
+			if atomic {
+				return nil, i, nil
+			}
+			continue
+		}
+		step.index = i
+		steps = append(steps, step)
+	}
+	return steps, -1, nil
+}
+
+func (m *MongoDB) stageClient(ctx context.Context, op Operation[Client], stored map[int]*Client) (mongoStep[Client], error) {
+	var step mongoStep[Client]
+	switch op.Op {
+	case BatchCreate:
+		if op.Entity == nil {
+			return step, ErrNilEntity{}
+		}
+		if op.Entity.ID != nil && stored[*op.Entity.ID] != nil {
+			return step, ErrAlreadyExists{errors.Errorf("id %d is taken", *op.Entity.ID)}
+		}
+		ID, err := m.claimID(ctx, "clients", op.Entity.ID)
+		if !tools.Try(err) {
+			return step, err
+		}
+		client := copyClient(*op.Entity)
+		client.ID, client.Version, client.DeletedAt = &ID, 1, nil
+		step.model = mongo.NewInsertOneModel().SetDocument(client)
+		step.ID, step.version, step.entity = ID, client.Version, client
+	case BatchUpdate:
+		if op.Entity == nil || op.Entity.ID == nil {
+			return step, ErrNilEntity{}
+		}
+		current, err := liveOf(stored, *op.Entity.ID, op.Entity.Version, func(client *Client) (int, bool) {
+			return client.Version, client.DeletedAt != nil
+		})
+		if !tools.Try(err) {
+			return step, err
+		}
+		client := copyClient(*op.Entity)
+		client.Version, client.DeletedAt = current.Version+1, nil
+		step.model = mongo.NewUpdateOneModel().SetFilter(versionFilter(*client.ID, current.Version)).SetUpdate(clientChanges(client))
+		step.ID, step.version, step.entity = *client.ID, client.Version, client
+	case BatchDelete:
+		current, err := liveOf(stored, op.ID, op.Version, func(client *Client) (int, bool) {
+			return client.Version, client.DeletedAt != nil
+		})
+		if !tools.Try(err) {
+			return step, err
+		}
+		owned := bson.M{"client_id": op.ID, "deleted_at": nil}
+		deletedAt := tombstone()
+		switch m.onClientDelete {
+		case DeleteCascade:
+			step.after = func(ctx context.Context) error {
+				_, err := m.projects.UpdateMany(ctx, owned, trashChanges(deletedAt))
+				return err
+			}
+		case DeleteNullify:
+			step.after = func(ctx context.Context) error {
+				_, err := m.projects.UpdateMany(ctx, owned, bson.M{
+					"$set": bson.M{"client_id": nil},
+					"$inc": bson.M{"version": 1},
+				})
+				return err
+			}
+		default:
+			n, err := m.projects.CountDocuments(ctx, owned)
+			if !tools.Try(err) {
+				return step, err
+			}
+			if n > 0 {
+				return step, ErrReferenced{errors.Errorf("client %d has %d projects", op.ID, n)}
+			}
+		}
+		client := copyClient(*current)
+		client.Version, client.DeletedAt = current.Version+1, &deletedAt
+		step.model = mongo.NewUpdateOneModel().SetFilter(versionFilter(op.ID, current.Version)).SetUpdate(trashChanges(deletedAt))
+		step.ID, step.version = op.ID, client.Version
+		stored[op.ID] = client
+		return step, nil
+	default:
+		return step, errUnknownOp(op.Op)
+	}
+	stored[step.ID] = step.entity
+	return step, nil
+}
+
+// stageProjects Turns the operations into the steps, the ones which can't apply to the stored projects fail right away.
+func (m *MongoDB) stageProjects(ctx context.Context, ops []Operation[Project], outcomes []Outcome[Project], atomic bool) ([]mongoStep[Project], int, error) {
+	var IDs, clientIDs []int
+	for _, op := range ops {
+		switch {
+		case op.Op == BatchDelete:
+			IDs = append(IDs, op.ID)
+		case op.Entity != nil:
+			if op.Entity.ID != nil {
+				IDs = append(IDs, *op.Entity.ID)
+			}
+			if op.Entity.ClientID != nil {
+				clientIDs = append(clientIDs, *op.Entity.ClientID)
+			}
+		}
+	}
+	stored, err := findAll[Project](ctx, m.projects, IDs)
+	if !tools.Try(err) {
+		return nil, -1, err
+	}
+	clients, err := findAll[Client](ctx, m.clients, clientIDs)
+	if !tools.Try(err) {
+		return nil, -1, err
+	}
+	var steps []mongoStep[Project]
+	for i, op := range ops {
+		step, err := m.stageProject(ctx, op, stored, clients)
+		if err != nil && fault.KindOf(err) == fault.Internal {
+			return nil, -1, err
+		}
+		if !tools.Try(err) {
+			outcomes[i].Err = err
+			if atomic {
+				return nil, i, nil
+			}
+			continue
+		}
+		step.index = i
+		steps = append(steps, step)
+	}
+	return steps, -1, nil
+}
+
+func (m *MongoDB) stageProject(ctx context.Context, op Operation[Project], stored map[int]*Project, clients map[int]*Client) (mongoStep[Project], error) {
+	var step mongoStep[Project]
+	version := func(project *Project) (int, bool) {
+		return project.Version, project.DeletedAt != nil
+	}
+	checkClient := func(ID *int) error {
+		if ID != nil && (clients[*ID] == nil || clients[*ID].DeletedAt != nil) {
+			return ErrDanglingReference{errors.Errorf("client %d does not exist", *ID)}
+		}
+		return nil
+	}
+	switch op.Op {
+	case BatchCreate:
+		if op.Entity == nil {
+			return step, ErrNilEntity{}
+		}
+		if op.Entity.ID != nil && stored[*op.Entity.ID] != nil {
+			return step, ErrAlreadyExists{errors.Errorf("id %d is taken", *op.Entity.ID)}
+		}
+		if err := checkClient(op.Entity.ClientID); !tools.Try(err) {
+			return step, err
+		}
+		ID, err := m.claimID(ctx, "projects", op.Entity.ID)
+		if !tools.Try(err) {
+			return step, err
+		}
+		project := copyProject(*op.Entity)
+		project.ID, project.Version, project.DeletedAt = &ID, 1, nil
+		step.model = mongo.NewInsertOneModel().SetDocument(project)
+		step.ID, step.version, step.entity = ID, project.Version, project
+	case BatchUpdate:
+		if op.Entity == nil || op.Entity.ID == nil {
+			return step, ErrNilEntity{}
+		}
+		current, err := liveOf(stored, *op.Entity.ID, op.Entity.Version, version)
+		if !tools.Try(err) {
+			return step, err
+		}
+		if err = checkClient(op.Entity.ClientID); !tools.Try(err) {
+			return step, err
+		}
+		project := copyProject(*op.Entity)
+		project.Version, project.DeletedAt = current.Version+1, nil
+		step.model = mongo.NewUpdateOneModel().SetFilter(versionFilter(*project.ID, current.Version)).SetUpdate(projectChanges(project))
+		step.ID, step.version, step.entity = *project.ID, project.Version, project
+	case BatchDelete:
+		current, err := liveOf(stored, op.ID, op.Version, version)
+		if !tools.Try(err) {
+			return step, err
+		}
+		deletedAt := tombstone()
+		project := copyProject(*current)
+		project.Version, project.DeletedAt = current.Version+1, &deletedAt
+		step.model = mongo.NewUpdateOneModel().SetFilter(versionFilter(op.ID, current.Version)).SetUpdate(trashChanges(deletedAt))
+		step.ID, step.version = op.ID, project.Version
+		stored[op.ID] = project
+		return step, nil
+	default:
+		return step, errUnknownOp(op.Op)
+	}
+	stored[step.ID] = step.entity
+	return step, nil
+}
+
+// findAll Fetches the entities with the IDs, trashed ones too, by ID.
+func findAll[T any](ctx context.Context, coll *mongo.Collection, IDs []int) (map[int]*T, error) {
+	res := make(map[int]*T, len(IDs))
+	if len(IDs) == 0 {
+		return res, nil
+	}
+	cur, err := coll.Find(ctx, bson.M{"id": bson.M{"$in": IDs}})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	defer func() { _ = cur.Close(ctx) }()
+	for cur.Next(ctx) {
+		var ref struct {
+			ID int `bson:"id"`
+		}
+		entity := new(T)
+		if err = cur.Decode(&ref); !tools.Try(err) {
+			return nil, err
+		}
+		if err = cur.Decode(entity); !tools.Try(err) {
+			return nil, err
+		}
+		res[ref.ID] = entity
+	}
+	return res, cur.Err()
+}
+
+// liveOf Returns the stored entity unless it's missing or trashed, checking its version against the expected one.
+func liveOf[T any](stored map[int]*T, ID int, expected int, version func(entity *T) (int, bool)) (*T, error) {
+	entity := stored[ID]
+	if entity == nil {
+		return nil, ErrNotFound{}
+	}
+	current, trashed := version(entity)
+	if trashed {
+		return nil, ErrNotFound{}
+	}
+	return entity, CheckVersion(current, expected)
 }
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	DeliveryPending DeliveryState = "pending"
+	DeliveryDone    DeliveryState = "delivered"
+	// DeliveryDead Attempts are over, the delivery stays in the dead letters until it's retried.
+	DeliveryDead DeliveryState = "dead"
+)
+
+type (
+	// Outbox Adapters keeping the events of the writes along with their deliveries to the webhooks. Events are
+	// appended by the Outboxed decorator, deliveries are made by the webhook dispatcher.
+	Outbox interface {
+		// AppendEvent Stores the event with a pending delivery of it to every webhook there is.
+		AppendEvent(ctx context.Context, event *Event) error
+		// ClaimDeliveries Returns up to limit pending deliveries due by now, with their events, postponing them by the
+		// lease, so they are not claimed again while being delivered.
+		ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+		// SaveDelivery Stores the state, the attempts, the next attempt time and the last error of the delivery.
+		SaveDelivery(ctx context.Context, delivery *Delivery) error
+		// SelectDeliveries Returns up to limit deliveries in the state by ID, with their events, 0 is unlimited.
+		SelectDeliveries(ctx context.Context, state DeliveryState, limit int) ([]*Delivery, error)
+		// RetryDelivery Makes the dead delivery pending again and due right away, ErrNotFound if it's not dead.
+		RetryDelivery(ctx context.Context, ID int) error
+
+		SelectWebhooks(ctx context.Context) ([]*Webhook, error)
+		GetWebhook(ctx context.Context, ID int) (*Webhook, error)
+		// CreateWebhook Allocates the ID, the pending deliveries of the earlier events are not made to the new webhook.
+		CreateWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error)
+		ReplaceWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error)
+		// DeleteWebhook Deletes the webhook along with its deliveries.
+		DeleteWebhook(ctx context.Context, ID int) error
+
+		// PruneEvents Deletes the delivered deliveries of the events appended before the time, and the events left
+		// with no deliveries, returns how many events are deleted. Pending and dead deliveries keep their events.
+		PruneEvents(ctx context.Context, before time.Time) (int, error)
+	}
+
+	// Event Write of an entity, kept in the outbox for the webhooks.
+	Event struct {
+		ID int       `json:"id" bson:"id" db:"id"`
+		At time.Time `json:"at" bson:"at" db:"at"`
+		// Type Entity and operation of the write, like client.create, see EventType.
+		Type     string `json:"type" bson:"type" db:"type"`
+		EntityID int    `json:"entity_id" bson:"entity_id" db:"entity_id"`
+		Actor    string `json:"actor" bson:"actor" db:"actor"`
+		// Data Entity as the write has left it, or as it was before the purge.
+		Data Payload `json:"data" bson:"data" db:"data"`
+	}
+
+	// Payload JSON document kept as is, stored as text by the SQL adapters.
+	Payload []byte
+
+	DeliveryState string
+
+	// Delivery Event due to the webhook, attempted until it's delivered or the attempts are over.
+	Delivery struct {
+		ID            int           `json:"id" bson:"id" db:"id"`
+		EventID       int           `json:"-" bson:"event_id" db:"event_id"`
+		WebhookID     int           `json:"webhook_id" bson:"webhook_id" db:"webhook_id"`
+		State         DeliveryState `json:"state" bson:"state" db:"state"`
+		Attempts      int           `json:"attempts" bson:"attempts" db:"attempts"`
+		NextAttemptAt time.Time     `json:"next_attempt_at" bson:"next_attempt_at" db:"next_attempt_at"`
+		LastError     string        `json:"last_error,omitempty" bson:"last_error" db:"last_error"`
+		// Event Joined by the reads.
+		Event *Event `json:"event,omitempty" bson:"-" db:"-"`
+	}
+
+	// Webhook Endpoint the events are posted to.
+	Webhook struct {
+		ID  int    `json:"id" bson:"id" db:"id"`
+		URL string `json:"url" bson:"url" db:"url"`
+		// Secret Key of the HMAC-SHA256 signatures of the deliveries.
+		Secret string `json:"secret,omitempty" bson:"secret" db:"secret"`
+	}
+
+	// Outboxed Appends the event of every write of the decorated adapter to its outbox, in the transaction of the
+	// write, so there are no events of the writes rolled back. MongoDB standalone servers have no transactions,
+	// there the event is appended after the write. Changes the client delete policy makes to the projects have no
+	// events, as well as the loads of the backups.
+	Outboxed struct {
+		Adapter
+	}
+)
+
+// EventType Type of the event of the operation on the entity, both named as in the audit log.
+func EventType(entity, operation string) string {
+	return entity + "." + operation
+}
+
+// NewOutboxed Decorates the adapter, which must keep an outbox itself.
+func NewOutboxed(adapter Adapter) (*Outboxed, error) {
+	if _, err := outboxOf(adapter); !tools.Try(err) {
+		return nil, err
+	}
+	return &Outboxed{Adapter: adapter}, nil
+}
+
+// Unwrap The decorated adapter, the outbox is its own.
+func (o *Outboxed) Unwrap() Adapter {
+	return o.Adapter
+}
+
+// WithTx Appends the events of the writes of fn in the same transaction.
+func (o *Outboxed) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	return o.Adapter.WithTx(ctx, func(tx Adapter) error {
+		outboxed, err := NewOutboxed(tx)
+		if !tools.Try(err) {
+			return err
+		}
+		return fn(outboxed)
+	})
+}
+
+// BatchClients Appends the events of the atomic batch in its transaction, a failure to append one fails the whole batch.
+// The batch that is not atomic is applied one operation after another, each one along with its event.
+func (o *Outboxed) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	if !atomic {
+		return applyDecorated(ctx, o, ops, applyClient)
+	}
+	var outcomes []Outcome[Client]
+	err := o.Adapter.WithTx(ctx, func(tx Adapter) error {
+		var err error
+		if outcomes, err = BatchClients(ctx, tx, ops, atomic); !tools.Try(err) {
+			return err
+		}
+		return publishBatch(ctx, tx, AuditClient, ops, outcomes, func(client *Client) int { return *client.ID }, trashedClient)
+	})
+	return settleBatch(o.Adapter, len(ops), outcomes, err)
+}
+
+func (o *Outboxed) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	if !atomic {
+		return applyDecorated(ctx, o, ops, applyProject)
+	}
+	var outcomes []Outcome[Project]
+	err := o.Adapter.WithTx(ctx, func(tx Adapter) error {
+		var err error
+		if outcomes, err = BatchProjects(ctx, tx, ops, atomic); !tools.Try(err) {
+			return err
+		}
+		return publishBatch(ctx, tx, AuditProject, ops, outcomes, func(project *Project) int { return *project.ID }, trashedProject)
+	})
+	return settleBatch(o.Adapter, len(ops), outcomes, err)
+}
+
+func (o *Outboxed) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		res, err := tx.CreateClient(ctx, client)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditClient, AuditCreate, *res.ID, res)
+	})
+}
+
+func (o *Outboxed) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		res, err := tx.ReplaceClient(ctx, client)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditClient, AuditReplace, *res.ID, res)
+	})
+}
+
+func (o *Outboxed) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		res, err := tx.UpdateClient(ctx, ID, update)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditClient, AuditUpdate, ID, res)
+	})
+}
+
+func (o *Outboxed) DeleteClient(ctx context.Context, ID int, version int) error {
+	_, err := withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		if err := tx.DeleteClient(ctx, ID, version); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, publish(ctx, tx, AuditClient, AuditDelete, ID, trashedClient(ctx, tx, ID))
+	})
+	return err
+}
+
+func (o *Outboxed) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		res, err := tx.RestoreClient(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditClient, AuditRestore, ID, res)
+	})
+}
+
+func (o *Outboxed) PurgeClient(ctx context.Context, ID int) error {
+	_, err := withEvent(ctx, o, func(tx Adapter) (*Client, error) {
+		before := trashedClient(ctx, tx, ID)
+		if err := tx.PurgeClient(ctx, ID); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, publish(ctx, tx, AuditClient, AuditPurge, ID, before)
+	})
+	return err
+}
+
+func (o *Outboxed) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		res, err := tx.CreateProject(ctx, project)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditProject, AuditCreate, *res.ID, res)
+	})
+}
+
+func (o *Outboxed) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		res, err := tx.ReplaceProject(ctx, project)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditProject, AuditReplace, *res.ID, res)
+	})
+}
+
+func (o *Outboxed) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		res, err := tx.UpdateProject(ctx, ID, update)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditProject, AuditUpdate, ID, res)
+	})
+}
+
+func (o *Outboxed) DeleteProject(ctx context.Context, ID int, version int) error {
+	_, err := withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		if err := tx.DeleteProject(ctx, ID, version); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, publish(ctx, tx, AuditProject, AuditDelete, ID, trashedProject(ctx, tx, ID))
+	})
+	return err
+}
+
+func (o *Outboxed) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	return withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		res, err := tx.RestoreProject(ctx, ID)
+		if !tools.Try(err) {
+			return nil, err
+		}
+		return res, publish(ctx, tx, AuditProject, AuditRestore, ID, res)
+	})
+}
+
+func (o *Outboxed) PurgeProject(ctx context.Context, ID int) error {
+	_, err := withEvent(ctx, o, func(tx Adapter) (*Project, error) {
+		before := trashedProject(ctx, tx, ID)
+		if err := tx.PurgeProject(ctx, ID); !tools.Try(err) {
+			return nil, err
+		}
+		return nil, publish(ctx, tx, AuditProject, AuditPurge, ID, before)
+	})
+	return err
+}
+
+// withEvent Runs the write, which appends its event, in a transaction of the decorated adapter.
+func withEvent[T any](ctx context.Context, o *Outboxed, write func(tx Adapter) (*T, error)) (*T, error) {
+	var res *T
+	err := o.Adapter.WithTx(ctx, func(tx Adapter) error {
+		var err error
+		res, err = write(tx)
+		return err
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// publish Appends the event of the write to the outbox of the transaction.
+func publish[T any](ctx context.Context, tx Adapter, entity, operation string, ID int, data *T) error {
+	outbox, err := outboxOf(tx)
+	if !tools.Try(err) {
+		return err
+	}
+	raw, err := json.Marshal(data)
+	if !tools.Try(err) {
+		return errors.Wrap(err, "outbox")
+	}
+	err = outbox.AppendEvent(ctx, &Event{
+		At:       time.Now().UTC().Truncate(time.Millisecond),
+		Type:     EventType(entity, operation),
+		EntityID: ID,
+		Actor:    ActorOf(ctx),
+		Data:     raw,
+	})
+	return errors.Wrap(err, "outbox")
+}
+
+// publishBatch Appends the events of the applied operations.
+func publishBatch[T any](
+	ctx context.Context,
+	tx Adapter,
+	entity string,
+	ops []Operation[T],
+	outcomes []Outcome[T],
+	idOf func(entity *T) int,
+	trashed func(ctx context.Context, adapter Adapter, ID int) *T,
+) error {
+	for i, op := range ops {
+		if outcomes[i].Err != nil {
+			continue
+		}
+		var err error
+		switch res := outcomes[i].Entity; op.Op {
+		case BatchCreate:
+			err = publish(ctx, tx, entity, AuditCreate, idOf(res), res)
+		case BatchUpdate:
+			err = publish(ctx, tx, entity, AuditReplace, idOf(res), res)
+		case BatchDelete:
+			err = publish(ctx, tx, entity, AuditDelete, op.ID, trashed(ctx, tx, op.ID))
+		}
+		if !tools.Try(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachEvents Joins the deliveries with their events.
+func attachEvents(deliveries []*Delivery, events []*Event) {
+	byID := make(map[int]*Event, len(events))
+	for _, event := range events {
+		event.At = event.At.UTC()
+		byID[event.ID] = event
+	}
+	for _, delivery := range deliveries {
+		delivery.NextAttemptAt = delivery.NextAttemptAt.UTC()
+		delivery.Event = byID[delivery.EventID]
+	}
+}
+
+// eventIDs IDs of the events of the deliveries.
+func eventIDs(deliveries []*Delivery) []int {
+	IDs := make([]int, len(deliveries))
+	for i, delivery := range deliveries {
+		IDs[i] = delivery.EventID
+	}
+	return IDs
+}
+
+// deliveryIDs IDs of the deliveries.
+func deliveryIDs(deliveries []*Delivery) []int {
+	IDs := make([]int, len(deliveries))
+	for i, delivery := range deliveries {
+		IDs[i] = delivery.ID
+	}
+	return IDs
+}
+
+// MarshalJSON Embeds the document as is, null if it's empty.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+func (p *Payload) UnmarshalJSON(raw []byte) error {
+	*p = append(Payload(nil), raw...)
+	return nil
+}
+
+// Value Stores the document as text.
+func (p Payload) Value() (driver.Value, error) {
+	return string(p), nil
+}
+
+// Scan Reads the document from text or bytes.
+func (p *Payload) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		*p = append(Payload(nil), src...)
+	case string:
+		*p = Payload(src)
+	default:
+		return errors.Errorf("unsupported payload type %T", src)
+	}
+	return nil
+}
+
+// outboxOf The outbox of the adapter, or of the decorated ones.
+func outboxOf(adapter Adapter) (Outbox, error) {
+	outbox, ok := As[Outbox](adapter)
+	if !ok {
+		return nil, errors.Errorf("%T has no outbox", adapter)
+	}
+	return outbox, nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+)
+
+func TestOutboxed(t *testing.T) {
+	for name, adapter := range map[string]Adapter{"memory": &Memory{}, "sqlite": &SQLite{}} {
+		adapter := adapter
+		t.Run(name, func(t *testing.T) {
+			ctx := WithActor(context.Background(), "alice")
+			require.NoError(t, adapter.Init(ctx, &config.Storage{
+				Addr:               filepath.Join(t.TempDir(), "db.sqlite"),
+				ClientDeletePolicy: string(DeleteCascade),
+			}))
+			require.NoError(t, Migrate(ctx, adapter, MigrateAuto))
+			db, err := NewOutboxed(adapter)
+			require.NoError(t, err)
+			outbox, ok := As[Outbox](db)
+			require.True(t, ok, "the outbox of the decorated adapter")
+			_, err = outbox.CreateWebhook(ctx, &Webhook{URL: "http://localhost/hook", Secret: "s3cret"})
+			require.NoError(t, err)
+
+			client, err := db.CreateClient(ctx, &Client{Name: "Acme"})
+			require.NoError(t, err)
+			_, err = db.UpdateClient(ctx, *client.ID, func(client *Client) error {
+				return errors.New("rejected")
+			})
+			require.Error(t, err)
+			_, err = db.CreateProject(ctx, &Project{ClientID: client.ID, Name: "Rocket"})
+			require.NoError(t, err)
+			require.NoError(t, db.DeleteClient(ctx, *client.ID, 0))
+			require.NoError(t, db.PurgeClient(ctx, *client.ID))
+			rollback := errors.New("rollback")
+			err = db.WithTx(ctx, func(tx Adapter) error {
+				if _, err := tx.CreateClient(ctx, &Client{Name: "Ghost"}); err != nil {
+					return err
+				}
+				return rollback
+			})
+			require.ErrorIs(t, err, rollback)
+			_, err = db.BatchClients(ctx, []Operation[Client]{
+				{Op: BatchCreate, Entity: &Client{Name: "Batched"}},
+				{Op: BatchDelete, ID: *client.ID},
+			}, false)
+			require.NoError(t, err)
+
+			deliveries, err := outbox.SelectDeliveries(ctx, DeliveryPending, 0)
+			require.NoError(t, err)
+			var types []string
+			for _, delivery := range deliveries {
+				types = append(types, delivery.Event.Type)
+				assert.Equal(t, "alice", delivery.Event.Actor)
+			}
+			assert.Equal(t, []string{
+				"client.create", "project.create", "client.delete", "client.purge", "client.create",
+			}, types, "failed and rolled back writes have no events")
+
+			var deleted Client
+			require.NoError(t, json.Unmarshal(deliveries[2].Event.Data, &deleted))
+			assert.Equal(t, client.ID, deleted.ID)
+			assert.NotNil(t, deleted.DeletedAt, "delete tells the trashed state")
+			var purged Client
+			require.NoError(t, json.Unmarshal(deliveries[3].Event.Data, &purged))
+			assert.Equal(t, "Acme", purged.Name, "purge tells the state before it")
+		})
+	}
+}
+
+func TestNewOutboxed(t *testing.T) {
+	_, err := NewOutboxed(&MockAdapter{})
+	assert.Error(t, err)
+}
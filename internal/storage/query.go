@@ -0,0 +1,632 @@
+package storage
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	OpEq     Operator = "=="
+	OpNe     Operator = "!="
+	OpLt     Operator = "=lt="
+	OpLe     Operator = "=le="
+	OpGt     Operator = "=gt="
+	OpGe     Operator = "=ge="
+	OpIn     Operator = "=in="
+	OpOut    Operator = "=out="
+	OpLike   Operator = "=like="
+	OpIsNull Operator = "=isnull="
+)
+
+const (
+	FieldInt FieldType = iota + 1
+	FieldString
+	// FieldDuration Nanoseconds, either as an integer or a Go duration string like 1h30m.
+	FieldDuration
+)
+
+// rsqlReserved Characters which need the value to be quoted.
+const rsqlReserved = `"'();,=!~<> `
+
+type (
+	// Operator RSQL/FIQL comparison operator.
+	Operator string
+
+	FieldType int
+
+	// Field Filterable entity field, known by its RSQL selector.
+	Field struct {
+		Name string
+		// Column SQL column.
+		Column string
+		// Key BSON document key.
+		Key      string
+		Type     FieldType
+		Nullable bool
+		Sortable bool
+		// value Extracts int64, string or nil from the entity.
+		value func(entity interface{}) interface{}
+	}
+
+	// Schema Allowlist of the entity fields for filters and sorting.
+	Schema struct {
+		fields map[string]*Field
+		id     *Field
+	}
+
+	// Node Filter expression: And, Or or Comparison.
+	Node interface {
+		node()
+	}
+
+	And struct {
+		Nodes []Node
+	}
+
+	Or struct {
+		Nodes []Node
+	}
+
+	Comparison struct {
+		Field *Field
+		Op    Operator
+		// Values int64, string or bool for =isnull=, converted to the field type.
+		Values []interface{}
+		// like Compiled =like= pattern.
+		like *regexp.Regexp
+	}
+
+	SortKey struct {
+		Field *Field
+		Desc  bool
+	}
+
+	// Query Parsed filter and sorting of a list, zero value selects everything in the ID order.
+	Query struct {
+		Filter Node
+		Sort   []SortKey
+		// Trash Selects the trashed entities instead of the live ones.
+		Trash bool
+	}
+
+	// Keyset Values of the sort keys of the entity a page is bounded by, its ID being the last one.
+	Keyset []interface{}
+
+	rsqlParser struct {
+		schema *Schema
+		in     string
+		pos    int
+	}
+)
+
+var (
+	ClientSchema = newSchema(
+		&Field{Name: "id", Column: "id", Key: "id", Type: FieldInt, Sortable: true, value: func(e interface{}) interface{} {
+			return intValue(e.(*Client).ID)
+		}},
+		&Field{Name: "name", Column: "name", Key: "name", Type: FieldString, Sortable: true, value: func(e interface{}) interface{} {
+			return e.(*Client).Name
+		}},
+		&Field{
+			Name: "settings.code_scan_interval", Column: "code_scan_interval", Key: "settings.code_scan_interval",
+			Type: FieldDuration, Sortable: true, value: func(e interface{}) interface{} {
+				return int64(e.(*Client).Settings.CodeScanInterval)
+			},
+		},
+	)
+	ProjectSchema = newSchema(
+		&Field{Name: "id", Column: "id", Key: "id", Type: FieldInt, Sortable: true, value: func(e interface{}) interface{} {
+			return intValue(e.(*Project).ID)
+		}},
+		&Field{Name: "client_id", Column: "client_id", Key: "client_id", Type: FieldInt, Nullable: true, value: func(e interface{}) interface{} {
+			return intValue(e.(*Project).ClientID)
+		}},
+		&Field{Name: "name", Column: "name", Key: "name", Type: FieldString, Sortable: true, value: func(e interface{}) interface{} {
+			return e.(*Project).Name
+		}},
+	)
+)
+
+func (And) node()        {}
+func (Or) node()         {}
+func (Comparison) node() {}
+
+func newSchema(fields ...*Field) *Schema {
+	s := &Schema{fields: map[string]*Field{}}
+	for _, field := range fields {
+		s.fields[field.Name] = field
+	}
+	s.id = s.fields["id"]
+	return s
+}
+
+// ParseQuery Parses the RSQL filter, like name=like=*soft*;id=gt=10, and the sort, like -name,id, both optional.
+func (s *Schema) ParseQuery(filter, sort string) (Query, error) {
+	var q Query
+	if filter != "" {
+		p := &rsqlParser{schema: s, in: filter}
+		node, err := p.parseOr()
+		if !tools.Try(err) {
+			return q, fault.Wrap(fault.Malformed, err, "filter")
+		}
+		if p.pos < len(p.in) {
+			return q, fault.New(fault.Malformed, "filter: unexpected "+strconv.Quote(p.in[p.pos:]))
+		}
+		q.Filter = node
+	}
+	if sort == "" {
+		return q, nil
+	}
+	seen := map[string]bool{}
+	for _, key := range strings.Split(sort, ",") {
+		desc := strings.HasPrefix(key, "-")
+		name := strings.TrimPrefix(strings.TrimPrefix(key, "-"), "+")
+		field, ok := s.fields[name]
+		if !ok || !field.Sortable {
+			return q, fault.New(fault.Malformed, "sort: field "+strconv.Quote(name)+" can't be sorted by")
+		}
+		if seen[name] {
+			return q, fault.New(fault.Malformed, "sort: field "+strconv.Quote(name)+" is repeated")
+		}
+		seen[name] = true
+		q.Sort = append(q.Sort, SortKey{Field: field, Desc: desc})
+	}
+	return q, nil
+}
+
+// Compare Builds a comparison of the field, the values are converted to its type.
+func (s *Schema) Compare(name string, op Operator, values ...interface{}) (Node, error) {
+	field, ok := s.fields[name]
+	if !ok {
+		return nil, fault.New(fault.Malformed, "field "+strconv.Quote(name)+" can't be filtered by")
+	}
+	args := make([]string, 0, len(values))
+	for _, value := range values {
+		args = append(args, toString(value))
+	}
+	c, err := newComparison(field, op, args)
+	return c, fault.Wrap(fault.Malformed, err, "filter")
+}
+
+// And Narrows the query filter down with one more condition.
+func (q Query) And(node Node) Query {
+	if q.Filter == nil {
+		q.Filter = node
+		return q
+	}
+	q.Filter = And{Nodes: []Node{q.Filter, node}}
+	return q
+}
+
+// sortKeys Sort of the query, always ending with the ID to make the order total.
+func (s *Schema) sortKeys(q Query) []SortKey {
+	keys := q.Sort
+	for _, key := range keys {
+		if key.Field == s.id {
+			return keys
+		}
+	}
+	return append(append([]SortKey{}, keys...), SortKey{Field: s.id})
+}
+
+// KeysetOf Sort key values of the entity, to bound the next or previous page with.
+func (s *Schema) KeysetOf(q Query, entity interface{}) Keyset {
+	return keysetOf(s.sortKeys(q), entity)
+}
+
+func keysetOf(keys []SortKey, entity interface{}) Keyset {
+	keyset := make(Keyset, 0, len(keys))
+	for _, key := range keys {
+		keyset = append(keyset, key.Field.value(entity))
+	}
+	return keyset
+}
+
+// Keyset Validates the JSON decoded values against the query sort keys.
+func (s *Schema) Keyset(q Query, values []interface{}) (Keyset, error) {
+	keys := s.sortKeys(q)
+	if len(values) != len(keys) {
+		return nil, fault.New(fault.Malformed, "cursor does not match the sort")
+	}
+	keyset := make(Keyset, 0, len(values))
+	for i, key := range keys {
+		var value interface{}
+		var err error
+		switch v := values[i].(type) {
+		case json.Number:
+			if key.Field.Type == FieldString {
+				return nil, fault.New(fault.Malformed, "cursor does not match the sort")
+			}
+			value, err = v.Int64()
+		case string:
+			if key.Field.Type != FieldString {
+				return nil, fault.New(fault.Malformed, "cursor does not match the sort")
+			}
+			value = v
+		default:
+			return nil, fault.New(fault.Malformed, "cursor does not match the sort")
+		}
+		if !tools.Try(err) {
+			return nil, fault.Wrap(fault.Malformed, err, "cursor does not match the sort")
+		}
+		keyset = append(keyset, value)
+	}
+	return keyset, nil
+}
+
+// match Evaluates the filter against the entity, the way the databases do.
+func match(node Node, entity interface{}) bool {
+	switch n := node.(type) {
+	case nil:
+		return true
+	case And:
+		for _, operand := range n.Nodes {
+			if !match(operand, entity) {
+				return false
+			}
+		}
+		return true
+	case Or:
+		for _, operand := range n.Nodes {
+			if match(operand, entity) {
+				return true
+			}
+		}
+		return false
+	case Comparison:
+		return n.match(entity)
+	}
+	return false
+}
+
+func (c Comparison) match(entity interface{}) bool {
+	value := c.Field.value(entity)
+	switch c.Op {
+	case OpIsNull:
+		return (value == nil) == c.Values[0].(bool)
+	case OpNe, OpOut:
+		// null is not equal to anything
+		for _, v := range c.Values {
+			if value != nil && compareValues(value, v) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if value == nil {
+		return false
+	}
+	switch c.Op {
+	case OpEq, OpIn:
+		for _, v := range c.Values {
+			if compareValues(value, v) == 0 {
+				return true
+			}
+		}
+		return false
+	case OpLt:
+		return compareValues(value, c.Values[0]) < 0
+	case OpLe:
+		return compareValues(value, c.Values[0]) <= 0
+	case OpGt:
+		return compareValues(value, c.Values[0]) > 0
+	case OpGe:
+		return compareValues(value, c.Values[0]) >= 0
+	case OpLike:
+		return c.like.MatchString(value.(string))
+	}
+	return false
+}
+
+// compareKeyset Position of the entity relative to the keyset in the order of the sort keys.
+func compareKeyset(keys []SortKey, entity interface{}, keyset Keyset) int {
+	for i, key := range keys {
+		cmp := compareValues(key.Field.value(entity), keyset[i])
+		if key.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// compareValues Compares int64 or string values, nil goes first.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case int64:
+		b, _ := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	}
+	return 0
+}
+
+// likePattern Converts =like= wildcards to the SQL LIKE pattern, escaping with a backslash.
+func likePattern(pattern string) string {
+	pattern = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(pattern)
+	return strings.ReplaceAll(pattern, "*", "%")
+}
+
+// likeRegexp Case-insensitive anchored regular expression of the =like= pattern, also valid for MongoDB.
+func likeRegexp(pattern string) string {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, ".*") + "$"
+}
+
+func newComparison(field *Field, op Operator, args []string) (Comparison, error) {
+	c := Comparison{Field: field, Op: op}
+	switch op {
+	case OpEq, OpNe, OpLt, OpLe, OpGt, OpGe, OpLike, OpIsNull:
+		if len(args) != 1 {
+			return c, errors.Errorf("%s takes a single value", op)
+		}
+	case OpIn, OpOut:
+		if len(args) == 0 {
+			return c, errors.Errorf("%s takes at least one value", op)
+		}
+	default:
+		return c, errors.Errorf("unknown operator %s", op)
+	}
+
+	switch {
+	case op == OpIsNull:
+		if !field.Nullable {
+			return c, errors.Errorf("field %q is never null", field.Name)
+		}
+		isNull, err := strconv.ParseBool(args[0])
+		if !tools.Try(err) {
+			return c, errors.Errorf("%s takes true or false", op)
+		}
+		c.Values = []interface{}{isNull}
+		return c, nil
+	case op == OpLike:
+		if field.Type != FieldString {
+			return c, errors.Errorf("field %q is not a string", field.Name)
+		}
+		c.like = regexp.MustCompile("(?is)" + likeRegexp(args[0]))
+	}
+
+	for _, arg := range args {
+		value, err := convertValue(field, arg)
+		if !tools.Try(err) {
+			return c, err
+		}
+		c.Values = append(c.Values, value)
+	}
+	return c, nil
+}
+
+func convertValue(field *Field, arg string) (interface{}, error) {
+	switch field.Type {
+	case FieldInt:
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if !tools.Try(err) {
+			return nil, errors.Errorf("field %q takes integers, not %q", field.Name, arg)
+		}
+		return n, nil
+	case FieldDuration:
+		if n, err := strconv.ParseInt(arg, 10, 64); tools.Try(err) {
+			return n, nil
+		}
+		d, err := time.ParseDuration(arg)
+		if !tools.Try(err) {
+			return nil, errors.Errorf("field %q takes durations, not %q", field.Name, arg)
+		}
+		return int64(d), nil
+	}
+	return arg, nil
+}
+
+func (p *rsqlParser) parseOr() (Node, error) {
+	var nodes []Node
+	for {
+		node, err := p.parseAnd()
+		if !tools.Try(err) {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !p.consume(',') {
+			break
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return Or{Nodes: nodes}, nil
+}
+
+func (p *rsqlParser) parseAnd() (Node, error) {
+	var nodes []Node
+	for {
+		node, err := p.parseConstraint()
+		if !tools.Try(err) {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if !p.consume(';') {
+			break
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return And{Nodes: nodes}, nil
+}
+
+func (p *rsqlParser) parseConstraint() (Node, error) {
+	if !p.consume('(') {
+		return p.parseComparison()
+	}
+	node, err := p.parseOr()
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if !p.consume(')') {
+		return nil, p.errorf("missing )")
+	}
+	return node, nil
+}
+
+func (p *rsqlParser) parseComparison() (Node, error) {
+	name := p.unreserved()
+	if name == "" {
+		return nil, p.errorf("field expected")
+	}
+	field, ok := p.schema.fields[name]
+	if !ok {
+		return nil, errors.Errorf("field %q can't be filtered by", name)
+	}
+	op, err := p.operator()
+	if !tools.Try(err) {
+		return nil, err
+	}
+
+	var args []string
+	if p.consume('(') {
+		for {
+			arg, err := p.value()
+			if !tools.Try(err) {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.consume(',') {
+				break
+			}
+		}
+		if !p.consume(')') {
+			return nil, p.errorf("missing )")
+		}
+	} else {
+		arg, err := p.value()
+		if !tools.Try(err) {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return newComparison(field, op, args)
+}
+
+func (p *rsqlParser) operator() (Operator, error) {
+	rest := p.in[p.pos:]
+	for alias, op := range map[string]Operator{">=": OpGe, "<=": OpLe, "==": OpEq, "!=": OpNe} {
+		if strings.HasPrefix(rest, alias) {
+			p.pos += 2
+			return op, nil
+		}
+	}
+	for alias, op := range map[string]Operator{">": OpGt, "<": OpLt} {
+		if strings.HasPrefix(rest, alias) {
+			p.pos++
+			return op, nil
+		}
+	}
+	if !strings.HasPrefix(rest, "=") {
+		return "", p.errorf("operator expected")
+	}
+	end := strings.IndexByte(rest[1:], '=')
+	if end < 0 {
+		return "", p.errorf("operator expected")
+	}
+	op := Operator(rest[:end+2])
+	p.pos += end + 2
+	return op, nil
+}
+
+func (p *rsqlParser) value() (string, error) {
+	if p.pos >= len(p.in) {
+		return "", p.errorf("value expected")
+	}
+	quote := p.in[p.pos]
+	if quote != '"' && quote != '\'' {
+		value := p.unreserved()
+		if value == "" {
+			return "", p.errorf("value expected")
+		}
+		return value, nil
+	}
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.in); p.pos++ {
+		c := p.in[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.in):
+			p.pos++
+			b.WriteByte(p.in[p.pos])
+		case c == quote:
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *rsqlParser) unreserved() string {
+	start := p.pos
+	for p.pos < len(p.in) && !strings.ContainsRune(rsqlReserved, rune(p.in[p.pos])) {
+		p.pos++
+	}
+	return p.in[start:p.pos]
+}
+
+func (p *rsqlParser) consume(c byte) bool {
+	if p.pos < len(p.in) && p.in[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *rsqlParser) errorf(msg string) error {
+	return errors.Errorf("%s at %d", msg, p.pos+1)
+}
+
+func intValue(n *int) interface{} {
+	if n == nil {
+		return nil
+	}
+	return int64(*n)
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+func TestParseQuery(t *testing.T) {
+	apple := &Client{ID: tools.IntPtr(2), Name: "Apple (Cupertino)", Settings: ClientSettings{CodeScanInterval: time.Minute}}
+	for _, tc := range []struct {
+		filter string
+		match  bool
+	}{
+		{"name==Apple", false},
+		{`name=="Apple (Cupertino)"`, true},
+		{`name=='Apple \'s'`, false},
+		{"name=like=app*", true},
+		{"name=like=*cup*o", false},
+		{`name=like="*(CUP*"`, true},
+		{"id=gt=1;id<3", true},
+		{"id=in=(1,3),name!=Apple", true},
+		{"(id==1,id==2);settings.code_scan_interval=ge=1m", true},
+		{"settings.code_scan_interval==60000000000", true},
+		{"id=out=(2)", false},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			query, err := ClientSchema.ParseQuery(tc.filter, "")
+			require.NoError(t, err)
+			assert.Equal(t, tc.match, match(query.Filter, apple))
+		})
+	}
+
+	orphan := &Project{ID: tools.IntPtr(1), Name: "orphan"}
+	for filter, matches := range map[string]bool{
+		"client_id=isnull=true": true,
+		"client_id!=1":          true,
+		"client_id=out=(1,2)":   true,
+		"client_id=lt=1":        false,
+		"client_id==1":          false,
+	} {
+		query, err := ProjectSchema.ParseQuery(filter, "")
+		require.NoError(t, err)
+		assert.Equal(t, matches, match(query.Filter, orphan), filter)
+	}
+}
+
+func TestMalformedQuery(t *testing.T) {
+	for _, tc := range []struct{ filter, sort string }{
+		{"version==1", ""},
+		{"name", ""},
+		{"name==", ""},
+		{"name=foo=bar", ""},
+		{"id==one", ""},
+		{"id=in=()", ""},
+		{"id=in=(1", ""},
+		{"(id==1", ""},
+		{"id==1;", ""},
+		{"id==1)", ""},
+		{`name=="open`, ""},
+		{"name=isnull=true", ""},
+		{"id=like=1*", ""},
+		{"settings.code_scan_interval==soon", ""},
+		{"", "version"},
+		{"", "name,-name"},
+	} {
+		_, err := ClientSchema.ParseQuery(tc.filter, tc.sort)
+		assert.Equal(t, fault.Malformed, fault.KindOf(err), tc)
+	}
+	_, err := ProjectSchema.ParseQuery("", "client_id")
+	assert.Equal(t, fault.Malformed, fault.KindOf(err))
+}
+
+func TestLikePattern(t *testing.T) {
+	assert.Equal(t, `100\%\_done%`, likePattern("100%_done*"))
+	assert.Equal(t, `^a\.b.*$`, likeRegexp("a.b*"))
+}
@@ -0,0 +1,594 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type (
+	// Resilient Guards the calls of the decorated adapter. Calls failing with a transient error are retried with
+	// a jittered exponential backoff; writes only if the error tells they haven't been applied, since none of them
+	// is idempotent. Consecutive transient failures open the circuit breaker, which fails the calls fast until the
+	// cooldown is over and a probe call succeeds. The bulkhead bounds the calls running at once, the ones waiting
+	// for their turn longer than the queue timeout fail. Every failure of these is ErrUnavailable.
+	Resilient struct {
+		Adapter
+		attempts     int
+		backoff      time.Duration
+		maxBackoff   time.Duration
+		queueTimeout time.Duration
+		// bulkhead Slots of the running calls, nil if unlimited.
+		bulkhead chan struct{}
+		breaker  *breaker
+	}
+
+	// CircuitBreaker Adapters failing fast while the storage is down.
+	CircuitBreaker interface {
+		// CircuitOpen Tells if the calls fail fast now.
+		CircuitOpen() bool
+	}
+
+	// breaker Circuit breaker counting consecutive transient failures.
+	breaker struct {
+		threshold int
+		cooldown  time.Duration
+
+		mu       sync.Mutex
+		failures int
+		openedAt time.Time
+		// probing The call let through by the open breaker is still running.
+		probing bool
+	}
+)
+
+// NewResilient Decorates the adapter with the retries, the breaker and the bulkhead of the config.
+func NewResilient(adapter Adapter, cfg *config.Storage) *Resilient {
+	r := &Resilient{
+		Adapter:      adapter,
+		attempts:     cfg.RetryAttempts,
+		backoff:      cfg.RetryBackoff,
+		maxBackoff:   cfg.RetryMaxBackoff,
+		queueTimeout: cfg.QueueTimeout,
+		breaker:      &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+	}
+	if r.attempts < 1 {
+		r.attempts = 1
+	}
+	if r.maxBackoff < r.backoff {
+		r.maxBackoff = r.backoff
+	}
+	if cfg.MaxConcurrent > 0 {
+		r.bulkhead = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return r
+}
+
+func (r *Resilient) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	res, err := guard(ctx, r, true, func(ctx context.Context) (listing[Client], error) {
+		clients, more, err := r.Adapter.SelectClients(ctx, query, page)
+		return listing[Client]{clients, more}, err
+	})
+	return res.entities, res.more, err
+}
+
+func (r *Resilient) GetClient(ctx context.Context, ID int) (*Client, error) {
+	return guard(ctx, r, true, func(ctx context.Context) (*Client, error) {
+		return r.Adapter.GetClient(ctx, ID)
+	})
+}
+
+func (r *Resilient) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Client, error) {
+		return r.Adapter.CreateClient(ctx, client)
+	})
+}
+
+func (r *Resilient) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Client, error) {
+		return r.Adapter.ReplaceClient(ctx, client)
+	})
+}
+
+func (r *Resilient) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Client, error) {
+		return r.Adapter.UpdateClient(ctx, ID, update)
+	})
+}
+
+func (r *Resilient) DeleteClient(ctx context.Context, ID int, version int) error {
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Adapter.DeleteClient(ctx, ID, version)
+	})
+	return err
+}
+
+func (r *Resilient) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Client, error) {
+		return r.Adapter.RestoreClient(ctx, ID)
+	})
+}
+
+func (r *Resilient) PurgeClient(ctx context.Context, ID int) error {
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Adapter.PurgeClient(ctx, ID)
+	})
+	return err
+}
+
+func (r *Resilient) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	res, err := guard(ctx, r, true, func(ctx context.Context) (listing[Project], error) {
+		projects, more, err := r.Adapter.SelectProjects(ctx, query, page)
+		return listing[Project]{projects, more}, err
+	})
+	return res.entities, res.more, err
+}
+
+func (r *Resilient) GetProject(ctx context.Context, ID int) (*Project, error) {
+	return guard(ctx, r, true, func(ctx context.Context) (*Project, error) {
+		return r.Adapter.GetProject(ctx, ID)
+	})
+}
+
+func (r *Resilient) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Project, error) {
+		return r.Adapter.CreateProject(ctx, project)
+	})
+}
+
+func (r *Resilient) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Project, error) {
+		return r.Adapter.ReplaceProject(ctx, project)
+	})
+}
+
+func (r *Resilient) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Project, error) {
+		return r.Adapter.UpdateProject(ctx, ID, update)
+	})
+}
+
+func (r *Resilient) DeleteProject(ctx context.Context, ID int, version int) error {
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Adapter.DeleteProject(ctx, ID, version)
+	})
+	return err
+}
+
+func (r *Resilient) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	return guard(ctx, r, false, func(ctx context.Context) (*Project, error) {
+		return r.Adapter.RestoreProject(ctx, ID)
+	})
+}
+
+func (r *Resilient) PurgeProject(ctx context.Context, ID int) error {
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Adapter.PurgeProject(ctx, ID)
+	})
+	return err
+}
+
+// Unwrap The decorated adapter, its migrations are not guarded as they run once on start.
+func (r *Resilient) Unwrap() Adapter {
+	return r.Adapter
+}
+
+func (r *Resilient) CircuitOpen() bool {
+	return r.breaker.open()
+}
+
+// Search Retried as a read, the index or the scan of the decorated adapter.
+func (r *Resilient) Search(ctx context.Context, text string, limit int) ([]*SearchHit, error) {
+	return guard(ctx, r, true, func(ctx context.Context) ([]*SearchHit, error) {
+		return Search(ctx, r.Adapter, text, limit)
+	})
+}
+
+// WithTx Retried as a write, running fn again once the transaction is rolled back. fn gets the adapter of
+// the transaction as is, so its calls are made within the slot of WithTx.
+func (r *Resilient) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Adapter.WithTx(ctx, fn)
+	})
+	return err
+}
+
+// BatchClients Not retried, as a part of the batch may have been applied.
+func (r *Resilient) BatchClients(ctx context.Context, ops []Operation[Client], atomic bool) ([]Outcome[Client], error) {
+	return guard(ctx, r, false, func(ctx context.Context) ([]Outcome[Client], error) {
+		return BatchClients(ctx, r.Adapter, ops, atomic)
+	})
+}
+
+func (r *Resilient) BatchProjects(ctx context.Context, ops []Operation[Project], atomic bool) ([]Outcome[Project], error) {
+	return guard(ctx, r, false, func(ctx context.Context) ([]Outcome[Project], error) {
+		return BatchProjects(ctx, r.Adapter, ops, atomic)
+	})
+}
+
+// AppendAudit Passes through to the decorated adapter, if it keeps an audit log.
+func (r *Resilient) AppendAudit(ctx context.Context, entry *AuditEntry) error {
+	auditLog, ok := As[AuditLog](r.Adapter)
+	if !ok {
+		return errors.Errorf("%T has no audit log", r.Adapter)
+	}
+	_, err := guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, auditLog.AppendAudit(ctx, entry)
+	})
+	return err
+}
+
+func (r *Resilient) SelectAudit(ctx context.Context, query Query, since time.Time, page Page) ([]*AuditEntry, bool, error) {
+	auditLog, ok := As[AuditLog](r.Adapter)
+	if !ok {
+		return nil, false, errors.Errorf("%T has no audit log", r.Adapter)
+	}
+	res, err := guard(ctx, r, true, func(ctx context.Context) (listing[AuditEntry], error) {
+		entries, more, err := auditLog.SelectAudit(ctx, query, since, page)
+		return listing[AuditEntry]{entries, more}, err
+	})
+	return res.entities, res.more, err
+}
+
+// Sequence Passes through to the decorated adapter, if it exposes the sequences.
+func (r *Resilient) Sequence(ctx context.Context, table string) (int, error) {
+	seq, ok := As[Sequencer](r.Adapter)
+	if !ok {
+		return 0, errors.Errorf("%T has no sequences", r.Adapter)
+	}
+	return guard(ctx, r, true, func(ctx context.Context) (int, error) {
+		return seq.Sequence(ctx, table)
+	})
+}
+
+// AdvanceSequence Retried as a read, advancing twice is the same as once.
+func (r *Resilient) AdvanceSequence(ctx context.Context, table string, ID int) error {
+	seq, ok := As[Sequencer](r.Adapter)
+	if !ok {
+		return errors.Errorf("%T has no sequences", r.Adapter)
+	}
+	_, err := guard(ctx, r, true, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, seq.AdvanceSequence(ctx, table, ID)
+	})
+	return err
+}
+
+// LoadClients Passes through to the decorated adapter, retried as a read since the loads are upserts.
+func (r *Resilient) LoadClients(ctx context.Context, clients []*Client, seq int) error {
+	loader, ok := As[Loader](r.Adapter)
+	if !ok {
+		return errors.Errorf("%T can't load backups", r.Adapter)
+	}
+	_, err := guard(ctx, r, true, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, loader.LoadClients(ctx, clients, seq)
+	})
+	return err
+}
+
+func (r *Resilient) LoadProjects(ctx context.Context, projects []*Project, seq int) error {
+	loader, ok := As[Loader](r.Adapter)
+	if !ok {
+		return errors.Errorf("%T can't load backups", r.Adapter)
+	}
+	_, err := guard(ctx, r, true, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, loader.LoadProjects(ctx, projects, seq)
+	})
+	return err
+}
+
+// guard Runs the call through the bulkhead and the breaker, retrying it while the error is transient.
+// Idempotent calls are retried on any transient error, the others only if it hasn't been applied.
+func guard[T any](ctx context.Context, r *Resilient, idempotent bool, call func(ctx context.Context) (T, error)) (T, error) {
+	var res T
+	var err error
+	for attempt := 1; ; attempt++ {
+		release, waitErr := r.acquire(ctx)
+		if !tools.Try(waitErr) {
+			return res, waitErr
+		}
+		if waitErr = r.breaker.allow(); !tools.Try(waitErr) {
+			release()
+			return res, waitErr
+		}
+		res, err = call(ctx)
+		release()
+		if ctx.Err() != nil {
+			// the caller has given up, it tells nothing about the storage
+			r.breaker.skip()
+			return res, err
+		}
+		retry, unapplied := transient(err)
+		r.breaker.record(!retry)
+		if !retry {
+			return res, err
+		}
+		if attempt >= r.attempts || !idempotent && !unapplied || !sleep(ctx, r.delay(attempt)) {
+			break
+		}
+	}
+	return res, ErrUnavailable{cause: err}
+}
+
+// acquire Takes a slot of the bulkhead, waiting for the queue timeout at most.
+func (r *Resilient) acquire(ctx context.Context) (func(), error) {
+	if r.bulkhead == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.bulkhead <- struct{}{}:
+		return func() { <-r.bulkhead }, nil
+	default:
+	}
+	timer := time.NewTimer(r.queueTimeout)
+	defer timer.Stop()
+	select {
+	case r.bulkhead <- struct{}{}:
+		return func() { <-r.bulkhead }, nil
+	case <-timer.C:
+		return nil, ErrUnavailable{cause: errors.New("too many concurrent calls"), retryAfter: time.Second}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// delay Backoff before the retry after the attempt, doubled by every attempt and jittered between its halves.
+func (r *Resilient) delay(attempt int) time.Duration {
+	d := r.backoff << (attempt - 1)
+	if d > r.maxBackoff || d <= 0 {
+		d = r.maxBackoff
+	}
+	if half := int64(d / 2); half > 0 {
+		return time.Duration(half + rand.Int63n(half+1)) //nolint:gosec // jitter only
+	}
+	return d
+}
+
+// allow Fails fast while the breaker is open, lets a single probe call through once the cooldown is over.
+func (b *breaker) allow() error {
+	if b.threshold < 1 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	wait := time.Until(b.openedAt.Add(b.cooldown))
+	if wait > 0 || b.probing {
+		if wait <= 0 {
+			wait = b.cooldown
+		}
+		return ErrUnavailable{cause: errors.New("circuit breaker is open"), retryAfter: wait}
+	}
+	b.probing = true
+	return nil
+}
+
+// open Tells if the calls fail fast, the breaker waiting for a probe call is not.
+func (b *breaker) open() bool {
+	if b.threshold < 1 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && (b.probing || time.Now().Before(b.openedAt.Add(b.cooldown)))
+}
+
+// record Counts the transient failure, or closes the breaker on anything else.
+func (b *breaker) record(ok bool) {
+	if b.threshold < 1 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if b.failures >= b.threshold {
+			log.Infoln("storage circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Warnf("storage circuit breaker opened for %s", b.cooldown)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// skip Lets the next probe through, if this call was the one.
+func (b *breaker) skip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// transient Tells if the error may go away on retry, and if it surely comes before the write has been applied.
+func transient(err error) (retry bool, unapplied bool) {
+	var unavailable ErrUnavailable
+	if err == nil || errors.As(err, &unavailable) {
+		// the latter is already guarded, e.g. by the nested decorator
+		return false, false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true, true
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		busy := sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+		return busy, busy
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		// serialization failure, deadlock, starting up, too many connections, connection rejected
+		case "40001", "40P01", "57P03", "53300", "08001", "08004":
+			return true, true
+		}
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01", false
+	}
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) {
+		return true, true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorLabel("TransientTransactionError") {
+		return true, true
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true, false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, false
+	}
+	return fault.KindOf(err) == fault.Unavailable, false
+}
+
+// sleep Waits for the delay, false if the context is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// AppendEvent Passes through to the decorated adapter, the outbox calls are guarded like the rest.
+func (r *Resilient) AppendEvent(ctx context.Context, event *Event) error {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return err
+	}
+	_, err = guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, outbox.AppendEvent(ctx, event)
+	})
+	return err
+}
+
+// ClaimDeliveries Not retried, as the deliveries may have been claimed.
+func (r *Resilient) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, false, func(ctx context.Context) ([]*Delivery, error) {
+		return outbox.ClaimDeliveries(ctx, now, lease, limit)
+	})
+}
+
+func (r *Resilient) SaveDelivery(ctx context.Context, delivery *Delivery) error {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return err
+	}
+	_, err = guard(ctx, r, true, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, outbox.SaveDelivery(ctx, delivery)
+	})
+	return err
+}
+
+func (r *Resilient) SelectDeliveries(ctx context.Context, state DeliveryState, limit int) ([]*Delivery, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, true, func(ctx context.Context) ([]*Delivery, error) {
+		return outbox.SelectDeliveries(ctx, state, limit)
+	})
+}
+
+func (r *Resilient) RetryDelivery(ctx context.Context, ID int) error {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return err
+	}
+	_, err = guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, outbox.RetryDelivery(ctx, ID)
+	})
+	return err
+}
+
+func (r *Resilient) SelectWebhooks(ctx context.Context) ([]*Webhook, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, true, func(ctx context.Context) ([]*Webhook, error) {
+		return outbox.SelectWebhooks(ctx)
+	})
+}
+
+func (r *Resilient) GetWebhook(ctx context.Context, ID int) (*Webhook, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, true, func(ctx context.Context) (*Webhook, error) {
+		return outbox.GetWebhook(ctx, ID)
+	})
+}
+
+func (r *Resilient) CreateWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, false, func(ctx context.Context) (*Webhook, error) {
+		return outbox.CreateWebhook(ctx, webhook)
+	})
+}
+
+// ReplaceWebhook Retried as a read, webhooks have no versions.
+func (r *Resilient) ReplaceWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return guard(ctx, r, true, func(ctx context.Context) (*Webhook, error) {
+		return outbox.ReplaceWebhook(ctx, webhook)
+	})
+}
+
+// PruneEvents Retried as a read, pruning twice is the same as once.
+func (r *Resilient) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return 0, err
+	}
+	return guard(ctx, r, true, func(ctx context.Context) (int, error) {
+		return outbox.PruneEvents(ctx, before)
+	})
+}
+
+func (r *Resilient) DeleteWebhook(ctx context.Context, ID int) error {
+	outbox, err := outboxOf(r.Adapter)
+	if !tools.Try(err) {
+		return err
+	}
+	_, err = guard(ctx, r, false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, outbox.DeleteWebhook(ctx, ID)
+	})
+	return err
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/fault"
+)
+
+// flaky Fails the next calls with the injected errors, one per call, then passes them to the adapter.
+type flaky struct {
+	Adapter
+	errs  chan error
+	calls int32
+	// hold Blocks the calls until closed, if set.
+	hold chan struct{}
+}
+
+func newFlaky(t *testing.T, errs ...error) *flaky {
+	memory := &Memory{}
+	require.NoError(t, memory.Init(context.Background(), &config.Storage{}))
+	f := &flaky{Adapter: memory, errs: make(chan error, len(errs))}
+	for _, err := range errs {
+		f.errs <- err
+	}
+	return f
+}
+
+func (f *flaky) fail() error {
+	atomic.AddInt32(&f.calls, 1)
+	if f.hold != nil {
+		<-f.hold
+	}
+	select {
+	case err := <-f.errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (f *flaky) GetClient(ctx context.Context, ID int) (*Client, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Adapter.GetClient(ctx, ID)
+}
+
+func (f *flaky) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Adapter.CreateClient(ctx, client)
+}
+
+func resilienceConfig() *config.Storage {
+	return &config.Storage{
+		RetryAttempts:    3,
+		RetryBackoff:     time.Millisecond,
+		RetryMaxBackoff:  5 * time.Millisecond,
+		BreakerThreshold: 100,
+		BreakerCooldown:  time.Minute,
+	}
+}
+
+func TestResilientRetries(t *testing.T) {
+	ctx := context.Background()
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		write bool
+		calls int32
+		kind  fault.Kind
+		ok    bool
+	}{
+		{name: "read retried", errs: []error{reset, reset}, calls: 3, ok: true},
+		{name: "read retries bounded", errs: []error{reset, reset, reset, reset}, calls: 3, kind: fault.Unavailable},
+		{name: "write not retried if it may be applied", errs: []error{reset}, write: true, calls: 1, kind: fault.Unavailable},
+		{name: "write retried if not applied", errs: []error{driver.ErrBadConn}, write: true, calls: 2, ok: true},
+		{name: "lasting errors not retried", errs: []error{ErrVersionMismatch{}}, write: true, calls: 1, kind: fault.Precondition},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFlaky(t, tc.errs...)
+			_, err := f.Adapter.CreateClient(ctx, &Client{Name: "Acme"})
+			require.NoError(t, err)
+			db := NewResilient(f, resilienceConfig())
+			if tc.write {
+				_, err = db.CreateClient(ctx, &Client{Name: "Meta"})
+			} else {
+				_, err = db.GetClient(ctx, 1)
+			}
+			assert.Equal(t, tc.calls, atomic.LoadInt32(&f.calls))
+			if tc.ok {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tc.kind, fault.KindOf(err))
+		})
+	}
+}
+
+func TestResilientBreaker(t *testing.T) {
+	ctx := context.Background()
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	f := newFlaky(t, reset, reset, reset)
+	cfg := resilienceConfig()
+	cfg.RetryAttempts, cfg.BreakerThreshold, cfg.BreakerCooldown = 1, 2, 50*time.Millisecond
+	db := NewResilient(f, cfg)
+	_, err := db.GetClient(ctx, 1)
+	assert.Equal(t, fault.Unavailable, fault.KindOf(err))
+	_, err = db.GetClient(ctx, 1)
+	assert.Equal(t, fault.Unavailable, fault.KindOf(err))
+
+	_, err = db.GetClient(ctx, 1)
+	assert.Equal(t, fault.Unavailable, fault.KindOf(err))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.calls), "open breaker fails fast")
+	assert.Positive(t, fault.RetryAfterOf(err))
+	assert.True(t, db.CircuitOpen())
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = db.GetClient(ctx, 1)
+	assert.Equal(t, fault.Unavailable, fault.KindOf(err), "failed probe opens the breaker again")
+	_, err = db.GetClient(ctx, 1)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&f.calls))
+	assert.Positive(t, fault.RetryAfterOf(err))
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = db.GetClient(ctx, 1)
+	assert.IsType(t, ErrNotFound{}, err, "probe got through, lasting errors close the breaker")
+	_, err = db.GetClient(ctx, 1)
+	assert.IsType(t, ErrNotFound{}, err)
+	assert.EqualValues(t, 5, atomic.LoadInt32(&f.calls))
+	assert.False(t, db.CircuitOpen())
+}
+
+func TestResilientBulkhead(t *testing.T) {
+	ctx := context.Background()
+	f := newFlaky(t)
+	f.hold = make(chan struct{})
+	cfg := resilienceConfig()
+	cfg.MaxConcurrent, cfg.QueueTimeout = 1, 10*time.Millisecond
+	db := NewResilient(f, cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = db.GetClient(ctx, 1)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&f.calls) == 1 }, time.Second, time.Millisecond)
+	_, err := db.GetClient(ctx, 1)
+	assert.Equal(t, fault.Unavailable, fault.KindOf(err), "no slot within the queue timeout")
+	assert.Positive(t, fault.RetryAfterOf(err))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.calls))
+
+	close(f.hold)
+	<-done
+	_, err = db.GetClient(ctx, 1)
+	assert.IsType(t, ErrNotFound{}, err, "slot is released")
+}
+
+func TestResilientWithTx(t *testing.T) {
+	ctx := context.Background()
+	memory := &Memory{}
+	require.NoError(t, memory.Init(ctx, &config.Storage{}))
+	db := NewResilient(memory, resilienceConfig())
+	failed := errors.New("failed")
+	err := db.WithTx(ctx, func(tx Adapter) error {
+		_, err := tx.CreateClient(ctx, &Client{Name: "Acme"})
+		require.NoError(t, err)
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	clients, _, err := db.SelectClients(ctx, Query{}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, clients, "the writes of fn are rolled back along with the transaction")
+}
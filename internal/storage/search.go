@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+// Types of the search hits.
+const (
+	HitClient  = "client"
+	HitProject = "project"
+)
+
+type (
+	// SearchHit Client or project named like the search text, the higher the rank the better the match.
+	SearchHit struct {
+		Type string  `json:"type" db:"type"`
+		ID   int     `json:"id" db:"id"`
+		Name string  `json:"name" db:"name"`
+		Rank float64 `json:"rank" db:"rank"`
+	}
+
+	// Searcher Adapters with a full-text index of the client and project names.
+	Searcher interface {
+		// Search Returns up to limit live entities named with every word of the text, the best matches first.
+		Search(ctx context.Context, text string, limit int) ([]*SearchHit, error)
+	}
+)
+
+// Search Looks the text up in the adapter index, or scans the names if it has none.
+func Search(ctx context.Context, adapter Adapter, text string, limit int) ([]*SearchHit, error) {
+	if searcher, ok := As[Searcher](adapter); ok {
+		return searcher.Search(ctx, text, limit)
+	}
+	return scanSearch(ctx, adapter, text, limit)
+}
+
+// scanSearch Selects the names containing every word, ranked by the share of the name the words cover.
+func scanSearch(ctx context.Context, adapter Adapter, text string, limit int) ([]*SearchHit, error) {
+	// asterisks are =like= wildcards, which can't be escaped
+	terms := strings.Fields(strings.ReplaceAll(text, "*", " "))
+	hits := []*SearchHit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+	clientsQuery, err := containsAll(ClientSchema, terms)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	clients, _, err := adapter.SelectClients(ctx, clientsQuery, Page{})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	projectsQuery, err := containsAll(ProjectSchema, terms)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	projects, _, err := adapter.SelectProjects(ctx, projectsQuery, Page{})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	for _, client := range clients {
+		hits = append(hits, &SearchHit{Type: HitClient, ID: *client.ID, Name: client.Name, Rank: coverage(client.Name, terms)})
+	}
+	for _, project := range projects {
+		hits = append(hits, &SearchHit{Type: HitProject, ID: *project.ID, Name: project.Name, Rank: coverage(project.Name, terms)})
+	}
+	return sortHits(hits, limit), nil
+}
+
+// containsAll Query of the names containing every term.
+func containsAll(schema *Schema, terms []string) (Query, error) {
+	var query Query
+	for _, term := range terms {
+		node, err := schema.Compare("name", OpLike, "*"+term+"*")
+		if !tools.Try(err) {
+			return query, err
+		}
+		query = query.And(node)
+	}
+	return query, nil
+}
+
+// coverage Share of the name length taken by the terms, 1 for the exact match.
+func coverage(name string, terms []string) float64 {
+	covered := 0
+	for _, term := range terms {
+		covered += utf8.RuneCountInString(term)
+	}
+	length := utf8.RuneCountInString(name)
+	if covered >= length {
+		return 1
+	}
+	return float64(covered) / float64(length)
+}
+
+// sortHits Best matches first, then clients ahead of projects in the ID order, cut down to the limit unless it's 0.
+func sortHits(hits []*SearchHit, limit int) []*SearchHit {
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.ID < b.ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// searchPhrases Words of the text quoted to be matched literally, every one of them is required.
+func searchPhrases(text string, prefix bool) string {
+	terms := strings.Fields(strings.ReplaceAll(text, `"`, " "))
+	for i, term := range terms {
+		terms[i] = `"` + term + `"`
+		if prefix {
+			terms[i] += "*"
+		}
+	}
+	return strings.Join(terms, " ")
+}
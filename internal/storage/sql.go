@@ -0,0 +1,987 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type (
+	// sqlStore Shared sqlx implementation of the Adapter, specialized by a sqlDialect.
+	sqlStore struct {
+		conn *sqlx.DB
+		// tx Transaction of WithTx the statements run in, instead of the connection pool, if set.
+		tx             *sqlx.Tx
+		dialect        sqlDialect
+		onClientDelete DeletePolicy
+	}
+
+	// queryer Either the connection pool or the transaction.
+	queryer interface {
+		sqlx.ExtContext
+		GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+		SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	}
+
+	// sqlDialect Backend specific bits of SQL the shared queries can't express.
+	sqlDialect interface {
+		// idExpr Returns an insert value expression for the optional explicit ID bound to a single placeholder.
+		idExpr(table string) string
+		// syncSequence Makes sure automatically allocated IDs of the table stay ahead of the explicit one.
+		syncSequence(ctx context.Context, tx *sqlx.Tx, table string, ID int) error
+		// migrationsDir Embedded resources directory with the dialect migrations.
+		migrationsDir() string
+		// lockMigrations Keeps the other connections from migrating until the transaction is done.
+		lockMigrations(ctx context.Context, tx *sqlx.Tx) error
+		// isForeignKeyViolation Tells if the error comes from the database referential integrity check.
+		isForeignKeyViolation(err error) bool
+		// isUniqueViolation Tells if the error comes from the primary key or unique index check.
+		isUniqueViolation(err error) bool
+		// forUpdate Locking clause of the select within read-modify-write transactions.
+		forUpdate() string
+		// forShare Locking clause of the select of a row the write refers to, so it's not changed until the commit.
+		forShare() string
+		// sequence Returns the last ID allocated for the table, 0 if none.
+		sequence(ctx context.Context, db sqlx.QueryerContext, table string) (int, error)
+		// advanceSequence Moves the sequence of the table up to the ID, never back.
+		advanceSequence(ctx context.Context, tx *sqlx.Tx, table string, ID int) error
+	}
+
+	flatClient struct {
+		Client
+		ClientSettings
+	}
+)
+
+func (c *flatClient) Inflate() *Client {
+	return &Client{
+		ID:        c.ID,
+		Name:      c.Name,
+		Settings:  c.ClientSettings,
+		Version:   c.Version,
+		DeletedAt: c.DeletedAt,
+	}
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.conn.PingContext(ctx)
+}
+
+// Close Waits for the queries in progress and closes the pool, within WithTx the connections are not the transaction's to close.
+func (s *sqlStore) Close(context.Context) error {
+	if s.tx != nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// withTx Runs fn with a copy of the store bound to the transaction, nested calls run within a savepoint of it.
+func (s *sqlStore) withTx(ctx context.Context, fn func(scoped sqlStore) error) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		scoped := *s
+		scoped.tx = tx
+		return fn(scoped)
+	})
+}
+
+// db Runs the statements in the transaction of WithTx, if there is one.
+func (s *sqlStore) db() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.conn
+}
+
+// configurePool Applies the pool limits of the config to the connection.
+func configurePool(db *sqlx.DB, cfg *config.Storage) {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+}
+
+func (s *sqlStore) SelectClients(ctx context.Context, query Query, page Page) ([]*Client, bool, error) {
+	var proxy []*flatClient
+	err := s.selectPage(ctx, &proxy, "select id, name, code_scan_interval, version, deleted_at from clients", trashCond(query), nil, ClientSchema, query, page)
+	if !tools.Try(err) {
+		return nil, false, err
+	}
+	proxy, more := window(proxy, page)
+	res := make([]*Client, 0, len(proxy))
+	for _, flat := range proxy {
+		res = append(res, flat.Inflate())
+	}
+	return res, more, nil
+}
+
+func (s *sqlStore) GetClient(ctx context.Context, ID int) (*Client, error) {
+	proxy := flatClient{}
+	err := s.db().GetContext(ctx, &proxy, s.conn.Rebind("select id, name, code_scan_interval, version, deleted_at from clients where id=? and deleted_at is null;"), ID)
+	if !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	return proxy.Inflate(), nil
+}
+
+func (s *sqlStore) CreateClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil {
+		return nil, ErrNilEntity{}
+	}
+	var res *Client
+	err := s.atomic(ctx, func(tx *sqlx.Tx) (err error) {
+		res, err = s.createClient(ctx, tx, client)
+		return err
+	})
+	if s.dialect.isUniqueViolation(err) {
+		return nil, ErrAlreadyExists{err}
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) createClient(ctx context.Context, tx *sqlx.Tx, client *Client) (*Client, error) {
+	if err := s.checkIDFree(ctx, tx, "clients", client.ID); !tools.Try(err) {
+		return nil, err
+	}
+	res := &flatClient{}
+	err := tx.GetContext(ctx, res, tx.Rebind(`
+		insert into clients (id, name, code_scan_interval, version)
+		values (`+s.dialect.idExpr("clients")+`,?,?,1)
+		returning id, name, code_scan_interval, version, deleted_at;
+	`), client.ID, client.Name, client.Settings.CodeScanInterval)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if err = s.syncSequence(ctx, tx, "clients", client.ID); !tools.Try(err) {
+		return nil, err
+	}
+	return res.Inflate(), nil
+}
+
+func (s *sqlStore) ReplaceClient(ctx context.Context, client *Client) (*Client, error) {
+	if client == nil || client.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+	var res *Client
+	err := s.atomic(ctx, func(tx *sqlx.Tx) (err error) {
+		if err = s.checkVersion(ctx, tx, "clients", *client.ID, client.Version); !tools.Try(err) {
+			return err
+		}
+		res, err = s.replaceClient(ctx, tx, client)
+		return err
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) UpdateClient(ctx context.Context, ID int, update func(client *Client) error) (*Client, error) {
+	var res *Client
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		proxy := flatClient{}
+		err := tx.GetContext(ctx, &proxy, tx.Rebind(`
+			select id, name, code_scan_interval, version, deleted_at from clients where id=? and deleted_at is null`+s.dialect.forUpdate()+`;
+		`), ID)
+		if !tools.Try(err) {
+			return passNotFound(err)
+		}
+		client := proxy.Inflate()
+		if err = update(client); !tools.Try(err) {
+			return err
+		}
+		if client.ID == nil || *client.ID != ID {
+			return errIDChanged
+		}
+		res, err = s.replaceClient(ctx, tx, client)
+		return err
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) replaceClient(ctx context.Context, tx *sqlx.Tx, client *Client) (*Client, error) {
+	res := &flatClient{}
+	err := tx.GetContext(ctx, res, tx.Rebind(`
+		update clients set name=?, code_scan_interval=?, version=version+1
+		where id=? and deleted_at is null
+		returning id, name, code_scan_interval, version, deleted_at;
+	`), client.Name, client.Settings.CodeScanInterval, client.ID)
+	if !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	return res.Inflate(), nil
+}
+
+// DeleteClient Deals with the live projects of the client according to the delete policy in the same transaction.
+func (s *sqlStore) DeleteClient(ctx context.Context, ID int, version int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		return s.deleteClient(ctx, tx, ID, version)
+	})
+}
+
+func (s *sqlStore) deleteClient(ctx context.Context, tx *sqlx.Tx, ID int, version int) error {
+	err := s.checkVersion(ctx, tx, "clients", ID, version)
+	if !tools.Try(err) {
+		return err
+	}
+	deletedAt := tombstone()
+	switch s.onClientDelete {
+	case DeleteCascade:
+		_, err = tx.ExecContext(ctx, tx.Rebind(`
+			update projects set deleted_at = ?, version = version + 1 where client_id = ? and deleted_at is null;
+		`), deletedAt, ID)
+	case DeleteNullify:
+		_, err = tx.ExecContext(ctx, tx.Rebind(`
+			update projects set client_id = null, version = version + 1 where client_id = ? and deleted_at is null;
+		`), ID)
+	default:
+		var n int
+		err = tx.GetContext(ctx, &n, tx.Rebind("select count(*) from projects where client_id = ? and deleted_at is null;"), ID)
+		if tools.Try(err) && n > 0 {
+			err = ErrReferenced{errors.Errorf("client %d has %d projects", ID, n)}
+		}
+	}
+	if !tools.Try(err) {
+		return err
+	}
+	return s.trash(ctx, tx, "clients", ID, deletedAt)
+}
+
+// RestoreClient Projects trashed at the same moment as the client were trashed along with it.
+func (s *sqlStore) RestoreClient(ctx context.Context, ID int) (*Client, error) {
+	res := &flatClient{}
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, tx.Rebind(`
+			update projects set deleted_at = null, version = version + 1
+			where client_id = ? and deleted_at = (select deleted_at from clients where id = ?);
+		`), ID, ID)
+		if !tools.Try(err) {
+			return err
+		}
+		err = tx.GetContext(ctx, res, tx.Rebind(`
+			update clients set deleted_at = null, version = version + 1
+			where id = ? and deleted_at is not null
+			returning id, name, code_scan_interval, version, deleted_at;
+		`), ID)
+		return passNotFound(err)
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res.Inflate(), nil
+}
+
+func (s *sqlStore) PurgeClient(ctx context.Context, ID int) error {
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, tx.Rebind(`
+			delete from projects where client_id = ? and deleted_at is not null
+			and exists (select 1 from clients where id = ? and deleted_at is not null);
+		`), ID, ID)
+		if !tools.Try(err) {
+			return err
+		}
+		return s.purge(ctx, tx, "clients", ID)
+	})
+	if s.dialect.isForeignKeyViolation(err) {
+		return ErrReferenced{err}
+	}
+	return err
+}
+
+func (s *sqlStore) SelectProjects(ctx context.Context, query Query, page Page) ([]*Project, bool, error) {
+	//goland:noinspection ALL
+	res := []*Project{}
+	err := s.selectPage(ctx, &res, "select id, client_id, name, version, deleted_at from projects", trashCond(query), nil, ProjectSchema, query, page)
+	if !tools.Try(err) {
+		return nil, false, err
+	}
+	res, more := window(res, page)
+	return res, more, nil
+}
+
+func (s *sqlStore) GetProject(ctx context.Context, ID int) (*Project, error) {
+	res := &Project{}
+	err := s.db().GetContext(ctx, res, s.conn.Rebind("select id, client_id, name, version, deleted_at from projects where id=? and deleted_at is null;"), ID)
+	if !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	return res, nil
+}
+
+func (s *sqlStore) CreateProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil {
+		return nil, ErrNilEntity{}
+	}
+	var res *Project
+	err := s.atomic(ctx, func(tx *sqlx.Tx) (err error) {
+		res, err = s.createProject(ctx, tx, project)
+		return err
+	})
+	switch {
+	case s.dialect.isUniqueViolation(err):
+		return nil, ErrAlreadyExists{err}
+	case s.dialect.isForeignKeyViolation(err):
+		return nil, ErrDanglingReference{err}
+	case !tools.Try(err):
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) createProject(ctx context.Context, tx *sqlx.Tx, project *Project) (*Project, error) {
+	if err := s.checkIDFree(ctx, tx, "projects", project.ID); !tools.Try(err) {
+		return nil, err
+	}
+	if err := s.checkClientExists(ctx, tx, project.ClientID); !tools.Try(err) {
+		return nil, err
+	}
+	res := &Project{}
+	err := tx.GetContext(ctx, res, tx.Rebind(`
+		insert into projects (id, client_id, name, version)
+		values (`+s.dialect.idExpr("projects")+`,?,?,1)
+		returning id, client_id, name, version, deleted_at;
+	`), project.ID, project.ClientID, project.Name)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if err = s.syncSequence(ctx, tx, "projects", project.ID); !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) ReplaceProject(ctx context.Context, project *Project) (*Project, error) {
+	if project == nil || project.ID == nil {
+		return nil, ErrNilEntity{}
+	}
+	var res *Project
+	err := s.atomic(ctx, func(tx *sqlx.Tx) (err error) {
+		if err = s.checkVersion(ctx, tx, "projects", *project.ID, project.Version); !tools.Try(err) {
+			return err
+		}
+		res, err = s.replaceProject(ctx, tx, project)
+		return err
+	})
+	if s.dialect.isForeignKeyViolation(err) {
+		return nil, ErrDanglingReference{err}
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) UpdateProject(ctx context.Context, ID int, update func(project *Project) error) (*Project, error) {
+	var res *Project
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		project := &Project{}
+		err := tx.GetContext(ctx, project, tx.Rebind(`
+			select id, client_id, name, version, deleted_at from projects where id=? and deleted_at is null`+s.dialect.forUpdate()+`;
+		`), ID)
+		if !tools.Try(err) {
+			return passNotFound(err)
+		}
+		if err = update(project); !tools.Try(err) {
+			return err
+		}
+		if project.ID == nil || *project.ID != ID {
+			return errIDChanged
+		}
+		res, err = s.replaceProject(ctx, tx, project)
+		return err
+	})
+	if s.dialect.isForeignKeyViolation(err) {
+		return nil, ErrDanglingReference{err}
+	}
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) replaceProject(ctx context.Context, tx *sqlx.Tx, project *Project) (*Project, error) {
+	if err := s.checkClientExists(ctx, tx, project.ClientID); !tools.Try(err) {
+		return nil, err
+	}
+	res := &Project{}
+	err := tx.GetContext(ctx, res, tx.Rebind(`
+		update projects set client_id=?, name=?, version=version+1
+		where id=? and deleted_at is null
+		returning id, client_id, name, version, deleted_at;
+	`), project.ClientID, project.Name, project.ID)
+	if !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	return res, nil
+}
+
+func (s *sqlStore) DeleteProject(ctx context.Context, ID int, version int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		return s.deleteProject(ctx, tx, ID, version)
+	})
+}
+
+func (s *sqlStore) deleteProject(ctx context.Context, tx *sqlx.Tx, ID int, version int) error {
+	if err := s.checkVersion(ctx, tx, "projects", ID, version); !tools.Try(err) {
+		return err
+	}
+	return s.trash(ctx, tx, "projects", ID, tombstone())
+}
+
+func (s *sqlStore) RestoreProject(ctx context.Context, ID int) (*Project, error) {
+	res := &Project{}
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		var clientID *int
+		err := tx.GetContext(ctx, &clientID, tx.Rebind(`
+			select client_id from projects where id = ? and deleted_at is not null`+s.dialect.forUpdate()+`;
+		`), ID)
+		if !tools.Try(err) {
+			return passNotFound(err)
+		}
+		if err = s.checkClientExists(ctx, tx, clientID); !tools.Try(err) {
+			return err
+		}
+		return tx.GetContext(ctx, res, tx.Rebind(`
+			update projects set deleted_at = null, version = version + 1
+			where id = ?
+			returning id, client_id, name, version, deleted_at;
+		`), ID)
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) PurgeProject(ctx context.Context, ID int) error {
+	return s.purge(ctx, s.db(), "projects", ID)
+}
+
+func (s *sqlStore) AppendAudit(ctx context.Context, entry *AuditEntry) error {
+	return s.db().GetContext(ctx, &entry.ID, s.conn.Rebind(`
+		insert into audit (at, actor, claimed_actor, operation, entity, entity_id, diff)
+		values (?, ?, ?, ?, ?, ?, ?)
+		returning id;
+	`), entry.At, entry.Actor, entry.ClaimedActor, entry.Operation, entry.Entity, entry.EntityID, entry.Diff)
+}
+
+func (s *sqlStore) SelectAudit(ctx context.Context, query Query, since time.Time, page Page) ([]*AuditEntry, bool, error) {
+	//goland:noinspection ALL
+	res := []*AuditEntry{}
+	err := s.selectPage(ctx, &res, "select id, at, actor, claimed_actor, operation, entity, entity_id, diff from audit",
+		"at >= ?", []interface{}{since.UTC()}, AuditSchema, query, page)
+	if !tools.Try(err) {
+		return nil, false, err
+	}
+	for _, entry := range res {
+		entry.At = entry.At.UTC()
+	}
+	res, more := window(res, page)
+	return res, more, nil
+}
+
+const deliveryColumns = "id, event_id, webhook_id, state, attempts, next_attempt_at, last_error"
+
+func (s *sqlStore) AppendEvent(ctx context.Context, event *Event) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &event.ID, tx.Rebind(`
+			insert into outbox (at, type, entity_id, actor, data)
+			values (?, ?, ?, ?, ?)
+			returning id;
+		`), event.At, event.Type, event.EntityID, event.Actor, event.Data)
+		if !tools.Try(err) {
+			return err
+		}
+		var webhookIDs []int
+		if err = tx.SelectContext(ctx, &webhookIDs, "select id from webhooks order by id;"); !tools.Try(err) {
+			return err
+		}
+		for _, webhookID := range webhookIDs {
+			_, err = tx.ExecContext(ctx, tx.Rebind(`
+				insert into deliveries (event_id, webhook_id, state, attempts, next_attempt_at, last_error)
+				values (?, ?, ?, 0, ?, '');
+			`), event.ID, webhookID, DeliveryPending, event.At)
+			if !tools.Try(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ClaimDeliveries Locks the due rows, so the concurrent claims of Postgres wait and skip them once they are postponed.
+func (s *sqlStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	var res []*Delivery
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		err := tx.SelectContext(ctx, &res, tx.Rebind(
+			"select "+deliveryColumns+" from deliveries where state = ? and next_attempt_at <= ?"+
+				" order by next_attempt_at, id"+limitClause(limit)+s.dialect.forUpdate()+";",
+		), DeliveryPending, now.UTC())
+		if !tools.Try(err) || len(res) == 0 {
+			return err
+		}
+		until := now.Add(lease).UTC()
+		stmt, args, err := sqlx.In("update deliveries set next_attempt_at = ? where id in (?);", until, deliveryIDs(res))
+		if !tools.Try(err) {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, tx.Rebind(stmt), args...); !tools.Try(err) {
+			return err
+		}
+		for _, delivery := range res {
+			delivery.NextAttemptAt = until
+		}
+		return s.attachEvents(ctx, tx, res)
+	})
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) SaveDelivery(ctx context.Context, delivery *Delivery) error {
+	return s.affectOne(s.db().ExecContext(ctx, s.conn.Rebind(`
+		update deliveries set state = ?, attempts = ?, next_attempt_at = ?, last_error = ?
+		where id = ?;
+	`), delivery.State, delivery.Attempts, delivery.NextAttemptAt.UTC(), delivery.LastError, delivery.ID))
+}
+
+func (s *sqlStore) SelectDeliveries(ctx context.Context, state DeliveryState, limit int) ([]*Delivery, error) {
+	//goland:noinspection ALL
+	res := []*Delivery{}
+	err := s.db().SelectContext(ctx, &res, s.conn.Rebind(
+		"select "+deliveryColumns+" from deliveries where state = ? order by id"+limitClause(limit)+";",
+	), state)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	if err = s.attachEvents(ctx, s.db(), res); !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) RetryDelivery(ctx context.Context, ID int) error {
+	return s.affectOne(s.db().ExecContext(ctx, s.conn.Rebind(`
+		update deliveries set state = ?, attempts = 0, next_attempt_at = ?, last_error = ''
+		where id = ? and state = ?;
+	`), DeliveryPending, time.Now().UTC(), ID, DeliveryDead))
+}
+
+func (s *sqlStore) SelectWebhooks(ctx context.Context) ([]*Webhook, error) {
+	//goland:noinspection ALL
+	res := []*Webhook{}
+	err := s.db().SelectContext(ctx, &res, "select id, url, secret from webhooks order by id;")
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStore) GetWebhook(ctx context.Context, ID int) (*Webhook, error) {
+	res := &Webhook{}
+	err := s.db().GetContext(ctx, res, s.conn.Rebind("select id, url, secret from webhooks where id = ?;"), ID)
+	if !tools.Try(err) {
+		return nil, passNotFound(err)
+	}
+	return res, nil
+}
+
+func (s *sqlStore) CreateWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
+		return nil, ErrNilEntity{}
+	}
+	res := *webhook
+	err := s.db().GetContext(ctx, &res.ID, s.conn.Rebind(
+		"insert into webhooks (url, secret) values (?, ?) returning id;",
+	), webhook.URL, webhook.Secret)
+	if !tools.Try(err) {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *sqlStore) ReplaceWebhook(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if webhook == nil {
+		return nil, ErrNilEntity{}
+	}
+	err := s.affectOne(s.db().ExecContext(ctx, s.conn.Rebind(
+		"update webhooks set url = ?, secret = ? where id = ?;",
+	), webhook.URL, webhook.Secret, webhook.ID))
+	if !tools.Try(err) {
+		return nil, err
+	}
+	res := *webhook
+	return &res, nil
+}
+
+func (s *sqlStore) DeleteWebhook(ctx context.Context, ID int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, tx.Rebind("delete from deliveries where webhook_id = ?;"), ID); !tools.Try(err) {
+			return err
+		}
+		return s.affectOne(tx.ExecContext(ctx, tx.Rebind("delete from webhooks where id = ?;"), ID))
+	})
+}
+
+func (s *sqlStore) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	var n int64
+	err := s.atomic(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, tx.Rebind(`
+			delete from deliveries
+			where state = ? and event_id in (select id from outbox where at < ?);
+		`), DeliveryDone, before.UTC())
+		if !tools.Try(err) {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, tx.Rebind(`
+			delete from outbox
+			where at < ? and not exists (select 1 from deliveries where deliveries.event_id = outbox.id);
+		`), before.UTC())
+		if !tools.Try(err) {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// attachEvents Selects the events of the deliveries.
+func (s *sqlStore) attachEvents(ctx context.Context, db sqlx.QueryerContext, deliveries []*Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	stmt, args, err := sqlx.In("select id, at, type, entity_id, actor, data from outbox where id in (?);", eventIDs(deliveries))
+	if !tools.Try(err) {
+		return err
+	}
+	var events []*Event
+	if err = sqlx.SelectContext(ctx, db, &events, s.conn.Rebind(stmt), args...); !tools.Try(err) {
+		return err
+	}
+	attachEvents(deliveries, events)
+	return nil
+}
+
+// limitClause Limits the select, unless the limit is 0.
+func limitClause(limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	return " limit " + strconv.Itoa(limit)
+}
+
+// selectPage Completes the select with the base condition, the query filter and order, and the keyset conditions
+// of the page, taking one extra row to peek past its limit.
+func (s *sqlStore) selectPage(
+	ctx context.Context, dest interface{}, stmt string, base string, baseArgs []interface{},
+	schema *Schema, query Query, page Page,
+) error {
+	conds, args := []string{base}, append([]interface{}{}, baseArgs...)
+	if query.Filter != nil {
+		cond, condArgs := sqlFilter(query.Filter)
+		conds, args = append(conds, cond), append(args, condArgs...)
+	}
+	keys := schema.sortKeys(query)
+	if page.After != nil {
+		cond, condArgs := sqlKeyset(keys, page.After, false)
+		conds, args = append(conds, cond), append(args, condArgs...)
+	}
+	if page.Before != nil {
+		cond, condArgs := sqlKeyset(keys, page.Before, true)
+		conds, args = append(conds, cond), append(args, condArgs...)
+	}
+	stmt += " where " + strings.Join(conds, " and ")
+	var order []string
+	for _, key := range keys {
+		if key.Desc != page.Backward() {
+			order = append(order, key.Field.Column+" desc")
+		} else {
+			order = append(order, key.Field.Column)
+		}
+	}
+	stmt += " order by " + strings.Join(order, ", ")
+	if page.Limit > 0 {
+		stmt += " limit ?"
+		args = append(args, page.Limit+1)
+	}
+	return s.db().SelectContext(ctx, dest, s.conn.Rebind(stmt+";"), args...)
+}
+
+// sqlFilter Translates the filter into the WHERE condition with ? placeholders.
+func sqlFilter(node Node) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	switch n := node.(type) {
+	case And:
+		for _, operand := range n.Nodes {
+			cond, condArgs := sqlFilter(operand)
+			conds, args = append(conds, cond), append(args, condArgs...)
+		}
+		return "(" + strings.Join(conds, " and ") + ")", args
+	case Or:
+		for _, operand := range n.Nodes {
+			cond, condArgs := sqlFilter(operand)
+			conds, args = append(conds, cond), append(args, condArgs...)
+		}
+		return "(" + strings.Join(conds, " or ") + ")", args
+	case Comparison:
+		return sqlComparison(n)
+	}
+	return "false", nil
+}
+
+func sqlComparison(c Comparison) (string, []interface{}) {
+	column := c.Field.Column
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(c.Values)), ",")
+	var cond string
+	switch c.Op {
+	case OpIsNull:
+		if c.Values[0].(bool) {
+			return column + " is null", nil
+		}
+		return column + " is not null", nil
+	case OpLike:
+		return "lower(" + column + ") like lower(?) escape '\\'", []interface{}{likePattern(c.Values[0].(string))}
+	case OpEq:
+		cond = column + " = ?"
+	case OpNe:
+		cond = column + " <> ?"
+	case OpLt:
+		cond = column + " < ?"
+	case OpLe:
+		cond = column + " <= ?"
+	case OpGt:
+		cond = column + " > ?"
+	case OpGe:
+		cond = column + " >= ?"
+	case OpIn:
+		cond = column + " in (" + placeholders + ")"
+	case OpOut:
+		cond = column + " not in (" + placeholders + ")"
+	}
+	if c.Field.Nullable && (c.Op == OpNe || c.Op == OpOut) {
+		// null is not equal to anything
+		cond = "(" + column + " is null or " + cond + ")"
+	}
+	return cond, c.Values
+}
+
+// sqlKeyset Condition of the rows past the keyset in the order of the keys, or ahead of it.
+func sqlKeyset(keys []SortKey, keyset Keyset, ahead bool) (string, []interface{}) {
+	var ors []string
+	var args []interface{}
+	for i, key := range keys {
+		var ands []string
+		for j, prev := range keys[:i] {
+			ands = append(ands, prev.Field.Column+" = ?")
+			args = append(args, keyset[j])
+		}
+		op := " > ?"
+		if key.Desc != ahead {
+			op = " < ?"
+		}
+		ands = append(ands, key.Field.Column+op)
+		args = append(args, keyset[i])
+		ors = append(ors, "("+strings.Join(ands, " and ")+")")
+	}
+	return "(" + strings.Join(ors, " or ") + ")", args
+}
+
+// atomic Runs the statements in a single transaction, or within a savepoint of the one of WithTx,
+// so their failure leaves it as it was.
+func (s *sqlStore) atomic(ctx context.Context, stmts func(tx *sqlx.Tx) error) error {
+	if s.tx != nil {
+		return savepoint(ctx, s.tx, func() error { return stmts(s.tx) })
+	}
+	tx, err := s.conn.BeginTxx(ctx, nil)
+	if !tools.Try(err) {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = stmts(tx); !tools.Try(err) {
+		return err
+	}
+	return tx.Commit()
+}
+
+// savepoint Runs the statements within a savepoint of the transaction, rolled back to if they fail.
+func savepoint(ctx context.Context, tx *sqlx.Tx, stmts func() error) error {
+	if _, err := tx.ExecContext(ctx, "savepoint atomic_stmts;"); !tools.Try(err) {
+		return err
+	}
+	if err := stmts(); !tools.Try(err) {
+		if _, rerr := tx.ExecContext(ctx, "rollback to savepoint atomic_stmts;"); !tools.Try(rerr) {
+			return errors.Wrap(rerr, "rollback to savepoint")
+		}
+		if _, rerr := tx.ExecContext(ctx, "release savepoint atomic_stmts;"); !tools.Try(rerr) {
+			return errors.Wrap(rerr, "release savepoint")
+		}
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "release savepoint atomic_stmts;")
+	return err
+}
+
+// syncSequence Keeps the automatically allocated IDs ahead of the explicit one, if given.
+func (s *sqlStore) syncSequence(ctx context.Context, tx *sqlx.Tx, table string, ID *int) error {
+	if ID == nil {
+		return nil
+	}
+	return s.dialect.syncSequence(ctx, tx, table, *ID)
+}
+
+// checkVersion Locks the live entity row and compares its version with the expected one.
+func (s *sqlStore) checkVersion(ctx context.Context, tx *sqlx.Tx, table string, ID int, version int) error {
+	var stored int
+	err := tx.GetContext(ctx, &stored, tx.Rebind(
+		"select version from "+table+" where id = ? and deleted_at is null"+s.dialect.forUpdate()+";",
+	), ID)
+	if !tools.Try(err) {
+		return passNotFound(err)
+	}
+	return CheckVersion(stored, version)
+}
+
+func (s *sqlStore) checkIDFree(ctx context.Context, tx *sqlx.Tx, table string, ID *int) error {
+	if ID == nil {
+		return nil
+	}
+	var n int
+	err := tx.GetContext(ctx, &n, tx.Rebind("select count(*) from "+table+" where id = ?;"), *ID)
+	if !tools.Try(err) {
+		return err
+	}
+	if n > 0 {
+		return ErrAlreadyExists{errors.Errorf("id %d is taken", *ID)}
+	}
+	return nil
+}
+
+// checkClientExists Locks the live client row, so a concurrent delete of the client waits for the referring write.
+func (s *sqlStore) checkClientExists(ctx context.Context, tx *sqlx.Tx, clientID *int) error {
+	if clientID == nil {
+		return nil
+	}
+	var ID int
+	err := tx.GetContext(ctx, &ID, tx.Rebind(
+		"select id from clients where id = ? and deleted_at is null"+s.dialect.forShare()+";",
+	), *clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDanglingReference{errors.Errorf("client %d does not exist", *clientID)}
+	}
+	return err
+}
+
+// trash Tombstones the live entity.
+func (s *sqlStore) trash(ctx context.Context, db sqlx.ExecerContext, table string, ID int, deletedAt time.Time) error {
+	return s.affectOne(db.ExecContext(ctx, s.conn.Rebind(
+		"update "+table+" set deleted_at = ?, version = version + 1 where id = ? and deleted_at is null;",
+	), deletedAt, ID))
+}
+
+// purge Deletes the trashed entity permanently.
+func (s *sqlStore) purge(ctx context.Context, db sqlx.ExecerContext, table string, ID int) error {
+	return s.affectOne(db.ExecContext(ctx, s.conn.Rebind("delete from "+table+" where id = ? and deleted_at is not null;"), ID))
+}
+
+func (s *sqlStore) LoadClients(ctx context.Context, clients []*Client, seq int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		for _, client := range clients {
+			_, err := tx.ExecContext(ctx, tx.Rebind(`
+				insert into clients (id, name, code_scan_interval, version, deleted_at)
+				values (?,?,?,?,?)
+				on conflict (id) do update set
+					name = excluded.name, code_scan_interval = excluded.code_scan_interval,
+					version = excluded.version, deleted_at = excluded.deleted_at;
+			`), client.ID, client.Name, client.Settings.CodeScanInterval, client.Version, client.DeletedAt)
+			if !tools.Try(err) {
+				return err
+			}
+			if *client.ID > seq {
+				seq = *client.ID
+			}
+		}
+		return s.dialect.advanceSequence(ctx, tx, "clients", seq)
+	})
+}
+
+func (s *sqlStore) LoadProjects(ctx context.Context, projects []*Project, seq int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		for _, project := range projects {
+			if project.ClientID != nil {
+				var n int
+				err := tx.GetContext(ctx, &n, tx.Rebind("select count(*) from clients where id = ?;"), *project.ClientID)
+				if !tools.Try(err) {
+					return err
+				}
+				if n == 0 {
+					return ErrDanglingReference{errors.Errorf("client %d does not exist", *project.ClientID)}
+				}
+			}
+			_, err := tx.ExecContext(ctx, tx.Rebind(`
+				insert into projects (id, client_id, name, version, deleted_at)
+				values (?,?,?,?,?)
+				on conflict (id) do update set
+					client_id = excluded.client_id, name = excluded.name,
+					version = excluded.version, deleted_at = excluded.deleted_at;
+			`), project.ID, project.ClientID, project.Name, project.Version, project.DeletedAt)
+			if !tools.Try(err) {
+				return err
+			}
+			if *project.ID > seq {
+				seq = *project.ID
+			}
+		}
+		return s.dialect.advanceSequence(ctx, tx, "projects", seq)
+	})
+}
+
+func (s *sqlStore) Sequence(ctx context.Context, table string) (int, error) {
+	return s.dialect.sequence(ctx, s.db(), table)
+}
+
+func (s *sqlStore) AdvanceSequence(ctx context.Context, table string, ID int) error {
+	return s.atomic(ctx, func(tx *sqlx.Tx) error {
+		return s.dialect.advanceSequence(ctx, tx, table, ID)
+	})
+}
+
+// trashCond Selects either the live or the trashed rows.
+func trashCond(query Query) string {
+	if query.Trash {
+		return "deleted_at is not null"
+	}
+	return "deleted_at is null"
+}
+
+// affectOne Tells ErrNotFound if the statement has changed nothing.
+func (s *sqlStore) affectOne(res sql.Result, err error) error {
+	if !tools.Try(err) {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if !tools.Try(err) {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound{}
+	}
+	return nil
+}
@@ -2,164 +2,213 @@ package storage
 
 import (
 	"context"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3" // Driver for SQLite3 init
+	"github.com/mattn/go-sqlite3" // Driver for SQLite3 init
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/resources"
 	"github.com/iamwavecut/ct-mend/tools"
 )
 
 type (
 	SQLite struct {
-		conn *sqlx.DB
-		ctx  context.Context
+		sqlStore
+		// fts5 The driver is built with the sqlite_fts5 tag.
+		fts5 bool
+		// searchable The search index is there, set atomically as the migrations run along with the calls.
+		searchable int32
 	}
 
-	flatClient struct {
-		Client
-		ClientSettings
-	}
+	sqliteDialect struct{}
 )
 
-func (c *flatClient) Inflate() *Client {
-	return &Client{
-		ID:       c.ID,
-		Name:     c.Name,
-		Settings: c.ClientSettings,
+func (s *SQLite) Init(ctx context.Context, cfg *config.Storage) error {
+	policy, err := ParseDeletePolicy(cfg.ClientDeletePolicy)
+	if !tools.Try(err) {
+		return err
 	}
-}
-
-func (s *SQLite) Init(ctx context.Context, path string) error {
-	db, err := sqlx.Connect("sqlite3", path)
+	db, err := sqlx.ConnectContext(ctx, "sqlite3", sqliteDSN(cfg))
 	if !tools.Try(err) {
 		return err
 	}
+	configurePool(db, cfg)
 	s.conn = db
-	s.ctx = ctx
-	return nil
+	s.dialect = sqliteDialect{}
+	s.onClientDelete = policy
+	return s.detectSearchIndex(ctx)
 }
 
-func (s *SQLite) SelectClients() ([]*Client, error) {
-	//goland:noinspection ALL
-	proxy := []*flatClient{}
-	err := s.conn.SelectContext(s.ctx, &proxy, `
-			select id, name, code_scan_interval from clients;
-		`)
-	if !tools.Try(err) {
-		return nil, passNotFound(err)
-	}
-	var res []*Client
-	for _, flat := range proxy {
-		res = append(res, flat.Inflate())
-	}
-	return res, nil
+// WithTx SQLite runs a single write transaction at a time, the other writes wait for it up to the busy timeout.
+func (s *SQLite) WithTx(ctx context.Context, fn func(tx Adapter) error) error {
+	return s.withTx(ctx, func(scoped sqlStore) error {
+		return fn(&SQLite{sqlStore: scoped, fts5: s.fts5, searchable: atomic.LoadInt32(&s.searchable)})
+	})
 }
 
-func (s *SQLite) GetClient(ID int) (*Client, error) {
-	proxy := flatClient{}
-	err := s.conn.GetContext(s.ctx, &proxy, "select id, name, code_scan_interval from clients where id=?;", ID)
+// detectSearchIndex Finds out whether the driver has FTS5 and the search index is there already.
+// Refuses the index without FTS5, as its triggers fail every write of the names.
+func (s *SQLite) detectSearchIndex(ctx context.Context) error {
+	err := s.conn.GetContext(ctx, &s.fts5, "select sqlite_compileoption_used('ENABLE_FTS5');")
 	if !tools.Try(err) {
-		return nil, passNotFound(err)
-	}
-	return proxy.Inflate(), nil
-}
-
-func (s *SQLite) UpsertClient(client *Client) (*Client, error) {
-	if client == nil {
-		return nil, ErrNilEntity{}
+		return err
 	}
-	res := &flatClient{}
-	err := s.conn.GetContext(s.ctx, res, `
-		insert into clients (id, name, code_scan_interval) 
-		values (?,?,?) 
-		on conflict(id) do update set
-		    name=excluded.name,
-			code_scan_interval=excluded.code_scan_interval
-		where excluded.id=id
-		returning id, name, code_scan_interval;
-	`, client.ID, client.Name, client.Settings.CodeScanInterval)
+	var tables int
+	err = s.conn.GetContext(ctx, &tables, "select count(*) from sqlite_master where type = 'table' and name = 'clients_search';")
 	if !tools.Try(err) {
-		return nil, err
+		return err
 	}
-	return res.Inflate(), nil
+	if tables > 0 && !s.fts5 {
+		return errors.New("search index needs the driver built with the sqlite_fts5 tag, its triggers fail the writes of the names without it: " +
+			"build with the tag, or drop the index by resources/migrations/sqlite/search_index.down.sql")
+	}
+	if tables > 0 && s.fts5 {
+		atomic.StoreInt32(&s.searchable, 1)
+	}
+	return nil
 }
 
-func (s *SQLite) DeleteClient(ID int) error {
-	res, err := s.conn.ExecContext(s.ctx, "delete from clients where id = ?;", ID)
-	if !tools.Try(err) {
+// Migrate Also sets the search index up once the schema is there, if the driver has FTS5, check mode reports it missing.
+func (s *SQLite) Migrate(ctx context.Context, mode MigrateMode) error {
+	if err := s.sqlStore.Migrate(ctx, mode); !tools.Try(err) {
 		return err
 	}
-	n, err := res.RowsAffected()
+	if !s.fts5 || atomic.LoadInt32(&s.searchable) == 1 {
+		return nil
+	}
+	if mode == MigrateCheck {
+		return errors.New("search index is missing, migrations needed")
+	}
+	if mode != MigrateAuto {
+		return nil
+	}
+	query, err := resources.FS.ReadFile(path.Join(s.dialect.migrationsDir(), "search_index.sql"))
 	if !tools.Try(err) {
 		return err
 	}
-	if n == 0 {
-		return ErrNotFound{}
+	err = s.atomic(ctx, func(tx *sqlx.Tx) error {
+		var tables int
+		err := tx.GetContext(ctx, &tables, "select count(*) from sqlite_master where type = 'table' and name = 'clients_search';")
+		if !tools.Try(err) || tables > 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, string(query))
+		return err
+	})
+	if !tools.Try(err) {
+		return errors.Wrap(err, "search index")
 	}
+	atomic.StoreInt32(&s.searchable, 1)
+	log.Infoln("created the search index")
 	return nil
 }
 
-func (s *SQLite) SelectProjects() ([]*Project, error) {
-	//goland:noinspection ALL
-	res := []*Project{}
-	err := s.conn.SelectContext(s.ctx, &res, `
-				select id, client_id, name from projects;
-			`)
-	if !tools.Try(err) {
-		return nil, ErrNotFound{}
-	}
-	return res, nil
+// Search Ranks the names by bm25 of the FTS5 index, every word matches as a prefix as well.
+// Scans the names until the index is there.
+func (s *SQLite) Search(ctx context.Context, text string, limit int) ([]*SearchHit, error) {
+	if atomic.LoadInt32(&s.searchable) == 0 {
+		return scanSearch(ctx, s, text, limit)
+	}
+	hits := []*SearchHit{}
+	phrases := searchPhrases(text, true)
+	if phrases == "" {
+		return hits, nil
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	err := s.db().SelectContext(ctx, &hits, `
+		select 'client' as type, c.id, c.name, -bm25(clients_search) as rank
+		from clients_search join clients c on c.id = clients_search.rowid
+		where clients_search match ? and c.deleted_at is null
+		union all
+		select 'project' as type, p.id, p.name, -bm25(projects_search) as rank
+		from projects_search join projects p on p.id = projects_search.rowid
+		where projects_search match ? and p.deleted_at is null
+		order by rank desc, type, id
+		limit ?;
+	`, phrases, phrases, limit)
+	return hits, errors.Wrap(err, "search")
 }
 
-func (s *SQLite) GetProject(ID int) (*Project, error) {
-	res := &Project{}
-	err := s.conn.GetContext(s.ctx, res, "select id, client_id, name from projects where id=?;", ID)
-	if !tools.Try(err) {
-		return nil, passNotFound(err)
+// sqliteDSN Appends the connection parameters to the address, the ones it has already take precedence.
+// The transactions take the write lock up front, as a deferred one failing to upgrade its read lock
+// gets database is locked right away, regardless of the busy timeout.
+func sqliteDSN(cfg *config.Storage) string {
+	params := url.Values{"_txlock": {"immediate"}}
+	if cfg.SQLiteWAL {
+		params.Set("_journal_mode", "WAL")
+	}
+	if cfg.SQLiteBusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(cfg.SQLiteBusyTimeout.Milliseconds(), 10))
 	}
-	return res, nil
+	separator := "?"
+	if strings.Contains(cfg.Addr, "?") {
+		separator = "&"
+	}
+	return cfg.Addr + separator + params.Encode()
 }
 
-func (s *SQLite) SelectProjectsOfClient(ID int) ([]*Project, error) {
-	var res []*Project
-	err := s.conn.SelectContext(s.ctx, &res, `select id, client_id, name from projects where client_id=?;`, ID)
-	if !tools.Try(err) {
-		return nil, err
-	}
-	return res, nil
+func (sqliteDialect) idExpr(string) string {
+	return "?"
 }
 
-func (s *SQLite) UpsertProject(project *Project) (*Project, error) {
-	if project == nil {
-		return nil, ErrNilEntity{}
-	}
-	res := &Project{}
-	err := s.conn.GetContext(s.ctx, res, `
-		insert into projects (id, client_id, name) 
-		values (?,?,?) 
-		on conflict(id) do update set
-		    name=excluded.name,
-			client_id=excluded.client_id
-		where excluded.id=id
-		returning id, client_id, name;
-	`, project.ID, project.ClientID, project.Name)
-	if !tools.Try(err) {
-		return nil, err
-	}
-	return res, nil
+// syncSequence AUTOINCREMENT keeps sqlite_sequence up to date by itself.
+func (sqliteDialect) syncSequence(context.Context, *sqlx.Tx, string, int) error {
+	return nil
 }
 
-func (s *SQLite) DeleteProject(ID int) error {
-	res, err := s.conn.ExecContext(s.ctx, "delete from projects where id = ?;", ID)
-	if !tools.Try(err) {
-		return err
-	}
-	n, err := res.RowsAffected()
+func (sqliteDialect) migrationsDir() string {
+	return "migrations/sqlite"
+}
+
+// lockMigrations The transaction has taken the write lock already, see sqliteDSN.
+func (sqliteDialect) lockMigrations(context.Context, *sqlx.Tx) error {
+	return nil
+}
+
+func (sqliteDialect) isForeignKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+func (sqliteDialect) isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
+
+func (sqliteDialect) sequence(ctx context.Context, db sqlx.QueryerContext, table string) (int, error) {
+	var seq int
+	err := sqlx.GetContext(ctx, db, &seq, "select coalesce(max(seq), 0) from sqlite_sequence where name = ?;", table)
+	return seq, err
+}
+
+// advanceSequence Explicit IDs keep sqlite_sequence ahead by themselves, but the sequence may be past every row.
+func (sqliteDialect) advanceSequence(ctx context.Context, tx *sqlx.Tx, table string, ID int) error {
+	_, err := tx.ExecContext(ctx, `
+		insert into sqlite_sequence (name, seq) select ?, 0 where not exists (select 1 from sqlite_sequence where name = ?);
+	`, table, table)
 	if !tools.Try(err) {
 		return err
 	}
-	if n == 0 {
-		return ErrNotFound{}
-	}
-	return nil
+	_, err = tx.ExecContext(ctx, "update sqlite_sequence set seq = max(seq, ?) where name = ?;", ID, table)
+	return err
+}
+
+// forUpdate SQLite has a single writer anyway.
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+// forShare SQLite transactions take the write lock up front, see sqliteDSN.
+func (sqliteDialect) forShare() string {
+	return ""
 }
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/resources"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+type SQLiteTestSuite struct {
+	suite.Suite
+}
+
+func (s *SQLiteTestSuite) newDB(policy DeletePolicy) *SQLite {
+	return s.open(&config.Storage{ClientDeletePolicy: string(policy)})
+}
+
+// open Migrated database in a temporary file, closed when the test is over.
+func (s *SQLiteTestSuite) open(cfg *config.Storage) *SQLite {
+	db := &SQLite{}
+	ctx := context.Background()
+	cfg.Addr = filepath.Join(s.T().TempDir(), "db.sqlite")
+	s.Require().NoError(db.Init(ctx, cfg))
+	s.T().Cleanup(func() {
+		s.NoError(db.Close(ctx))
+	})
+	s.Require().NoError(db.Migrate(ctx, MigrateAuto))
+	return db
+}
+
+func (s *SQLiteTestSuite) TestConcurrentWrites() {
+	db := s.open(&config.Storage{
+		ClientDeletePolicy: string(DeleteRestrict),
+		SQLiteWAL:          true,
+		SQLiteBusyTimeout:  5 * time.Second,
+	})
+	ctx := context.Background()
+	eg, writeCtx := errgroup.WithContext(ctx)
+	for i := 0; i < 8; i++ {
+		eg.Go(func() error {
+			for j := 0; j < 20; j++ {
+				if _, err := db.UpdateClient(writeCtx, 1, func(*Client) error { return nil }); !tools.Try(err) {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	s.Require().NoError(eg.Wait(), "writes wait for each other, instead of failing with database is locked")
+	client, err := db.GetClient(ctx, 1)
+	s.Require().NoError(err)
+	s.Equal(161, client.Version)
+
+	var mode string
+	s.Require().NoError(db.conn.Get(&mode, "pragma journal_mode;"))
+	s.Equal("wal", mode)
+}
+
+func (s *SQLiteTestSuite) TestSearchIndex() {
+	ctx := context.Background()
+	cfg := &config.Storage{ClientDeletePolicy: string(DeleteRestrict)}
+	db := s.open(cfg)
+	if !db.fts5 {
+		s.T().Skip("the driver is built without the sqlite_fts5 tag")
+	}
+	// fixtures: client 2 is Apple
+	hits, err := db.Search(ctx, "appl", 10)
+	s.Require().NoError(err)
+	s.Require().Len(hits, 1)
+	s.Equal(SearchHit{Type: HitClient, ID: 2, Name: "Apple", Rank: hits[0].Rank}, *hits[0])
+	s.Positive(hits[0].Rank)
+	_, err = db.UpdateClient(ctx, 2, func(client *Client) error {
+		client.Name = "Pear"
+		return nil
+	})
+	s.Require().NoError(err)
+	hits, err = db.Search(ctx, "appl", 10)
+	s.Require().NoError(err)
+	s.Empty(hits, "renames are indexed")
+
+	reopened := &SQLite{}
+	s.Require().NoError(reopened.Init(ctx, cfg))
+	defer func() { s.NoError(reopened.Close(ctx)) }()
+	s.EqualValues(1, atomic.LoadInt32(&reopened.searchable), "the index is found without migrations")
+	hits, err = reopened.Search(ctx, "pear", 10)
+	s.Require().NoError(err)
+	s.Len(hits, 1)
+}
+
+func (s *SQLiteTestSuite) TestSearchIndexWithoutFTS5() {
+	ctx := context.Background()
+	cfg := &config.Storage{ClientDeletePolicy: string(DeleteRestrict)}
+	db := s.open(cfg)
+	if db.fts5 {
+		s.T().Skip("the driver is built with the sqlite_fts5 tag")
+	}
+	// stands in for the index left by a binary having FTS5
+	_, err := db.conn.ExecContext(ctx, "create table clients_search (name text);")
+	s.Require().NoError(err)
+	s.Error((&SQLite{}).Init(ctx, cfg), "the writes of the names would fail")
+}
+
+func (s *SQLiteTestSuite) TestSearchIndexDropped() {
+	ctx := context.Background()
+	cfg := &config.Storage{ClientDeletePolicy: string(DeleteRestrict)}
+	db := s.open(cfg)
+	if !db.fts5 {
+		s.T().Skip("the driver is built without the sqlite_fts5 tag")
+	}
+	query, err := resources.FS.ReadFile("migrations/sqlite/search_index.down.sql")
+	s.Require().NoError(err)
+	_, err = db.conn.ExecContext(ctx, string(query))
+	s.Require().NoError(err)
+
+	reopened := &SQLite{}
+	s.Require().NoError(reopened.Init(ctx, cfg))
+	defer func() { s.NoError(reopened.Close(ctx)) }()
+	s.Error(reopened.Migrate(ctx, MigrateCheck), "the index is missing")
+	s.Require().NoError(reopened.Migrate(ctx, MigrateAuto))
+	s.NoError(reopened.Migrate(ctx, MigrateCheck))
+	hits, err := reopened.Search(ctx, "appl", 10)
+	s.Require().NoError(err)
+	s.Len(hits, 1)
+}
+
+func (s *SQLiteTestSuite) TestDanglingProject() {
+	db := s.newDB(DeleteRestrict)
+	_, err := db.CreateProject(context.Background(), &Project{ClientID: tools.IntPtr(753), Name: "dangling"})
+	s.IsType(ErrDanglingReference{}, err)
+}
+
+func (s *SQLiteTestSuite) TestDeletePolicies() {
+	ctx := context.Background()
+	// fixtures: projects 2 and 3 belong to client 1
+	db := s.newDB(DeleteRestrict)
+	s.IsType(ErrReferenced{}, db.DeleteClient(ctx, 1, 0))
+	_, err := db.GetClient(ctx, 1)
+	s.NoError(err)
+
+	db = s.newDB(DeleteCascade)
+	s.Require().NoError(db.DeleteClient(ctx, 1, 0))
+	_, err = db.GetProject(ctx, 2)
+	s.IsType(ErrNotFound{}, err)
+
+	db = s.newDB(DeleteNullify)
+	s.Require().NoError(db.DeleteClient(ctx, 1, 0))
+	project, err := db.GetProject(ctx, 2)
+	s.Require().NoError(err)
+	s.Nil(project.ClientID)
+}
+
+func (s *SQLiteTestSuite) TestTrash() {
+	ctx := context.Background()
+	// fixtures: projects 2 and 3 belong to client 1
+	db := s.newDB(DeleteRestrict)
+	s.Require().NoError(db.DeleteProject(ctx, 2, 0))
+	s.IsType(ErrReferenced{}, db.DeleteClient(ctx, 1, 0), "project 3 is still live")
+	s.Require().NoError(db.DeleteProject(ctx, 3, 0))
+	s.Require().NoError(db.DeleteClient(ctx, 1, 0))
+	_, err := db.RestoreProject(ctx, 2)
+	s.IsType(ErrDanglingReference{}, err)
+	_, err = db.RestoreClient(ctx, 1)
+	s.Require().NoError(err)
+	_, err = db.GetProject(ctx, 2)
+	s.IsType(ErrNotFound{}, err, "projects trashed on their own stay in the trash")
+	restored, err := db.RestoreProject(ctx, 2)
+	s.Require().NoError(err)
+	s.Nil(restored.DeletedAt)
+	s.Equal(3, restored.Version)
+
+	db = s.newDB(DeleteCascade)
+	s.Require().NoError(db.DeleteClient(ctx, 1, 0))
+	trash, _, err := db.SelectProjects(ctx, Query{Trash: true}, Page{})
+	s.Require().NoError(err)
+	s.Require().Len(trash, 2)
+	s.Equal(2, *trash[0].ID)
+	s.NotNil(trash[0].DeletedAt)
+	_, err = db.RestoreClient(ctx, 1)
+	s.Require().NoError(err)
+	project, err := db.GetProject(ctx, 3)
+	s.Require().NoError(err)
+	s.Equal(1, *project.ClientID)
+
+	s.IsType(ErrNotFound{}, db.PurgeClient(ctx, 1), "only trashed entities are purged")
+	s.Require().NoError(db.DeleteClient(ctx, 1, 0))
+	s.Require().NoError(db.PurgeClient(ctx, 1))
+	s.IsType(ErrNotFound{}, db.PurgeProject(ctx, 2))
+	_, err = db.RestoreClient(ctx, 1)
+	s.IsType(ErrNotFound{}, err)
+}
+
+func (s *SQLiteTestSuite) TestWriteSemantics() {
+	ctx := context.Background()
+	db := s.newDB(DeleteRestrict)
+	_, err := db.CreateClient(ctx, &Client{ID: tools.IntPtr(1), Name: "taken"})
+	s.IsType(ErrAlreadyExists{}, err)
+	_, err = db.ReplaceClient(ctx, &Client{ID: tools.IntPtr(753), Name: "missing"})
+	s.IsType(ErrNotFound{}, err)
+
+	replaced, err := db.ReplaceProject(ctx, &Project{ID: tools.IntPtr(2), Name: "unowned"})
+	s.Require().NoError(err)
+	s.Nil(replaced.ClientID)
+	updated, err := db.UpdateProject(ctx, 2, func(project *Project) error {
+		project.ClientID = tools.IntPtr(1)
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal(1, *updated.ClientID)
+	s.Equal("unowned", updated.Name)
+	s.Equal(3, updated.Version)
+
+	_, err = db.ReplaceProject(ctx, &Project{ID: tools.IntPtr(2), Name: "stale", Version: 2})
+	s.IsType(ErrVersionMismatch{}, err)
+	s.IsType(ErrVersionMismatch{}, db.DeleteProject(ctx, 2, 2))
+
+	_, err = db.UpdateProject(ctx, 2, func(project *Project) error {
+		project.ClientID = tools.IntPtr(753)
+		return nil
+	})
+	s.IsType(ErrDanglingReference{}, err)
+}
+
+func (s *SQLiteTestSuite) TestPagination() {
+	ctx := context.Background()
+	db := s.newDB(DeleteRestrict)
+	// fixtures: projects 2 and 3 belong to client 1
+	owned, err := ProjectSchema.ParseQuery("client_id==1", "")
+	s.Require().NoError(err)
+	projects, more, err := db.SelectProjects(ctx, owned, Page{Limit: 1})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 1)
+	s.Equal(2, *projects[0].ID)
+	s.True(more)
+
+	projects, more, err = db.SelectProjects(ctx, owned, Page{Limit: 1, Before: Keyset{int64(3)}})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 1)
+	s.Equal(2, *projects[0].ID)
+	s.False(more)
+
+	all, _, err := db.SelectProjects(ctx, Query{}, Page{})
+	s.Require().NoError(err)
+	last := *all[len(all)-1].ID
+	projects, more, err = db.SelectProjects(ctx, Query{}, Page{Limit: 2, Before: Keyset{int64(last + 1)}})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 2)
+	s.Less(*projects[0].ID, *projects[1].ID, "backward pages keep the ID order")
+	s.Equal(last, *projects[1].ID)
+	s.Equal(len(all) > 2, more)
+}
+
+func (s *SQLiteTestSuite) TestFilterAndSort() {
+	ctx := context.Background()
+	db := s.newDB(DeleteRestrict)
+	// fixtures: clients Microsoft 10µs, Apple 20µs, Alphabet 5µs and Meta 1µs
+	for _, tc := range []struct {
+		name, filter, sort string
+		IDs                []int
+	}{
+		{"Like", "name=like=A*", "", []int{2, 3}},
+		{"LikeEscapes", `name=like="M_ta"`, "", nil},
+		{"Nested", "(name==Meta,name==Apple);settings.code_scan_interval=gt=1000", "", []int{2}},
+		{"Out", "id=out=(1,2)", "-name", []int{4, 3}},
+		{"Sort", "", "-settings.code_scan_interval", []int{2, 1, 3, 4}},
+	} {
+		s.Run(tc.name, func() {
+			query, err := ClientSchema.ParseQuery(tc.filter, tc.sort)
+			s.Require().NoError(err)
+			clients, _, err := db.SelectClients(ctx, query, Page{})
+			s.Require().NoError(err)
+			var IDs []int
+			for _, client := range clients {
+				IDs = append(IDs, *client.ID)
+			}
+			s.Equal(tc.IDs, IDs)
+		})
+	}
+
+	// fixtures: project 1 is not owned
+	unowned, err := ProjectSchema.ParseQuery("client_id=isnull=true", "")
+	s.Require().NoError(err)
+	projects, _, err := db.SelectProjects(ctx, unowned, Page{})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 1)
+	s.Equal(1, *projects[0].ID)
+	others, err := ProjectSchema.ParseQuery("client_id!=2", "")
+	s.Require().NoError(err)
+	projects, _, err = db.SelectProjects(ctx, others, Page{})
+	s.Require().NoError(err)
+	s.Len(projects, 5, "null is not equal to anything")
+
+	query, err := ClientSchema.ParseQuery("", "name")
+	s.Require().NoError(err)
+	page, more, err := db.SelectClients(ctx, query, Page{Limit: 2})
+	s.Require().NoError(err)
+	s.True(more)
+	s.Equal("Apple", page[1].Name)
+	page, more, err = db.SelectClients(ctx, query, Page{Limit: 2, After: ClientSchema.KeysetOf(query, page[1])})
+	s.Require().NoError(err)
+	s.False(more)
+	s.Require().Len(page, 2)
+	s.Equal("Meta", page[0].Name)
+	s.Equal("Microsoft", page[1].Name)
+}
+
+func TestSQLiteSuite(t *testing.T) {
+	suite.Run(t, new(SQLiteTestSuite))
+}
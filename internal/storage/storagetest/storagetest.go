@@ -0,0 +1,579 @@
+// Package storagetest Conformance suite of storage.Adapter, the behaviour every implementation must share
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+// Suite Runs the conformance tests against the adapters New returns, e.g.
+//
+//	suite.Run(t, &storagetest.Suite{New: func(t *testing.T) storage.Adapter { ... }})
+type Suite struct {
+	suite.Suite
+	// New Returns an initialized adapter with the latest schema and the restrict delete policy, see Clear for
+	// the ones populated by migrations. It's called for every test, which should register the cleanup of the adapter.
+	New func(t *testing.T) storage.Adapter
+	// NoTransactions The adapter has no transactions to roll back, like MongoDB standalone servers.
+	NoTransactions bool
+
+	db  storage.Adapter
+	ctx context.Context
+}
+
+// Clear Deletes and purges every entity, though the ID sequences keep going.
+func Clear(ctx context.Context, db storage.Adapter) error {
+	for _, trash := range []bool{false, true} {
+		projects, _, err := db.SelectProjects(ctx, storage.Query{Trash: trash}, storage.Page{})
+		if !tools.Try(err) {
+			return err
+		}
+		for _, project := range projects {
+			if !trash {
+				if err = db.DeleteProject(ctx, *project.ID, 0); !tools.Try(err) {
+					return err
+				}
+			}
+			if err = db.PurgeProject(ctx, *project.ID); !tools.Try(err) {
+				return err
+			}
+		}
+	}
+	for _, trash := range []bool{false, true} {
+		clients, _, err := db.SelectClients(ctx, storage.Query{Trash: trash}, storage.Page{})
+		if !tools.Try(err) {
+			return err
+		}
+		for _, client := range clients {
+			if !trash {
+				if err = db.DeleteClient(ctx, *client.ID, 0); !tools.Try(err) {
+					return err
+				}
+			}
+			if err = db.PurgeClient(ctx, *client.ID); !tools.Try(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Suite) SetupTest() {
+	s.Require().NotNil(s.New, "New must be set")
+	s.ctx = context.Background()
+	s.db = s.New(s.T())
+}
+
+func (s *Suite) TearDownTest() {
+	s.NoError(s.db.Close(s.ctx))
+}
+
+func (s *Suite) TestPing() {
+	s.NoError(s.db.Ping(s.ctx))
+}
+
+func (s *Suite) TestEmpty() {
+	clients, more, err := s.db.SelectClients(s.ctx, storage.Query{}, storage.Page{})
+	s.Require().NoError(err, "empty collections are not an error")
+	s.NotNil(clients)
+	s.Empty(clients)
+	s.False(more)
+	projects, more, err := s.db.SelectProjects(s.ctx, storage.Query{}, storage.Page{})
+	s.Require().NoError(err)
+	s.NotNil(projects)
+	s.Empty(projects)
+	s.False(more)
+}
+
+func (s *Suite) TestNotFound() {
+	_, err := s.db.GetClient(s.ctx, 1)
+	s.IsType(storage.ErrNotFound{}, err)
+	_, err = s.db.ReplaceClient(s.ctx, &storage.Client{ID: tools.IntPtr(1), Name: "missing"})
+	s.IsType(storage.ErrNotFound{}, err)
+	_, err = s.db.UpdateClient(s.ctx, 1, func(*storage.Client) error { return nil })
+	s.IsType(storage.ErrNotFound{}, err)
+	s.IsType(storage.ErrNotFound{}, s.db.DeleteClient(s.ctx, 1, 0))
+	_, err = s.db.RestoreClient(s.ctx, 1)
+	s.IsType(storage.ErrNotFound{}, err)
+	s.IsType(storage.ErrNotFound{}, s.db.PurgeClient(s.ctx, 1))
+
+	_, err = s.db.GetProject(s.ctx, 1)
+	s.IsType(storage.ErrNotFound{}, err)
+	_, err = s.db.ReplaceProject(s.ctx, &storage.Project{ID: tools.IntPtr(1), Name: "missing"})
+	s.IsType(storage.ErrNotFound{}, err)
+	_, err = s.db.UpdateProject(s.ctx, 1, func(*storage.Project) error { return nil })
+	s.IsType(storage.ErrNotFound{}, err)
+	s.IsType(storage.ErrNotFound{}, s.db.DeleteProject(s.ctx, 1, 0))
+	_, err = s.db.RestoreProject(s.ctx, 1)
+	s.IsType(storage.ErrNotFound{}, err)
+	s.IsType(storage.ErrNotFound{}, s.db.PurgeProject(s.ctx, 1))
+}
+
+func (s *Suite) TestNilEntity() {
+	_, err := s.db.CreateClient(s.ctx, nil)
+	s.IsType(storage.ErrNilEntity{}, err)
+	_, err = s.db.ReplaceClient(s.ctx, nil)
+	s.IsType(storage.ErrNilEntity{}, err)
+	_, err = s.db.CreateProject(s.ctx, nil)
+	s.IsType(storage.ErrNilEntity{}, err)
+	_, err = s.db.ReplaceProject(s.ctx, nil)
+	s.IsType(storage.ErrNilEntity{}, err)
+}
+
+func (s *Suite) TestClientCRUD() {
+	created, err := s.db.CreateClient(s.ctx, &storage.Client{
+		Name:     "Microsoft",
+		Settings: storage.ClientSettings{CodeScanInterval: 10000},
+	})
+	s.Require().NoError(err)
+	s.Require().NotNil(created.ID)
+	s.Equal("Microsoft", created.Name)
+	s.Equal(1, created.Version)
+	s.Nil(created.DeletedAt)
+
+	stored, err := s.db.GetClient(s.ctx, *created.ID)
+	s.Require().NoError(err)
+	s.Equal(created, stored)
+
+	replaced, err := s.db.ReplaceClient(s.ctx, &storage.Client{ID: created.ID, Name: "Apple"})
+	s.Require().NoError(err)
+	s.Equal("Apple", replaced.Name)
+	s.Zero(replaced.Settings.CodeScanInterval, "replace overwrites every field")
+	s.Equal(2, replaced.Version)
+
+	updated, err := s.db.UpdateClient(s.ctx, *created.ID, func(client *storage.Client) error {
+		client.Settings.CodeScanInterval = 5000
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal("Apple", updated.Name)
+	s.EqualValues(5000, updated.Settings.CodeScanInterval)
+	s.Equal(3, updated.Version)
+
+	_, err = s.db.ReplaceClient(s.ctx, &storage.Client{ID: created.ID, Name: "stale", Version: 2})
+	s.IsType(storage.ErrVersionMismatch{}, err)
+	s.IsType(storage.ErrVersionMismatch{}, s.db.DeleteClient(s.ctx, *created.ID, 2))
+
+	s.Require().NoError(s.db.DeleteClient(s.ctx, *created.ID, 3))
+	_, err = s.db.GetClient(s.ctx, *created.ID)
+	s.IsType(storage.ErrNotFound{}, err)
+	restored, err := s.db.RestoreClient(s.ctx, *created.ID)
+	s.Require().NoError(err)
+	s.Equal("Apple", restored.Name)
+	s.Require().NoError(s.db.DeleteClient(s.ctx, *created.ID, 0))
+	s.Require().NoError(s.db.PurgeClient(s.ctx, *created.ID))
+	_, err = s.db.RestoreClient(s.ctx, *created.ID)
+	s.IsType(storage.ErrNotFound{}, err)
+}
+
+func (s *Suite) TestProjectCRUD() {
+	client, err := s.db.CreateClient(s.ctx, &storage.Client{Name: "owner"})
+	s.Require().NoError(err)
+	created, err := s.db.CreateProject(s.ctx, &storage.Project{ClientID: client.ID, Name: "first"})
+	s.Require().NoError(err)
+	s.Require().NotNil(created.ID)
+	s.Equal(*client.ID, *created.ClientID)
+	s.Equal(1, created.Version)
+
+	stored, err := s.db.GetProject(s.ctx, *created.ID)
+	s.Require().NoError(err)
+	s.Equal(created, stored)
+
+	replaced, err := s.db.ReplaceProject(s.ctx, &storage.Project{ID: created.ID, Name: "orphaned"})
+	s.Require().NoError(err)
+	s.Nil(replaced.ClientID)
+	updated, err := s.db.UpdateProject(s.ctx, *created.ID, func(project *storage.Project) error {
+		project.ClientID = client.ID
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal(*client.ID, *updated.ClientID)
+	s.Equal(3, updated.Version)
+
+	_, err = s.db.CreateProject(s.ctx, &storage.Project{ClientID: tools.IntPtr(753), Name: "dangling"})
+	s.IsType(storage.ErrDanglingReference{}, err)
+	s.IsType(storage.ErrReferenced{}, s.db.DeleteClient(s.ctx, *client.ID, 0), "restrict is the default policy")
+
+	s.Require().NoError(s.db.DeleteProject(s.ctx, *created.ID, 0))
+	_, err = s.db.GetProject(s.ctx, *created.ID)
+	s.IsType(storage.ErrNotFound{}, err)
+	s.Require().NoError(s.db.DeleteClient(s.ctx, *client.ID, 0))
+	_, err = s.db.RestoreProject(s.ctx, *created.ID)
+	s.IsType(storage.ErrDanglingReference{}, err, "client is trashed")
+}
+
+func (s *Suite) TestIDAllocation() {
+	first, err := s.db.CreateClient(s.ctx, &storage.Client{Name: "first"})
+	s.Require().NoError(err)
+	base := *first.ID
+	second, err := s.db.CreateClient(s.ctx, &storage.Client{Name: "second"})
+	s.Require().NoError(err)
+	s.Equal(base+1, *second.ID)
+
+	explicit, err := s.db.CreateClient(s.ctx, &storage.Client{ID: tools.IntPtr(base + 10), Name: "explicit"})
+	s.Require().NoError(err)
+	s.Equal(base+10, *explicit.ID)
+	_, err = s.db.CreateClient(s.ctx, &storage.Client{ID: explicit.ID, Name: "again"})
+	s.IsType(storage.ErrAlreadyExists{}, err)
+
+	s.Require().NoError(s.db.DeleteClient(s.ctx, *explicit.ID, 0))
+	s.Require().NoError(s.db.PurgeClient(s.ctx, *explicit.ID))
+	next, err := s.db.CreateClient(s.ctx, &storage.Client{Name: "next"})
+	s.Require().NoError(err)
+	s.Equal(base+11, *next.ID, "purged IDs are not reused")
+
+	_, err = s.db.CreateClient(s.ctx, &storage.Client{ID: tools.IntPtr(base + 5), Name: "lower"})
+	s.Require().NoError(err)
+	after, err := s.db.CreateClient(s.ctx, &storage.Client{Name: "after"})
+	s.Require().NoError(err)
+	s.Equal(base+12, *after.ID, "explicit IDs below the sequence don't move it back")
+}
+
+func (s *Suite) TestOrdering() {
+	for _, client := range []*storage.Client{
+		{ID: tools.IntPtr(3), Name: "Alphabet"},
+		{ID: tools.IntPtr(1), Name: "Microsoft"},
+		{ID: tools.IntPtr(4), Name: "Meta"},
+		{ID: tools.IntPtr(2), Name: "Apple"},
+	} {
+		_, err := s.db.CreateClient(s.ctx, client)
+		s.Require().NoError(err)
+	}
+	for _, tc := range []struct {
+		sort string
+		IDs  []int
+	}{
+		{"", []int{1, 2, 3, 4}},
+		{"name", []int{3, 2, 4, 1}},
+		{"-name", []int{1, 4, 2, 3}},
+		{"-id", []int{4, 3, 2, 1}},
+	} {
+		query, err := storage.ClientSchema.ParseQuery("", tc.sort)
+		s.Require().NoError(err)
+		clients, _, err := s.db.SelectClients(s.ctx, query, storage.Page{})
+		s.Require().NoError(err)
+		s.Equal(tc.IDs, ids(clients), tc.sort)
+	}
+
+	query, err := storage.ClientSchema.ParseQuery("", "name")
+	s.Require().NoError(err)
+	clients, more, err := s.db.SelectClients(s.ctx, query, storage.Page{Limit: 2})
+	s.Require().NoError(err)
+	s.True(more)
+	s.Equal([]int{3, 2}, ids(clients))
+	after := storage.ClientSchema.KeysetOf(query, clients[1])
+	clients, more, err = s.db.SelectClients(s.ctx, query, storage.Page{Limit: 2, After: after})
+	s.Require().NoError(err)
+	s.False(more)
+	s.Equal([]int{4, 1}, ids(clients))
+	before := storage.ClientSchema.KeysetOf(query, clients[0])
+	clients, more, err = s.db.SelectClients(s.ctx, query, storage.Page{Limit: 1, Before: before})
+	s.Require().NoError(err)
+	s.True(more)
+	s.Equal([]int{2}, ids(clients))
+}
+
+func (s *Suite) TestSearch() {
+	for _, client := range []*storage.Client{
+		{ID: tools.IntPtr(1), Name: "Kernel Labs"},
+		{ID: tools.IntPtr(2), Name: "Kernel"},
+		{ID: tools.IntPtr(3), Name: "Linux Foundation"},
+	} {
+		_, err := s.db.CreateClient(s.ctx, client)
+		s.Require().NoError(err)
+	}
+	for _, project := range []*storage.Project{
+		{ID: tools.IntPtr(1), ClientID: tools.IntPtr(3), Name: "kernel fuzzing"},
+		{ID: tools.IntPtr(2), ClientID: tools.IntPtr(3), Name: "kernel archive"},
+	} {
+		_, err := s.db.CreateProject(s.ctx, project)
+		s.Require().NoError(err)
+	}
+	s.Require().NoError(s.db.DeleteProject(s.ctx, 2, 0))
+	_, err := s.db.UpdateClient(s.ctx, 3, func(client *storage.Client) error {
+		client.Name = "Linux Kernel Foundation"
+		return nil
+	})
+	s.Require().NoError(err)
+
+	hits, err := storage.Search(s.ctx, s.db, "kernel", 10)
+	s.Require().NoError(err)
+	s.ElementsMatch([]string{"client 1", "client 2", "client 3", "project 1"}, hitKeys(hits), "trashed ones are not found")
+	var clients []string
+	for _, key := range hitKeys(hits) {
+		if strings.HasPrefix(key, storage.HitClient) {
+			clients = append(clients, key)
+		}
+	}
+	s.Equal([]string{"client 2", "client 1", "client 3"}, clients, "closer matches go first")
+
+	hits, err = storage.Search(s.ctx, s.db, "KERNEL fuzzing", 10)
+	s.Require().NoError(err)
+	s.Equal([]string{"project 1"}, hitKeys(hits), "every word is required")
+	hits, err = storage.Search(s.ctx, s.db, "kernel", 2)
+	s.Require().NoError(err)
+	s.Len(hits, 2)
+	hits, err = storage.Search(s.ctx, s.db, "nothing", 10)
+	s.Require().NoError(err)
+	s.NotNil(hits)
+	s.Empty(hits)
+}
+
+func (s *Suite) TestBatch() {
+	outcomes, err := storage.BatchClients(s.ctx, s.db, []storage.Operation[storage.Client]{
+		{Op: storage.BatchCreate, Entity: &storage.Client{ID: tools.IntPtr(1), Name: "Acme"}},
+		{Op: storage.BatchCreate, Entity: &storage.Client{ID: tools.IntPtr(1), Name: "taken"}},
+		{Op: storage.BatchUpdate, Entity: &storage.Client{ID: tools.IntPtr(1), Name: "Acme Corp", Version: 1}},
+		{Op: storage.BatchDelete, ID: 1, Version: 1},
+		{Op: "upsert", Entity: &storage.Client{Name: "unknown"}},
+	}, false)
+	s.Require().NoError(err)
+	s.Require().Len(outcomes, 5)
+	s.NoError(outcomes[0].Err)
+	s.Equal(1, outcomes[0].Entity.Version)
+	s.IsType(storage.ErrAlreadyExists{}, outcomes[1].Err, "failed operations don't stop the batch")
+	s.NoError(outcomes[2].Err)
+	s.Equal("Acme Corp", outcomes[2].Entity.Name)
+	s.Equal(2, outcomes[2].Entity.Version, "operations see the ones before")
+	s.IsType(storage.ErrVersionMismatch{}, outcomes[3].Err)
+	s.Error(outcomes[4].Err)
+	stored, err := s.db.GetClient(s.ctx, 1)
+	s.Require().NoError(err)
+	s.Equal("Acme Corp", stored.Name)
+
+	projects, err := storage.BatchProjects(s.ctx, s.db, []storage.Operation[storage.Project]{
+		{Op: storage.BatchCreate, Entity: &storage.Project{ID: tools.IntPtr(1), ClientID: tools.IntPtr(1), Name: "kept"}},
+		{Op: storage.BatchCreate, Entity: &storage.Project{ID: tools.IntPtr(2), ClientID: tools.IntPtr(1), Name: "removed"}},
+		{Op: storage.BatchCreate, Entity: &storage.Project{ID: tools.IntPtr(3), ClientID: tools.IntPtr(9), Name: "dangling"}},
+	}, false)
+	s.Require().NoError(err)
+	s.NoError(projects[0].Err)
+	s.NoError(projects[1].Err)
+	s.IsType(storage.ErrDanglingReference{}, projects[2].Err)
+
+	if s.NoTransactions {
+		return
+	}
+	outcomes, err = storage.BatchClients(s.ctx, s.db, []storage.Operation[storage.Client]{
+		{Op: storage.BatchCreate, Entity: &storage.Client{ID: tools.IntPtr(2), Name: "Initech"}},
+		{Op: storage.BatchUpdate, Entity: &storage.Client{ID: tools.IntPtr(1), Name: "renamed"}},
+		{Op: storage.BatchDelete, ID: 1},
+	}, true)
+	s.Require().NoError(err)
+	s.Equal(storage.ErrBatchAborted{Index: 2}, outcomes[0].Err)
+	s.Equal(storage.ErrBatchAborted{Index: 2}, outcomes[1].Err)
+	s.IsType(storage.ErrReferenced{}, outcomes[2].Err, "projects restrict the delete")
+	_, err = s.db.GetClient(s.ctx, 2)
+	s.IsType(storage.ErrNotFound{}, err, "atomic batch is rolled back entirely")
+	stored, err = s.db.GetClient(s.ctx, 1)
+	s.Require().NoError(err)
+	s.Equal("Acme Corp", stored.Name)
+
+	projects, err = storage.BatchProjects(s.ctx, s.db, []storage.Operation[storage.Project]{
+		{Op: storage.BatchDelete, ID: 2},
+		{Op: storage.BatchUpdate, Entity: &storage.Project{ID: tools.IntPtr(1), ClientID: tools.IntPtr(1), Name: "renamed", Version: 1}},
+	}, true)
+	s.Require().NoError(err)
+	s.NoError(projects[0].Err)
+	s.NoError(projects[1].Err)
+	s.Equal("renamed", projects[1].Entity.Name)
+	_, err = s.db.GetProject(s.ctx, 2)
+	s.IsType(storage.ErrNotFound{}, err)
+
+	// rolled back within a savepoint, or along with the transaction where there are none
+	_ = s.db.WithTx(s.ctx, func(tx storage.Adapter) error {
+		_, err := storage.BatchClients(s.ctx, tx, []storage.Operation[storage.Client]{
+			{Op: storage.BatchCreate, Entity: &storage.Client{ID: tools.IntPtr(3), Name: "Globex"}},
+			{Op: storage.BatchDelete, ID: 1},
+		}, true)
+		return err
+	})
+	_, err = s.db.GetClient(s.ctx, 3)
+	s.IsType(storage.ErrNotFound{}, err, "atomic batch within the transaction leaves nothing behind")
+}
+
+func (s *Suite) TestWithTx() {
+	var client *storage.Client
+	err := s.db.WithTx(s.ctx, func(tx storage.Adapter) (err error) {
+		if client, err = tx.CreateClient(s.ctx, &storage.Client{Name: "Acme"}); err != nil {
+			return err
+		}
+		stored, err := tx.GetClient(s.ctx, *client.ID)
+		if err != nil {
+			return err
+		}
+		s.Equal("Acme", stored.Name, "transaction sees its own writes")
+		_, err = tx.CreateProject(s.ctx, &storage.Project{ClientID: client.ID, Name: "Rocket"})
+		return err
+	})
+	s.Require().NoError(err)
+	projects, _, err := s.db.SelectProjects(s.ctx, storage.Query{}, storage.Page{})
+	s.Require().NoError(err)
+	s.Require().Len(projects, 1)
+
+	rollback := errors.New("rollback")
+	err = s.db.WithTx(s.ctx, func(tx storage.Adapter) error {
+		if err := tx.DeleteProject(s.ctx, *projects[0].ID, 0); err != nil {
+			return err
+		}
+		return tx.WithTx(s.ctx, func(tx storage.Adapter) error {
+			if err := tx.DeleteClient(s.ctx, *client.ID, 0); err != nil {
+				return err
+			}
+			return rollback
+		})
+	})
+	s.ErrorIs(err, rollback, "error of fn is returned as is")
+	if s.NoTransactions {
+		return
+	}
+	_, err = s.db.GetClient(s.ctx, *client.ID)
+	s.NoError(err, "nested transaction is rolled back")
+	_, err = s.db.GetProject(s.ctx, *projects[0].ID)
+	s.NoError(err, "outer transaction is rolled back along with it")
+
+	err = s.db.WithTx(s.ctx, func(tx storage.Adapter) error {
+		return tx.WithTx(s.ctx, func(tx storage.Adapter) error {
+			_, err := tx.ReplaceClient(s.ctx, &storage.Client{ID: client.ID, Name: "Acme Corp"})
+			return err
+		})
+	})
+	s.Require().NoError(err)
+	stored, err := s.db.GetClient(s.ctx, *client.ID)
+	s.Require().NoError(err)
+	s.Equal("Acme Corp", stored.Name, "nested transaction is committed along with the outer one")
+}
+
+func (s *Suite) TestOutbox() {
+	outbox, ok := storage.As[storage.Outbox](s.db)
+	if !ok {
+		s.T().Skip("adapter has no outbox")
+	}
+	hook, err := outbox.CreateWebhook(s.ctx, &storage.Webhook{URL: "http://localhost/hook", Secret: "s3cret"})
+	s.Require().NoError(err)
+	s.NotZero(hook.ID)
+	stored, err := outbox.GetWebhook(s.ctx, hook.ID)
+	s.Require().NoError(err)
+	s.Equal(hook, stored)
+	_, err = outbox.ReplaceWebhook(s.ctx, &storage.Webhook{ID: hook.ID + 1000, URL: "http://localhost/gone"})
+	s.ErrorAs(err, &storage.ErrNotFound{})
+	other, err := outbox.CreateWebhook(s.ctx, &storage.Webhook{URL: "http://localhost/other", Secret: "other"})
+	s.Require().NoError(err)
+	other.URL = "http://localhost/replaced"
+	_, err = outbox.ReplaceWebhook(s.ctx, other)
+	s.Require().NoError(err)
+	hooks, err := outbox.SelectWebhooks(s.ctx)
+	s.Require().NoError(err)
+	s.Equal([]*storage.Webhook{hook, other}, hooks)
+
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	event := &storage.Event{At: at, Type: "client.create", EntityID: 1, Actor: "tester", Data: storage.Payload(`{"id": 1}`)}
+	s.Require().NoError(outbox.AppendEvent(s.ctx, event))
+	s.NotZero(event.ID)
+	deliveries, err := outbox.ClaimDeliveries(s.ctx, at, time.Minute, 10)
+	s.Require().NoError(err)
+	s.Require().Len(deliveries, 2, "a delivery to every webhook")
+	for _, delivery := range deliveries {
+		s.Equal(storage.DeliveryPending, delivery.State)
+		s.WithinDuration(at.Add(time.Minute), delivery.NextAttemptAt, time.Millisecond, "postponed by the lease")
+		s.Require().NotNil(delivery.Event)
+		s.Equal(event.ID, delivery.Event.ID)
+		s.Equal("client.create", delivery.Event.Type)
+		s.JSONEq(`{"id": 1}`, string(delivery.Event.Data))
+	}
+	claimed, err := outbox.ClaimDeliveries(s.ctx, at, time.Minute, 10)
+	s.Require().NoError(err)
+	s.Empty(claimed, "leased deliveries are not claimed again")
+
+	dead, done := deliveries[0], deliveries[1]
+	dead.State, dead.Attempts, dead.LastError = storage.DeliveryDead, 3, "boom"
+	s.Require().NoError(outbox.SaveDelivery(s.ctx, dead))
+	done.State, done.Attempts = storage.DeliveryDone, 1
+	s.Require().NoError(outbox.SaveDelivery(s.ctx, done))
+	letters, err := outbox.SelectDeliveries(s.ctx, storage.DeliveryDead, 0)
+	s.Require().NoError(err)
+	s.Require().Len(letters, 1)
+	s.Equal(dead.ID, letters[0].ID)
+	s.Equal(3, letters[0].Attempts)
+	s.Equal("boom", letters[0].LastError)
+	s.NotNil(letters[0].Event)
+
+	s.ErrorAs(outbox.RetryDelivery(s.ctx, done.ID), &storage.ErrNotFound{}, "only the dead ones are retried")
+	s.Require().NoError(outbox.RetryDelivery(s.ctx, dead.ID))
+	claimed, err = outbox.ClaimDeliveries(s.ctx, time.Now().UTC().Add(time.Second), time.Minute, 10)
+	s.Require().NoError(err)
+	s.Require().Len(claimed, 1, "retried delivery is due right away")
+	s.Equal(dead.ID, claimed[0].ID)
+	s.Zero(claimed[0].Attempts)
+
+	s.Require().NoError(outbox.DeleteWebhook(s.ctx, dead.WebhookID))
+	_, err = outbox.GetWebhook(s.ctx, dead.WebhookID)
+	s.ErrorAs(err, &storage.ErrNotFound{})
+	s.ErrorAs(outbox.DeleteWebhook(s.ctx, dead.WebhookID), &storage.ErrNotFound{})
+	s.ErrorAs(outbox.SaveDelivery(s.ctx, dead), &storage.ErrNotFound{}, "deliveries are deleted along with the webhook")
+}
+
+func (s *Suite) TestPruneEvents() {
+	outbox, ok := storage.As[storage.Outbox](s.db)
+	if !ok {
+		s.T().Skip("adapter has no outbox")
+	}
+	_, err := outbox.CreateWebhook(s.ctx, &storage.Webhook{URL: "http://localhost/hook", Secret: "s3cret"})
+	s.Require().NoError(err)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, at := range []time.Time{now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), now} {
+		event := &storage.Event{At: at, Type: "client.create", EntityID: 1, Actor: "tester", Data: storage.Payload(`{}`)}
+		s.Require().NoError(outbox.AppendEvent(s.ctx, event))
+	}
+	deliveries, err := outbox.SelectDeliveries(s.ctx, storage.DeliveryPending, 0)
+	s.Require().NoError(err)
+	s.Require().Len(deliveries, 3)
+	old, dead, recent := deliveries[0], deliveries[1], deliveries[2]
+	for delivery, state := range map[*storage.Delivery]storage.DeliveryState{
+		old: storage.DeliveryDone, dead: storage.DeliveryDead, recent: storage.DeliveryDone,
+	} {
+		delivery.State, delivery.Attempts = state, 1
+		s.Require().NoError(outbox.SaveDelivery(s.ctx, delivery))
+	}
+
+	n, err := outbox.PruneEvents(s.ctx, now.Add(-time.Hour))
+	s.Require().NoError(err)
+	s.Equal(1, n)
+	done, err := outbox.SelectDeliveries(s.ctx, storage.DeliveryDone, 0)
+	s.Require().NoError(err)
+	s.Require().Len(done, 1, "recent events are kept")
+	s.Equal(recent.ID, done[0].ID)
+	letters, err := outbox.SelectDeliveries(s.ctx, storage.DeliveryDead, 0)
+	s.Require().NoError(err)
+	s.Require().Len(letters, 1, "dead letters keep their events")
+	s.Require().NotNil(letters[0].Event)
+	s.Equal(dead.EventID, letters[0].Event.ID)
+	n, err = outbox.PruneEvents(s.ctx, now.Add(-time.Hour))
+	s.Require().NoError(err)
+	s.Zero(n)
+}
+
+func hitKeys(hits []*storage.SearchHit) []string {
+	var res []string
+	for _, hit := range hits {
+		res = append(res, hit.Type+" "+strconv.Itoa(hit.ID))
+	}
+	return res
+}
+
+func ids(clients []*storage.Client) []int {
+	var res []int
+	for _, client := range clients {
+		res = append(res, *client.ID)
+	}
+	return res
+}
@@ -0,0 +1,228 @@
+// Package webhook Delivery of the outbox events to the webhooks
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+	"github.com/iamwavecut/ct-mend/tools"
+)
+
+const (
+	// SignatureHeader HMAC-SHA256 of the request body keyed with the webhook secret, see Sign.
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	// DeliveryHeader ID of the delivery, the same for its every attempt, so the receiver may skip the repeated ones.
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// pruneInterval How often the dispatcher prunes the delivered events.
+const pruneInterval = 10 * time.Minute
+
+var errWebhookGone = errors.New("webhook is deleted")
+
+// Dispatcher Posts the events of the outbox to the webhooks, retrying the failed deliveries with exponential backoff
+// until the attempts are over and the delivery goes to the dead letters.
+type Dispatcher struct {
+	outbox storage.Outbox
+	client *http.Client
+	cfg    config.Webhooks
+	now    func() time.Time
+}
+
+// NewDispatcher Makes the deliveries of the outbox as configured.
+func NewDispatcher(outbox storage.Outbox, cfg config.Webhooks) *Dispatcher {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = config.DefaultTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	return &Dispatcher{
+		outbox: outbox,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cfg:    cfg,
+		now:    func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// Sign Signature of the body with the secret, as the SignatureHeader tells it.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret Random secret of a webhook, 32 bytes in hex.
+func NewSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); !tools.Try(err) {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Run Makes the due deliveries every poll interval until the context is done, pruning the delivered events
+// every pruneInterval.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		if d.now().Sub(pruned) >= pruneInterval {
+			pruned = d.now()
+			n, err := d.Prune(ctx)
+			if !tools.Try(err) && ctx.Err() == nil {
+				log.WithError(err).Errorln("webhook events prune failed")
+			}
+			if n > 0 {
+				log.Infof("pruned %d delivered webhook events", n)
+			}
+		}
+		for {
+			n, err := d.Dispatch(ctx)
+			if !tools.Try(err) && ctx.Err() == nil {
+				log.WithError(err).Errorln("webhook dispatch failed")
+			}
+			// a full round may have left more due ones behind
+			if n < d.cfg.Concurrency || ctx.Err() != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch Claims a round of the due deliveries and makes them at once, returns how many were claimed.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	now := d.now()
+	// long enough for the whole round, so the deliveries in progress are not claimed again
+	deliveries, err := d.outbox.ClaimDeliveries(ctx, now, 2*d.cfg.Timeout, d.cfg.Concurrency)
+	if !tools.Try(err) || len(deliveries) == 0 {
+		return 0, err
+	}
+	webhooks, err := d.outbox.SelectWebhooks(ctx)
+	if !tools.Try(err) {
+		return len(deliveries), err
+	}
+	byID := make(map[int]*storage.Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byID[webhook.ID] = webhook
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(deliveries))
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func(i int, delivery *storage.Delivery) {
+			defer wg.Done()
+			errs[i] = d.attempt(ctx, byID[delivery.WebhookID], delivery)
+		}(i, delivery)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if !tools.Try(err) {
+			return len(deliveries), err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// Prune Deletes the events delivered and older than the retention, returns how many.
+func (d *Dispatcher) Prune(ctx context.Context) (int, error) {
+	if d.cfg.Retention <= 0 {
+		return 0, nil
+	}
+	return d.outbox.PruneEvents(ctx, d.now().Add(-d.cfg.Retention))
+}
+
+// attempt Makes the delivery and saves its outcome. Once the context is done the delivery is left as claimed,
+// so it's made again after the lease.
+func (d *Dispatcher) attempt(ctx context.Context, webhook *storage.Webhook, delivery *storage.Delivery) error {
+	err := errWebhookGone
+	if webhook != nil {
+		err = d.deliver(ctx, webhook, delivery)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	delivery.Attempts++
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		delivery.State = storage.DeliveryDone
+	case delivery.Attempts >= d.cfg.MaxAttempts || errors.Is(err, errWebhookGone):
+		delivery.State, delivery.LastError = storage.DeliveryDead, err.Error()
+		log.WithError(err).Warnf("webhook delivery %d is dead after %d attempts", delivery.ID, delivery.Attempts)
+	default:
+		delivery.NextAttemptAt = d.now().Add(d.delay(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+	return errors.Wrapf(d.outbox.SaveDelivery(ctx, delivery), "save delivery %d", delivery.ID)
+}
+
+// deliver Posts the event to the webhook, any response but 2xx is a failure.
+func (d *Dispatcher) deliver(ctx context.Context, webhook *storage.Webhook, delivery *storage.Delivery) error {
+	if delivery.Event == nil {
+		return errors.Errorf("event %d is missing", delivery.EventID)
+	}
+	body, err := json.Marshal(delivery.Event)
+	if !tools.Try(err) {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if !tools.Try(err) {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	res, err := d.client.Do(req)
+	if !tools.Try(err) {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// delay Backoff before the attempt after the given ones, doubled by every attempt and jittered between its halves.
+func (d *Dispatcher) delay(attempts int) time.Duration {
+	delay := d.cfg.Backoff << (attempts - 1)
+	if delay > d.cfg.MaxBackoff || delay <= 0 {
+		delay = d.cfg.MaxBackoff
+	}
+	if half := int(delay / 2); half > 0 {
+		return time.Duration(half + tools.RandInt(0, half+1))
+	}
+	return delay
+}
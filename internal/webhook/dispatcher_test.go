@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iamwavecut/ct-mend/internal/config"
+	"github.com/iamwavecut/ct-mend/internal/storage"
+)
+
+// receiver Local webhook endpoint, failing with the status while it's set.
+type receiver struct {
+	*httptest.Server
+	secret string
+	status int32
+
+	mu     sync.Mutex
+	events []storage.Event
+	heads  []http.Header
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	rcv := &receiver{secret: secret}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		mac := hmac.New(sha256.New, []byte(rcv.secret))
+		mac.Write(body)
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status := atomic.LoadInt32(&rcv.status); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		var event storage.Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.events = append(rcv.events, event)
+		rcv.heads = append(rcv.heads, r.Header.Clone())
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) received() ([]storage.Event, []http.Header) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]storage.Event(nil), rcv.events...), append([]http.Header(nil), rcv.heads...)
+}
+
+func newOutbox(t *testing.T) (storage.Adapter, storage.Outbox) {
+	db, err := storage.New(context.Background(), &config.Storage{Type: "memory", Migrate: "auto", Outbox: true})
+	require.NoError(t, err)
+	outbox, ok := storage.As[storage.Outbox](db)
+	require.True(t, ok)
+	return db, outbox
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	ctx := context.Background()
+	db, outbox := newOutbox(t)
+	rcv := newReceiver(t, "s3cret")
+	_, err := outbox.CreateWebhook(ctx, &storage.Webhook{URL: rcv.URL, Secret: "s3cret"})
+	require.NoError(t, err)
+	client, err := db.CreateClient(ctx, &storage.Client{Name: "Acme"})
+	require.NoError(t, err)
+
+	d := NewDispatcher(outbox, config.Webhooks{Concurrency: 10, Timeout: time.Second, MaxAttempts: 3})
+	n, err := d.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	events, heads := rcv.received()
+	require.Len(t, events, 1, "signature is verified")
+	assert.Equal(t, "client.create", events[0].Type)
+	assert.Equal(t, *client.ID, events[0].EntityID)
+	assert.JSONEq(t, `{"id": `+strconv.Itoa(*client.ID)+`, "name": "Acme", "settings": {"code_scan_interval": 0}, "version": 1}`, string(events[0].Data))
+	assert.Equal(t, "client.create", heads[0].Get(EventHeader))
+	assert.NotEmpty(t, heads[0].Get(DeliveryHeader))
+
+	delivered, err := outbox.SelectDeliveries(ctx, storage.DeliveryDone, 0)
+	require.NoError(t, err)
+	require.Len(t, delivered, 1)
+	assert.Equal(t, 1, delivered[0].Attempts)
+	n, err = d.Dispatch(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n, "delivered once")
+
+	pruned, err := d.Prune(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, pruned, "kept forever without the retention")
+	d.cfg.Retention = time.Hour
+	d.now = func() time.Time { return time.Now().UTC().Add(2 * time.Hour) }
+	pruned, err = d.Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned, "delivered past the retention")
+	delivered, err = outbox.SelectDeliveries(ctx, storage.DeliveryDone, 0)
+	require.NoError(t, err)
+	assert.Empty(t, delivered)
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	ctx := context.Background()
+	db, outbox := newOutbox(t)
+	rcv := newReceiver(t, "s3cret")
+	atomic.StoreInt32(&rcv.status, http.StatusServiceUnavailable)
+	_, err := outbox.CreateWebhook(ctx, &storage.Webhook{URL: rcv.URL, Secret: "s3cret"})
+	require.NoError(t, err)
+	_, err = db.CreateClient(ctx, &storage.Client{Name: "Acme"})
+	require.NoError(t, err)
+
+	d := NewDispatcher(outbox, config.Webhooks{
+		Concurrency: 10, Timeout: time.Second, MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute,
+	})
+	now := time.Now().UTC()
+	d.now = func() time.Time { return now }
+	for attempt := 1; attempt < 3; attempt++ {
+		n, err := d.Dispatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, n, "attempt %d", attempt)
+		pending, err := outbox.SelectDeliveries(ctx, storage.DeliveryPending, 0)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		assert.Equal(t, attempt, pending[0].Attempts)
+		assert.Contains(t, pending[0].LastError, "503")
+		backoff := time.Second << (attempt - 1)
+		assert.WithinRange(t, pending[0].NextAttemptAt, now.Add(backoff/2), now.Add(backoff), "jittered backoff")
+
+		n, err = d.Dispatch(ctx)
+		require.NoError(t, err)
+		require.Zero(t, n, "not due before the backoff")
+		now = pending[0].NextAttemptAt
+	}
+	_, err = d.Dispatch(ctx)
+	require.NoError(t, err)
+	dead, err := outbox.SelectDeliveries(ctx, storage.DeliveryDead, 0)
+	require.NoError(t, err)
+	require.Len(t, dead, 1, "dead once the attempts are over")
+	assert.Equal(t, 3, dead[0].Attempts)
+	events, _ := rcv.received()
+	assert.Empty(t, events)
+
+	atomic.StoreInt32(&rcv.status, 0)
+	require.NoError(t, outbox.RetryDelivery(ctx, dead[0].ID))
+	d.now = func() time.Time { return time.Now().UTC() }
+	_, err = d.Dispatch(ctx)
+	require.NoError(t, err)
+	events, _ = rcv.received()
+	assert.Len(t, events, 1, "dead letter is delivered once retried")
+}
+
+func TestDispatcherRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db, outbox := newOutbox(t)
+	rcv := newReceiver(t, "s3cret")
+	_, err := outbox.CreateWebhook(ctx, &storage.Webhook{URL: rcv.URL, Secret: "s3cret"})
+	require.NoError(t, err)
+	for _, name := range []string{"Acme", "Globex", "Initech"} {
+		_, err = db.CreateClient(ctx, &storage.Client{Name: name})
+		require.NoError(t, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- NewDispatcher(outbox, config.Webhooks{PollInterval: 10 * time.Millisecond, Concurrency: 2, Timeout: time.Second}).Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		events, _ := rcv.received()
+		return len(events) == 3
+	}, time.Second, 10*time.Millisecond, "every event is delivered, more than a round of them")
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestDelay(t *testing.T) {
+	d := NewDispatcher(nil, config.Webhooks{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	} {
+		delay := d.delay(tc.attempts)
+		assert.GreaterOrEqual(t, delay, tc.max/2, "attempts %d", tc.attempts)
+		assert.LessOrEqual(t, delay, tc.max, "attempts %d", tc.attempts)
+	}
+}
+
+func TestSign(t *testing.T) {
+	assert.Equal(t,
+		"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")),
+	)
+}
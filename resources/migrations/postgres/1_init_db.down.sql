@@ -0,0 +1,3 @@
+drop table if exists projects;
+
+drop table if exists clients;
@@ -0,0 +1,17 @@
+create table if not exists clients
+(
+    id serial not null
+    constraint clients_pk
+    primary key,
+    name text not null,
+    code_scan_interval bigint
+);
+
+create table if not exists projects
+(
+    id serial not null
+    constraint projects_pk
+    primary key,
+    client_id integer,
+    name text
+);
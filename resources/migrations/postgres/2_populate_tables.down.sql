@@ -0,0 +1,7 @@
+delete from clients;
+
+delete from projects;
+
+alter sequence clients_id_seq restart;
+
+alter sequence projects_id_seq restart;
@@ -0,0 +1,4 @@
+drop index if exists projects_client_id_index;
+
+alter table projects
+    drop constraint if exists projects_clients_id_fk;
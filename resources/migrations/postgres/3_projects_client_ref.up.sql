@@ -0,0 +1,10 @@
+update projects
+set client_id = null
+where client_id not in (select id from clients);
+
+alter table projects
+    add constraint projects_clients_id_fk
+    foreign key (client_id) references clients (id);
+
+create index if not exists projects_client_id_index
+    on projects (client_id);
@@ -0,0 +1,5 @@
+alter table clients
+    drop column if exists version;
+
+alter table projects
+    drop column if exists version;
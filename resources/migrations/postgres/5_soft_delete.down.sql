@@ -0,0 +1,6 @@
+-- trashed entities come back to life
+alter table clients
+    drop column if exists deleted_at;
+
+alter table projects
+    drop column if exists deleted_at;
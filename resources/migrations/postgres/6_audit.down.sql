@@ -0,0 +1,3 @@
+drop index if exists audit_entity;
+
+drop table if exists audit;
@@ -0,0 +1 @@
+drop index if exists projects_client_id_index;
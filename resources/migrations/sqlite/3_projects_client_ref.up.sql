@@ -0,0 +1,6 @@
+update projects
+set client_id = null
+where client_id not in (select id from clients);
+
+create index if not exists projects_client_id_index
+    on projects (client_id);
@@ -0,0 +1,5 @@
+alter table clients
+    drop column version;
+
+alter table projects
+    drop column version;
@@ -0,0 +1,5 @@
+alter table clients
+    add column version integer not null default 1;
+
+alter table projects
+    add column version integer not null default 1;
@@ -0,0 +1,5 @@
+alter table clients
+    add column deleted_at timestamp;
+
+alter table projects
+    add column deleted_at timestamp;
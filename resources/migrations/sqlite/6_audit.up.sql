@@ -0,0 +1,15 @@
+create table if not exists audit
+(
+    id integer not null
+    constraint audit_pk
+    primary key autoincrement,
+    at timestamp not null,
+    actor text not null,
+    claimed_actor text not null default '',
+    operation text not null,
+    entity text not null,
+    entity_id integer not null,
+    diff text not null
+);
+
+create index if not exists audit_entity on audit (entity, entity_id);
@@ -0,0 +1,11 @@
+drop index if exists deliveries_event;
+
+drop index if exists deliveries_due;
+
+drop index if exists outbox_at;
+
+drop table if exists deliveries;
+
+drop table if exists outbox;
+
+drop table if exists webhooks;
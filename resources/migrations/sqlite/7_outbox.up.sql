@@ -0,0 +1,43 @@
+create table if not exists webhooks
+(
+    id integer not null
+    constraint webhooks_pk
+    primary key autoincrement,
+    url text not null,
+    secret text not null
+);
+
+create table if not exists outbox
+(
+    id integer not null
+    constraint outbox_pk
+    primary key autoincrement,
+    at timestamp not null,
+    type text not null,
+    entity_id integer not null,
+    actor text not null,
+    data text not null
+);
+
+create table if not exists deliveries
+(
+    id integer not null
+    constraint deliveries_pk
+    primary key autoincrement,
+    event_id integer not null
+    constraint deliveries_outbox_id_fk
+    references outbox (id),
+    webhook_id integer not null
+    constraint deliveries_webhooks_id_fk
+    references webhooks (id),
+    state text not null,
+    attempts integer not null,
+    next_attempt_at timestamp not null,
+    last_error text not null
+);
+
+create index if not exists deliveries_due on deliveries (state, next_attempt_at);
+
+create index if not exists outbox_at on outbox (at);
+
+create index if not exists deliveries_event on deliveries (event_id);
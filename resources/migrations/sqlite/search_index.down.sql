@@ -0,0 +1,10 @@
+-- Drops the search index of search_index.sql, run it by an sqlite3 shell having FTS5, the binaries without it refuse the index.
+drop trigger if exists clients_search_insert;
+drop trigger if exists clients_search_delete;
+drop trigger if exists clients_search_update;
+drop table if exists clients_search;
+
+drop trigger if exists projects_search_insert;
+drop trigger if exists projects_search_delete;
+drop trigger if exists projects_search_update;
+drop table if exists projects_search;
@@ -0,0 +1,35 @@
+-- Not versioned, it's derived from the names: created and filled up if the driver has FTS5, see SQLite.Migrate.
+-- search_index.down.sql drops it.
+create virtual table clients_search using fts5(name, content='clients', content_rowid='id');
+
+create trigger clients_search_insert after insert on clients begin
+    insert into clients_search (rowid, name) values (new.id, new.name);
+end;
+
+create trigger clients_search_delete after delete on clients begin
+    insert into clients_search (clients_search, rowid, name) values ('delete', old.id, old.name);
+end;
+
+create trigger clients_search_update after update of name on clients begin
+    insert into clients_search (clients_search, rowid, name) values ('delete', old.id, old.name);
+    insert into clients_search (rowid, name) values (new.id, new.name);
+end;
+
+insert into clients_search (clients_search) values ('rebuild');
+
+create virtual table projects_search using fts5(name, content='projects', content_rowid='id');
+
+create trigger projects_search_insert after insert on projects begin
+    insert into projects_search (rowid, name) values (new.id, new.name);
+end;
+
+create trigger projects_search_delete after delete on projects begin
+    insert into projects_search (projects_search, rowid, name) values ('delete', old.id, old.name);
+end;
+
+create trigger projects_search_update after update of name on projects begin
+    insert into projects_search (projects_search, rowid, name) values ('delete', old.id, old.name);
+    insert into projects_search (rowid, name) values (new.id, new.name);
+end;
+
+insert into projects_search (projects_search) values ('rebuild');